@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"org/bredin/go-notes/pkg/backup"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+type cliConfig struct {
+	At            string
+	BackupRoot    string
+	DbFileName    string
+	IndexFileName string
+	Keep          int
+	List          bool
+	Restore       string
+}
+
+func main() {
+	config, err := parseCli(os.Args[1:])
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	switch {
+	case config.List:
+		err = listBackups(config)
+	case config.Restore != "" || config.At != "":
+		err = restoreBackup(config)
+	default:
+		err = takeBackup(config)
+	}
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+func listBackups(config cliConfig) error {
+	names, err := backup.List(config.BackupRoot)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func parseCli(args []string) (cliConfig, error) {
+	var config cliConfig
+	fs := flag.NewFlagSet("backup-notes", flag.ContinueOnError)
+	fs.StringVar(&config.At, "at", "", "Restore the newest backup at or before this RFC3339 time")
+	fs.StringVar(&config.BackupRoot, "dir", "data/backups", "Backup root directory")
+	fs.StringVar(&config.DbFileName, "db", "data/notes.sqlite3", "Sqlite3 backing file")
+	fs.StringVar(&config.IndexFileName, "index", "data/notes.index", "Bleve index root directory")
+	fs.IntVar(&config.Keep, "keep", backup.DEFAULT_RETENTION, "Number of backups to retain")
+	fs.BoolVar(&config.List, "list", false, "List available backups")
+	fs.StringVar(&config.Restore, "restore", "", "Restore the named backup; the server must be stopped")
+	err := fs.Parse(args)
+	return config, err
+}
+
+func restoreBackup(config cliConfig) error {
+	backupDir := filepath.Join(config.BackupRoot, config.Restore)
+	if config.At != "" {
+		at, err := time.Parse(time.RFC3339, config.At)
+		if err != nil {
+			return err
+		}
+		if backupDir, err = backup.FindBackup(config.BackupRoot, at); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Restoring %s", backupDir)
+	return backup.Restore(backupDir, config.DbFileName, config.IndexFileName)
+}
+
+func takeBackup(config cliConfig) error {
+	// A running server holds the index lock, in which case only the
+	// database is saved and the backup is marked for reindexing.
+	idx, err := bleve.OpenUsing(config.IndexFileName, map[string]interface{}{
+		"read_only":    true,
+		"bolt_timeout": "1s",
+	})
+	if err != nil {
+		log.Printf("Cannot open index, backup will require reindex: %s", err.Error())
+		idx = nil
+	} else {
+		defer idx.Close()
+	}
+
+	backupDir, err := backup.Backup(config.DbFileName, idx, config.BackupRoot)
+	if err != nil {
+		return err
+	}
+	log.Printf("Saved %s", backupDir)
+
+	removed, err := backup.Rotate(config.BackupRoot, config.Keep)
+	for _, name := range removed {
+		log.Printf("Removed %s", name)
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"org/bredin/go-notes/pkg/export"
+	"org/bredin/go-notes/pkg/notes"
+	"os"
+)
+
+type cliConfig struct {
+	DbFileName  string
+	Format      string
+	OutFileName string
+	UserName    string
+}
+
+func main() {
+	config, err := parseCli(os.Args[1:])
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if _, err = export.ContentType(config.Format); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	db, err := notes.OpenNoteDb(config.DbFileName)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	author, err := notes.GetAuthorByName(db, config.UserName)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if author == nil {
+		log.Fatalf("No user named %s", config.UserName)
+	}
+
+	out, err := os.Create(config.OutFileName)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if err = export.Export(db, author.Id, config.Format, out); err != nil {
+		out.Close()
+		log.Fatal(err.Error())
+	}
+	if err = out.Close(); err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+func parseCli(args []string) (cliConfig, error) {
+	var config cliConfig
+	fs := flag.NewFlagSet("export-notes", flag.ContinueOnError)
+	fs.StringVar(&config.DbFileName, "db", "data/notes.sqlite3", "Sqlite3 backing file")
+	fs.StringVar(&config.Format, "format", export.FORMAT_ZIP, "Archive format: zip or tar.gz")
+	fs.StringVar(&config.OutFileName, "out", "", "Archive file name, defaults to <user>.<format>")
+	fs.StringVar(&config.UserName, "user", "", "Name of the user whose notes are exported")
+	if err := fs.Parse(args); err != nil {
+		return config, err
+	}
+	if config.UserName == "" {
+		return config, fmt.Errorf("missing -user")
+	}
+	if config.OutFileName == "" {
+		config.OutFileName = config.UserName + "." + config.Format
+	}
+	return config, nil
+}
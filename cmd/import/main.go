@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"org/bredin/go-notes/pkg/importer"
+	"org/bredin/go-notes/pkg/notes"
+	"os"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+type cliConfig struct {
+	DbFileName    string
+	Format        string
+	IndexFileName string
+	Source        string
+	UserName      string
+}
+
+func main() {
+	config, err := parseCli(os.Args[1:])
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	db, err := notes.CreateNoteDb(config.DbFileName)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	author, err := notes.GetAuthorByName(db, config.UserName)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if author == nil {
+		log.Fatalf("No user named %s", config.UserName)
+	}
+
+	// The index is locked while the server runs; notes imported without
+	// it are found once the index is rebuilt.
+	idx, err := bleve.OpenUsing(config.IndexFileName, map[string]interface{}{"bolt_timeout": "1s"})
+	if err != nil {
+		log.Printf("Cannot open index, reindex after import: %s", err.Error())
+		idx = nil
+	} else {
+		defer idx.Close()
+	}
+
+	report, err := importSource(db, idx, author.Id, config.Format, config.Source)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+}
+
+func importSource(db *sql.DB, idx bleve.Index, authorId int, format string, source string) (*importer.Report, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return importer.ImportArchive(db, idx, authorId, format, f, info.Size())
+	}
+	switch format {
+	case importer.FORMAT_JOPLIN:
+		return importer.ImportJoplinDir(db, idx, authorId, source)
+	case importer.FORMAT_MARKDOWN:
+		return importer.ImportMarkdownDir(db, idx, authorId, source)
+	}
+	return nil, fmt.Errorf("cannot import %s from a directory", format)
+}
+
+func parseCli(args []string) (cliConfig, error) {
+	var config cliConfig
+	fs := flag.NewFlagSet("import-notes", flag.ContinueOnError)
+	fs.StringVar(&config.DbFileName, "db", "data/notes.sqlite3", "Sqlite3 backing file")
+	fs.StringVar(&config.Format, "format", importer.FORMAT_MARKDOWN, "Source format: markdown, enex, or joplin")
+	fs.StringVar(&config.IndexFileName, "index", "data/notes.index", "Bleve index root directory")
+	fs.StringVar(&config.Source, "src", "", "Directory, zip, or ENEX file to import")
+	fs.StringVar(&config.UserName, "user", "", "Name of the user who will own the imported notes")
+	if err := fs.Parse(args); err != nil {
+		return config, err
+	}
+	if config.Source == "" || config.UserName == "" {
+		return config, fmt.Errorf("missing -src or -user")
+	}
+	return config, nil
+}
@@ -6,7 +6,9 @@ import (
 	"org/bredin/go-notes/pkg/index"
 	"org/bredin/go-notes/pkg/notes"
 	"org/bredin/go-notes/pkg/routes"
+	"org/bredin/go-notes/pkg/webhooks"
 	"os"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -27,13 +29,23 @@ func main() {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+	if _, err = notes.PruneEvents(db, time.Now().AddDate(0, 0, -notes.EVENT_RETENTION_DAYS)); err != nil {
+		log.Fatal(err.Error())
+	}
 	db.Close()
 
-	idx, err := index.OpenIndex(config.IndexFileName)
+	idx, err := index.MigrateIndex(config.DbFileName, config.IndexFileName)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	dispatcher := webhooks.NewDispatcher(config.DbFileName)
+	go func() {
+		if err := dispatcher.Run(); err != nil {
+			log.Printf("Webhooks stopped: %s", err.Error())
+		}
+	}()
+
 	app := fiber.New()
 	routes.InstallRoutes(app, config.DbFileName, &idx)
 	log.Fatal(app.Listen(config.Port))
@@ -2,21 +2,30 @@ module org/bredin/go-notes
 
 go 1.18
 
-require github.com/golang-jwt/jwt/v4 v4.4.3
+require (
+	github.com/fasthttp/websocket v1.4.3-rc.6
+	github.com/golang-jwt/jwt/v4 v4.4.3
+	github.com/microcosm-cc/bluemonday v1.0.27
+	github.com/stretchr/testify v1.8.1
+	github.com/writeas/go-strip-markdown v2.0.1+incompatible
+	github.com/yuin/goldmark v1.5.6
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
+	github.com/aymerick/douceur v0.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gorilla/css v1.0.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.8.1 // indirect
-	github.com/writeas/go-strip-markdown v2.0.1+incompatible // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/savsgio/gotils v0.0.0-20210617111740-97865ed5a873 // indirect
+	golang.org/x/net v0.26.0 // indirect
 )
 
 require (
 	github.com/RoaringBitmap/roaring v0.9.4 // indirect
 	github.com/andybalholm/brotli v1.0.4 // indirect
 	github.com/bits-and-blooms/bitset v1.2.0 // indirect
-	github.com/blevesearch/bleve/v2 v2.3.5 // indirect
+	github.com/blevesearch/bleve/v2 v2.3.5
 	github.com/blevesearch/bleve_index_api v1.0.4 // indirect
 	github.com/blevesearch/geo v0.1.15 // indirect
 	github.com/blevesearch/go-porterstemmer v1.0.3 // indirect
@@ -32,27 +41,27 @@ require (
 	github.com/blevesearch/zapx/v13 v13.3.6 // indirect
 	github.com/blevesearch/zapx/v14 v14.3.6 // indirect
 	github.com/blevesearch/zapx/v15 v15.3.6 // indirect
-	github.com/gofiber/fiber/v2 v2.40.1 // indirect
-	github.com/gofiber/jwt/v3 v3.3.4 // indirect
+	github.com/gofiber/fiber/v2 v2.40.1
+	github.com/gofiber/jwt/v3 v3.3.4
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/golang/geo v0.0.0-20210211234256-740aa86cb551 // indirect
 	github.com/golang/protobuf v1.3.2 // indirect
-	github.com/golang/snappy v0.0.1 // indirect
+	github.com/golang/snappy v0.0.3 // indirect
 	github.com/json-iterator/go v0.0.0-20171115153421-f7279a603ede // indirect
 	github.com/klauspost/compress v1.15.13 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.16 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
-	github.com/mattn/go-sqlite3 v1.14.16 // indirect
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/mschoch/smat v0.2.0 // indirect
 	github.com/rivo/uniseg v0.4.3 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.43.0 // indirect
+	github.com/valyala/fasthttp v1.43.0
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	go.etcd.io/bbolt v1.3.5 // indirect
 	go.uber.org/atomic v1.10.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
-	go.uber.org/zap v1.24.0 // indirect
-	golang.org/x/crypto v0.4.0 // indirect
-	golang.org/x/sys v0.3.0 // indirect
+	go.uber.org/zap v1.24.0
+	golang.org/x/crypto v0.24.0
+	golang.org/x/sys v0.21.0 // indirect
 )
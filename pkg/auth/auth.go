@@ -4,12 +4,15 @@ import (
 	"database/sql"
 	"errors"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var adminIds map[int]bool
 var serverSecret []byte
 
 func GetSecret() []byte {
@@ -54,3 +57,15 @@ func GetUserId(db *sql.DB, username string, password string) (int, error) {
 	}
 	return userId, nil
 }
+
+func IsAdmin(userId int) bool {
+	if adminIds == nil {
+		adminIds = make(map[int]bool)
+		for _, idStr := range strings.Split(os.Getenv("ADMINS"), ",") {
+			if id, err := strconv.Atoi(strings.TrimSpace(idStr)); err == nil {
+				adminIds[id] = true
+			}
+		}
+	}
+	return adminIds[userId]
+}
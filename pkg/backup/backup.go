@@ -0,0 +1,348 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const BACKUP_TIME_FORMAT = "20060102T150405.000Z"
+const DB_FILE_NAME = "notes.sqlite3"
+const DEFAULT_RETENTION = 7
+const INDEX_DIR_NAME = "notes.index"
+const MANIFEST_FILE_NAME = "manifest.json"
+const REINDEX_MARKER_NAME = "REINDEX"
+
+type Manifest struct {
+	Created   int64
+	DbSha256  string
+	IndexDocs uint64
+	Notes     int
+	Reindex   bool
+}
+
+/**
+ * Snapshot the note database and, if possible, the index into a new
+ * timestamped directory under backupRoot.  The database copy uses
+ * VACUUM INTO, so it is consistent while the server keeps writing.
+ * If idx is nil or cannot be copied, a rebuild marker is written instead
+ * of an index snapshot, and restore will reindex from the database.
+ */
+func Backup(dbFileName string, idx bleve.Index, backupRoot string) (string, error) {
+	now := time.Now().UTC()
+	backupDir := filepath.Join(backupRoot, now.Format(BACKUP_TIME_FORMAT))
+	if err := os.MkdirAll(backupRoot, 0755); err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(backupDir, 0755); err != nil {
+		return "", err
+	}
+
+	manifest, err := snapshot(dbFileName, idx, backupDir)
+	if err != nil {
+		os.RemoveAll(backupDir)
+		return "", err
+	}
+	manifest.Created = now.Unix()
+	if err = writeManifest(backupDir, manifest); err != nil {
+		os.RemoveAll(backupDir)
+		return "", err
+	}
+	return backupDir, nil
+}
+
+/**
+ * Return the newest backup taken at or before the given time.
+ */
+func FindBackup(backupRoot string, at time.Time) (string, error) {
+	names, err := List(backupRoot)
+	if err != nil {
+		return "", err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		created, err := time.Parse(BACKUP_TIME_FORMAT, names[i])
+		if err != nil {
+			continue
+		}
+		if !created.After(at) {
+			return filepath.Join(backupRoot, names[i]), nil
+		}
+	}
+	return "", fmt.Errorf("no backup in %s at or before %s", backupRoot, at.Format(time.RFC3339))
+}
+
+/**
+ * List backup directory names, oldest first.
+ */
+func List(backupRoot string) ([]string, error) {
+	entries, err := os.ReadDir(backupRoot)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(BACKUP_TIME_FORMAT, entry.Name()); err != nil {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+/**
+ * Swap a verified backup into place.  The server must not be running.
+ */
+func Restore(backupDir string, dbFileName string, indexDirName string) error {
+	manifest, err := Verify(backupDir)
+	if err != nil {
+		return err
+	}
+
+	restoreDbFileName := dbFileName + ".restore"
+	if err = copyFile(filepath.Join(backupDir, DB_FILE_NAME), restoreDbFileName); err != nil {
+		return err
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err = os.Remove(dbFileName + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err = os.Rename(restoreDbFileName, dbFileName); err != nil {
+		return err
+	}
+
+	restoreIndexDirName := indexDirName + ".restore"
+	os.RemoveAll(restoreIndexDirName)
+	if manifest.Reindex {
+		idx, err := index.CreateIndex(dbFileName, restoreIndexDirName)
+		if err != nil {
+			return err
+		}
+		if err = idx.Close(); err != nil {
+			return err
+		}
+	} else if err = copyDir(filepath.Join(backupDir, INDEX_DIR_NAME), restoreIndexDirName); err != nil {
+		return err
+	}
+
+	oldIndexDirName := indexDirName + ".old"
+	os.RemoveAll(oldIndexDirName)
+	if err = os.Rename(indexDirName, oldIndexDirName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err = os.Rename(restoreIndexDirName, indexDirName); err != nil {
+		return err
+	}
+	return os.RemoveAll(oldIndexDirName)
+}
+
+/**
+ * Delete all but the newest keep backups, returning the removed names.
+ */
+func Rotate(backupRoot string, keep int) ([]string, error) {
+	if keep < 1 {
+		return nil, fmt.Errorf("illegal retention count: %d", keep)
+	}
+	names, err := List(backupRoot)
+	if err != nil || len(names) <= keep {
+		return nil, err
+	}
+
+	removed := names[:len(names)-keep]
+	for _, name := range removed {
+		if err = os.RemoveAll(filepath.Join(backupRoot, name)); err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
+
+/**
+ * Check the backup checksum, SQLite integrity, and that the index
+ * snapshot opens, returning the backup manifest.
+ */
+func Verify(backupDir string) (*Manifest, error) {
+	manifest, err := readManifest(backupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	dbFileName := filepath.Join(backupDir, DB_FILE_NAME)
+	checksum, err := fileSha256(dbFileName)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != manifest.DbSha256 {
+		return nil, fmt.Errorf("checksum mismatch on %s", dbFileName)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+dbFileName+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var result string
+	if err = db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return nil, err
+	}
+	if result != "ok" {
+		return nil, fmt.Errorf("integrity check failed on %s: %s", dbFileName, result)
+	}
+
+	if manifest.Reindex {
+		if _, err = os.Stat(filepath.Join(backupDir, REINDEX_MARKER_NAME)); err != nil {
+			return nil, err
+		}
+		return manifest, nil
+	}
+	docCount, err := countDocs(filepath.Join(backupDir, INDEX_DIR_NAME))
+	if err != nil {
+		return nil, err
+	}
+	if docCount != manifest.IndexDocs {
+		return nil, fmt.Errorf("index snapshot has %d documents, expected %d",
+			docCount, manifest.IndexDocs)
+	}
+	return manifest, nil
+}
+
+func countDocs(indexDirName string) (uint64, error) {
+	idx, err := bleve.OpenUsing(indexDirName, map[string]interface{}{"read_only": true})
+	if err != nil {
+		return 0, err
+	}
+	defer idx.Close()
+	return idx.DocCount()
+}
+
+func copyDir(srcDirName string, dstDirName string) error {
+	return filepath.Walk(srcDirName, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcDirName, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dstDirName, relPath)
+		if info.IsDir() {
+			return os.MkdirAll(dstPath, 0755)
+		}
+		return copyFile(path, dstPath)
+	})
+}
+
+func copyFile(srcFileName string, dstFileName string) error {
+	src, err := os.Open(srcFileName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(dstFileName)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func fileSha256(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func readManifest(backupDir string) (*Manifest, error) {
+	content, err := os.ReadFile(filepath.Join(backupDir, MANIFEST_FILE_NAME))
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err = json.Unmarshal(content, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func snapshot(dbFileName string, idx bleve.Index, backupDir string) (*Manifest, error) {
+	var manifest Manifest
+	db, err := notes.OpenNoteDb(dbFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	backupDbFileName := filepath.Join(backupDir, DB_FILE_NAME)
+	if _, err = db.Exec("VACUUM INTO ?", backupDbFileName); err != nil {
+		return nil, err
+	}
+	if err = db.QueryRow("SELECT COUNT(*) FROM notes").Scan(&manifest.Notes); err != nil {
+		return nil, err
+	}
+	if manifest.DbSha256, err = fileSha256(backupDbFileName); err != nil {
+		return nil, err
+	}
+
+	copyable, ok := idx.(bleve.IndexCopyable)
+	if idx == nil || !ok {
+		manifest.Reindex = true
+	} else if err = copyable.CopyTo(bleve.FileSystemDirectory(
+		filepath.Join(backupDir, INDEX_DIR_NAME))); err != nil {
+		os.RemoveAll(filepath.Join(backupDir, INDEX_DIR_NAME))
+		manifest.Reindex = true
+	} else if manifest.IndexDocs, err = countDocs(filepath.Join(backupDir, INDEX_DIR_NAME)); err != nil {
+		return nil, err
+	}
+
+	if manifest.Reindex {
+		if err = os.WriteFile(filepath.Join(backupDir, REINDEX_MARKER_NAME), nil, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return &manifest, nil
+}
+
+func writeManifest(backupDir string, manifest *Manifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(backupDir, MANIFEST_FILE_NAME), content, 0644)
+}
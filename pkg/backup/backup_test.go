@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"database/sql"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_BacksUpAndRestores(t *testing.T) {
+	tmpDirName := t.TempDir()
+	dbFileName := tmpDirName + "/notes.sqlite3"
+	indexDirName := tmpDirName + "/notes.index"
+	backupRoot := tmpDirName + "/backups"
+
+	db := createDb(t, dbFileName, "first note")
+	idx, err := index.CreateIndex(dbFileName, indexDirName)
+	if err != nil {
+		t.Fatalf("Cannot create index %s", err)
+	}
+
+	backupDir, err := Backup(dbFileName, idx, backupRoot)
+	assert.Nil(t, err, "Unexpected error on backup")
+	manifest, err := Verify(backupDir)
+	assert.Nil(t, err, "Unexpected error on verify")
+	assert.Equal(t, 1, manifest.Notes, "Backed up all notes")
+	assert.Equal(t, uint64(1), manifest.IndexDocs, "Backed up index")
+	assert.False(t, manifest.Reindex, "Unexpected reindex marker")
+
+	_, err = notes.CreateNote(db, &notes.NoteRecord{Author: 1, Content: "second note"})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	db.Close()
+	idx.Close()
+
+	err = Restore(backupDir, dbFileName, indexDirName)
+	assert.Nil(t, err, "Unexpected error on restore")
+
+	db, _ = notes.OpenNoteDb(dbFileName)
+	defer db.Close()
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM notes").Scan(&count)
+	assert.Equal(t, 1, count, "Restored note count")
+
+	idx, err = index.OpenIndex(indexDirName)
+	assert.Nil(t, err, "Unexpected error opening restored index")
+	defer idx.Close()
+	docCount, _ := idx.DocCount()
+	assert.Equal(t, uint64(1), docCount, "Restored index")
+}
+
+func Test_MarksReindexWithoutIndex(t *testing.T) {
+	tmpDirName := t.TempDir()
+	dbFileName := tmpDirName + "/notes.sqlite3"
+	indexDirName := tmpDirName + "/notes.index"
+	backupRoot := tmpDirName + "/backups"
+
+	db := createDb(t, dbFileName, "first note")
+	db.Close()
+
+	backupDir, err := Backup(dbFileName, nil, backupRoot)
+	assert.Nil(t, err, "Unexpected error on backup")
+	manifest, err := Verify(backupDir)
+	assert.Nil(t, err, "Unexpected error on verify")
+	assert.True(t, manifest.Reindex, "Expected reindex marker")
+
+	err = Restore(backupDir, dbFileName, indexDirName)
+	assert.Nil(t, err, "Unexpected error on restore")
+	idx, err := index.OpenIndex(indexDirName)
+	assert.Nil(t, err, "Unexpected error opening rebuilt index")
+	defer idx.Close()
+	docCount, _ := idx.DocCount()
+	assert.Equal(t, uint64(1), docCount, "Rebuilt index")
+}
+
+func Test_RejectsCorruptBackup(t *testing.T) {
+	tmpDirName := t.TempDir()
+	dbFileName := tmpDirName + "/notes.sqlite3"
+	backupRoot := tmpDirName + "/backups"
+
+	db := createDb(t, dbFileName, "first note")
+	db.Close()
+
+	backupDir, err := Backup(dbFileName, nil, backupRoot)
+	assert.Nil(t, err, "Unexpected error on backup")
+	f, _ := os.OpenFile(filepath.Join(backupDir, DB_FILE_NAME), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte("garbage"))
+	f.Close()
+
+	_, err = Verify(backupDir)
+	assert.NotNil(t, err, "Expected error on corrupt backup")
+	err = Restore(backupDir, dbFileName, tmpDirName+"/notes.index")
+	assert.NotNil(t, err, "Expected restore to refuse corrupt backup")
+}
+
+func Test_RotatesAndFindsBackups(t *testing.T) {
+	backupRoot := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		name := start.Add(time.Duration(i) * time.Hour).Format(BACKUP_TIME_FORMAT)
+		os.Mkdir(filepath.Join(backupRoot, name), 0755)
+	}
+	os.Mkdir(filepath.Join(backupRoot, "not-a-backup"), 0755)
+
+	found, err := FindBackup(backupRoot, start.Add(90*time.Minute))
+	assert.Nil(t, err, "Unexpected error finding backup")
+	assert.Equal(t, start.Add(time.Hour).Format(BACKUP_TIME_FORMAT), filepath.Base(found))
+	_, err = FindBackup(backupRoot, start.Add(-time.Minute))
+	assert.NotNil(t, err, "Expected error finding backup before first")
+
+	removed, err := Rotate(backupRoot, 2)
+	assert.Nil(t, err, "Unexpected error on rotation")
+	assert.Equal(t, 3, len(removed), "Removed oldest backups")
+	names, _ := List(backupRoot)
+	assert.Equal(t, []string{
+		start.Add(3 * time.Hour).Format(BACKUP_TIME_FORMAT),
+		start.Add(4 * time.Hour).Format(BACKUP_TIME_FORMAT),
+	}, names)
+}
+
+func createDb(t *testing.T, dbFileName string, content string) *sql.DB {
+	db, err := notes.CreateNoteDb(dbFileName)
+	if err != nil {
+		t.Fatalf("Cannot create db %s", err)
+	}
+	authorId, _ := notes.CreateAuthor(db, "Test Author", "")
+	if _, err := notes.CreateNote(db, &notes.NoteRecord{
+		Author: authorId, Content: content, Privacy: notes.DEFAULT_ACCESS, RenderHint: 1,
+	}); err != nil {
+		t.Fatalf("Cannot insert note %s", err)
+	}
+	return db
+}
@@ -0,0 +1,1361 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/fasthttp/websocket"
+)
+
+const API_PREFIX = "/api/v1"
+
+/**
+ * Typed client for the /api/v1 routes described by /openapi.json.
+ */
+type Client struct {
+	BaseUrl    string
+	HttpClient *http.Client
+	Token      string
+}
+
+/**
+ * Field or Position locates the error in an invalid search query.
+ */
+type ApiError struct {
+	Code     string
+	Field    string
+	Message  string
+	Position *int
+	Status   int
+}
+
+type AuthorRecord struct {
+	Id   int
+	Name string
+}
+
+type BackupResult struct {
+	Backup  string   `json:"backup"`
+	Removed []string `json:"removed"`
+}
+
+/**
+ * One step of an edit: keep, insert or remove text, counted in runes.
+ */
+type CollabComponent struct {
+	Delete int    `json:"delete,omitempty"`
+	Insert string `json:"insert,omitempty"`
+	Retain int    `json:"retain,omitempty"`
+}
+
+type CollabCursor struct {
+	Position     int `json:"position"`
+	SelectionEnd int `json:"selectionEnd"`
+}
+
+/**
+ * A message of an editing session. Clients send op messages with the
+ * Version they were made on, and cursor messages. Type is then one of
+ * init, ack, op, presence, saved or error.
+ */
+type CollabMessage struct {
+	ClientId     int                 `json:"clientId,omitempty"`
+	Content      *string             `json:"content,omitempty"`
+	Cursor       *CollabCursor       `json:"cursor,omitempty"`
+	Message      string              `json:"message,omitempty"`
+	Op           []CollabComponent   `json:"op,omitempty"`
+	Participants []CollabParticipant `json:"participants,omitempty"`
+	Revision     int                 `json:"revision,omitempty"`
+	Type         string              `json:"type"`
+	Version      int                 `json:"version"`
+}
+
+type CollabParticipant struct {
+	ClientId int           `json:"clientId"`
+	Cursor   *CollabCursor `json:"cursor,omitempty"`
+	UserId   int           `json:"userId"`
+	UserName string        `json:"userName"`
+}
+
+/**
+ * An open editing session on a note, over a WebSocket.
+ */
+type CollabSession struct {
+	conn *websocket.Conn
+}
+
+/**
+ * A change to a note readable by the user, or to sharing by or with them.
+ * Kind is one of created, updated, deleted, privacy or shared, or reset
+ * when the events to resume from are gone and notes need reloading.
+ */
+/**
+ * ParentId is 0 for comments starting a thread. Deleted comments with
+ * replies stay in their thread without content.
+ */
+type Comment struct {
+	Author     int
+	AuthorName string
+	Content    string
+	Created    int
+	Deleted    bool
+	Edited     int
+	Html       string
+	Id         int
+	NoteId     int
+	ParentId   int
+	Resolved   bool
+}
+
+/**
+ * Fields left nil are not sent. ParentId only applies on creation and
+ * Resolved on update.
+ */
+type CommentRequest struct {
+	Content  *string `json:"content,omitempty"`
+	ParentId *int    `json:"parentId,omitempty"`
+	Resolved *bool   `json:"resolved,omitempty"`
+}
+
+type Event struct {
+	Author   int
+	Created  int
+	Id       int
+	Kind     string
+	NoteId   int
+	Notebook string
+	Privacy  string
+	Tags     []string
+	User     int
+}
+
+/**
+ * An open stream of Server-Sent Events, read one at a time with Next.
+ */
+type EventStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+type FacetCount struct {
+	Count int
+	Term  string
+}
+
+type ImportReport struct {
+	Imported []ImportReportEntry
+	Skipped  []ImportReportEntry
+	Warnings []ImportReportEntry
+}
+
+type ImportReportEntry struct {
+	Message string
+	NoteId  int
+	Source  string
+}
+
+/**
+ * Language is blank when it is detected from the content.
+ */
+type JournalDay struct {
+	Date   string
+	NoteId int
+}
+
+type JournalSettings struct {
+	Template int
+	TimeZone string
+}
+
+/**
+ * Fields left nil are not sent, so updates only touch what is set.
+ */
+type JournalSettingsRequest struct {
+	Template *int    `json:"template,omitempty"`
+	TimeZone *string `json:"timeZone,omitempty"`
+}
+
+type Note struct {
+	NoteRecord
+	Id       int
+	Language string
+	Notebook string
+	Revision int
+	Tags     []string
+}
+
+type NoteBatch struct {
+	Items   []Note `json:"items"`
+	Missing []int  `json:"missing"`
+}
+
+/**
+ * Cursor is taken from the next-page link and is empty on the last page.
+ */
+type NotePage struct {
+	Cursor    string        `json:"-"`
+	Items     []int         `json:"items"`
+	Next      string        `json:"next"`
+	Summaries []NoteSummary `json:"summaries"`
+}
+
+/**
+ * Kind is comment, edit, mention or shared. NoteId is 0 for shared.
+ */
+type Notification struct {
+	Actor     int
+	ActorName string
+	CommentId int
+	Created   int
+	Id        int
+	Kind      string
+	NoteId    int
+	Read      bool
+}
+
+/**
+ * Cursor is taken from the next-page link and is empty on the last page.
+ */
+type NotificationPage struct {
+	Cursor string         `json:"-"`
+	Items  []Notification `json:"items"`
+	Next   string         `json:"next"`
+}
+
+/**
+ * Structured search: free text and phrases filtered by any of the authors
+ * ("me" for the caller) and privacy levels, all of the tags, a notebook,
+ * and a creation range from CreatedAfter up to but excluding
+ * CreatedBefore, given as YYYY-MM-DD. Language restricts the search to
+ * notes in that language.
+ */
+type NoteQuery struct {
+	Authors       []string `json:"authors,omitempty"`
+	CreatedAfter  string   `json:"createdAfter,omitempty"`
+	CreatedBefore string   `json:"createdBefore,omitempty"`
+	Language      string   `json:"language,omitempty"`
+	Notebook      string   `json:"notebook,omitempty"`
+	Phrases       []string `json:"phrases,omitempty"`
+	Privacy       []string `json:"privacy,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	Text          string   `json:"text,omitempty"`
+}
+
+type NoteRecord struct {
+	Author     int
+	Content    string
+	Created    int
+	Privacy    int
+	RenderHint int
+}
+
+/**
+ * Fields left nil are not sent, so updates only touch what is set.
+ */
+type NoteRequest struct {
+	Content    *string   `json:"content,omitempty"`
+	Language   *string   `json:"language,omitempty"`
+	Notebook   *string   `json:"notebook,omitempty"`
+	Privacy    *int      `json:"privacy,omitempty"`
+	RenderHint *int      `json:"renderHint,omitempty"`
+	Tags       *[]string `json:"tags,omitempty"`
+}
+
+type NoteSummary struct {
+	Author     int
+	AuthorName string
+	Created    int
+	Id         int
+	Snippet    string
+	Title      string
+}
+
+/**
+ * Smart notebooks are pinned saved searches: SearchId names the search to
+ * run for their notes. Notes is the API path listing the notes either way.
+ */
+type Notebook struct {
+	Count    int
+	Name     string
+	Notes    string
+	SearchId int
+	Smart    bool
+}
+
+type PageOptions struct {
+	Cursor string
+	Expand bool
+	Limit  int
+}
+
+type RelatedNote struct {
+	Id          string
+	Reason      string
+	Score       float64
+	SharedTags  []string
+	SharedTerms []string
+}
+
+type RelatedNotes struct {
+	Items     []RelatedNote `json:"items"`
+	Summaries []NoteSummary `json:"summaries"`
+}
+
+type RenderedNote struct {
+	Html string
+	Toc  []TocEntry
+}
+
+/**
+ * Fragments holds HTML snippets keyed by field, with matches wrapped in
+ * <mark>, when highlighting is requested.
+ */
+type SearchHit struct {
+	Fragments map[string][]string
+	Id        string
+	Score     float64
+}
+
+type SavedSearch struct {
+	Created int
+	Id      int
+	Name    string
+	Pinned  bool
+	Query   NoteQuery
+}
+
+/**
+ * Fields left nil are not sent, so updates only touch what is set.
+ */
+type SavedSearchRequest struct {
+	Name   *string    `json:"name,omitempty"`
+	Pinned *bool      `json:"pinned,omitempty"`
+	Query  *NoteQuery `json:"query,omitempty"`
+}
+
+/**
+ * Sort is one of relevance (the default), newest or oldest.
+ */
+type SearchOptions struct {
+	PageOptions
+	Facets    bool
+	Highlight bool
+	Sort      string
+}
+
+type SearchPage struct {
+	Cursor    string                  `json:"-"`
+	Facets    map[string][]FacetCount `json:"facets"`
+	Items     []SearchHit             `json:"items"`
+	Next      string                  `json:"next"`
+	Summaries []NoteSummary           `json:"summaries"`
+	Total     uint64                  `json:"total"`
+}
+
+/**
+ * Kind is one of title, tag or author. NoteId is set for titles and
+ * Count, the number of readable notes, for tags and authors.
+ */
+type Suggestion struct {
+	Count  int
+	Kind   string
+	NoteId int
+	Text   string
+}
+
+type SummaryBatch struct {
+	Items   []NoteSummary `json:"items"`
+	Missing []int         `json:"missing"`
+}
+
+/**
+ * A note changed offline. Leave Id at 0 for a note created offline and
+ * name it with ClientId; otherwise BaseRevision is the revision the change
+ * was made to.
+ */
+type SyncChange struct {
+	NoteRequest
+	BaseRevision int    `json:"baseRevision"`
+	ClientId     string `json:"clientId,omitempty"`
+	Deleted      bool   `json:"deleted,omitempty"`
+	Id           int    `json:"id"`
+}
+
+/**
+ * Note is nil when the note was deleted or is no longer readable.
+ */
+type SyncNote struct {
+	Deleted  bool
+	Id       int
+	Note     *Note
+	Revision int
+}
+
+type SyncRequest struct {
+	Changes []SyncChange `json:"changes"`
+	Cursor  int          `json:"cursor"`
+}
+
+type SyncResponse struct {
+	Applied   []SyncResult `json:"applied"`
+	Changes   []SyncNote   `json:"changes"`
+	Conflicts []SyncResult `json:"conflicts"`
+	Cursor    int          `json:"cursor"`
+	More      bool         `json:"more"`
+	Rejected  []SyncResult `json:"rejected"`
+}
+
+/**
+ * CopyId is the note keeping the client's version of a conflicting change.
+ */
+type SyncResult struct {
+	ClientId string
+	CopyId   int
+	Error    string
+	Id       int
+	Revision int
+}
+
+/**
+ * A GFM checkbox of a note. Due is empty when the task has no due date.
+ */
+type Task struct {
+	Done      bool
+	Due       string
+	Id        int
+	Line      int
+	NoteId    int
+	NoteTitle string
+	Text      string
+}
+
+type TaskPage struct {
+	Cursor string `json:"-"`
+	Items  []Task `json:"items"`
+	Next   string `json:"next"`
+}
+
+/**
+ * Privacy and Tags are given to the notes created from the template.
+ */
+type Template struct {
+	Author     int
+	AuthorName string
+	Id         int
+	Privacy    int
+	Prompts    []TemplatePrompt
+	Tags       []string
+	Title      string
+}
+
+/**
+ * Values fill the prompts by name and may override date, time and user.
+ * Title fills {{title}}, by default with the template's title.
+ */
+type TemplateNoteRequest struct {
+	Notebook *string           `json:"notebook,omitempty"`
+	Privacy  *int              `json:"privacy,omitempty"`
+	Tags     *[]string         `json:"tags,omitempty"`
+	Title    *string           `json:"title,omitempty"`
+	Values   map[string]string `json:"values,omitempty"`
+}
+
+type TemplatePrompt struct {
+	Label string
+	Name  string
+}
+
+type TemplateRequest struct {
+	Privacy *int      `json:"privacy,omitempty"`
+	Tags    *[]string `json:"tags,omitempty"`
+}
+
+type TocEntry struct {
+	Id    string
+	Level int
+	Title string
+}
+
+/**
+ * Secret is only set by CreateWebhook, to check the signatures of the
+ * deliveries.
+ */
+type Webhook struct {
+	Active   bool
+	AllUsers bool
+	Created  int
+	Events   []string
+	Id       int
+	Notebook string
+	Secret   string
+	Tag      string
+	Url      string
+}
+
+/**
+ * Status is pending, delivered or failed. Payload is the JSON body posted.
+ */
+type WebhookDelivery struct {
+	Attempts     int
+	Created      int
+	Delivered    int
+	Error        string
+	EventId      int
+	Id           int
+	Kind         string
+	Payload      string
+	ResponseCode int
+	Status       string
+	WebhookId    int
+}
+
+/**
+ * Cursor is taken from the next-page link and is empty on the last page.
+ */
+type WebhookDeliveryPage struct {
+	Cursor string            `json:"-"`
+	Items  []WebhookDelivery `json:"items"`
+	Next   string            `json:"next"`
+}
+
+/**
+ * Fields left nil are not sent, so updates only touch what is set.
+ */
+type WebhookRequest struct {
+	Active   *bool     `json:"active,omitempty"`
+	AllUsers *bool     `json:"allUsers,omitempty"`
+	Events   *[]string `json:"events,omitempty"`
+	Notebook *string   `json:"notebook,omitempty"`
+	Tag      *string   `json:"tag,omitempty"`
+	Url      *string   `json:"url,omitempty"`
+}
+
+type batchRequest struct {
+	Ids  []int  `json:"ids"`
+	View string `json:"view"`
+}
+
+type errorBody struct {
+	Error struct {
+		Code     string `json:"code"`
+		Field    string `json:"field"`
+		Message  string `json:"message"`
+		Position *int   `json:"position"`
+	} `json:"error"`
+}
+
+func NewClient(baseUrl string) *Client {
+	return &Client{BaseUrl: strings.TrimSuffix(baseUrl, "/"), HttpClient: http.DefaultClient}
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+/**
+ * Join the editing session of a note. The first message is init, with
+ * the document and its version.
+ */
+func (c *Client) Collaborate(noteId int) (*CollabSession, error) {
+	sessionUrl := "ws" + strings.TrimPrefix(c.BaseUrl, "http") + API_PREFIX + "/notes/" + strconv.Itoa(noteId) + "/collab"
+	header := http.Header{}
+	if c.Token != "" {
+		header.Set("Authorization", "Bearer "+c.Token)
+	}
+	conn, response, err := websocket.DefaultDialer.Dial(sessionUrl, header)
+	if err == websocket.ErrBadHandshake && response != nil {
+		defer response.Body.Close()
+		return nil, newApiError(response)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &CollabSession{conn: conn}, nil
+}
+
+func (c *Client) CreateBackup() (*BackupResult, error) {
+	var result BackupResult
+	if err := c.doJson(http.MethodPost, "/admin/backups", nil, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *Client) CreateComment(noteId int, request CommentRequest) (*Comment, error) {
+	var comment Comment
+	if err := c.doJson(http.MethodPost, commentsPath(noteId), nil, request, &comment); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+func (c *Client) CreateNote(request NoteRequest) (*Note, error) {
+	var note Note
+	if err := c.doJson(http.MethodPost, "/notes", nil, request, &note); err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+func (c *Client) CreateNoteFromTemplate(templateId int, request TemplateNoteRequest) (*Note, error) {
+	var note Note
+	if err := c.doJson(http.MethodPost, "/templates/"+strconv.Itoa(templateId)+"/notes", nil, request, &note); err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+func (c *Client) CreateSavedSearch(request SavedSearchRequest) (*SavedSearch, error) {
+	var search SavedSearch
+	if err := c.doJson(http.MethodPost, "/searches", nil, request, &search); err != nil {
+		return nil, err
+	}
+	return &search, nil
+}
+
+func (c *Client) CreateWebhook(request WebhookRequest) (*Webhook, error) {
+	var webhook Webhook
+	if err := c.doJson(http.MethodPost, "/webhooks", nil, request, &webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func (c *Client) DeleteComment(noteId int, commentId int) error {
+	return c.doJson(http.MethodDelete, commentsPath(noteId)+"/"+strconv.Itoa(commentId), nil, nil, nil)
+}
+
+/**
+ * Delete a note unless it changed since revision, with a 412 ApiError.
+ */
+func (c *Client) DeleteNote(noteId int, revision int) error {
+	return c.doJsonHeader(http.MethodDelete, "/notes/"+strconv.Itoa(noteId), nil, ifMatch(revision), nil, nil)
+}
+
+func (c *Client) DeleteSavedSearch(searchId int) error {
+	return c.doJson(http.MethodDelete, "/searches/"+strconv.Itoa(searchId), nil, nil, nil)
+}
+
+/**
+ * Stream an archive of the caller's notes in the given format to w.
+ */
+func (c *Client) DeleteWebhook(webhookId int) error {
+	return c.doJson(http.MethodDelete, "/webhooks/"+strconv.Itoa(webhookId), nil, nil, nil)
+}
+
+/**
+ * Stream the events after lastEventId, or only new ones when it is empty.
+ * The stream has to be closed.
+ */
+func (c *Client) Events(lastEventId string) (*EventStream, error) {
+	var query url.Values
+	if lastEventId != "" {
+		query = url.Values{"after": {lastEventId}}
+	}
+	response, err := c.do(http.MethodGet, "/events", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &EventStream{body: response.Body, scanner: bufio.NewScanner(response.Body)}, nil
+}
+
+func (c *Client) Export(format string, w io.Writer) error {
+	response, err := c.do(http.MethodGet, "/export", url.Values{"format": {format}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+/**
+ * Be notified of the edits of a note.
+ */
+func (c *Client) FollowNote(noteId int) error {
+	return c.doJson(http.MethodPost, "/notes/"+strconv.Itoa(noteId)+"/follow", nil, nil, nil)
+}
+
+func (c *Client) GetComment(noteId int, commentId int) (*Comment, error) {
+	var comment Comment
+	if err := c.doJson(http.MethodGet, commentsPath(noteId)+"/"+strconv.Itoa(commentId), nil, nil, &comment); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+/**
+ * Fetch the journal note for a date, YYYY-MM-DD or today, creating it when
+ * there is none.
+ */
+func (c *Client) GetJournalNote(date string) (*Note, error) {
+	var note Note
+	if err := c.doJson(http.MethodGet, "/journal/"+url.PathEscape(date), nil, nil, &note); err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+func (c *Client) GetJournalSettings() (*JournalSettings, error) {
+	var settings JournalSettings
+	if err := c.doJson(http.MethodGet, "/journal/settings", nil, nil, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func (c *Client) GetNote(noteId int) (*Note, error) {
+	var note Note
+	if err := c.doJson(http.MethodGet, "/notes/"+strconv.Itoa(noteId), nil, nil, &note); err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+/**
+ * Fetch a note unless it is still at revision, returning nil then.
+ */
+func (c *Client) GetNoteIfChanged(noteId int, revision int) (*Note, error) {
+	header := http.Header{"If-None-Match": {noteETag(revision)}}
+	response, err := c.do(http.MethodGet, "/notes/"+strconv.Itoa(noteId), nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	var note Note
+	if err = json.NewDecoder(response.Body).Decode(&note); err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+func (c *Client) GetNoteSummaries(noteIds []int) (*SummaryBatch, error) {
+	var batch SummaryBatch
+	if err := c.doJson(http.MethodPost, "/notes/batch", nil, batchRequest{noteIds, "summary"}, &batch); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+func (c *Client) GetNotes(noteIds []int) (*NoteBatch, error) {
+	var batch NoteBatch
+	if err := c.doJson(http.MethodPost, "/notes/batch", nil, batchRequest{noteIds, "full"}, &batch); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+func (c *Client) GetSavedSearch(searchId int) (*SavedSearch, error) {
+	var search SavedSearch
+	if err := c.doJson(http.MethodGet, "/searches/"+strconv.Itoa(searchId), nil, nil, &search); err != nil {
+		return nil, err
+	}
+	return &search, nil
+}
+
+func (c *Client) GetTemplate(templateId int) (*Template, error) {
+	var template Template
+	if err := c.doJson(http.MethodGet, "/templates/"+strconv.Itoa(templateId), nil, nil, &template); err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+func (c *Client) GetUser(userId int) (*AuthorRecord, error) {
+	var author AuthorRecord
+	if err := c.doJson(http.MethodGet, "/users/"+strconv.Itoa(userId), nil, nil, &author); err != nil {
+		return nil, err
+	}
+	return &author, nil
+}
+
+func (c *Client) GetWebhook(webhookId int) (*Webhook, error) {
+	var webhook Webhook
+	if err := c.doJson(http.MethodGet, "/webhooks/"+strconv.Itoa(webhookId), nil, nil, &webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func (c *Client) ImportNotes(format string, fileName string, archive io.Reader) (*ImportReport, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err := writer.WriteField("format", format); err != nil {
+		return nil, err
+	}
+	part, err := writer.CreateFormFile("archive", fileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(part, archive); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	response, err := c.do(http.MethodPost, "/notes/import", nil,
+		http.Header{"Content-Type": {writer.FormDataContentType()}}, &body)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var report ImportReport
+	if err = json.NewDecoder(response.Body).Decode(&report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+/**
+ * List the caller's notebooks followed by their pinned saved searches.
+ */
+/**
+ * List the comments on a note, oldest first.
+ */
+func (c *Client) ListComments(noteId int) ([]Comment, error) {
+	var list struct {
+		Items []Comment `json:"items"`
+	}
+	if err := c.doJson(http.MethodGet, commentsPath(noteId), nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+/**
+ * List the dates from through to with a journal note, the current month
+ * when both are empty.
+ */
+func (c *Client) ListJournalDays(from string, to string) ([]JournalDay, error) {
+	query := url.Values{}
+	if from != "" {
+		query.Set("from", from)
+	}
+	if to != "" {
+		query.Set("to", to)
+	}
+	var list struct {
+		Items []JournalDay `json:"items"`
+	}
+	if err := c.doJson(http.MethodGet, "/journal", query, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c *Client) ListNotebooks() ([]Notebook, error) {
+	var list struct {
+		Items []Notebook `json:"items"`
+	}
+	if err := c.doJson(http.MethodGet, "/notebooks", nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+/**
+ * List a page of recent note ids. Leave the cursor empty for the first page.
+ */
+func (c *Client) ListNotes(options PageOptions) (*NotePage, error) {
+	var page NotePage
+	if err := c.doJson(http.MethodGet, "/notes", pageQuery(options), nil, &page); err != nil {
+		return nil, err
+	}
+	page.Cursor = nextCursor(page.Next)
+	return &page, nil
+}
+
+func (c *Client) ListNotifications(options PageOptions, unreadOnly bool) (*NotificationPage, error) {
+	query := pageQuery(options)
+	if unreadOnly {
+		query.Set("unread", "true")
+	}
+	var page NotificationPage
+	if err := c.doJson(http.MethodGet, "/notifications", query, nil, &page); err != nil {
+		return nil, err
+	}
+	page.Cursor = nextCursor(page.Next)
+	return &page, nil
+}
+
+func (c *Client) ListSavedSearches(pinnedOnly bool) ([]SavedSearch, error) {
+	var query url.Values
+	if pinnedOnly {
+		query = url.Values{"pinned": {"true"}}
+	}
+	var list struct {
+		Items []SavedSearch `json:"items"`
+	}
+	if err := c.doJson(http.MethodGet, "/searches", query, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+/**
+ * List the open tasks of readable notes, or the done ones, soonest due
+ * first, only those due on or before dueBefore unless it is empty.
+ */
+func (c *Client) ListTasks(options PageOptions, done bool, dueBefore string) (*TaskPage, error) {
+	query := pageQuery(options)
+	if done {
+		query.Set("done", "true")
+	}
+	if dueBefore != "" {
+		query.Set("dueBefore", dueBefore)
+	}
+	var page TaskPage
+	if err := c.doJson(http.MethodGet, "/tasks", query, nil, &page); err != nil {
+		return nil, err
+	}
+	page.Cursor = nextCursor(page.Next)
+	return &page, nil
+}
+
+func (c *Client) ListTemplates() ([]Template, error) {
+	var list struct {
+		Items []Template `json:"items"`
+	}
+	if err := c.doJson(http.MethodGet, "/templates", nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+/**
+ * List the deliveries to a webhook, newest first.
+ */
+func (c *Client) ListWebhookDeliveries(webhookId int, options PageOptions) (*WebhookDeliveryPage, error) {
+	var page WebhookDeliveryPage
+	path := "/webhooks/" + strconv.Itoa(webhookId) + "/deliveries"
+	if err := c.doJson(http.MethodGet, path, pageQuery(options), nil, &page); err != nil {
+		return nil, err
+	}
+	page.Cursor = nextCursor(page.Next)
+	return &page, nil
+}
+
+func (c *Client) ListWebhooks() ([]Webhook, error) {
+	var list struct {
+		Items []Webhook `json:"items"`
+	}
+	if err := c.doJson(http.MethodGet, "/webhooks", nil, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+/**
+ * Log in and keep the returned token for subsequent requests.
+ */
+func (c *Client) Login(userName string, password string) (int, error) {
+	form := url.Values{"user": {userName}, "pass": {password}}
+	response, err := c.do(http.MethodPost, "/login", nil,
+		http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	var login struct {
+		Id    int    `json:"id"`
+		Token string `json:"token"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&login); err != nil {
+		return 0, err
+	}
+	c.Token = login.Token
+	return login.Id, nil
+}
+
+/**
+ * Mark the given notifications as read, or all of them when none is
+ * given, and return how many are left unread.
+ */
+func (c *Client) MarkNotificationsRead(notificationIds ...int) (int, error) {
+	var count struct {
+		Unread int `json:"unread"`
+	}
+	request := struct {
+		Ids []int `json:"ids"`
+	}{notificationIds}
+	if err := c.doJson(http.MethodPost, "/notifications/read", nil, request, &count); err != nil {
+		return 0, err
+	}
+	return count.Unread, nil
+}
+
+/**
+ * List up to limit notes on the same subject as a note, with summaries
+ * when expand is set.
+ */
+func (c *Client) RelatedNotes(noteId int, limit int, expand bool) (*RelatedNotes, error) {
+	var related RelatedNotes
+	path := "/notes/" + strconv.Itoa(noteId) + "/related"
+	query := pageQuery(PageOptions{Expand: expand, Limit: limit})
+	if err := c.doJson(http.MethodGet, path, query, nil, &related); err != nil {
+		return nil, err
+	}
+	return &related, nil
+}
+
+func (c *Client) RenderNote(noteId int) (*RenderedNote, error) {
+	var rendered RenderedNote
+	if err := c.doJson(http.MethodGet, "/notes/"+strconv.Itoa(noteId)+"/render",
+		url.Values{"format": {"json"}}, nil, &rendered); err != nil {
+		return nil, err
+	}
+	return &rendered, nil
+}
+
+/**
+ * Run a saved search with the caller's current access rights.
+ */
+func (c *Client) RunSavedSearch(searchId int, options SearchOptions) (*SearchPage, error) {
+	var page SearchPage
+	path := "/searches/" + strconv.Itoa(searchId) + "/notes"
+	if err := c.doJson(http.MethodGet, path, searchQuery(options), nil, &page); err != nil {
+		return nil, err
+	}
+	page.Cursor = nextCursor(page.Next)
+	return &page, nil
+}
+
+/**
+ * Search with the query syntax, e.g. `lentils tag:errands after:2024-01-01`.
+ */
+func (c *Client) Search(query string, options SearchOptions) (*SearchPage, error) {
+	params := searchQuery(options)
+	params.Set("q", query)
+	var page SearchPage
+	if err := c.doJson(http.MethodGet, "/search", params, nil, &page); err != nil {
+		return nil, err
+	}
+	page.Cursor = nextCursor(page.Next)
+	return &page, nil
+}
+
+func (c *Client) SearchQuery(query NoteQuery, options SearchOptions) (*SearchPage, error) {
+	var page SearchPage
+	if err := c.doJson(http.MethodPost, "/search", searchQuery(options), query, &page); err != nil {
+		return nil, err
+	}
+	page.Cursor = nextCursor(page.Next)
+	return &page, nil
+}
+
+/**
+ * Flag a note as a template, or change what the notes created from it get.
+ */
+func (c *Client) SetTemplate(noteId int, request TemplateRequest) (*Template, error) {
+	var template Template
+	if err := c.doJson(http.MethodPost, "/notes/"+strconv.Itoa(noteId)+"/template", nil, request, &template); err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+/**
+ * Complete titles, tags and author names of readable notes from partial
+ * input, allowing a typo in longer words.
+ */
+func (c *Client) Suggest(q string, limit int) ([]Suggestion, error) {
+	query := pageQuery(PageOptions{Limit: limit})
+	query.Set("q", q)
+	var list struct {
+		Items []Suggestion `json:"items"`
+	}
+	if err := c.doJson(http.MethodGet, "/suggest", query, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+/**
+ * Send the changes made offline since the last sync and get up to limit
+ * notes changed on the server since the cursor of that sync.
+ */
+func (c *Client) Sync(request SyncRequest, limit int) (*SyncResponse, error) {
+	var response SyncResponse
+	query := pageQuery(PageOptions{Limit: limit})
+	if err := c.doJson(http.MethodPost, "/sync", query, request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+/**
+ * Check or uncheck a task in its note, or flip it when done is nil.
+ */
+func (c *Client) ToggleTask(taskId int, done *bool) (*Task, error) {
+	request := struct {
+		Done *bool `json:"done,omitempty"`
+	}{done}
+	var task Task
+	if err := c.doJson(http.MethodPost, "/tasks/"+strconv.Itoa(taskId)+"/toggle", nil, request, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (c *Client) UnfollowNote(noteId int) error {
+	return c.doJson(http.MethodDelete, "/notes/"+strconv.Itoa(noteId)+"/follow", nil, nil, nil)
+}
+
+func (c *Client) UnreadNotifications() (int, error) {
+	var count struct {
+		Unread int `json:"unread"`
+	}
+	if err := c.doJson(http.MethodGet, "/notifications/unread", nil, nil, &count); err != nil {
+		return 0, err
+	}
+	return count.Unread, nil
+}
+
+func (c *Client) UnsetTemplate(noteId int) error {
+	return c.doJson(http.MethodDelete, "/notes/"+strconv.Itoa(noteId)+"/template", nil, nil, nil)
+}
+
+func (c *Client) UpdateComment(noteId int, commentId int, request CommentRequest) (*Comment, error) {
+	var comment Comment
+	path := commentsPath(noteId) + "/" + strconv.Itoa(commentId)
+	if err := c.doJson(http.MethodPatch, path, nil, request, &comment); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+func (c *Client) UpdateJournalSettings(request JournalSettingsRequest) (*JournalSettings, error) {
+	var settings JournalSettings
+	if err := c.doJson(http.MethodPatch, "/journal/settings", nil, request, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+/**
+ * Update a note unless it changed since revision, with a 412 ApiError.
+ */
+func (c *Client) UpdateNote(noteId int, revision int, request NoteRequest) (*Note, error) {
+	var note Note
+	path := "/notes/" + strconv.Itoa(noteId)
+	if err := c.doJsonHeader(http.MethodPatch, path, nil, ifMatch(revision), request, &note); err != nil {
+		return nil, err
+	}
+	return &note, nil
+}
+
+func (c *Client) UpdateSavedSearch(searchId int, request SavedSearchRequest) (*SavedSearch, error) {
+	var search SavedSearch
+	if err := c.doJson(http.MethodPatch, "/searches/"+strconv.Itoa(searchId), nil, request, &search); err != nil {
+		return nil, err
+	}
+	return &search, nil
+}
+
+func (c *Client) UpdateWebhook(webhookId int, request WebhookRequest) (*Webhook, error) {
+	var webhook Webhook
+	if err := c.doJson(http.MethodPatch, "/webhooks/"+strconv.Itoa(webhookId), nil, request, &webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func (s *CollabSession) Close() error {
+	return s.conn.Close()
+}
+
+/**
+ * Wait for the next message of the session.
+ */
+func (s *CollabSession) Next() (*CollabMessage, error) {
+	var message CollabMessage
+	if err := s.conn.ReadJSON(&message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+func (s *CollabSession) Send(message CollabMessage) error {
+	return s.conn.WriteJSON(message)
+}
+
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
+
+/**
+ * Wait for the next event. Comments and reconnection hints are skipped.
+ */
+func (s *EventStream) Next() (*Event, error) {
+	var event Event
+	var data string
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "":
+			if line == "" && data != "" {
+				if err := json.Unmarshal([]byte(data), &event); err != nil {
+					return nil, err
+				}
+				return &event, nil
+			}
+		case "data":
+			data += value
+		case "event":
+			event.Kind = value
+		case "id":
+			event.Id, _ = strconv.Atoi(value)
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+/**
+ * Send a request to an API path, returning an *ApiError for any
+ * non-2xx response.
+ */
+/**
+ * Send a request and return its response when successful or, for
+ * conditional reads, not modified. Otherwise return an ApiError.
+ */
+func (c *Client) do(method string, path string, query url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	requestUrl := c.BaseUrl + API_PREFIX + path
+	if len(query) > 0 {
+		requestUrl += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, requestUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if c.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	response, err := c.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 200 && response.StatusCode < 300 || response.StatusCode == http.StatusNotModified {
+		return response, nil
+	}
+
+	defer response.Body.Close()
+	return nil, newApiError(response)
+}
+
+func (c *Client) doJson(method string, path string, query url.Values, in interface{}, out interface{}) error {
+	return c.doJsonHeader(method, path, query, nil, in, out)
+}
+
+func (c *Client) doJsonHeader(method string, path string, query url.Values, header http.Header, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+		header = header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Content-Type", "application/json")
+	}
+
+	response, err := c.do(method, path, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
+
+func commentsPath(noteId int) string {
+	return "/notes/" + strconv.Itoa(noteId) + "/comments"
+}
+
+func ifMatch(revision int) http.Header {
+	return http.Header{"If-Match": {noteETag(revision)}}
+}
+
+func newApiError(response *http.Response) *ApiError {
+	apiErr := &ApiError{Status: response.StatusCode}
+	content, _ := io.ReadAll(response.Body)
+	var errBody errorBody
+	if json.Unmarshal(content, &errBody) == nil && errBody.Error.Code != "" {
+		apiErr.Code = errBody.Error.Code
+		apiErr.Field = errBody.Error.Field
+		apiErr.Message = errBody.Error.Message
+		apiErr.Position = errBody.Error.Position
+	} else {
+		apiErr.Message = strings.TrimSpace(string(content))
+	}
+	return apiErr
+}
+
+func nextCursor(next string) string {
+	if next == "" {
+		return ""
+	}
+	nextUrl, err := url.Parse(next)
+	if err != nil {
+		return ""
+	}
+	return nextUrl.Query().Get("cursor")
+}
+
+func noteETag(revision int) string {
+	return `"` + strconv.Itoa(revision) + `"`
+}
+
+func pageQuery(options PageOptions) url.Values {
+	params := url.Values{}
+	if options.Cursor != "" {
+		params.Set("cursor", options.Cursor)
+	}
+	if options.Expand {
+		params.Set("expand", "summary")
+	}
+	if options.Limit > 0 {
+		params.Set("limit", strconv.Itoa(options.Limit))
+	}
+	return params
+}
+
+func searchQuery(options SearchOptions) url.Values {
+	params := pageQuery(options.PageOptions)
+	if options.Facets {
+		params.Set("facets", "true")
+	}
+	if options.Highlight {
+		params.Set("highlight", "true")
+	}
+	if options.Sort != "" {
+		params.Set("sort", options.Sort)
+	}
+	return params
+}
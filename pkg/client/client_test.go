@@ -0,0 +1,1147 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"org/bredin/go-notes/pkg/routes"
+	"org/bredin/go-notes/pkg/webhooks"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type fiberTransport struct {
+	app *fiber.App
+}
+
+func (t fiberTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	return t.app.Test(request, -1)
+}
+
+func Test_ManagesNotes(t *testing.T) {
+	c := createClient(t)
+	userId, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	content := "# Shopping\n\nbuy lentils"
+	privacy := notes.PRIVATE_ACCESS
+	tags := []string{"#Errands"}
+	note, err := c.CreateNote(NoteRequest{Content: &content, Privacy: &privacy, Tags: &tags})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	assert.Equal(t, userId, note.Author)
+	assert.Equal(t, content, note.Content)
+	assert.Equal(t, notes.PRIVATE_ACCESS, note.Privacy)
+	assert.Equal(t, []string{"errands"}, note.Tags)
+
+	page, err := c.ListNotes(PageOptions{Limit: 10})
+	assert.Nil(t, err, "Unexpected error listing notes")
+	assert.Equal(t, []int{note.Id}, page.Items)
+	assert.Equal(t, "", page.Cursor)
+
+	hits, err := c.Search("lentils", SearchOptions{PageOptions: PageOptions{Limit: 10}})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, 1, len(hits.Items))
+
+	content = "# Shopping\n\nbuy rice"
+	updated, err := c.UpdateNote(note.Id, note.Revision, NoteRequest{Content: &content})
+	assert.Nil(t, err, "Unexpected error on note update")
+	assert.Equal(t, content, updated.Content)
+	assert.Equal(t, notes.PRIVATE_ACCESS, updated.Privacy)
+
+	unchanged, err := c.GetNoteIfChanged(note.Id, updated.Revision)
+	assert.Nil(t, err, "Unexpected error on conditional get")
+	assert.Nil(t, unchanged, "Expected no note when unchanged")
+	changed, err := c.GetNoteIfChanged(note.Id, note.Revision)
+	assert.Nil(t, err, "Unexpected error on conditional get")
+	assert.Equal(t, updated, changed)
+
+	stale := "# Shopping\n\nbuy beans"
+	_, err = c.UpdateNote(note.Id, note.Revision, NoteRequest{Content: &stale})
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusPreconditionFailed, apiErr.Status)
+	assert.Equal(t, "precondition_failed", apiErr.Code)
+	err = c.DeleteNote(note.Id, note.Revision)
+	apiErr, ok = err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusPreconditionFailed, apiErr.Status)
+
+	rendered, err := c.RenderNote(note.Id)
+	assert.Nil(t, err, "Unexpected error on render")
+	assert.Contains(t, rendered.Html, "buy rice")
+
+	author, err := c.GetUser(userId)
+	assert.Nil(t, err, "Unexpected error getting user")
+	assert.Equal(t, "Test User", author.Name)
+
+	err = c.doJson(http.MethodDelete, "/notes/"+strconv.Itoa(note.Id), nil, nil, nil)
+	apiErr, ok = err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusPreconditionRequired, apiErr.Status)
+	assert.Nil(t, c.DeleteNote(note.Id, updated.Revision), "Unexpected error on delete")
+	_, err = c.GetNote(note.Id)
+	apiErr, ok = err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusNotFound, apiErr.Status)
+	assert.Equal(t, "note_not_found", apiErr.Code)
+}
+
+func Test_FetchesNotesInBatches(t *testing.T) {
+	c := createClient(t)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	content := "# Groceries\n\nBuy *lentils* and rice."
+	tags := []string{"errands"}
+	note, err := c.CreateNote(NoteRequest{Content: &content, Tags: &tags})
+	assert.Nil(t, err, "Unexpected error on note creation")
+
+	summaries, err := c.GetNoteSummaries([]int{note.Id, note.Id + 100})
+	assert.Nil(t, err, "Unexpected error fetching summaries")
+	assert.Equal(t, []NoteSummary{{
+		Author: note.Author, AuthorName: "Test User", Created: note.Created, Id: note.Id,
+		Snippet: "Buy lentils and rice.", Title: "Groceries",
+	}}, summaries.Items)
+	assert.Equal(t, []int{note.Id + 100}, summaries.Missing)
+
+	batch, err := c.GetNotes([]int{note.Id})
+	assert.Nil(t, err, "Unexpected error fetching notes")
+	assert.Equal(t, []Note{*note}, batch.Items)
+	assert.Equal(t, []int{}, batch.Missing)
+
+	page, err := c.ListNotes(PageOptions{Expand: true})
+	assert.Nil(t, err, "Unexpected error listing notes")
+	assert.Equal(t, summaries.Items, page.Summaries)
+
+	hits, err := c.Search("lentils", SearchOptions{PageOptions: PageOptions{Expand: true}})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, summaries.Items, hits.Summaries)
+}
+
+func Test_PagesNotesAndSearch(t *testing.T) {
+	c := createClient(t)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	var created []int
+	for i := 0; i < 5; i++ {
+		content := fmt.Sprintf("paging note %d", i)
+		note, err := c.CreateNote(NoteRequest{Content: &content})
+		assert.Nil(t, err, "Unexpected error on note creation")
+		created = append([]int{note.Id}, created...)
+	}
+
+	var listed []int
+	cursor := ""
+	for pages := 0; pages < 5; pages++ {
+		page, err := c.ListNotes(PageOptions{Cursor: cursor, Limit: 2})
+		assert.Nil(t, err, "Unexpected error listing notes")
+		listed = append(listed, page.Items...)
+		if cursor = page.Cursor; cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, created, listed)
+
+	seen := make(map[string]bool)
+	cursor = ""
+	for pages := 0; pages < 5; pages++ {
+		page, err := c.Search("paging", SearchOptions{PageOptions: PageOptions{Cursor: cursor, Limit: 2}})
+		assert.Nil(t, err, "Unexpected error on search")
+		for _, hit := range page.Items {
+			assert.False(t, seen[hit.Id], "Repeated hit %s", hit.Id)
+			seen[hit.Id] = true
+		}
+		if cursor = page.Cursor; cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, 5, len(seen))
+
+	_, err = c.ListNotes(PageOptions{Cursor: "not a cursor", Limit: 2})
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+}
+
+func Test_HighlightsSortsAndFacets(t *testing.T) {
+	c := createClient(t)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	var created []int
+	for i, tag := range []string{"work", "home", "work"} {
+		content := fmt.Sprintf("# Plan %d\n\nweekly *plan* review", i)
+		tags := []string{tag}
+		note, err := c.CreateNote(NoteRequest{Content: &content, Tags: &tags})
+		assert.Nil(t, err, "Unexpected error on note creation")
+		created = append(created, note.Id)
+	}
+
+	page, err := c.Search("review", SearchOptions{Facets: true, Highlight: true, Sort: index.SORT_OLDEST})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, uint64(3), page.Total)
+	var ids []string
+	for _, hit := range page.Items {
+		ids = append(ids, hit.Id)
+	}
+	assert.Equal(t, []string{
+		strconv.Itoa(created[0]), strconv.Itoa(created[1]), strconv.Itoa(created[2]),
+	}, ids)
+	assert.Equal(t, []string{"Plan 0\n\nweekly plan <mark>review</mark>"}, page.Items[0].Fragments["Content"])
+	assert.Equal(t, []FacetCount{{2, "work"}, {1, "home"}}, page.Facets["Tags"])
+	assert.Equal(t, []FacetCount{{3, "Test User"}}, page.Facets["Author"])
+	assert.Equal(t, []FacetCount{{3, "protected"}}, page.Facets["Privacy"])
+	assert.Contains(t, page.Facets["Created"], FacetCount{3, "day"})
+
+	page, err = c.Search("review", SearchOptions{PageOptions: PageOptions{Limit: 2}, Sort: index.SORT_NEWEST})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, strconv.Itoa(created[2]), page.Items[0].Id)
+	page, err = c.Search("review", SearchOptions{PageOptions: PageOptions{Cursor: page.Cursor}, Sort: index.SORT_NEWEST})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, strconv.Itoa(created[0]), page.Items[0].Id)
+
+	_, err = c.Search("review", SearchOptions{Sort: "sideways"})
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+}
+
+func Test_SearchesWithFilters(t *testing.T) {
+	c := createClient(t)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	var created []string
+	for i, notebook := range []string{"Projects", "Home", "Projects"} {
+		content := fmt.Sprintf("# Review %d\n\nquarterly review", i)
+		privacy := notes.PROTECTED_ACCESS
+		if i == 2 {
+			privacy = notes.PUBLIC_ACCESS
+		}
+		note, err := c.CreateNote(NoteRequest{Content: &content, Notebook: &notebook, Privacy: &privacy})
+		assert.Nil(t, err, "Unexpected error on note creation")
+		assert.Equal(t, notebook, note.Notebook)
+		created = append(created, strconv.Itoa(note.Id))
+	}
+	hitIds := func(page *SearchPage) []string {
+		ids := []string{}
+		for _, hit := range page.Items {
+			ids = append(ids, hit.Id)
+		}
+		return ids
+	}
+
+	page, err := c.Search("review notebook:Projects author:me", SearchOptions{Sort: index.SORT_OLDEST})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, []string{created[0], created[2]}, hitIds(page))
+
+	tomorrow := time.Now().AddDate(0, 0, 1).Format(index.QUERY_DATE_FORMAT)
+	page, err = c.Search("review after:"+tomorrow, SearchOptions{})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, []string{}, hitIds(page))
+
+	page, err = c.SearchQuery(NoteQuery{
+		CreatedBefore: tomorrow, Notebook: "Projects", Privacy: []string{"public"},
+	}, SearchOptions{})
+	assert.Nil(t, err, "Unexpected error on structured search")
+	assert.Equal(t, []string{created[2]}, hitIds(page))
+
+	_, err = c.Search("review before:someday", SearchOptions{})
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+	assert.Equal(t, "invalid_query", apiErr.Code)
+	assert.Equal(t, 14, *apiErr.Position)
+	request, _ := http.NewRequest(http.MethodGet, "http://notes.test/note/search/%22review", nil)
+	request.Header.Set("Authorization", "Bearer "+c.Token)
+	response, err := c.HttpClient.Do(request)
+	assert.Nil(t, err, "Unexpected error on legacy search")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode, "Expected the legacy route to reject bad queries too")
+
+	_, err = c.SearchQuery(NoteQuery{CreatedAfter: "someday"}, SearchOptions{})
+	apiErr, ok = err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+	assert.Equal(t, "createdAfter", apiErr.Field)
+}
+
+func Test_SearchesByLanguage(t *testing.T) {
+	c := createClient(t)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	content := "# Ragazze\n\nLe ragazze"
+	language := "it"
+	note, err := c.CreateNote(NoteRequest{Content: &content, Language: &language})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	assert.Equal(t, "it", note.Language)
+
+	page, err := c.Search("ragazza", SearchOptions{})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, 1, len(page.Items), "Expected the Italian plural to match")
+	page, err = c.SearchQuery(NoteQuery{Text: "ragazza", Language: "en"}, SearchOptions{})
+	assert.Nil(t, err, "Unexpected error on structured search")
+	assert.Equal(t, 0, len(page.Items))
+
+	language = "auto"
+	note, err = c.UpdateNote(note.Id, note.Revision, NoteRequest{Language: &language})
+	assert.Nil(t, err, "Unexpected error on note update")
+	assert.Equal(t, "", note.Language)
+
+	language = "tlh"
+	_, err = c.CreateNote(NoteRequest{Content: &content, Language: &language})
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+	_, err = c.SearchQuery(NoteQuery{Language: "tlh"}, SearchOptions{})
+	apiErr, ok = err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, "language", apiErr.Field)
+}
+
+func Test_SuggestsFromReadableNotes(t *testing.T) {
+	app, _ := createServer(t)
+	c := newTestClient(app)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	other := newTestClient(app)
+	_, err = other.Login("Other User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	privacy := notes.PRIVATE_ACCESS
+	content := "# Secret recipes\n\nsalt"
+	_, err = other.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	content = "# Sourdough recipes\n\nflour"
+	tags := []string{"recipes"}
+	mine, err := c.CreateNote(NoteRequest{Content: &content, Tags: &tags})
+	assert.Nil(t, err, "Unexpected error on note creation")
+
+	suggestions, err := c.Suggest("recipws", 5)
+	assert.Nil(t, err, "Unexpected error on suggest")
+	assert.Equal(t, []Suggestion{
+		{Kind: "title", NoteId: mine.Id, Text: "Sourdough recipes"},
+		{Count: 1, Kind: "tag", Text: "recipes"},
+	}, suggestions)
+
+	suggestions, err = c.Suggest("other", 5)
+	assert.Nil(t, err, "Unexpected error on suggest")
+	assert.Equal(t, 0, len(suggestions), "Expected no author without readable notes")
+
+	_, err = c.Suggest("", 5)
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+}
+
+func Test_StreamsReadableEvents(t *testing.T) {
+	app, _ := createServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen %s", err)
+	}
+	go app.Listener(listener)
+	t.Cleanup(func() { listener.Close() })
+
+	c := NewClient("http://" + listener.Addr().String())
+	userId, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	other := NewClient(c.BaseUrl)
+	otherId, err := other.Login("Other User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	stream, err := c.Events("")
+	assert.Nil(t, err, "Unexpected error opening event stream")
+	defer stream.Close()
+
+	content := "# Diary\n\nprivate"
+	privacy := notes.PRIVATE_ACCESS
+	_, err = other.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	content = "# Announcement\n\npublic"
+	privacy = notes.PUBLIC_ACCESS
+	public, err := other.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	mine, err := c.CreateNote(NoteRequest{Content: &content})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	assert.Nil(t, c.DeleteNote(mine.Id, mine.Revision), "Unexpected error on delete")
+
+	first := nextEvent(t, stream)
+	assert.Equal(t, Event{Author: otherId, Created: first.Created, Id: first.Id, Kind: "created",
+		NoteId: public.Id, Privacy: "public"}, *first)
+	event := nextEvent(t, stream)
+	assert.Equal(t, "created", event.Kind)
+	assert.Equal(t, mine.Id, event.NoteId)
+	assert.Equal(t, userId, event.Author)
+	assert.Equal(t, "deleted", nextEvent(t, stream).Kind)
+
+	resumed, err := c.Events(strconv.Itoa(first.Id))
+	assert.Nil(t, err, "Unexpected error resuming event stream")
+	defer resumed.Close()
+	assert.Equal(t, event.Id, nextEvent(t, resumed).Id, "Expected missed events on resume")
+
+	_, err = c.Events("latest")
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+}
+
+func Test_EditsSharedNotesTogether(t *testing.T) {
+	app, dbFileName := createServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen %s", err)
+	}
+	go app.Listener(listener)
+	t.Cleanup(func() { listener.Close() })
+
+	c := NewClient("http://" + listener.Addr().String())
+	userId, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	other := NewClient(c.BaseUrl)
+	otherId, err := other.Login("Other User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	content := "# Meeting\n"
+	privacy := notes.PROTECTED_ACCESS
+	note, err := c.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	_, err = other.Collaborate(note.Id)
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusForbidden, apiErr.Status, "Expected readers without edit rights kept out")
+
+	db, err := notes.OpenNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error opening db")
+	assert.Nil(t, notes.SharesWith(db, userId, otherId), "Unexpected error sharing")
+	db.Close()
+
+	assert.Nil(t, c.FollowNote(note.Id), "Unexpected error following")
+	mine, err := c.Collaborate(note.Id)
+	assert.Nil(t, err, "Unexpected error joining session")
+	defer mine.Close()
+	init := nextMessage(t, mine)
+	assert.Equal(t, "init", init.Type)
+	assert.Equal(t, content, *init.Content)
+	theirs, err := other.Collaborate(note.Id)
+	assert.Nil(t, err, "Unexpected error joining session")
+	defer theirs.Close()
+	init = nextMessage(t, theirs)
+	assert.Equal(t, 2, len(init.Participants))
+	assert.Equal(t, "Other User", nextMessage(t, mine).Participants[1].UserName)
+
+	assert.Nil(t, mine.Send(CollabMessage{Type: "op", Version: init.Version,
+		Op: []CollabComponent{{Retain: 10}, {Insert: "- budget\n"}}}))
+	assert.Equal(t, CollabMessage{Type: "ack", Version: 1}, *nextMessage(t, mine))
+	assert.Nil(t, theirs.Send(CollabMessage{Type: "op", Version: init.Version,
+		Op: []CollabComponent{{Retain: 2}, {Insert: "Weekly "}, {Retain: 8}}}))
+	assert.Equal(t, "op", nextMessage(t, theirs).Type)
+	assert.Equal(t, CollabMessage{Type: "ack", Version: 2}, *nextMessage(t, theirs))
+	op := nextMessage(t, mine)
+	assert.Equal(t, []CollabComponent{{Retain: 2}, {Insert: "Weekly "}, {Retain: 17}}, op.Op)
+
+	assert.Nil(t, theirs.Send(CollabMessage{Type: "cursor", Cursor: &CollabCursor{Position: 9, SelectionEnd: 15}}))
+	presence := nextMessage(t, mine)
+	assert.Equal(t, &CollabCursor{Position: 9, SelectionEnd: 15}, presence.Participants[1].Cursor)
+
+	mine.Close()
+	theirs.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	saved, err := c.GetNote(note.Id)
+	for err == nil && saved.Revision == note.Revision && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		saved, err = c.GetNote(note.Id)
+	}
+	assert.Nil(t, err, "Unexpected error on get")
+	assert.Equal(t, "# Weekly Meeting\n- budget\n", saved.Content, "Expected the session saved when everybody left")
+	assert.Equal(t, userId, saved.Author)
+	notifications, err := c.ListNotifications(PageOptions{Limit: 10}, true)
+	assert.Nil(t, err, "Unexpected error listing notifications")
+	assert.Equal(t, 1, len(notifications.Items))
+	assert.Equal(t, otherId, notifications.Items[0].Actor, "Expected the session saved as its latest editor")
+
+	err = c.doJson(http.MethodGet, "/notes/"+strconv.Itoa(note.Id)+"/collab", nil, nil, nil)
+	apiErr, ok = err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusUpgradeRequired, apiErr.Status)
+}
+
+func Test_SyncsOfflineChanges(t *testing.T) {
+	app, _ := createServer(t)
+	c := newTestClient(app)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	other := newTestClient(app)
+	_, err = other.Login("Other User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	content := "# Shopping\n\nbread"
+	note, err := c.CreateNote(NoteRequest{Content: &content})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	offline := "# Offline\n\nwritten on a plane"
+	response, err := c.Sync(SyncRequest{Changes: []SyncChange{
+		{ClientId: "a", NoteRequest: NoteRequest{Content: &offline}},
+	}}, 10)
+	assert.Nil(t, err, "Unexpected error on sync")
+	assert.Equal(t, 1, len(response.Applied))
+	assert.Equal(t, "a", response.Applied[0].ClientId)
+	assert.Equal(t, 2, len(response.Changes))
+	assert.Equal(t, note.Id, response.Changes[0].Id)
+	assert.Equal(t, offline, response.Changes[1].Note.Content)
+	assert.False(t, response.More)
+	cursor := response.Cursor
+
+	content = "# Shopping\n\nbread, milk"
+	updated, err := c.UpdateNote(note.Id, note.Revision, NoteRequest{Content: &content})
+	assert.Nil(t, err, "Unexpected error on update")
+	assert.Equal(t, note.Revision+1, updated.Revision)
+	stale := "# Shopping\n\nbread, eggs"
+	response, err = c.Sync(SyncRequest{Cursor: cursor, Changes: []SyncChange{
+		{BaseRevision: note.Revision, Id: note.Id, NoteRequest: NoteRequest{Content: &stale}},
+	}}, 10)
+	assert.Nil(t, err, "Unexpected error on sync")
+	assert.Equal(t, 0, len(response.Applied))
+	assert.Equal(t, 1, len(response.Conflicts))
+	assert.Equal(t, updated.Revision, response.Conflicts[0].Revision)
+	copyId := response.Conflicts[0].CopyId
+	assert.NotEqual(t, 0, copyId, "Expected a conflict copy")
+	current, err := c.GetNote(note.Id)
+	assert.Nil(t, err, "Unexpected error on get")
+	assert.Equal(t, content, current.Content, "Expected the server version kept")
+	conflict, err := c.GetNote(copyId)
+	assert.Nil(t, err, "Unexpected error on get")
+	assert.Equal(t, stale, conflict.Content)
+	assert.Equal(t, []string{"conflict"}, conflict.Tags)
+	cursor = response.Cursor
+
+	response, err = c.Sync(SyncRequest{Cursor: cursor, Changes: []SyncChange{
+		{BaseRevision: updated.Revision, Deleted: true, Id: note.Id},
+	}}, 10)
+	assert.Nil(t, err, "Unexpected error on sync")
+	assert.Equal(t, 1, len(response.Applied))
+	assert.Equal(t, []SyncNote{{Deleted: true, Id: note.Id, Revision: updated.Revision + 1}}, response.Changes)
+
+	privacy := notes.PUBLIC_ACCESS
+	public, err := other.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	response, err = c.Sync(SyncRequest{Cursor: response.Cursor, Changes: []SyncChange{
+		{BaseRevision: public.Revision, Id: public.Id, NoteRequest: NoteRequest{Content: &stale}},
+	}}, 10)
+	assert.Nil(t, err, "Unexpected error on sync")
+	assert.Equal(t, 1, len(response.Rejected))
+	assert.Equal(t, public.Id, response.Changes[0].Id, "Expected readable notes of others")
+
+	_, err = c.Sync(SyncRequest{Cursor: response.Cursor + 100}, 10)
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+}
+
+func Test_DiscussesNotesInComments(t *testing.T) {
+	app, dbFileName := createServer(t)
+	c := newTestClient(app)
+	userId, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	other := newTestClient(app)
+	otherId, err := other.Login("Other User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	content, privacy := "# Launch\n\nchecklist", notes.PUBLIC_ACCESS
+	note, err := c.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	text := "Check the *rocket*"
+	_, err = other.CreateComment(note.Id, CommentRequest{Content: &text})
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusForbidden, apiErr.Status, "Expected readers unable to comment unless shared with")
+
+	db, err := notes.OpenNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error opening DB")
+	assert.Nil(t, notes.SharesWith(db, userId, otherId), "Unexpected error sharing")
+	db.Close()
+	comment, err := other.CreateComment(note.Id, CommentRequest{Content: &text})
+	assert.Nil(t, err, "Unexpected error commenting")
+	assert.Equal(t, "<p>Check the <em>rocket</em></p>\n", comment.Html)
+	reply := "Done"
+	answer, err := c.CreateComment(note.Id, CommentRequest{Content: &reply, ParentId: &comment.Id})
+	assert.Nil(t, err, "Unexpected error replying")
+	assert.Equal(t, comment.Id, answer.ParentId)
+
+	page, err := c.Search("rocket", SearchOptions{Highlight: true})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, 1, len(page.Items), "Expected notes found by their comments")
+	assert.Equal(t, []string{"Check the <mark>rocket</mark>"}, page.Items[0].Fragments["Comments"])
+
+	resolved := true
+	updated, err := c.UpdateComment(note.Id, comment.Id, CommentRequest{Resolved: &resolved})
+	assert.Nil(t, err, "Unexpected error resolving")
+	assert.True(t, updated.Resolved)
+	_, err = c.UpdateComment(note.Id, comment.Id, CommentRequest{Content: &reply})
+	apiErr, ok = err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, "comment_forbidden", apiErr.Code)
+	_, err = c.GetComment(note.Id+1, comment.Id)
+	apiErr, ok = err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusNotFound, apiErr.Status)
+
+	assert.Nil(t, other.DeleteComment(note.Id, comment.Id), "Unexpected error deleting")
+	comments, err := other.ListComments(note.Id)
+	assert.Nil(t, err, "Unexpected error listing comments")
+	assert.Equal(t, 2, len(comments))
+	assert.True(t, comments[0].Deleted, "Expected the thread kept for its reply")
+	page, err = c.Search("rocket", SearchOptions{})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, 0, len(page.Items), "Expected deleted comments unindexed")
+}
+
+func Test_CreatesNotesFromTemplates(t *testing.T) {
+	app, _ := createServer(t)
+	c := newTestClient(app)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	other := newTestClient(app)
+	_, err = other.Login("Other User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	content, privacy := "# Incident {{date}}\n\nReported by {{user}}\n\n## Impact\n\n{{impact: Who was affected?}}", 0
+	note, err := c.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	_, err = c.CreateNoteFromTemplate(note.Id, TemplateNoteRequest{})
+	assert.Equal(t, "template_not_found", err.(*ApiError).Code)
+	_, err = other.SetTemplate(note.Id, TemplateRequest{})
+	assert.Equal(t, 403, err.(*ApiError).Status, "Expected others' notes not flaggable")
+
+	defaultPrivacy, tags := notes.PROTECTED_ACCESS, []string{"incident"}
+	template, err := c.SetTemplate(note.Id, TemplateRequest{Privacy: &defaultPrivacy, Tags: &tags})
+	assert.Nil(t, err, "Unexpected error flagging template")
+	assert.Equal(t, []TemplatePrompt{{Label: "Who was affected?", Name: "impact"}}, template.Prompts)
+	assert.Equal(t, "Incident {{date}}", template.Title)
+	list, err := c.ListTemplates()
+	assert.Nil(t, err, "Unexpected error listing templates")
+	assert.Equal(t, 1, len(list))
+
+	created, err := c.CreateNoteFromTemplate(note.Id, TemplateNoteRequest{
+		Values: map[string]string{"date": "2024-03-05", "Impact": "Everyone"},
+	})
+	assert.Nil(t, err, "Unexpected error creating from template")
+	assert.Equal(t, "# Incident 2024-03-05\n\nReported by Test User\n\n## Impact\n\nEveryone", created.Content)
+	assert.Equal(t, notes.PROTECTED_ACCESS, created.Privacy)
+	assert.Equal(t, []string{"incident"}, created.Tags)
+
+	_, err = other.GetTemplate(note.Id)
+	assert.Equal(t, 403, err.(*ApiError).Status, "Expected private templates hidden")
+	assert.Nil(t, c.UnsetTemplate(note.Id), "Unexpected error unflagging")
+	list, _ = c.ListTemplates()
+	assert.Equal(t, 0, len(list))
+}
+
+func Test_KeepsJournalFromTemplate(t *testing.T) {
+	app, _ := createServer(t)
+	c := newTestClient(app)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	settings, err := c.GetJournalSettings()
+	assert.Nil(t, err, "Unexpected error fetching settings")
+	assert.Equal(t, "UTC", settings.TimeZone)
+	timeZone := "Mars/Olympus"
+	_, err = c.UpdateJournalSettings(JournalSettingsRequest{TimeZone: &timeZone})
+	assert.Equal(t, 400, err.(*ApiError).Status, "Expected unknown time zones rejected")
+
+	content, privacy := "# Journal {{date}}\n\n## Gratitude\n\n{{gratitude}}", 0
+	note, err := c.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	_, err = c.SetTemplate(note.Id, TemplateRequest{})
+	assert.Nil(t, err, "Unexpected error flagging template")
+	timeZone = "Europe/Paris"
+	settings, err = c.UpdateJournalSettings(JournalSettingsRequest{Template: &note.Id, TimeZone: &timeZone})
+	assert.Nil(t, err, "Unexpected error updating settings")
+	assert.Equal(t, JournalSettings{Template: note.Id, TimeZone: "Europe/Paris"}, *settings)
+
+	journal, err := c.GetJournalNote("2024-03-05")
+	assert.Nil(t, err, "Unexpected error on journal note")
+	assert.Equal(t, "# Journal 2024-03-05\n\n## Gratitude\n\n", journal.Content)
+	again, err := c.GetJournalNote("2024-03-05")
+	assert.Nil(t, err, "Unexpected error on journal note")
+	assert.Equal(t, journal.Id, again.Id, "Expected one journal note per day")
+	_, err = c.GetJournalNote("yesterday")
+	assert.Equal(t, 400, err.(*ApiError).Status)
+	_, err = c.GetJournalNote(time.Now().AddDate(0, 0, 2).Format("2006-01-02"))
+	assert.Equal(t, 400, err.(*ApiError).Status, "Expected future days rejected")
+	request, _ := http.NewRequest(http.MethodGet, "http://notes.test/journal/2024-03-05", nil)
+	request.Header.Set("Authorization", "Bearer "+c.Token)
+	response, err := c.HttpClient.Do(request)
+	assert.Nil(t, err, "Unexpected error on journal note")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Empty(t, response.Header.Get("Deprecation"), "Expected /journal/:date not deprecated")
+
+	days, err := c.ListJournalDays("2024-03-01", "2024-03-31")
+	assert.Nil(t, err, "Unexpected error listing days")
+	assert.Equal(t, []JournalDay{{Date: "2024-03-05", NoteId: journal.Id}}, days)
+	_, err = c.ListJournalDays("2024-03-31", "2024-03-01")
+	assert.Equal(t, 400, err.(*ApiError).Status, "Expected backward ranges rejected")
+}
+
+func Test_ListsAndTogglesTasks(t *testing.T) {
+	app, _ := createServer(t)
+	c := newTestClient(app)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	other := newTestClient(app)
+	_, err = other.Login("Other User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	content, privacy := "# Release\n\n- [ ] Tag @due(2025-01-02)\n- [ ] Announce\n- [x] Freeze", notes.PUBLIC_ACCESS
+	note, err := c.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	page, err := c.ListTasks(PageOptions{Limit: 1}, false, "")
+	assert.Nil(t, err, "Unexpected error listing tasks")
+	assert.Equal(t, []Task{{Due: "2025-01-02", Id: page.Items[0].Id, Line: 3, NoteId: note.Id, NoteTitle: "Release",
+		Text: "Tag"}}, page.Items)
+	next, err := c.ListTasks(PageOptions{Cursor: page.Cursor, Limit: 1}, false, "")
+	assert.Nil(t, err, "Unexpected error listing tasks")
+	assert.Equal(t, "Announce", next.Items[0].Text)
+	assert.Equal(t, "", next.Cursor)
+	_, err = c.ListTasks(PageOptions{}, false, "soon")
+	assert.Equal(t, 400, err.(*ApiError).Status)
+
+	_, err = other.ToggleTask(page.Items[0].Id, nil)
+	assert.Equal(t, "note_forbidden", err.(*ApiError).Code, "Expected public notes of others not editable")
+	task, err := c.ToggleTask(page.Items[0].Id, nil)
+	assert.Nil(t, err, "Unexpected error toggling task")
+	assert.True(t, task.Done)
+	updated, _ := c.GetNote(note.Id)
+	assert.Equal(t, "# Release\n\n- [x] Tag @due(2025-01-02)\n- [ ] Announce\n- [x] Freeze", updated.Content)
+	undone := false
+	task, err = c.ToggleTask(page.Items[0].Id, &undone)
+	assert.Nil(t, err, "Unexpected error toggling task")
+	assert.False(t, task.Done)
+	toggle := func(revision int) *http.Response {
+		path := "http://notes.test" + API_PREFIX + "/tasks/" + strconv.Itoa(task.Id) + "/toggle"
+		request, _ := http.NewRequest(http.MethodPost, path, nil)
+		request.Header.Set("Authorization", "Bearer "+c.Token)
+		request.Header.Set("If-Match", noteETag(revision))
+		response, err := c.HttpClient.Do(request)
+		assert.Nil(t, err, "Unexpected error toggling task")
+		return response
+	}
+	assert.Equal(t, http.StatusPreconditionFailed, toggle(updated.Revision).StatusCode,
+		"Expected toggles on an older revision refused")
+	updated, _ = c.GetNote(note.Id)
+	response := toggle(updated.Revision)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, noteETag(updated.Revision+1), response.Header.Get("ETag"), "Expected the ETag of the edit")
+	_, err = c.ToggleTask(0, nil)
+	assert.Equal(t, "task_not_found", err.(*ApiError).Code)
+}
+
+func Test_NotifiesMentionsAndFollowedEdits(t *testing.T) {
+	app, dbFileName := createServer(t)
+	c := newTestClient(app)
+	userId, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	other := newTestClient(app)
+	otherId, err := other.Login("Other User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	db, err := notes.OpenNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error opening DB")
+	assert.Nil(t, notes.SharesWith(db, userId, otherId), "Unexpected error sharing")
+	db.Close()
+
+	content, privacy := "# Agenda\n\n@Other User to present", notes.PROTECTED_ACCESS
+	note, err := c.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	assert.Nil(t, other.FollowNote(note.Id), "Unexpected error following")
+	content += " first"
+	note, err = c.UpdateNote(note.Id, note.Revision, NoteRequest{Content: &content})
+	assert.Nil(t, err, "Unexpected error on update")
+
+	unread, err := other.UnreadNotifications()
+	assert.Nil(t, err, "Unexpected error counting")
+	assert.Equal(t, 3, unread)
+	page, err := other.ListNotifications(PageOptions{Limit: 2}, true)
+	assert.Nil(t, err, "Unexpected error listing")
+	assert.Equal(t, []string{"edit", "mention"}, []string{page.Items[0].Kind, page.Items[1].Kind})
+	assert.Equal(t, note.Id, page.Items[0].NoteId)
+	assert.Equal(t, "Test User", page.Items[0].ActorName)
+	page, err = other.ListNotifications(PageOptions{Cursor: page.Cursor, Limit: 2}, true)
+	assert.Nil(t, err, "Unexpected error listing")
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, "shared", page.Items[0].Kind)
+	assert.Equal(t, "", page.Cursor)
+
+	unread, err = other.MarkNotificationsRead(page.Items[0].Id)
+	assert.Nil(t, err, "Unexpected error marking read")
+	assert.Equal(t, 2, unread)
+	unread, err = other.MarkNotificationsRead()
+	assert.Nil(t, err, "Unexpected error marking all read")
+	assert.Equal(t, 0, unread)
+	assert.Nil(t, other.UnfollowNote(note.Id), "Unexpected error unfollowing")
+	content += " please"
+	_, err = c.UpdateNote(note.Id, note.Revision, NoteRequest{Content: &content})
+	assert.Nil(t, err, "Unexpected error on update")
+	unread, _ = other.UnreadNotifications()
+	assert.Equal(t, 0, unread, "Expected no edit notified once unfollowed")
+}
+
+func Test_ManagesWebhooks(t *testing.T) {
+	app, dbFileName := createServer(t)
+	c := newTestClient(app)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	other := newTestClient(app)
+	_, err = other.Login("Other User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	db, err := notes.OpenNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error opening db")
+	_, err = notes.CreateAuthor(db, "Admin User", "secret")
+	db.Close()
+	assert.Nil(t, err, "Unexpected error on author creation")
+	admin := newTestClient(app)
+	_, err = admin.Login("Admin User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	received := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(webhooks.EVENT_HEADER)
+	}))
+	defer receiver.Close()
+	dispatcher := webhooks.NewDispatcher(dbFileName)
+	go dispatcher.Run()
+	defer dispatcher.Stop()
+
+	badUrl, allUsers := "ftp://example.com", true
+	_, err = c.CreateWebhook(WebhookRequest{Url: &badUrl})
+	assert.Equal(t, 400, err.(*ApiError).Status, "Expected only http urls")
+	publicUrl := "https://example.com/hook"
+	_, err = c.CreateWebhook(WebhookRequest{Url: &publicUrl, AllUsers: &allUsers})
+	assert.Equal(t, 403, err.(*ApiError).Status, "Expected only admins to get all events")
+	for _, privateUrl := range []string{receiver.URL, "http://169.254.169.254/latest/meta-data", "http://[::1]/"} {
+		_, err = c.CreateWebhook(WebhookRequest{Url: &privateUrl})
+		assert.Equal(t, 400, err.(*ApiError).Status, "Expected only admins to post to private addresses")
+	}
+	events, notebook := []string{notes.EVENT_CREATED}, "Work"
+	webhook, err := admin.CreateWebhook(WebhookRequest{Url: &receiver.URL, Events: &events, Notebook: &notebook})
+	assert.Nil(t, err, "Unexpected error creating webhook")
+	assert.Equal(t, 64, len(webhook.Secret))
+	assert.True(t, webhook.Active)
+
+	content := "# Report"
+	_, err = admin.CreateNote(NoteRequest{Content: &content})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	note, err := admin.CreateNote(NoteRequest{Content: &content, Notebook: &notebook})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	select {
+	case kind := <-received:
+		assert.Equal(t, notes.EVENT_CREATED, kind)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a delivery")
+	}
+	var page *WebhookDeliveryPage
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(20 * time.Millisecond) {
+		page, err = admin.ListWebhookDeliveries(webhook.Id, PageOptions{Limit: 10})
+		assert.Nil(t, err, "Unexpected error listing deliveries")
+		if len(page.Items) > 0 && page.Items[0].Status != notes.DELIVERY_PENDING {
+			break
+		}
+	}
+	assert.Equal(t, 1, len(page.Items), "Expected only notes in the notebook delivered")
+	assert.Equal(t, notes.DELIVERY_DELIVERED, page.Items[0].Status)
+	assert.Contains(t, page.Items[0].Payload, fmt.Sprintf(`"NoteId":%d`, note.Id))
+
+	active := false
+	webhook, err = admin.UpdateWebhook(webhook.Id, WebhookRequest{Active: &active})
+	assert.Nil(t, err, "Unexpected error updating webhook")
+	assert.False(t, webhook.Active)
+	assert.Equal(t, "", webhook.Secret, "Expected the secret only shown on creation")
+	list, err := admin.ListWebhooks()
+	assert.Nil(t, err, "Unexpected error listing webhooks")
+	assert.Equal(t, 1, len(list))
+	_, err = other.GetWebhook(webhook.Id)
+	assert.Equal(t, "webhook_not_found", err.(*ApiError).Code)
+	assert.Nil(t, admin.DeleteWebhook(webhook.Id), "Unexpected error deleting webhook")
+	list, _ = admin.ListWebhooks()
+	assert.Equal(t, 0, len(list))
+}
+
+func Test_RunsSavedSearchesWithCurrentRights(t *testing.T) {
+	app, dbFileName := createServer(t)
+	c := newTestClient(app)
+	userId, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	other := newTestClient(app)
+	otherId, err := other.Login("Other User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	var created []string
+	for _, privacy := range []int{notes.PROTECTED_ACCESS, notes.PRIVATE_ACCESS} {
+		content := "# Plans\n\nweekly review"
+		note, err := other.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+		assert.Nil(t, err, "Unexpected error on note creation")
+		created = append(created, strconv.Itoa(note.Id))
+	}
+	notebook := "Plans"
+	content := "# My plans\n\nweekly review"
+	mine, err := c.CreateNote(NoteRequest{Content: &content, Notebook: &notebook})
+	assert.Nil(t, err, "Unexpected error on note creation")
+
+	name, pinned := "Weekly", true
+	search, err := c.CreateSavedSearch(SavedSearchRequest{
+		Name: &name, Pinned: &pinned, Query: &NoteQuery{Text: "weekly", Authors: []string{"Other User"}},
+	})
+	assert.Nil(t, err, "Unexpected error saving search")
+	assert.Equal(t, []string{"Other User"}, search.Query.Authors)
+
+	page, err := c.RunSavedSearch(search.Id, SearchOptions{})
+	assert.Nil(t, err, "Unexpected error running saved search")
+	assert.Equal(t, 0, len(page.Items))
+
+	db, err := notes.OpenNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error opening db")
+	assert.Nil(t, notes.SharesWith(db, otherId, userId), "Unexpected error sharing")
+	db.Close()
+
+	page, err = c.RunSavedSearch(search.Id, SearchOptions{})
+	assert.Nil(t, err, "Unexpected error running saved search")
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, created[0], page.Items[0].Id)
+
+	page, err = c.Search("weekly", SearchOptions{Sort: index.SORT_OLDEST})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, 2, len(page.Items))
+	assert.Equal(t, strconv.Itoa(mine.Id), page.Items[1].Id)
+
+	notebooks, err := c.ListNotebooks()
+	assert.Nil(t, err, "Unexpected error listing notebooks")
+	assert.Equal(t, []Notebook{
+		{Count: 1, Name: "Plans", Notes: "/api/v1/search?q=notebook%3A%22Plans%22"},
+		{Name: "Weekly", Notes: "/api/v1/searches/" + strconv.Itoa(search.Id) + "/notes", SearchId: search.Id, Smart: true},
+	}, notebooks)
+
+	_, err = c.CreateSavedSearch(SavedSearchRequest{Name: &name})
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusConflict, apiErr.Status)
+
+	name, pinned = "Mine", false
+	search, err = c.UpdateSavedSearch(search.Id, SavedSearchRequest{
+		Name: &name, Pinned: &pinned, Query: &NoteQuery{Text: "weekly", Authors: []string{"me"}},
+	})
+	assert.Nil(t, err, "Unexpected error updating saved search")
+	assert.Equal(t, "Mine", search.Name)
+	searches, err := c.ListSavedSearches(true)
+	assert.Nil(t, err, "Unexpected error listing saved searches")
+	assert.Equal(t, []SavedSearch{}, searches)
+	page, err = c.RunSavedSearch(search.Id, SearchOptions{})
+	assert.Nil(t, err, "Unexpected error running saved search")
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, strconv.Itoa(mine.Id), page.Items[0].Id)
+
+	_, err = other.GetSavedSearch(search.Id)
+	apiErr, ok = err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, "search_not_found", apiErr.Code)
+
+	assert.Nil(t, c.DeleteSavedSearch(search.Id), "Unexpected error deleting saved search")
+	_, err = c.GetSavedSearch(search.Id)
+	apiErr, ok = err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusNotFound, apiErr.Status)
+}
+
+func Test_HidesNotesMadePrivate(t *testing.T) {
+	app, dbFileName := createServer(t)
+	c := newTestClient(app)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	other := newTestClient(app)
+	_, err = other.Login("Other User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	content, privacy := "# Quokka sightings\n\nRottnest", notes.PUBLIC_ACCESS
+	note, err := c.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	page, err := other.Search("quokka", SearchOptions{})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, 1, len(page.Items))
+
+	request, _ := http.NewRequest(http.MethodGet, "http://notes.test/note/privacy/"+strconv.Itoa(note.Id)+"/0", nil)
+	request.Header.Set("Authorization", "Bearer "+c.Token)
+	response, err := c.HttpClient.Do(request)
+	assert.Nil(t, err, "Unexpected error changing privacy")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	page, err = other.Search("quokka", SearchOptions{})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, 0, len(page.Items), "Expected the note reindexed as private")
+
+	note, _ = c.GetNote(note.Id)
+	_, err = c.UpdateNote(note.Id, note.Revision, NoteRequest{Privacy: &privacy})
+	assert.Nil(t, err, "Unexpected error on update")
+	page, _ = other.Search("quokka", SearchOptions{})
+	assert.Equal(t, 1, len(page.Items))
+	db, err := notes.OpenNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error opening db")
+	assert.Nil(t, notes.SetNotePrivacy(db, 1, note.Id, notes.PRIVATE_ACCESS), "Unexpected error on privacy")
+	db.Close()
+	page, err = other.Search("quokka", SearchOptions{})
+	assert.Nil(t, err, "Unexpected error on search")
+	assert.Equal(t, 0, len(page.Items), "Expected hits checked against the database")
+	suggestions, err := other.Suggest("quok", 10)
+	assert.Nil(t, err, "Unexpected error suggesting")
+	assert.Equal(t, 0, len(suggestions))
+}
+
+func Test_FindsReadableRelatedNotes(t *testing.T) {
+	app, _ := createServer(t)
+	c := newTestClient(app)
+	_, err := c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	other := newTestClient(app)
+	_, err = other.Login("Other User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+
+	content := "# Sourdough\n\nFeed the sourdough starter with rye flour"
+	note, err := c.CreateNote(NoteRequest{Content: &content})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	content = "# Bread\n\nBake sourdough with rye"
+	mine, err := c.CreateNote(NoteRequest{Content: &content})
+	assert.Nil(t, err, "Unexpected error on note creation")
+	for _, privacy := range []int{notes.PRIVATE_ACCESS, notes.PUBLIC_ACCESS} {
+		content = "# Rye\n\nrye flour"
+		_, err = other.CreateNote(NoteRequest{Content: &content, Privacy: &privacy})
+		assert.Nil(t, err, "Unexpected error on note creation")
+	}
+
+	related, err := c.RelatedNotes(note.Id, 10, true)
+	assert.Nil(t, err, "Unexpected error finding related notes")
+	assert.Equal(t, 2, len(related.Items), "Expected only readable notes")
+	assert.Equal(t, strconv.Itoa(mine.Id), related.Items[0].Id)
+	assert.Equal(t, "Shares terms rye, sourdough", related.Items[0].Reason)
+	assert.Equal(t, 2, len(related.Summaries))
+
+	_, err = other.RelatedNotes(note.Id, 10, false)
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusForbidden, apiErr.Status)
+}
+
+func Test_ReportsErrors(t *testing.T) {
+	c := createClient(t)
+	_, err := c.Login("Test User", "wrong")
+	apiErr, ok := err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusForbidden, apiErr.Status)
+
+	_, err = c.Login("Test User", "secret")
+	assert.Nil(t, err, "Unexpected error on login")
+	_, err = c.CreateNote(NoteRequest{})
+	apiErr, ok = err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+	assert.Equal(t, "bad_request", apiErr.Code)
+
+	_, err = c.CreateBackup()
+	apiErr, ok = err.(*ApiError)
+	assert.True(t, ok, "Expected an ApiError, got %v", err)
+	assert.Equal(t, http.StatusForbidden, apiErr.Status)
+}
+
+func createClient(t *testing.T) *Client {
+	app, _ := createServer(t)
+	return newTestClient(app)
+}
+
+/**
+ * Serve a fresh database holding "Test User" and "Other User", both with
+ * password "secret".
+ */
+func createServer(t *testing.T) (*fiber.App, string) {
+	os.Setenv("SECRET", "test secret")
+	// The id an admin created after the test users gets.
+	os.Setenv("ADMINS", "3")
+	tmpDirName := t.TempDir()
+	dbFileName := tmpDirName + "/notes.sqlite3"
+
+	db, err := notes.CreateNoteDb(dbFileName)
+	if err != nil {
+		t.Fatalf("Cannot create db %s", err)
+	}
+	for _, userName := range []string{"Test User", "Other User"} {
+		if _, err = notes.CreateAuthor(db, userName, "secret"); err != nil {
+			db.Close()
+			t.Fatalf("Cannot create author %s", err)
+		}
+	}
+	db.Close()
+	idx, err := bleve.New(tmpDirName+"/notes.index", index.NewIndexMapping())
+	if err != nil {
+		t.Fatalf("Cannot create index %s", err)
+	}
+	t.Cleanup(func() { idx.Close() })
+
+	app := fiber.New()
+	routes.InstallRoutes(app, dbFileName, &idx)
+	return app, dbFileName
+}
+
+/**
+ * Wait a few seconds at most for the next event of a stream.
+ */
+func nextEvent(t *testing.T, stream *EventStream) *Event {
+	received := make(chan *Event, 1)
+	go func() {
+		event, err := stream.Next()
+		assert.Nil(t, err, "Unexpected error reading event")
+		received <- event
+	}()
+	select {
+	case event := <-received:
+		if event == nil {
+			t.FailNow()
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for an event")
+	}
+	return nil
+}
+
+/**
+ * Wait a few seconds at most for the next message of a session.
+ */
+func nextMessage(t *testing.T, session *CollabSession) *CollabMessage {
+	received := make(chan *CollabMessage, 1)
+	go func() {
+		message, err := session.Next()
+		assert.Nil(t, err, "Unexpected error reading message")
+		received <- message
+	}()
+	select {
+	case message := <-received:
+		if message == nil {
+			t.FailNow()
+		}
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a message")
+	}
+	return nil
+}
+
+func newTestClient(app *fiber.App) *Client {
+	c := NewClient("http://notes.test")
+	c.HttpClient = &http.Client{Transport: fiberTransport{app}}
+	return c
+}
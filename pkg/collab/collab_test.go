@@ -0,0 +1,170 @@
+package collab
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryStore struct {
+	content  string
+	editors  map[int]bool
+	release  chan bool
+	revision int
+	savedBy  []int
+}
+
+func Test_TransformsConcurrentEdits(t *testing.T) {
+	doc := "héllo world"
+	cases := []struct {
+		a, b Op
+		want string
+	}{
+		{Op{{Retain: 5}, {Insert: ","}, {Retain: 6}}, Op{{Retain: 11}, {Insert: "!"}}, "héllo, world!"},
+		{Op{{Insert: "A"}, {Retain: 11}}, Op{{Insert: "B"}, {Retain: 11}}, "ABhéllo world"},
+		{Op{{Delete: 6}, {Retain: 5}}, Op{{Retain: 2}, {Delete: 7}, {Retain: 2}}, "ld"},
+		{Op{{Retain: 6}, {Delete: 5}, {Insert: "there"}}, Op{{Retain: 6}, {Insert: "big "}, {Retain: 5}}, "héllo big there"},
+	}
+	for _, c := range cases {
+		aPrime, bPrime, err := Transform(c.a, c.b)
+		assert.Nil(t, err, "Unexpected error on transform")
+		afterA, _ := c.a.Apply(doc)
+		afterB, _ := c.b.Apply(doc)
+		viaA, err := bPrime.Apply(afterA)
+		assert.Nil(t, err, "Unexpected error applying b'")
+		viaB, err := aPrime.Apply(afterB)
+		assert.Nil(t, err, "Unexpected error applying a'")
+		assert.Equal(t, c.want, viaA)
+		assert.Equal(t, c.want, viaB)
+	}
+
+	_, _, err := Transform(Op{{Retain: 3}}, Op{{Retain: 4}})
+	assert.NotNil(t, err, "Expected an error on different base lengths")
+	_, err = Op{{Retain: 3}}.Apply(doc)
+	assert.NotNil(t, err, "Expected an error on a base length mismatch")
+	assert.NotNil(t, Op{{Retain: 2, Insert: "x"}}.Validate(), "Expected components doing two things rejected")
+	assert.NotNil(t, Op{{Delete: -1}}.Validate(), "Expected negative lengths rejected")
+}
+
+func Test_DiffsAndMovesPositions(t *testing.T) {
+	op := Diff("a quick fox", "a slow fox")
+	assert.Equal(t, Op{{Retain: 2}, {Insert: "slow"}, {Delete: 5}, {Retain: 4}}, op)
+	assert.Equal(t, Op{{Retain: 3}}, Diff("abc", "abc"))
+
+	insert := Op{{Retain: 2}, {Insert: "xy"}, {Retain: 3}}
+	assert.Equal(t, 1, TransformPosition(1, insert, false))
+	assert.Equal(t, 2, TransformPosition(2, insert, false))
+	assert.Equal(t, 4, TransformPosition(2, insert, true))
+	assert.Equal(t, 5, TransformPosition(3, insert, false))
+	remove := Op{{Retain: 1}, {Delete: 3}, {Retain: 1}}
+	assert.Equal(t, 1, TransformPosition(3, remove, false))
+	assert.Equal(t, 2, TransformPosition(5, remove, false))
+}
+
+func Test_MergesSessionEdits(t *testing.T) {
+	store := &memoryStore{content: "notes", editors: map[int]bool{1: true, 2: true}, revision: 1}
+	hub := NewHub(store)
+	session, alice, err := hub.Join(7, 1, "Alice")
+	assert.Nil(t, err, "Unexpected error joining")
+	init := <-alice.Messages()
+	assert.Equal(t, MESSAGE_INIT, init.Type)
+	assert.Equal(t, "notes", *init.Content)
+	_, bob, err := hub.Join(7, 2, "Bob")
+	assert.Nil(t, err, "Unexpected error joining")
+	init = <-bob.Messages()
+	assert.Equal(t, 2, len(init.Participants))
+	assert.Equal(t, MESSAGE_PRESENCE, (<-alice.Messages()).Type)
+
+	session.Receive(alice, Message{Op: Op{{Insert: "My "}, {Retain: 5}}, Type: MESSAGE_OP})
+	session.Receive(bob, Message{Op: Op{{Retain: 5}, {Insert: "!"}}, Type: MESSAGE_OP})
+	assert.Equal(t, Message{Type: MESSAGE_ACK, Version: 1}, <-alice.Messages())
+	assert.Equal(t, Op{{Retain: 8}, {Insert: "!"}}, (<-alice.Messages()).Op, "Expected Bob's op transformed")
+	assert.Equal(t, Op{{Insert: "My "}, {Retain: 5}}, (<-bob.Messages()).Op)
+	assert.Equal(t, Message{Type: MESSAGE_ACK, Version: 2}, <-bob.Messages())
+
+	session.Receive(bob, Message{Cursor: &Cursor{Position: 3, SelectionEnd: 3}, Type: MESSAGE_CURSOR})
+	presence := <-alice.Messages()
+	assert.Equal(t, &Cursor{Position: 3, SelectionEnd: 3}, presence.Participants[1].Cursor)
+	session.Receive(bob, Message{Op: Op{{Retain: 9}}, Type: MESSAGE_OP, Version: 5})
+	assert.Equal(t, MESSAGE_ERROR, (<-bob.Messages()).Type, "Expected unknown versions rejected")
+
+	store.content, store.revision = "notes today", 2
+	session.save()
+	assert.Equal(t, "My notes today!", store.content, "Expected the outside change merged")
+	assert.Equal(t, 4, store.revision)
+	assert.Equal(t, []int{1, 2}, store.savedBy, "Expected each edit saved as its author's")
+	assert.Equal(t, Op{{Retain: 8}, {Insert: " today"}, {Retain: 1}}, (<-alice.Messages()).Op)
+	assert.Equal(t, Message{Revision: 3, Type: MESSAGE_SAVED, Version: 3}, <-alice.Messages())
+	assert.Equal(t, Message{Revision: 4, Type: MESSAGE_SAVED, Version: 3}, <-alice.Messages())
+
+	store.editors[2] = false
+	session.checkEditors()
+	var last Message
+	for message := range bob.Messages() {
+		last = message
+	}
+	assert.Equal(t, MESSAGE_ERROR, last.Type, "Expected Bob dropped without edit rights")
+	assert.Equal(t, 1, len((<-alice.Messages()).Participants))
+
+	session.Receive(alice, Message{Op: Op{{Delete: 3}, {Retain: 12}}, Type: MESSAGE_OP, Version: 3})
+	session.Leave(alice)
+	assert.Equal(t, "notes today!", store.content, "Expected a save when the last participant leaves")
+	assert.Equal(t, 0, len(hub.sessions))
+}
+
+func Test_KeepsEditingWhileSaving(t *testing.T) {
+	store := &memoryStore{content: "notes", editors: map[int]bool{1: true}, release: make(chan bool), revision: 1}
+	hub := NewHub(store)
+	session, alice, err := hub.Join(7, 1, "Alice")
+	assert.Nil(t, err, "Unexpected error joining")
+	<-alice.Messages()
+	session.Receive(alice, Message{Op: Op{{Insert: "My "}, {Retain: 5}}, Type: MESSAGE_OP})
+	<-alice.Messages()
+
+	store.content, store.revision = "notes today", 2
+	done := make(chan bool)
+	go func() {
+		session.save()
+		done <- true
+	}()
+	// The save announces on release once it merged the outside change, then
+	// waits on it.
+	<-store.release
+	assert.Equal(t, Op{{Retain: 8}, {Insert: " today"}}, (<-alice.Messages()).Op, "Expected the outside change merged")
+	session.Receive(alice, Message{Op: Op{{Insert: "Oh, "}, {Retain: 8}}, Type: MESSAGE_OP, Version: 1})
+	assert.Equal(t, Message{Type: MESSAGE_ACK, Version: 3}, <-alice.Messages(), "Expected edits while saving")
+	store.release <- true
+	<-store.release
+	assert.Equal(t, "My notes today", store.content)
+	assert.Equal(t, Message{Revision: 3, Type: MESSAGE_SAVED, Version: 3}, <-alice.Messages())
+	store.release <- true
+	<-done
+	assert.Equal(t, "Oh, My notes today", store.content, "Expected edits made while saving saved next")
+	assert.Equal(t, Message{Revision: 4, Type: MESSAGE_SAVED, Version: 3}, <-alice.Messages())
+
+	store.release = nil
+	session.Leave(alice)
+	assert.Equal(t, 4, store.revision, "Expected no save without changes")
+	assert.Equal(t, 0, len(hub.sessions))
+}
+
+func (s *memoryStore) CanEdit(noteId int, userId int) (bool, error) {
+	return s.editors[userId], nil
+}
+
+func (s *memoryStore) Load(noteId int) (string, int, error) {
+	return s.content, s.revision, nil
+}
+
+func (s *memoryStore) Save(noteId int, userId int, content string, revision int) (int, error) {
+	if revision != s.revision {
+		return 0, ErrNoteChanged
+	}
+	if s.release != nil {
+		s.release <- true
+		<-s.release
+	}
+	s.content, s.savedBy = content, append(s.savedBy, userId)
+	s.revision++
+	return s.revision, nil
+}
@@ -0,0 +1,494 @@
+package collab
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Edits are saved at most every SAVE_DELAY, and when the last participant
+// leaves.
+const SAVE_DELAY = 2 * time.Second
+
+// Participants that fall SEND_BUFFER messages behind are dropped, as their
+// connection is gone or too slow to keep up.
+const SEND_BUFFER = 64
+
+// Saving retries SAVE_ATTEMPTS times when the note keeps changing outside
+// the session.
+const SAVE_ATTEMPTS = 3
+
+const MESSAGE_ACK = "ack"
+const MESSAGE_CURSOR = "cursor"
+const MESSAGE_ERROR = "error"
+const MESSAGE_INIT = "init"
+const MESSAGE_OP = "op"
+const MESSAGE_PRESENCE = "presence"
+const MESSAGE_SAVED = "saved"
+
+var ErrNoteChanged = errors.New("note changed outside the session")
+
+/**
+ * A caret at Position, with the text up to SelectionEnd selected when
+ * they differ. Both count runes.
+ */
+type Cursor struct {
+	Position     int `json:"position"`
+	SelectionEnd int `json:"selectionEnd"`
+}
+
+/**
+ * The editing sessions, one per note being edited.
+ */
+type Hub struct {
+	lock     sync.Mutex
+	nextId   int
+	sessions map[int]*Session
+	store    Store
+}
+
+/**
+ * Everything sent over a session. Clients send op messages with the
+ * version they were made on, and cursor messages. The server answers with
+ * init on joining, ack for the client's own ops with the version they
+ * made, op for the others', presence when participants come, go or move,
+ * saved with the note revision, and error.
+ */
+type Message struct {
+	ClientId     int           `json:"clientId,omitempty"`
+	Content      *string       `json:"content,omitempty"`
+	Cursor       *Cursor       `json:"cursor,omitempty"`
+	Message      string        `json:"message,omitempty"`
+	Op           Op            `json:"op,omitempty"`
+	Participants []Participant `json:"participants,omitempty"`
+	Revision     int           `json:"revision,omitempty"`
+	Type         string        `json:"type"`
+	Version      int           `json:"version"`
+}
+
+/**
+ * A connection to a session. A user may take part from several clients.
+ */
+type Participant struct {
+	ClientId int     `json:"clientId"`
+	Cursor   *Cursor `json:"cursor,omitempty"`
+	UserId   int     `json:"userId"`
+	UserName string  `json:"userName"`
+	send     chan Message
+}
+
+/**
+ * The document of a note being edited, with the operations applied to it
+ * since the session started. Its version counts them. Unsaved holds the
+ * operations that turn the content last saved into the document with the
+ * users who made them, so that each user's run of operations is saved as
+ * an edit of their own.
+ *
+ * The store is only used without holding lock, so that participants keep
+ * editing while the note is loaded or saved; saving serializes saves.
+ */
+type Session struct {
+	closed       bool
+	content      string
+	ended        chan struct{}
+	history      []Op
+	hub          *Hub
+	loadErr      error
+	loaded       chan struct{}
+	lock         sync.Mutex
+	noteId       int
+	participants map[int]*Participant
+	revision     int
+	savedContent string
+	saveTimer    *time.Timer
+	saving       sync.Mutex
+	unsaved      []edit
+}
+
+/**
+ * Where sessions load notes from and save them to. Save stores the
+ * content as an edit of userId, failing with ErrNoteChanged when the note
+ * is no longer at revision.
+ */
+type Store interface {
+	CanEdit(noteId int, userId int) (bool, error)
+	Load(noteId int) (string, int, error)
+	Save(noteId int, userId int, content string, revision int) (int, error)
+}
+
+// An operation of a user not saved yet.
+type edit struct {
+	op     Op
+	userId int
+}
+
+func NewHub(store Store) *Hub {
+	return &Hub{sessions: make(map[int]*Session), store: store}
+}
+
+/**
+ * Join the session on a note, starting it from the stored note when
+ * nobody is editing it. The participant first receives an init message.
+ */
+func (h *Hub) Join(noteId int, userId int, userName string) (*Session, *Participant, error) {
+	h.lock.Lock()
+	h.nextId++
+	participant := &Participant{ClientId: h.nextId, UserId: userId, UserName: userName,
+		send: make(chan Message, SEND_BUFFER)}
+	h.lock.Unlock()
+
+	for {
+		h.lock.Lock()
+		session := h.sessions[noteId]
+		if session == nil {
+			session = &Session{ended: make(chan struct{}), hub: h, loaded: make(chan struct{}), noteId: noteId,
+				participants: make(map[int]*Participant)}
+			h.sessions[noteId] = session
+			h.lock.Unlock()
+			session.load()
+		} else {
+			h.lock.Unlock()
+		}
+		<-session.loaded
+
+		session.lock.Lock()
+		if session.loadErr != nil {
+			session.lock.Unlock()
+			return nil, nil, session.loadErr
+		}
+		// A session ending is left for a new one once it saved.
+		if session.closed {
+			session.lock.Unlock()
+			<-session.ended
+			continue
+		}
+		session.participants[participant.ClientId] = participant
+		content := session.content
+		participant.send <- Message{ClientId: participant.ClientId, Content: &content,
+			Participants: session.listParticipants(), Revision: session.revision, Type: MESSAGE_INIT,
+			Version: len(session.history)}
+		session.broadcastPresence(participant.ClientId)
+		session.lock.Unlock()
+		return session, participant, nil
+	}
+}
+
+/**
+ * Return the messages to send to the participant, closed once it left or
+ * was dropped.
+ */
+func (p *Participant) Messages() <-chan Message {
+	return p.send
+}
+
+/**
+ * Leave the session, ending it with a last save when nobody is left.
+ */
+func (s *Session) Leave(participant *Participant) {
+	s.lock.Lock()
+	s.remove(participant)
+	if len(s.participants) > 0 || s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	if s.saveTimer != nil {
+		s.saveTimer.Stop()
+	}
+	s.lock.Unlock()
+
+	// The session stays with the hub until saved, so that those joining
+	// meanwhile wait to load what it saved.
+	s.save()
+	s.end()
+}
+
+/**
+ * Handle a message from a participant, answering errors with an error
+ * message.
+ */
+func (s *Session) Receive(participant *Participant, message Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.participants[participant.ClientId] == nil {
+		return
+	}
+	var err error
+	switch message.Type {
+	case MESSAGE_CURSOR:
+		err = s.move(participant, message.Cursor)
+	case MESSAGE_OP:
+		err = s.submit(participant, message.Version, message.Op)
+	default:
+		err = fmt.Errorf("unexpected message type: %s", message.Type)
+	}
+	if err != nil {
+		s.send(participant, Message{Message: err.Error(), Type: MESSAGE_ERROR, Version: len(s.history)})
+	}
+}
+
+/**
+ * Apply an operation of userId to the document, moving the cursors it
+ * shifts, and send it to everybody but its author. Operations of user 0
+ * come from the stored note, so are not saved.
+ */
+func (s *Session) apply(op Op, clientId int, userId int) error {
+	content, err := op.Apply(s.content)
+	if err != nil {
+		return err
+	}
+	s.content = content
+	s.history = append(s.history, op)
+	if userId != 0 {
+		s.unsaved = append(s.unsaved, edit{op: op, userId: userId})
+	}
+	for _, participant := range s.participants {
+		if participant.Cursor != nil {
+			own := participant.ClientId == clientId
+			participant.Cursor = &Cursor{
+				Position:     TransformPosition(participant.Cursor.Position, op, own),
+				SelectionEnd: TransformPosition(participant.Cursor.SelectionEnd, op, own),
+			}
+		}
+	}
+	s.broadcast(Message{ClientId: clientId, Op: op, Type: MESSAGE_OP, Version: len(s.history)}, clientId)
+	if s.saveTimer == nil {
+		s.saveTimer = time.AfterFunc(SAVE_DELAY, s.flush)
+	}
+	return nil
+}
+
+func (s *Session) broadcast(message Message, exceptId int) {
+	for _, participant := range s.participants {
+		if participant.ClientId != exceptId {
+			s.send(participant, message)
+		}
+	}
+}
+
+func (s *Session) broadcastPresence(exceptId int) {
+	s.broadcast(Message{Participants: s.listParticipants(), Type: MESSAGE_PRESENCE, Version: len(s.history)}, exceptId)
+}
+
+/**
+ * Drop the participants who lost the right to edit the note since they
+ * joined.
+ */
+func (s *Session) checkEditors() {
+	s.lock.Lock()
+	userIds := make(map[int]bool)
+	for _, participant := range s.participants {
+		userIds[participant.UserId] = true
+	}
+	s.lock.Unlock()
+	rights := make(map[int]bool)
+	for userId := range userIds {
+		if canEdit, err := s.hub.store.CanEdit(s.noteId, userId); err == nil {
+			rights[userId] = canEdit
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, participant := range s.participants {
+		if canEdit, checked := rights[participant.UserId]; checked && !canEdit {
+			s.send(participant, Message{Message: "no longer allowed to edit the note", Type: MESSAGE_ERROR,
+				Version: len(s.history)})
+			s.remove(participant)
+		}
+	}
+}
+
+/**
+ * Remove an ended session from the hub and let those waiting to join the
+ * note start a new one.
+ */
+func (s *Session) end() {
+	s.hub.lock.Lock()
+	if s.hub.sessions[s.noteId] == s {
+		delete(s.hub.sessions, s.noteId)
+	}
+	s.hub.lock.Unlock()
+	close(s.ended)
+}
+
+func (s *Session) flush() {
+	s.lock.Lock()
+	s.saveTimer = nil
+	closed := s.closed
+	s.lock.Unlock()
+	if closed {
+		return
+	}
+	s.save()
+	s.checkEditors()
+}
+
+func (s *Session) listParticipants() []Participant {
+	participants := []Participant{}
+	for _, participant := range s.participants {
+		participants = append(participants, *participant)
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].ClientId < participants[j].ClientId
+	})
+	return participants
+}
+
+/**
+ * Load the note of a new session, ending the session when that fails.
+ */
+func (s *Session) load() {
+	content, revision, err := s.hub.store.Load(s.noteId)
+	s.lock.Lock()
+	s.content, s.revision, s.savedContent = content, revision, content
+	s.closed, s.loadErr = err != nil, err
+	s.lock.Unlock()
+	if err != nil {
+		s.end()
+	}
+	close(s.loaded)
+}
+
+func (s *Session) move(participant *Participant, cursor *Cursor) error {
+	if cursor == nil {
+		return fmt.Errorf("cursor message without cursor")
+	}
+	length := utf8.RuneCountInString(s.content)
+	if cursor.Position < 0 || cursor.Position > length || cursor.SelectionEnd < 0 || cursor.SelectionEnd > length {
+		return fmt.Errorf("cursor %+v outside the document of %d runes", *cursor, length)
+	}
+	participant.Cursor = &Cursor{Position: cursor.Position, SelectionEnd: cursor.SelectionEnd}
+	s.broadcastPresence(participant.ClientId)
+	return nil
+}
+
+/**
+ * Apply the change from the content last saved to the stored content,
+ * transformed to follow the unsaved operations. These are transformed in
+ * turn to follow it, so that they apply to the stored content, which
+ * becomes the content last saved.
+ */
+func (s *Session) rebase(stored string, revision int) error {
+	external := Diff(s.savedContent, stored)
+	unsaved := make([]edit, len(s.unsaved))
+	var err error
+	for i, concurrent := range s.unsaved {
+		unsaved[i].userId = concurrent.userId
+		if external, unsaved[i].op, err = Transform(external, concurrent.op); err != nil {
+			return err
+		}
+	}
+	if err = s.apply(external, 0, 0); err != nil {
+		return err
+	}
+	s.savedContent, s.revision, s.unsaved = stored, revision, unsaved
+	return nil
+}
+
+func (s *Session) remove(participant *Participant) {
+	if s.participants[participant.ClientId] == nil {
+		return
+	}
+	delete(s.participants, participant.ClientId)
+	close(participant.send)
+	s.broadcastPresence(0)
+}
+
+/**
+ * Save the document when it changed, each run of operations by the same
+ * user as an edit of theirs. Changes saved to the note outside the
+ * session since it was last saved are merged in as an operation of their
+ * own, which the unsaved operations follow.
+ */
+func (s *Session) save() {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+	for attempt := 1; ; {
+		s.lock.Lock()
+		if len(s.unsaved) == 0 {
+			s.lock.Unlock()
+			return
+		}
+		userId, content := s.unsaved[0].userId, s.savedContent
+		count := 0
+		var err error
+		for ; count < len(s.unsaved) && s.unsaved[count].userId == userId && err == nil; count++ {
+			content, err = s.unsaved[count].op.Apply(content)
+		}
+		revision := s.revision
+		if err == nil && content == s.savedContent {
+			s.unsaved = s.unsaved[count:]
+			s.lock.Unlock()
+			continue
+		}
+		s.lock.Unlock()
+
+		if err == nil {
+			revision, err = s.hub.store.Save(s.noteId, userId, content, revision)
+			if err == nil {
+				s.lock.Lock()
+				s.savedContent, s.revision, s.unsaved = content, revision, s.unsaved[count:]
+				s.broadcast(Message{Revision: revision, Type: MESSAGE_SAVED, Version: len(s.history)}, 0)
+				s.lock.Unlock()
+				continue
+			}
+		}
+		if errors.Is(err, ErrNoteChanged) && attempt < SAVE_ATTEMPTS {
+			attempt++
+			var stored string
+			if stored, revision, err = s.hub.store.Load(s.noteId); err == nil {
+				s.lock.Lock()
+				err = s.rebase(stored, revision)
+				s.lock.Unlock()
+				if err == nil {
+					continue
+				}
+			}
+		}
+		s.lock.Lock()
+		s.broadcast(Message{Message: "cannot save: " + err.Error(), Type: MESSAGE_ERROR,
+			Version: len(s.history)}, 0)
+		s.lock.Unlock()
+		return
+	}
+}
+
+/**
+ * Queue a message, dropping the participant when it is too far behind.
+ */
+func (s *Session) send(participant *Participant, message Message) {
+	select {
+	case participant.send <- message:
+	default:
+		delete(s.participants, participant.ClientId)
+		close(participant.send)
+	}
+}
+
+/**
+ * Apply an operation a participant made on a version of the document,
+ * transformed against those applied since.
+ */
+func (s *Session) submit(participant *Participant, version int, op Op) error {
+	if version < 0 || version > len(s.history) {
+		return fmt.Errorf("unknown version %d, the document is at %d", version, len(s.history))
+	}
+	if err := op.Validate(); err != nil {
+		return err
+	}
+	var err error
+	for _, concurrent := range s.history[version:] {
+		if op, _, err = Transform(op, concurrent); err != nil {
+			return err
+		}
+	}
+	if err = s.apply(op, participant.ClientId, participant.UserId); err != nil {
+		return err
+	}
+	s.send(participant, Message{Type: MESSAGE_ACK, Version: len(s.history)})
+	return nil
+}
@@ -0,0 +1,284 @@
+package collab
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+/**
+ * One step of an operation: keep, insert or remove text. Exactly one field
+ * is set, and lengths count runes.
+ */
+type Component struct {
+	Delete int    `json:"delete,omitempty"`
+	Insert string `json:"insert,omitempty"`
+	Retain int    `json:"retain,omitempty"`
+}
+
+/**
+ * An edit of a whole document, walking it from start to end. Concurrent
+ * operations on the same document are merged with Transform.
+ */
+type Op []Component
+
+/**
+ * Walks the components of an operation, splitting retains and deletes
+ * as the other operation requires.
+ */
+type walker struct {
+	current Component
+	index   int
+	op      Op
+}
+
+/**
+ * Return the operation turning before into after, as one change between
+ * their common prefix and suffix.
+ */
+func Diff(before string, after string) Op {
+	from, to := []rune(before), []rune(after)
+	prefix := 0
+	for prefix < len(from) && prefix < len(to) && from[prefix] == to[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(from)-prefix && suffix < len(to)-prefix &&
+		from[len(from)-1-suffix] == to[len(to)-1-suffix] {
+		suffix++
+	}
+	var op Op
+	op.retain(prefix)
+	op.insert(string(to[prefix : len(to)-suffix]))
+	op.delete(len(from) - prefix - suffix)
+	op.retain(suffix)
+	return op
+}
+
+/**
+ * Turn two operations made concurrently on the same document into a pair
+ * that applies after each other: apply(apply(doc, a), b') equals
+ * apply(apply(doc, b), a'). Text inserted by both at the same place puts
+ * a's first.
+ */
+func Transform(a Op, b Op) (Op, Op, error) {
+	if a.BaseLength() != b.BaseLength() {
+		return nil, nil, fmt.Errorf("cannot transform operations on %d and %d runes", a.BaseLength(), b.BaseLength())
+	}
+	var aPrime, bPrime Op
+	first, second := newWalker(a), newWalker(b)
+	for !first.done() || !second.done() {
+		switch {
+		case first.current.Insert != "":
+			aPrime.insert(first.current.Insert)
+			bPrime.retain(utf8.RuneCountInString(first.current.Insert))
+			first.next()
+			continue
+		case second.current.Insert != "":
+			aPrime.retain(utf8.RuneCountInString(second.current.Insert))
+			bPrime.insert(second.current.Insert)
+			second.next()
+			continue
+		}
+
+		length := first.length()
+		if second.length() < length {
+			length = second.length()
+		}
+		if length == 0 {
+			return nil, nil, fmt.Errorf("illegal components %+v and %+v", first.current, second.current)
+		}
+		switch {
+		case first.current.Retain > 0 && second.current.Retain > 0:
+			aPrime.retain(length)
+			bPrime.retain(length)
+		case first.current.Delete > 0 && second.current.Retain > 0:
+			aPrime.delete(length)
+		case first.current.Retain > 0 && second.current.Delete > 0:
+			bPrime.delete(length)
+		}
+		first.advance(length)
+		second.advance(length)
+	}
+	return aPrime, bPrime, nil
+}
+
+/**
+ * Move a position in a document to where it is after an operation.
+ * Text inserted right at the position goes before it when after is set.
+ */
+func TransformPosition(position int, op Op, after bool) int {
+	transformed := position
+	index := 0
+	for _, component := range op {
+		if index > position {
+			break
+		}
+		switch {
+		case component.Retain > 0:
+			index += component.Retain
+		case component.Insert != "":
+			if index < position || after {
+				transformed += utf8.RuneCountInString(component.Insert)
+			}
+		case component.Delete > 0:
+			if index < position {
+				deleted := position - index
+				if component.Delete < deleted {
+					deleted = component.Delete
+				}
+				transformed -= deleted
+			}
+			index += component.Delete
+		}
+	}
+	return transformed
+}
+
+/**
+ * Apply the operation to a document of its base length.
+ */
+func (op Op) Apply(doc string) (string, error) {
+	text := []rune(doc)
+	if len(text) != op.BaseLength() {
+		return "", fmt.Errorf("operation on %d runes cannot apply to %d", op.BaseLength(), len(text))
+	}
+	result := make([]rune, 0, op.TargetLength())
+	index := 0
+	for _, component := range op {
+		switch {
+		case component.Retain > 0:
+			result = append(result, text[index:index+component.Retain]...)
+			index += component.Retain
+		case component.Insert != "":
+			result = append(result, []rune(component.Insert)...)
+		case component.Delete > 0:
+			index += component.Delete
+		}
+	}
+	return string(result), nil
+}
+
+/**
+ * Return the length in runes of the documents the operation applies to.
+ */
+func (op Op) BaseLength() int {
+	length := 0
+	for _, component := range op {
+		length += component.Retain + component.Delete
+	}
+	return length
+}
+
+/**
+ * Return the length in runes of the documents the operation produces.
+ */
+func (op Op) TargetLength() int {
+	length := 0
+	for _, component := range op {
+		length += component.Retain + utf8.RuneCountInString(component.Insert)
+	}
+	return length
+}
+
+/**
+ * Check that every component does exactly one thing.
+ */
+func (op Op) Validate() error {
+	for i, component := range op {
+		set := 0
+		if component.Delete != 0 {
+			set++
+		}
+		if component.Insert != "" {
+			set++
+		}
+		if component.Retain != 0 {
+			set++
+		}
+		if set != 1 || component.Delete < 0 || component.Retain < 0 {
+			return fmt.Errorf("illegal component %d: %+v", i, component)
+		}
+	}
+	return nil
+}
+
+func (op *Op) delete(length int) {
+	if length <= 0 {
+		return
+	}
+	if last := len(*op) - 1; last >= 0 && (*op)[last].Delete > 0 {
+		(*op)[last].Delete += length
+		return
+	}
+	*op = append(*op, Component{Delete: length})
+}
+
+/**
+ * Append an insertion, keeping it before an adjacent deletion so that
+ * equal edits have one representation.
+ */
+func (op *Op) insert(text string) {
+	if text == "" {
+		return
+	}
+	last := len(*op) - 1
+	if last >= 0 && (*op)[last].Insert != "" {
+		(*op)[last].Insert += text
+		return
+	}
+	if last >= 0 && (*op)[last].Delete > 0 {
+		if last > 0 && (*op)[last-1].Insert != "" {
+			(*op)[last-1].Insert += text
+			return
+		}
+		deleted := (*op)[last]
+		(*op)[last] = Component{Insert: text}
+		*op = append(*op, deleted)
+		return
+	}
+	*op = append(*op, Component{Insert: text})
+}
+
+func (op *Op) retain(length int) {
+	if length <= 0 {
+		return
+	}
+	if last := len(*op) - 1; last >= 0 && (*op)[last].Retain > 0 {
+		(*op)[last].Retain += length
+		return
+	}
+	*op = append(*op, Component{Retain: length})
+}
+
+func newWalker(op Op) *walker {
+	w := &walker{index: -1, op: op}
+	w.next()
+	return w
+}
+
+func (w *walker) advance(length int) {
+	if w.current.Retain > 0 {
+		w.current.Retain -= length
+	} else {
+		w.current.Delete -= length
+	}
+	if w.current.Retain == 0 && w.current.Delete == 0 {
+		w.next()
+	}
+}
+
+func (w *walker) done() bool {
+	return w.index >= len(w.op)
+}
+
+func (w *walker) length() int {
+	return w.current.Retain + w.current.Delete
+}
+
+func (w *walker) next() {
+	w.index++
+	w.current = Component{}
+	if w.index < len(w.op) {
+		w.current = w.op[w.index]
+	}
+}
@@ -0,0 +1,237 @@
+package export
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"org/bredin/go-notes/pkg/frontmatter"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const FORMAT_TAR_GZ = "tar.gz"
+const FORMAT_ZIP = "zip"
+const MANIFEST_FILE_NAME = "manifest.json"
+const MAX_FILE_NAME_LENGTH = 100
+
+type Manifest struct {
+	Author   string
+	Exported int64
+	Notes    []ManifestEntry
+}
+
+type ManifestEntry struct {
+	Attachments []string
+	Created     int
+	File        string
+	Id          int
+	Privacy     int
+	RenderHint  int
+	Tags        []string
+	Title       string
+}
+
+type archiveWriter interface {
+	Close() error
+	WriteFile(name string, modTime time.Time, content []byte) error
+}
+
+/**
+ * Return the MIME type for an archive format, or an error if the format
+ * is not supported.
+ */
+func ContentType(format string) (string, error) {
+	switch format {
+	case FORMAT_TAR_GZ:
+		return "application/gzip", nil
+	case FORMAT_ZIP:
+		return "application/zip", nil
+	}
+	return "", fmt.Errorf("unsupported export format: %s", format)
+}
+
+/**
+ * Write all notes authored by authorId, with their attachments and a
+ * manifest, to an archive in the given format.
+ */
+func Export(db *sql.DB, authorId int, format string, w io.Writer) error {
+	author, err := notes.GetAuthor(db, authorId)
+	if err != nil {
+		return err
+	}
+	if author == nil {
+		return fmt.Errorf("no author %d", authorId)
+	}
+	noteIds, err := notes.GetAuthorNotes(db, authorId)
+	if err != nil {
+		return err
+	}
+
+	archive, err := newArchiveWriter(format, w)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	manifest := Manifest{Author: author.Name, Exported: now.Unix(), Notes: []ManifestEntry{}}
+	usedNames := make(map[string]bool)
+	for _, noteId := range noteIds {
+		entry, err := exportNote(db, archive, authorId, noteId, usedNames)
+		if err != nil {
+			archive.Close()
+			return err
+		}
+		manifest.Notes = append(manifest.Notes, *entry)
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		archive.Close()
+		return err
+	}
+	if err = archive.WriteFile(MANIFEST_FILE_NAME, now, content); err != nil {
+		archive.Close()
+		return err
+	}
+	return archive.Close()
+}
+
+/**
+ * Derive a file-system safe, unique Markdown file name from a note title.
+ */
+func NoteFileName(title string, noteId int, usedNames map[string]bool) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '-'
+		}
+		return r
+	}, title)
+	if runes := []rune(name); len(runes) > MAX_FILE_NAME_LENGTH {
+		name = string(runes[:MAX_FILE_NAME_LENGTH])
+	}
+	name = strings.Trim(name, " .")
+	if name == "" {
+		name = "untitled"
+	}
+	if usedNames[strings.ToLower(name)] {
+		name = name + "-" + strconv.Itoa(noteId)
+	}
+	usedNames[strings.ToLower(name)] = true
+	return name + ".md"
+}
+
+func exportNote(db *sql.DB, archive archiveWriter, authorId int, noteId int, usedNames map[string]bool) (*ManifestEntry, error) {
+	note, err := notes.GetNote(db, authorId, noteId)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := notes.GetNoteTags(db, noteId)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := notes.GetAttachments(db, noteId)
+	if err != nil {
+		return nil, err
+	}
+
+	created := time.Unix(int64(note.Created), 0).UTC()
+	title := index.GetTitleFromContent(note.Content)
+	entry := ManifestEntry{
+		Attachments: []string{},
+		Created:     note.Created,
+		File:        path.Join("notes", NoteFileName(title, noteId, usedNames)),
+		Id:          noteId,
+		Privacy:     note.Privacy,
+		RenderHint:  note.RenderHint,
+		Tags:        tags,
+		Title:       title,
+	}
+	content, err := frontmatter.Format(&frontmatter.FrontMatter{
+		Created:    created,
+		Privacy:    notes.PrivacyName(note.Privacy),
+		RenderHint: &note.RenderHint,
+		Tags:       tags,
+	}, note.Content)
+	if err != nil {
+		return nil, err
+	}
+	if err = archive.WriteFile(entry.File, created, []byte(content)); err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range attachments {
+		fileName := path.Join("attachments", strconv.Itoa(noteId), path.Base(attachment.Name))
+		if err = archive.WriteFile(fileName, created, attachment.Content); err != nil {
+			return nil, err
+		}
+		entry.Attachments = append(entry.Attachments, fileName)
+	}
+	return &entry, nil
+}
+
+func newArchiveWriter(format string, w io.Writer) (archiveWriter, error) {
+	switch format {
+	case FORMAT_TAR_GZ:
+		gz := gzip.NewWriter(w)
+		return &tarWriter{gz, tar.NewWriter(gz)}, nil
+	case FORMAT_ZIP:
+		return &zipWriter{zip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unsupported export format: %s", format)
+}
+
+type tarWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (t *tarWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		t.gz.Close()
+		return err
+	}
+	return t.gz.Close()
+}
+
+func (t *tarWriter) WriteFile(name string, modTime time.Time, content []byte) error {
+	header := tar.Header{
+		Mode:    0644,
+		ModTime: modTime,
+		Name:    name,
+		Size:    int64(len(content)),
+	}
+	if err := t.tw.WriteHeader(&header); err != nil {
+		return err
+	}
+	_, err := t.tw.Write(content)
+	return err
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
+}
+
+func (z *zipWriter) WriteFile(name string, modTime time.Time, content []byte) error {
+	f, err := z.zw.CreateHeader(&zip.FileHeader{
+		Method:   zip.Deflate,
+		Modified: modTime,
+		Name:     name,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	return err
+}
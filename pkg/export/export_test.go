@@ -0,0 +1,92 @@
+package export
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"org/bredin/go-notes/pkg/notes"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ExportsZip(t *testing.T) {
+	db, _ := notes.CreateNoteDb(":memory:")
+	defer db.Close()
+	authorId, _ := notes.CreateAuthor(db, "Test Author", "")
+	otherId, _ := notes.CreateAuthor(db, "Other Author", "")
+
+	id, _ := notes.CreateNote(db, &notes.NoteRecord{
+		Author: authorId, Content: "# Groceries\nmilk", Created: 1700000000, Privacy: notes.PRIVATE_ACCESS,
+	})
+	notes.SetNoteTags(db, id, []string{"home", "shopping"})
+	notes.CreateAttachment(db, &notes.AttachmentRecord{
+		Note: id, Name: "list.txt", MimeType: "text/plain", Content: []byte("eggs"),
+	})
+	notes.CreateNote(db, &notes.NoteRecord{Author: authorId, Content: "# Groceries\nbread", Created: 1700000001})
+	notes.CreateNote(db, &notes.NoteRecord{Author: otherId, Content: "not mine", Created: 1700000002})
+
+	var buf bytes.Buffer
+	err := Export(db, authorId, FORMAT_ZIP, &buf)
+	assert.Nil(t, err, "Unexpected error on export")
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err, "Unexpected error reading archive")
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		content, _ := io.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(content)
+	}
+
+	assert.Contains(t, files, "notes/Groceries.md")
+	assert.Contains(t, files, "notes/Groceries-2.md")
+	assert.Equal(t, "eggs", files["attachments/1/list.txt"])
+	note := files["notes/Groceries.md"]
+	assert.True(t, strings.HasPrefix(note, "---\ncreated: 2023-11-14T22:13:20Z\n"), note)
+	assert.Contains(t, note, "privacy: private\n")
+	assert.Contains(t, note, "- shopping\n")
+	assert.True(t, strings.HasSuffix(note, "---\n# Groceries\nmilk\n"), note)
+
+	var manifest Manifest
+	err = json.Unmarshal([]byte(files[MANIFEST_FILE_NAME]), &manifest)
+	assert.Nil(t, err, "Unexpected error reading manifest")
+	assert.Equal(t, "Test Author", manifest.Author)
+	assert.Equal(t, 2, len(manifest.Notes), "Exported only own notes")
+	assert.Equal(t, []string{"attachments/1/list.txt"}, manifest.Notes[0].Attachments)
+}
+
+func Test_ExportsTarGz(t *testing.T) {
+	db, _ := notes.CreateNoteDb(":memory:")
+	defer db.Close()
+	authorId, _ := notes.CreateAuthor(db, "Test Author", "")
+	notes.CreateNote(db, &notes.NoteRecord{Author: authorId, Content: "a/b: c?", Created: 0})
+
+	var buf bytes.Buffer
+	err := Export(db, authorId, FORMAT_TAR_GZ, &buf)
+	assert.Nil(t, err, "Unexpected error on export")
+
+	gz, err := gzip.NewReader(&buf)
+	assert.Nil(t, err, "Unexpected error reading gzip")
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+	assert.Equal(t, []string{"notes/a-b- c-.md", MANIFEST_FILE_NAME}, names)
+}
+
+func Test_RejectsUnknownFormat(t *testing.T) {
+	_, err := ContentType("rar")
+	assert.NotNil(t, err, "Expected error on unknown format")
+}
@@ -0,0 +1,115 @@
+package frontmatter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const DELIMITER = "---"
+
+type FrontMatter struct {
+	Created    time.Time `yaml:"created"`
+	Privacy    string    `yaml:"privacy,omitempty"`
+	RenderHint *int      `yaml:"renderHint,omitempty"`
+	Tags       []string  `yaml:"tags,omitempty"`
+}
+
+/**
+ * Prefix the note body with a YAML front matter block.
+ */
+func Format(fm *FrontMatter, body string) (string, error) {
+	header, err := yaml.Marshal(fm)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteString(DELIMITER + "\n")
+	sb.Write(header)
+	sb.WriteString(DELIMITER + "\n")
+	sb.WriteString(body)
+	if !strings.HasSuffix(body, "\n") {
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+/**
+ * Split a leading YAML front matter block from the note body.  Returns a
+ * nil FrontMatter if the content has none.  Keys written by other tools,
+ * such as `date` for the creation time or comma-separated tags, are
+ * accepted.
+ */
+func Parse(content string) (*FrontMatter, string, error) {
+	normalized := strings.ReplaceAll(content, "\r\n", "\n")
+	if !strings.HasPrefix(normalized, DELIMITER+"\n") {
+		return nil, content, nil
+	}
+	rest := normalized[len(DELIMITER)+1:]
+	var header string
+	if strings.HasPrefix(rest, DELIMITER) {
+		header, rest = "", rest[len(DELIMITER):]
+	} else if end := strings.Index(rest, "\n"+DELIMITER); end >= 0 {
+		header, rest = rest[:end], rest[end+1+len(DELIMITER):]
+	} else {
+		return nil, content, nil
+	}
+	body := strings.TrimPrefix(rest, "\n")
+
+	var fields map[string]interface{}
+	if err := yaml.Unmarshal([]byte(header), &fields); err != nil {
+		return nil, content, err
+	}
+
+	var fm FrontMatter
+	for _, key := range []string{"created", "date"} {
+		if value, ok := fields[key]; ok {
+			created, err := parseTime(value)
+			if err != nil {
+				return nil, content, err
+			}
+			fm.Created = created
+			break
+		}
+	}
+	switch privacy := fields["privacy"].(type) {
+	case string:
+		fm.Privacy = privacy
+	case int:
+		fm.Privacy = strconv.Itoa(privacy)
+	}
+	if renderHint, ok := fields["renderHint"].(int); ok {
+		fm.RenderHint = &renderHint
+	}
+	switch tags := fields["tags"].(type) {
+	case string:
+		fm.Tags = strings.FieldsFunc(tags, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	case []interface{}:
+		for _, tag := range tags {
+			fm.Tags = append(fm.Tags, fmt.Sprint(tag))
+		}
+	}
+	return &fm, body, nil
+}
+
+func parseTime(value interface{}) (time.Time, error) {
+	switch t := value.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+			if parsed, err := time.ParseInLocation(layout, t, time.UTC); err == nil {
+				return parsed, nil
+			}
+		}
+	case int:
+		return time.Unix(int64(t), 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse front matter time: %v", value)
+}
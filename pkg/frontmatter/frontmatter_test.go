@@ -0,0 +1,42 @@
+package frontmatter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RoundTripsFrontMatter(t *testing.T) {
+	renderHint := 1
+	fm := FrontMatter{
+		Created:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Privacy:    "public",
+		RenderHint: &renderHint,
+		Tags:       []string{"a", "b"},
+	}
+	content, err := Format(&fm, "# Title\nbody")
+	assert.Nil(t, err, "Unexpected error formatting front matter")
+
+	parsed, body, err := Parse(content)
+	assert.Nil(t, err, "Unexpected error parsing front matter")
+	assert.Equal(t, "# Title\nbody\n", body)
+	assert.Equal(t, fm.Created, parsed.Created.UTC())
+	assert.Equal(t, fm.Privacy, parsed.Privacy)
+	assert.Equal(t, renderHint, *parsed.RenderHint)
+	assert.Equal(t, fm.Tags, parsed.Tags)
+}
+
+func Test_ParsesForeignFrontMatter(t *testing.T) {
+	parsed, body, err := Parse("---\r\ndate: 2024-01-02 10:30\r\ntags: a, b\r\n---\r\nbody")
+	assert.Nil(t, err, "Unexpected error parsing front matter")
+	assert.Equal(t, "body", body)
+	assert.Equal(t, time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC), parsed.Created)
+	assert.Equal(t, []string{"a", "b"}, parsed.Tags)
+	assert.Nil(t, parsed.RenderHint)
+
+	parsed, body, err = Parse("# No front matter\n---\n")
+	assert.Nil(t, err, "Unexpected error without front matter")
+	assert.Nil(t, parsed, "Unexpected front matter")
+	assert.Equal(t, "# No front matter\n---\n", body)
+}
@@ -0,0 +1,139 @@
+package importer
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"org/bredin/go-notes/pkg/notes"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+const ENEX_TIME_FORMAT = "20060102T150405Z"
+
+type enexNote struct {
+	Content   string         `xml:"content"`
+	Created   string         `xml:"created"`
+	Resources []enexResource `xml:"resource"`
+	Tags      []string       `xml:"tag"`
+	Title     string         `xml:"title"`
+}
+
+type enexResource struct {
+	Data struct {
+		Encoding string `xml:"encoding,attr"`
+		Value    string `xml:",chardata"`
+	} `xml:"data"`
+	FileName string `xml:"resource-attributes>file-name"`
+	Mime     string `xml:"mime"`
+}
+
+/**
+ * Import an Evernote ENEX export.  Note content is converted from ENML to
+ * markdown, resources are kept as attachments, and conversions that drop
+ * markup are reported as warnings.
+ */
+func ImportEnex(db *sql.DB, idx bleve.Index, authorId int, r io.Reader) (*Report, error) {
+	var report Report
+	var items []Item
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "note" {
+			continue
+		}
+
+		var note enexNote
+		if err = decoder.DecodeElement(&note, &start); err != nil {
+			return nil, err
+		}
+		source := fmt.Sprintf("note %d: %s", len(items)+len(report.Skipped)+1, note.Title)
+		item, err := enexItem(&note, source, &report)
+		if err != nil {
+			report.Skipped = append(report.Skipped, ReportEntry{Message: err.Error(), Source: source})
+			continue
+		}
+		items = append(items, *item)
+	}
+
+	if err := ImportItems(db, idx, authorId, items, nil, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func enexItem(note *enexNote, source string, report *Report) (*Item, error) {
+	media := make(map[string]notes.AttachmentRecord)
+	var attachments []notes.AttachmentRecord
+	usedNames := make(map[string]bool)
+	for i, resource := range note.Resources {
+		if resource.Data.Encoding != "" && resource.Data.Encoding != "base64" {
+			report.Warnings = append(report.Warnings, ReportEntry{
+				Message: "unsupported resource encoding " + resource.Data.Encoding, Source: source,
+			})
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(resource.Data.Value), ""))
+		if err != nil {
+			report.Warnings = append(report.Warnings, ReportEntry{
+				Message: "cannot decode resource: " + err.Error(), Source: source,
+			})
+			continue
+		}
+
+		name := path.Base(resource.FileName)
+		if resource.FileName == "" {
+			name = fmt.Sprintf("resource-%d", i+1)
+		}
+		name = renameAttachment(name, usedNames, source, report)
+		attachment := notes.AttachmentRecord{Content: data, MimeType: resource.Mime, Name: name}
+		hash := md5.Sum(data)
+		media[hex.EncodeToString(hash[:])] = attachment
+		attachments = append(attachments, attachment)
+	}
+
+	markdown, lossy, err := ConvertEnml(note.Content, media)
+	if err != nil {
+		return nil, err
+	}
+	for _, element := range lossy {
+		report.Warnings = append(report.Warnings, ReportEntry{Message: "dropped " + element, Source: source})
+	}
+
+	created := time.Now()
+	if note.Created != "" {
+		if created, err = time.Parse(ENEX_TIME_FORMAT, note.Created); err != nil {
+			return nil, err
+		}
+	}
+	content := markdown
+	if title := strings.TrimSpace(note.Title); title != "" {
+		content = "# " + title + "\n\n" + markdown
+	}
+	return &Item{
+		Attachments: attachments,
+		Content:     content,
+		Created:     int(created.Unix()),
+		Hash:        ContentHash([]byte(note.Created + "\x00" + note.Title + "\x00" + note.Content)),
+		Privacy:     notes.DEFAULT_ACCESS,
+		RenderHint:  1,
+		Source:      source,
+		Tags:        note.Tags,
+	}, nil
+}
@@ -0,0 +1,352 @@
+package importer
+
+import (
+	"encoding/xml"
+	"io"
+	"org/bredin/go-notes/pkg/notes"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var blankLinesRegexp = regexp.MustCompile(`\n{3,}`)
+var trailingSpaceRegexp = regexp.MustCompile(`[ \t]+\n`)
+var whitespaceRegexp = regexp.MustCompile(`[\s\x{00a0}]+`)
+
+type enmlList struct {
+	count   int
+	ordered bool
+}
+
+type enmlConverter struct {
+	buffers   []*strings.Builder
+	codeDivs  []bool
+	hrefs     []string
+	lists     []enmlList
+	lossy     map[string]bool
+	media     map[string]notes.AttachmentRecord
+	preDepth  int
+	skipDepth int
+	tables    [][][]string
+}
+
+/**
+ * Convert Evernote's XHTML-based ENML to markdown.  Media are linked by
+ * the MD5 hash of their content to attachments.  Markup without a
+ * markdown equivalent is dropped and its element name returned.
+ */
+func ConvertEnml(enml string, media map[string]notes.AttachmentRecord) (string, []string, error) {
+	converter := enmlConverter{
+		buffers: []*strings.Builder{{}},
+		lossy:   make(map[string]bool),
+		media:   media,
+	}
+	decoder := xml.NewDecoder(strings.NewReader(enml))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			converter.start(t)
+		case xml.EndElement:
+			converter.end(t)
+		case xml.CharData:
+			converter.text(string(t))
+		}
+	}
+
+	var lossy []string
+	for name := range converter.lossy {
+		lossy = append(lossy, name)
+	}
+	sort.Strings(lossy)
+	markdown := trailingSpaceRegexp.ReplaceAllString(converter.out().String(), "\n")
+	markdown = blankLinesRegexp.ReplaceAllString(markdown, "\n\n")
+	return strings.TrimSpace(markdown) + "\n", lossy, nil
+}
+
+func (c *enmlConverter) end(element xml.EndElement) {
+	name := strings.ToLower(element.Name.Local)
+	if c.skipDepth > 0 {
+		if name == "en-crypt" {
+			c.skipDepth--
+		}
+		return
+	}
+
+	switch name {
+	case "a":
+		text := c.pop()
+		href := c.hrefs[len(c.hrefs)-1]
+		c.hrefs = c.hrefs[:len(c.hrefs)-1]
+		if href == "" {
+			c.write(text)
+		} else {
+			c.write("[" + text + "](" + href + ")")
+		}
+	case "b", "strong":
+		c.write("**")
+	case "blockquote":
+		quoted := strings.TrimSpace(c.pop())
+		c.ensureBlankLine()
+		for _, line := range strings.Split(quoted, "\n") {
+			c.write(strings.TrimRight("> "+line, " ") + "\n")
+		}
+		c.ensureBlankLine()
+	case "code":
+		if c.preDepth == 0 {
+			c.write("`")
+		}
+	case "div", "li", "p":
+		if name == "div" {
+			codeDiv := c.codeDivs[len(c.codeDivs)-1]
+			c.codeDivs = c.codeDivs[:len(c.codeDivs)-1]
+			if codeDiv {
+				c.endPre()
+				return
+			}
+			if c.preDepth > 0 {
+				c.ensureNewline()
+				return
+			}
+		}
+		c.ensureNewline()
+		if name == "p" {
+			c.ensureBlankLine()
+		}
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		c.ensureBlankLine()
+	case "i", "em":
+		c.write("*")
+	case "ol", "ul":
+		c.lists = c.lists[:len(c.lists)-1]
+		c.ensureNewline()
+		if len(c.lists) == 0 {
+			c.ensureBlankLine()
+		}
+	case "pre":
+		c.endPre()
+	case "s", "strike", "del":
+		c.write("~~")
+	case "table":
+		c.writeTable()
+	case "td", "th":
+		cell := strings.TrimSpace(whitespaceRegexp.ReplaceAllString(c.pop(), " "))
+		if len(c.tables) == 0 {
+			c.write(cell + " ")
+			return
+		}
+		table := c.tables[len(c.tables)-1]
+		if len(table) > 0 {
+			row := &table[len(table)-1]
+			*row = append(*row, strings.ReplaceAll(cell, "|", `\|`))
+		}
+	}
+}
+
+func (c *enmlConverter) endPre() {
+	c.preDepth--
+	c.ensureNewline()
+	c.write("```\n\n")
+}
+
+func (c *enmlConverter) ensureBlankLine() {
+	c.ensureNewline()
+	out := c.out().String()
+	if out != "" && !strings.HasSuffix(out, "\n\n") {
+		c.write("\n")
+	}
+}
+
+func (c *enmlConverter) ensureNewline() {
+	out := c.out().String()
+	if out != "" && !strings.HasSuffix(out, "\n") {
+		c.write("\n")
+	}
+}
+
+func (c *enmlConverter) out() *strings.Builder {
+	return c.buffers[len(c.buffers)-1]
+}
+
+func (c *enmlConverter) pop() string {
+	text := c.out().String()
+	c.buffers = c.buffers[:len(c.buffers)-1]
+	return text
+}
+
+func (c *enmlConverter) push() {
+	c.buffers = append(c.buffers, &strings.Builder{})
+}
+
+func (c *enmlConverter) startPre() {
+	c.ensureBlankLine()
+	c.write("```\n")
+	c.preDepth++
+}
+
+func (c *enmlConverter) start(element xml.StartElement) {
+	name := strings.ToLower(element.Name.Local)
+	if c.skipDepth > 0 {
+		if name == "en-crypt" {
+			c.skipDepth++
+		}
+		return
+	}
+	attrs := make(map[string]string)
+	for _, attr := range element.Attr {
+		attrs[strings.ToLower(attr.Name.Local)] = attr.Value
+	}
+
+	switch name {
+	case "a":
+		c.hrefs = append(c.hrefs, attrs["href"])
+		c.push()
+	case "b", "strong":
+		c.write("**")
+	case "blockquote":
+		c.push()
+	case "br":
+		c.write("\n")
+	case "code":
+		if c.preDepth == 0 {
+			c.write("`")
+		}
+	case "div", "p":
+		codeDiv := name == "div" && c.preDepth == 0 && strings.Contains(attrs["style"], "-en-codeblock")
+		if name == "div" {
+			c.codeDivs = append(c.codeDivs, codeDiv)
+		}
+		if codeDiv {
+			c.startPre()
+		} else if c.preDepth == 0 {
+			c.ensureNewline()
+		}
+	case "en-crypt":
+		c.lossy["en-crypt"] = true
+		c.skipDepth = 1
+	case "en-media":
+		c.writeMedia(attrs)
+	case "en-todo":
+		if len(c.lists) == 0 {
+			c.ensureNewline()
+			c.write("- ")
+		}
+		if attrs["checked"] == "true" {
+			c.write("[x] ")
+		} else {
+			c.write("[ ] ")
+		}
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		level, _ := strconv.Atoi(name[1:])
+		c.ensureBlankLine()
+		c.write(strings.Repeat("#", level) + " ")
+	case "hr":
+		c.ensureBlankLine()
+		c.write("---\n\n")
+	case "i", "em":
+		c.write("*")
+	case "img":
+		c.write("![" + attrs["alt"] + "](" + attrs["src"] + ")")
+	case "li":
+		c.ensureNewline()
+		depth := len(c.lists)
+		if depth == 0 {
+			c.write("- ")
+			return
+		}
+		list := &c.lists[depth-1]
+		c.write(strings.Repeat("  ", depth-1))
+		if list.ordered {
+			list.count++
+			c.write(strconv.Itoa(list.count) + ". ")
+		} else {
+			c.write("- ")
+		}
+	case "ol", "ul":
+		c.ensureNewline()
+		c.lists = append(c.lists, enmlList{ordered: name == "ol"})
+	case "pre":
+		c.startPre()
+	case "s", "strike", "del":
+		c.write("~~")
+	case "table":
+		c.tables = append(c.tables, [][]string{})
+	case "td", "th":
+		c.push()
+	case "tr":
+		if len(c.tables) > 0 {
+			c.tables[len(c.tables)-1] = append(c.tables[len(c.tables)-1], []string{})
+		}
+	case "u", "sup", "sub", "font":
+		c.lossy[name] = true
+	}
+}
+
+func (c *enmlConverter) text(text string) {
+	if c.skipDepth > 0 {
+		return
+	}
+	if c.preDepth > 0 {
+		c.write(text)
+		return
+	}
+	text = whitespaceRegexp.ReplaceAllString(text, " ")
+	out := c.out().String()
+	if out == "" || strings.HasSuffix(out, "\n") || strings.HasSuffix(out, " ") {
+		text = strings.TrimLeft(text, " ")
+	}
+	c.write(text)
+}
+
+func (c *enmlConverter) write(text string) {
+	c.out().WriteString(text)
+}
+
+func (c *enmlConverter) writeMedia(attrs map[string]string) {
+	attachment, ok := c.media[strings.ToLower(attrs["hash"])]
+	if !ok {
+		c.lossy["missing en-media"] = true
+		return
+	}
+	link := "[" + attachment.Name + "](" + notes.AttachmentLink(attachment.Name) + ")"
+	if strings.HasPrefix(attachment.MimeType, "image/") {
+		link = "!" + link
+	}
+	c.write(link)
+}
+
+func (c *enmlConverter) writeTable() {
+	table := c.tables[len(c.tables)-1]
+	c.tables = c.tables[:len(c.tables)-1]
+	if len(table) == 0 {
+		return
+	}
+
+	width := 0
+	for _, row := range table {
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+	c.ensureBlankLine()
+	for i, row := range table {
+		for len(row) < width {
+			row = append(row, "")
+		}
+		c.write("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			c.write(strings.Repeat("| --- ", width) + "|\n")
+		}
+	}
+	c.ensureBlankLine()
+}
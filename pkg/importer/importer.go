@@ -0,0 +1,203 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"path"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+const FORMAT_ENEX = "enex"
+const FORMAT_JOPLIN = "joplin"
+const FORMAT_MARKDOWN = "markdown"
+const IMPORT_BATCH_SIZE = 100
+
+type Item struct {
+	Attachments []notes.AttachmentRecord
+	Content     string
+	Created     int
+	Hash        string
+	Privacy     int
+	RenderHint  int
+	Source      string
+	Tags        []string
+}
+
+type Report struct {
+	Imported []ReportEntry
+	Skipped  []ReportEntry
+	Warnings []ReportEntry
+}
+
+type ReportEntry struct {
+	Message string `json:",omitempty"`
+	NoteId  int    `json:",omitempty"`
+	Source  string
+}
+
+// LinkRewriter rewrites the content of an imported item once the note ids
+// of every item in the import, keyed by source, are known.
+type LinkRewriter func(item *Item, noteIds map[string]int) (string, bool)
+
+func ContentHash(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+/**
+ * Import an uploaded file: a zip of Markdown files or of a Joplin export,
+ * or an ENEX file.
+ */
+func ImportArchive(db *sql.DB, idx bleve.Index, authorId int, format string, r io.ReaderAt, size int64) (*Report, error) {
+	switch format {
+	case FORMAT_ENEX:
+		return ImportEnex(db, idx, authorId, io.NewSectionReader(r, 0, size))
+	case FORMAT_JOPLIN:
+		return ImportJoplinZip(db, idx, authorId, r, size)
+	case FORMAT_MARKDOWN:
+		return ImportMarkdownZip(db, idx, authorId, r, size)
+	}
+	return nil, fmt.Errorf("unsupported import format: %s", format)
+}
+
+/**
+ * Create notes for items not previously imported by the author, in
+ * batched transactions, then rewrite links and index the new notes in a
+ * single batch.  idx may be nil, in which case the index must be rebuilt.
+ */
+func ImportItems(db *sql.DB, idx bleve.Index, authorId int, items []Item, rewrite LinkRewriter, report *Report) error {
+	noteIds := make(map[string]int)
+	var newItems []*Item
+	for i := range items {
+		item := &items[i]
+		noteId, err := notes.GetImportedNote(db, authorId, item.Hash)
+		if err != nil {
+			return err
+		}
+		if noteId != 0 {
+			noteIds[item.Source] = noteId
+			report.Skipped = append(report.Skipped, ReportEntry{
+				Message: "already imported", NoteId: noteId, Source: item.Source,
+			})
+			continue
+		}
+		newItems = append(newItems, item)
+	}
+
+	var createdIds []int
+	for start := 0; start < len(newItems); start += IMPORT_BATCH_SIZE {
+		end := start + IMPORT_BATCH_SIZE
+		if end > len(newItems) {
+			end = len(newItems)
+		}
+		ids, err := createBatch(db, authorId, newItems[start:end])
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			noteIds[newItems[start+i].Source] = id
+			report.Imported = append(report.Imported, ReportEntry{NoteId: id, Source: newItems[start+i].Source})
+		}
+		createdIds = append(createdIds, ids...)
+	}
+
+	if rewrite != nil {
+		if err := rewriteBatch(db, authorId, newItems, noteIds, rewrite); err != nil {
+			return err
+		}
+	}
+
+	if idx == nil || len(createdIds) == 0 {
+		return nil
+	}
+	return index.IndexNotes(idx, db, createdIds)
+}
+
+func createBatch(db *sql.DB, authorId int, items []*Item) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, item := range items {
+		noteId, err := notes.CreateNote(tx, &notes.NoteRecord{
+			Author:     authorId,
+			Content:    item.Content,
+			Created:    item.Created,
+			Privacy:    item.Privacy,
+			RenderHint: item.RenderHint,
+		})
+		if err == nil {
+			err = notes.SetNoteTags(tx, noteId, item.Tags)
+		}
+		for _, attachment := range item.Attachments {
+			if err != nil {
+				break
+			}
+			attachment.Note = noteId
+			err = notes.CreateAttachment(tx, &attachment)
+		}
+		if err == nil {
+			err = notes.RecordImport(tx, authorId, item.Hash, noteId)
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		ids = append(ids, noteId)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	notes.PublishEvents(db)
+	return ids, nil
+}
+
+/**
+ * Name an attachment uniquely among the used names of its note, as
+ * name-2.ext and so on, and report when it had to be renamed.
+ */
+func renameAttachment(name string, used map[string]bool, source string, report *Report) string {
+	unique := name
+	ext := path.Ext(name)
+	for n := 2; used[unique]; n++ {
+		unique = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext)
+	}
+	used[unique] = true
+	if unique != name {
+		report.Warnings = append(report.Warnings, ReportEntry{
+			Message: "renamed attachment " + name + " to " + unique, Source: source,
+		})
+	}
+	return unique
+}
+
+func rewriteBatch(db *sql.DB, authorId int, items []*Item, noteIds map[string]int, rewrite LinkRewriter) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		content, changed := rewrite(item, noteIds)
+		if !changed {
+			continue
+		}
+		if err = notes.UpdateNoteContent(tx, authorId, noteIds[item.Source], content); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	notes.PublishEvents(db)
+	return nil
+}
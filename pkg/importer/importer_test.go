@@ -0,0 +1,171 @@
+package importer
+
+import (
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ImportsMarkdownVault(t *testing.T) {
+	tmpDirName := t.TempDir()
+	db, _ := notes.CreateNoteDb(tmpDirName + "/notes.sqlite3")
+	defer db.Close()
+	authorId, _ := notes.CreateAuthor(db, "Test Author", "")
+	idx, err := index.CreateIndex(tmpDirName+"/notes.sqlite3", tmpDirName+"/notes.index")
+	if err != nil {
+		t.Fatalf("Cannot create index %s", err)
+	}
+	defer idx.Close()
+
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	vault := fstest.MapFS{
+		"Daily.md": {
+			Data: []byte("---\ndate: 2024-03-01\ntags: [work, Standup]\nprivacy: private\n---\n" +
+				"# Daily\nSee [[Projects/Roadmap|the roadmap]] and [old](Projects/Roadmap.md)."),
+			ModTime: modTime,
+		},
+		"Projects/Roadmap.md": {Data: []byte("# Roadmap\nback to [daily](../Daily.md)"), ModTime: modTime},
+		"Projects/logo.png":   {Data: []byte{0x89}, ModTime: modTime},
+		".obsidian/app.json":  {Data: []byte("{}"), ModTime: modTime},
+	}
+
+	report, err := ImportMarkdown(db, idx, authorId, vault)
+	assert.Nil(t, err, "Unexpected error on import")
+	assert.Equal(t, 2, len(report.Imported), "Imported markdown files")
+	assert.Equal(t, 1, len(report.Skipped), "Skipped non-markdown files")
+
+	dailyId, roadmapId := report.Imported[0].NoteId, report.Imported[1].NoteId
+	daily, err := notes.GetNote(db, authorId, dailyId)
+	assert.Nil(t, err, "Unexpected error on note retrieval")
+	assert.Equal(t, "# Daily\nSee [the roadmap](note:2) and [old](note:2).", daily.Content)
+	assert.Equal(t, notes.PRIVATE_ACCESS, daily.Privacy)
+	assert.Equal(t, int(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).Unix()), daily.Created)
+	tags, _ := notes.GetNoteTags(db, dailyId)
+	assert.Equal(t, []string{"standup", "work"}, tags)
+
+	roadmap, _ := notes.GetNote(db, authorId, roadmapId)
+	assert.Equal(t, "# Roadmap\nback to [daily](note:1)", roadmap.Content)
+	assert.Equal(t, int(modTime.Unix()), roadmap.Created)
+
+	docCount, _ := idx.DocCount()
+	assert.Equal(t, uint64(2), docCount, "Indexed imported notes")
+
+	report, err = ImportMarkdown(db, idx, authorId, vault)
+	assert.Nil(t, err, "Unexpected error on re-import")
+	assert.Equal(t, 0, len(report.Imported), "Re-import is idempotent")
+	assert.Equal(t, 3, len(report.Skipped), "Re-import skips imported files")
+}
+
+func Test_ConvertsEnml(t *testing.T) {
+	media := map[string]notes.AttachmentRecord{
+		"0123abcd": {Name: "cat.png", MimeType: "image/png"},
+	}
+	enml := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE en-note SYSTEM "http://xml.evernote.com/pub/enml2.dtd">
+<en-note><div><b>Bold</b> and <i>italic</i>&nbsp;text</div>
+<div><en-todo checked="true"/>done</div>
+<ul><li>one</li><li>two<ol><li>nested</li></ol></li></ul>
+<div>See <a href="https://example.com">example</a> <u>underlined</u></div>
+<en-media hash="0123ABCD" type="image/png"/>
+<table><tr><th>a</th><th>b</th></tr><tr><td>1</td><td>2</td></tr></table>
+<en-crypt>secret</en-crypt></en-note>`
+
+	markdown, lossy, err := ConvertEnml(enml, media)
+	assert.Nil(t, err, "Unexpected error converting ENML")
+	assert.Equal(t, "**Bold** and *italic* text\n"+
+		"- [x] done\n"+
+		"- one\n- two\n  1. nested\n\n"+
+		"See [example](https://example.com) underlined\n"+
+		"![cat.png](attachment:cat.png)\n\n"+
+		"| a | b |\n| --- | --- |\n| 1 | 2 |\n", markdown)
+	assert.Equal(t, []string{"en-crypt", "u"}, lossy)
+}
+
+func Test_ImportsEnex(t *testing.T) {
+	db, _ := notes.CreateNoteDb(":memory:")
+	defer db.Close()
+	authorId, _ := notes.CreateAuthor(db, "Test Author", "")
+
+	enex := `<?xml version="1.0" encoding="UTF-8"?>
+<en-export>
+<note><title>Trip</title>
+<content><![CDATA[<en-note><div>Packing <en-media hash="acbd18db4cc2f85cedef654fccc4a4d8" type="text/plain"/>
+<en-media hash="37b51d194a7513e45b56f6524f2d51f2" type="text/plain"/></div></en-note>]]></content>
+<created>20130730T205204Z</created><tag>travel</tag>
+<resource><data encoding="base64">Zm9v</data><mime>text/plain</mime>
+<resource-attributes><file-name>list.txt</file-name></resource-attributes></resource>
+<resource><data encoding="base64">YmFy</data><mime>text/plain</mime>
+<resource-attributes><file-name>list.txt</file-name></resource-attributes></resource>
+</note>
+<note><title>Bad date</title><content><![CDATA[<en-note/>]]></content><created>yesterday</created></note>
+</en-export>`
+
+	report, err := ImportEnex(db, nil, authorId, strings.NewReader(enex))
+	assert.Nil(t, err, "Unexpected error on ENEX import")
+	assert.Equal(t, 1, len(report.Imported), "Imported valid notes")
+	assert.Equal(t, 1, len(report.Skipped), "Reported invalid notes")
+
+	noteId := report.Imported[0].NoteId
+	note, _ := notes.GetNote(db, authorId, noteId)
+	assert.Equal(t, "# Trip\n\nPacking [list.txt](attachment:list.txt) [list-2.txt](attachment:list-2.txt)\n",
+		note.Content)
+	assert.Equal(t, int(time.Date(2013, 7, 30, 20, 52, 4, 0, time.UTC).Unix()), note.Created)
+	attachments, _ := notes.GetAttachments(db, noteId)
+	assert.Equal(t, 2, len(attachments), "Kept resources as attachments")
+	assert.Equal(t, "bar", string(attachments[0].Content), "Expected resources of the same name both kept")
+	assert.Equal(t, "foo", string(attachments[1].Content))
+	assert.Equal(t, []ReportEntry{{Message: "renamed attachment list.txt to list-2.txt", Source: "note 1: Trip"}},
+		report.Warnings)
+	tags, _ := notes.GetNoteTags(db, noteId)
+	assert.Equal(t, []string{"travel"}, tags)
+}
+
+func Test_ImportsJoplin(t *testing.T) {
+	db, _ := notes.CreateNoteDb(":memory:")
+	defer db.Close()
+	authorId, _ := notes.CreateAuthor(db, "Test Author", "")
+
+	noteA := strings.Repeat("a", 32)
+	noteB := strings.Repeat("b", 32)
+	folder := strings.Repeat("c", 32)
+	resource := strings.Repeat("d", 32)
+	other := strings.Repeat("e", 32)
+	export := fstest.MapFS{
+		noteA + ".md": {Data: []byte("Meeting\n\nSee [plan](:/" + noteB + ") and ![img](:/" + resource + ") ![img](:/" + other + ")\n\n" +
+			"id: " + noteA + "\nparent_id: " + folder + "\ncreated_time: 2019-01-01T12:00:00.000Z\nis_todo: 1\ntype_: 1")},
+		noteB + ".json": {Data: []byte(`{"id": "` + noteB + `", "title": "Plan", "body": "steps",
+			"created_time": 1546430400000, "type_": 1}`)},
+		folder + ".md":                   {Data: []byte("Work\n\nid: " + folder + "\ntype_: 2")},
+		resource + ".md":                 {Data: []byte("photo.png\n\nid: " + resource + "\nmime: image/png\nfile_extension: png\ntype_: 4")},
+		"resources/" + resource + ".png": {Data: []byte{0x89, 0x50}},
+		other + ".md":                    {Data: []byte("photo.png\n\nid: " + other + "\nmime: image/png\nfile_extension: png\ntype_: 4")},
+		"resources/" + other + ".png":    {Data: []byte{0x89, 0x51}},
+		"settings.md":                    {Data: []byte("x\n\nid: 1\ntype_: 3")},
+	}
+
+	report, err := ImportJoplin(db, nil, authorId, export)
+	assert.Nil(t, err, "Unexpected error on Joplin import")
+	assert.Equal(t, 2, len(report.Imported), "Imported notes")
+	assert.Equal(t, 1, len(report.Skipped), "Skipped unsupported items")
+	assert.Equal(t, 2, len(report.Warnings), "Reported dropped to-do state and renamed attachment")
+
+	meetingId, planId := report.Imported[0].NoteId, report.Imported[1].NoteId
+	meeting, _ := notes.GetNote(db, authorId, meetingId)
+	assert.Equal(t, "# Meeting\n\nSee [plan](note:"+strconv.Itoa(planId)+") and ![img](attachment:photo.png) ![img](attachment:photo-2.png)",
+		meeting.Content)
+	assert.Equal(t, int(time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC).Unix()), meeting.Created)
+	tags, _ := notes.GetNoteTags(db, meetingId)
+	assert.Equal(t, []string{"work"}, tags)
+	attachments, _ := notes.GetAttachments(db, meetingId)
+	assert.Equal(t, 2, len(attachments), "Kept resources of the same name as attachments")
+
+	plan, _ := notes.GetNote(db, authorId, planId)
+	assert.Equal(t, "# Plan\n\nsteps", plan.Content)
+}
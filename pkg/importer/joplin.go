@@ -0,0 +1,265 @@
+package importer
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"org/bredin/go-notes/pkg/notes"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+const JOPLIN_NOTE = "1"
+const JOPLIN_FOLDER = "2"
+const JOPLIN_RESOURCE = "4"
+const JOPLIN_TAG = "5"
+const JOPLIN_NOTE_TAG = "6"
+
+var joplinLinkRegexp = regexp.MustCompile(`\]\(:/([0-9a-f]{32})\)`)
+var joplinMetadataRegexp = regexp.MustCompile(`^([a-z_]+): ?(.*)$`)
+
+type joplinItem map[string]string
+
+func ImportJoplinDir(db *sql.DB, idx bleve.Index, authorId int, dirName string) (*Report, error) {
+	return ImportJoplin(db, idx, authorId, os.DirFS(dirName))
+}
+
+func ImportJoplinZip(db *sql.DB, idx bleve.Index, authorId int, r io.ReaderAt, size int64) (*Report, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return ImportJoplin(db, idx, authorId, zr)
+}
+
+/**
+ * Import a Joplin raw (.md) or JSON export.  Notebooks are mapped to tags,
+ * resources referenced by a note become its attachments, and links
+ * between notes become internal note links.
+ */
+func ImportJoplin(db *sql.DB, idx bleve.Index, authorId int, fsys fs.FS) (*Report, error) {
+	var report Report
+	itemsByType := make(map[string][]joplinItem)
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		ext := path.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".md" && ext != ".json") {
+			continue
+		}
+		raw, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		item, err := parseJoplinItem(entry.Name(), raw)
+		if err != nil {
+			report.Skipped = append(report.Skipped, ReportEntry{Message: err.Error(), Source: entry.Name()})
+			continue
+		}
+		if item["encryption_applied"] == "1" {
+			report.Skipped = append(report.Skipped, ReportEntry{Message: "encrypted item", Source: entry.Name()})
+			continue
+		}
+		item["hash"] = ContentHash(raw)
+		itemsByType[item["type_"]] = append(itemsByType[item["type_"]], item)
+	}
+
+	folders := make(map[string]string)
+	for _, folder := range itemsByType[JOPLIN_FOLDER] {
+		folders[folder["id"]] = folder["title"]
+	}
+	tagNames := make(map[string]string)
+	for _, tag := range itemsByType[JOPLIN_TAG] {
+		tagNames[tag["id"]] = tag["title"]
+	}
+	noteTags := make(map[string][]string)
+	for _, noteTag := range itemsByType[JOPLIN_NOTE_TAG] {
+		if name, ok := tagNames[noteTag["tag_id"]]; ok {
+			noteTags[noteTag["note_id"]] = append(noteTags[noteTag["note_id"]], name)
+		}
+	}
+	resources := make(map[string]notes.AttachmentRecord)
+	for _, resource := range itemsByType[JOPLIN_RESOURCE] {
+		attachment, err := readJoplinResource(fsys, resource)
+		if err != nil {
+			report.Warnings = append(report.Warnings, ReportEntry{
+				Message: "missing resource: " + err.Error(), Source: resource["id"],
+			})
+			continue
+		}
+		resources[resource["id"]] = *attachment
+	}
+	for itemType, items := range itemsByType {
+		switch itemType {
+		case JOPLIN_NOTE, JOPLIN_FOLDER, JOPLIN_RESOURCE, JOPLIN_TAG, JOPLIN_NOTE_TAG:
+			continue
+		}
+		for _, item := range items {
+			report.Skipped = append(report.Skipped, ReportEntry{
+				Message: "unsupported item type " + itemType, Source: item["id"],
+			})
+		}
+	}
+
+	var items []Item
+	for _, note := range itemsByType[JOPLIN_NOTE] {
+		items = append(items, joplinNoteItem(note, folders, noteTags, resources, &report))
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Created < items[j].Created
+	})
+
+	rewrite := func(item *Item, noteIds map[string]int) (string, bool) {
+		changed := false
+		content := joplinLinkRegexp.ReplaceAllStringFunc(item.Content, func(link string) string {
+			id := joplinLinkRegexp.FindStringSubmatch(link)[1]
+			if noteId, ok := noteIds[id]; ok {
+				changed = true
+				return "](" + notes.NoteLink(noteId) + ")"
+			}
+			return link
+		})
+		return content, changed
+	}
+	if err = ImportItems(db, idx, authorId, items, rewrite, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func joplinNoteItem(note joplinItem, folders map[string]string, noteTags map[string][]string,
+	resources map[string]notes.AttachmentRecord, report *Report) Item {
+	source := note["id"]
+	item := Item{
+		Content:    note["body"],
+		Created:    int(time.Now().Unix()),
+		Hash:       note["hash"],
+		Privacy:    notes.DEFAULT_ACCESS,
+		RenderHint: 1,
+		Source:     source,
+		Tags:       noteTags[source],
+	}
+	if title := strings.TrimSpace(note["title"]); title != "" {
+		item.Content = "# " + title + "\n\n" + item.Content
+	}
+	for _, key := range []string{"user_created_time", "created_time"} {
+		if created, err := parseJoplinTime(note[key]); err == nil {
+			item.Created = int(created.Unix())
+			break
+		}
+	}
+	if folder, ok := folders[note["parent_id"]]; ok {
+		item.Tags = append(item.Tags, folder)
+	}
+	names := make(map[string]string)
+	usedNames := make(map[string]bool)
+	for _, match := range joplinLinkRegexp.FindAllStringSubmatch(note["body"], -1) {
+		attachment, ok := resources[match[1]]
+		if !ok || names[match[1]] != "" {
+			continue
+		}
+		attachment.Name = renameAttachment(attachment.Name, usedNames, source, report)
+		names[match[1]] = attachment.Name
+		item.Attachments = append(item.Attachments, attachment)
+	}
+	item.Content = joplinLinkRegexp.ReplaceAllStringFunc(item.Content, func(link string) string {
+		if name, ok := names[joplinLinkRegexp.FindStringSubmatch(link)[1]]; ok {
+			return "](" + notes.AttachmentLink(name) + ")"
+		}
+		return link
+	})
+
+	if note["markup_language"] == "2" {
+		report.Warnings = append(report.Warnings, ReportEntry{Message: "HTML note kept as-is", Source: source})
+	}
+	if note["is_todo"] == "1" {
+		report.Warnings = append(report.Warnings, ReportEntry{Message: "dropped to-do state", Source: source})
+	}
+	return item
+}
+
+/**
+ * Parse a Joplin item: either a JSON object, or the raw format of a title
+ * line, optional body, and trailing `key: value` metadata lines.
+ */
+func parseJoplinItem(fileName string, raw []byte) (joplinItem, error) {
+	item := make(joplinItem)
+	if path.Ext(fileName) == ".json" {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		for key, value := range fields {
+			switch v := value.(type) {
+			case float64:
+				item[key] = strconv.FormatInt(int64(v), 10)
+			case string:
+				item[key] = v
+			case nil:
+			default:
+				item[key] = fmt.Sprint(v)
+			}
+		}
+	} else {
+		lines := strings.Split(strings.ReplaceAll(string(raw), "\r\n", "\n"), "\n")
+		for len(lines) > 0 && lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		end := len(lines)
+		for end > 0 {
+			match := joplinMetadataRegexp.FindStringSubmatch(lines[end-1])
+			if match == nil {
+				break
+			}
+			item[match[1]] = match[2]
+			end--
+		}
+		content := strings.TrimRight(strings.Join(lines[:end], "\n"), "\n")
+		parts := strings.SplitN(content, "\n", 2)
+		item["title"] = parts[0]
+		if len(parts) > 1 {
+			item["body"] = strings.TrimPrefix(parts[1], "\n")
+		}
+	}
+
+	if item["id"] == "" || item["type_"] == "" {
+		return nil, fmt.Errorf("not a Joplin item")
+	}
+	return item, nil
+}
+
+func parseJoplinTime(value string) (time.Time, error) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func readJoplinResource(fsys fs.FS, resource joplinItem) (*notes.AttachmentRecord, error) {
+	fileName := resource["id"]
+	if ext := resource["file_extension"]; ext != "" {
+		fileName += "." + ext
+	}
+	content, err := fs.ReadFile(fsys, path.Join("resources", fileName))
+	if err != nil {
+		return nil, err
+	}
+
+	name := resource["title"]
+	if name == "" {
+		name = fileName
+	}
+	return &notes.AttachmentRecord{Content: content, MimeType: resource["mime"], Name: path.Base(name)}, nil
+}
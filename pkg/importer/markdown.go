@@ -0,0 +1,191 @@
+package importer
+
+import (
+	"archive/zip"
+	"database/sql"
+	"io"
+	"io/fs"
+	"net/url"
+	"org/bredin/go-notes/pkg/frontmatter"
+	"org/bredin/go-notes/pkg/notes"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+var markdownLinkRegexp = regexp.MustCompile(`(!?)\[([^\]]*)\]\(([^)\s]+)\)`)
+var wikiLinkRegexp = regexp.MustCompile(`(!?)\[\[([^\]|#]+)(#[^\]|]*)?(?:\|([^\]]+))?\]\]`)
+
+func ImportMarkdownDir(db *sql.DB, idx bleve.Index, authorId int, dirName string) (*Report, error) {
+	return ImportMarkdown(db, idx, authorId, os.DirFS(dirName))
+}
+
+func ImportMarkdownZip(db *sql.DB, idx bleve.Index, authorId int, r io.ReaderAt, size int64) (*Report, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return ImportMarkdown(db, idx, authorId, zr)
+}
+
+/**
+ * Import every Markdown file in fsys, such as an exported archive or an
+ * Obsidian vault.  Relative and wiki links between imported files are
+ * rewritten to internal note links.
+ */
+func ImportMarkdown(db *sql.DB, idx bleve.Index, authorId int, fsys fs.FS) (*Report, error) {
+	var report Report
+	var items []Item
+	err := fs.WalkDir(fsys, ".", func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath != "." && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if !isMarkdownFile(filePath) {
+			report.Skipped = append(report.Skipped, ReportEntry{Message: "not markdown", Source: filePath})
+			return nil
+		}
+
+		item, err := readMarkdownItem(fsys, filePath, entry, &report)
+		if err != nil {
+			return err
+		}
+		items = append(items, *item)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ImportItems(db, idx, authorId, items, newMarkdownLinkRewriter(), &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+func isMarkdownFile(filePath string) bool {
+	ext := strings.ToLower(path.Ext(filePath))
+	return ext == ".md" || ext == ".markdown"
+}
+
+func readMarkdownItem(fsys fs.FS, filePath string, entry fs.DirEntry, report *Report) (*Item, error) {
+	raw, err := fs.ReadFile(fsys, filePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := entry.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	item := Item{
+		Content:    string(raw),
+		Created:    int(info.ModTime().Unix()),
+		Hash:       ContentHash(raw),
+		Privacy:    notes.DEFAULT_ACCESS,
+		RenderHint: 1,
+		Source:     filePath,
+	}
+	fm, body, err := frontmatter.Parse(item.Content)
+	if err != nil {
+		report.Warnings = append(report.Warnings, ReportEntry{
+			Message: "ignoring front matter: " + err.Error(), Source: filePath,
+		})
+		return &item, nil
+	}
+	if fm == nil {
+		return &item, nil
+	}
+
+	item.Content = body
+	item.Tags = fm.Tags
+	if !fm.Created.IsZero() {
+		item.Created = int(fm.Created.Unix())
+	}
+	if fm.RenderHint != nil {
+		item.RenderHint = *fm.RenderHint
+	}
+	if fm.Privacy != "" {
+		if item.Privacy, err = notes.ParsePrivacy(fm.Privacy); err != nil {
+			item.Privacy = notes.DEFAULT_ACCESS
+			report.Warnings = append(report.Warnings, ReportEntry{Message: err.Error(), Source: filePath})
+		}
+	}
+	return &item, nil
+}
+
+type markdownLinkRewriter struct {
+	byName map[string]int
+}
+
+func newMarkdownLinkRewriter() LinkRewriter {
+	rewriter := markdownLinkRewriter{}
+	return rewriter.rewrite
+}
+
+func (r *markdownLinkRewriter) rewrite(item *Item, noteIds map[string]int) (string, bool) {
+	if r.byName == nil {
+		r.byName = make(map[string]int)
+		for source, noteId := range noteIds {
+			r.byName[markdownBaseName(source)] = noteId
+		}
+	}
+
+	changed := false
+	content := markdownLinkRegexp.ReplaceAllStringFunc(item.Content, func(link string) string {
+		match := markdownLinkRegexp.FindStringSubmatch(link)
+		if match[1] != "" {
+			return link
+		}
+		target, err := url.PathUnescape(strings.SplitN(match[3], "#", 2)[0])
+		if err != nil || target == "" || strings.Contains(target, ":") {
+			return link
+		}
+		resolved := path.Join(path.Dir(item.Source), target)
+		noteId, ok := noteIds[resolved]
+		if !ok {
+			noteId, ok = noteIds[resolved+".md"]
+		}
+		if !ok {
+			return link
+		}
+		changed = true
+		return "[" + match[2] + "](" + notes.NoteLink(noteId) + ")"
+	})
+	content = wikiLinkRegexp.ReplaceAllStringFunc(content, func(link string) string {
+		match := wikiLinkRegexp.FindStringSubmatch(link)
+		if match[1] != "" {
+			return link
+		}
+		noteId, ok := r.byName[markdownBaseName(match[2])]
+		if !ok {
+			return link
+		}
+		text := match[4]
+		if text == "" {
+			text = strings.TrimSpace(match[2])
+		}
+		changed = true
+		return "[" + text + "](" + notes.NoteLink(noteId) + ")"
+	})
+	return content, changed
+}
+
+func markdownBaseName(filePath string) string {
+	name := path.Base(strings.TrimSpace(filePath))
+	if isMarkdownFile(name) {
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+	return strings.ToLower(name)
+}
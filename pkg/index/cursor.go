@@ -0,0 +1,35 @@
+package index
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+/**
+ * Sort key of the last hit on a page. Keys may hold binary-encoded
+ * numbers and dates, so each one is base64 encoded separately.
+ */
+type SearchCursor struct {
+	Sort []string
+}
+
+func ParseSearchCursor(cursor string) (*SearchCursor, error) {
+	var sort []string
+	for _, field := range strings.Split(cursor, ".") {
+		decoded, err := base64.RawURLEncoding.DecodeString(field)
+		if err != nil {
+			return nil, fmt.Errorf("malformed cursor: %s", cursor)
+		}
+		sort = append(sort, string(decoded))
+	}
+	return &SearchCursor{Sort: sort}, nil
+}
+
+func (c SearchCursor) String() string {
+	fields := make([]string, len(c.Sort))
+	for i, value := range c.Sort {
+		fields[i] = base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return strings.Join(fields, ".")
+}
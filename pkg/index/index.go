@@ -2,6 +2,7 @@ package index
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"org/bredin/go-notes/pkg/notes"
 	"strconv"
@@ -9,13 +10,46 @@ import (
 	"time"
 
 	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/standard"
+	"github.com/blevesearch/bleve/v2/analysis/token/edgengram"
+	"github.com/blevesearch/bleve/v2/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/v2/analysis/token/truncate"
+	"github.com/blevesearch/bleve/v2/analysis/tokenizer/unicode"
+	"github.com/blevesearch/bleve/v2/mapping"
 	_ "github.com/mattn/go-sqlite3"
 	stripmd "github.com/writeas/go-strip-markdown"
 )
 
+const DEFAULT_SEARCH_SIZE = 10
+const INDEX_BATCH_SIZE = 100
+const SNIPPET_LENGTH = 200
+
+type NoteDocument struct {
+	Author   string
+	AuthorId string
+	Comments []string
+	Content  string
+	Created  time.Time
+	Id       string
+	Language string
+	Notebook string
+	Privacy  string
+	Tags     []string
+	Title    string
+}
+
+/**
+ * Index a note with the document type of its language's analyzer.
+ */
+func (doc NoteDocument) BleveType() string {
+	return LanguageAnalyzer(doc.Language)
+}
+
 type SearchHit struct {
-	Id    string
-	Score float64
+	Fragments map[string][]string `json:",omitempty"`
+	Id        string
+	Score     float64
 }
 
 /**
@@ -31,84 +65,258 @@ func CreateIndex(dbFileName string, indexDirName string) (bleve.Index, error) {
 		db.Close()
 	}(db)
 
-	indexMapping := bleve.NewIndexMapping()
-	index, err := bleve.New(indexDirName, indexMapping)
+	index, err := bleve.New(indexDirName, NewIndexMapping())
 	if err != nil {
 		return nil, err
 	}
+	if err = index.SetInternal([]byte(MAPPING_VERSION_KEY), []byte(MAPPING_VERSION)); err != nil {
+		return nil, err
+	}
 
-	rows, err := db.Query("SELECT rowId, author, content, created FROM notes")
+	rows, err := db.Query("SELECT rowId FROM notes")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	type noteRecord struct {
-		Author  int
-		Content string
-		Created int64
-		Id      int
-	}
-	type noteIndex struct {
-		Author  string
-		Content string
-		Created time.Time
-		Id      string
-		Title   string
-	}
-	note := noteRecord{}
-	noteI := noteIndex{}
+	var noteIds []int
+	var noteId int
 	for rows.Next() {
-		if err := rows.Scan(&note.Id, &note.Author, &note.Content, &note.Created); err != nil {
-			return nil, err
-		}
-
-		noteI.Id = strconv.Itoa(note.Id)
-		noteI.Content = stripmd.Strip(note.Content)
-		noteI.Created = time.Unix(note.Created, 0)
-		noteI.Title = GetTitleFromContent(note.Content)
-
-		author, err := notes.GetAuthor(db, note.Author)
-		if err != nil {
-			log.Fatalf("Cannot find author %d: %s", note.Author, err.Error())
-		}
-		noteI.Author = author.Name
-
-		if err := index.Index(noteI.Id, noteI); err != nil {
+		if err := rows.Scan(&noteId); err != nil {
 			return nil, err
 		}
+		noteIds = append(noteIds, noteId)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	rows.Close()
 
+	for start := 0; start < len(noteIds); start += INDEX_BATCH_SIZE {
+		end := start + INDEX_BATCH_SIZE
+		if end > len(noteIds) {
+			end = len(noteIds)
+		}
+		if err := IndexNotes(index, db, noteIds[start:end]); err != nil {
+			return nil, err
+		}
+	}
 	return index, nil
 }
 
+/**
+ * Return the start of the note body after its title line as plain text,
+ * cut at a word boundary near SNIPPET_LENGTH characters, or at
+ * SNIPPET_LENGTH when no word ends near it.
+ */
+func GetSnippetFromContent(content string) string {
+	lines := strings.SplitN(content, "\n", 2)
+	if len(lines) < 2 {
+		return ""
+	}
+	snippet := []rune(strings.Join(strings.Fields(stripmd.Strip(lines[1])), " "))
+	if len(snippet) <= SNIPPET_LENGTH {
+		return string(snippet)
+	}
+	cut := SNIPPET_LENGTH
+	for cut > SNIPPET_LENGTH/2 && snippet[cut] != ' ' {
+		cut--
+	}
+	if snippet[cut] != ' ' {
+		cut = SNIPPET_LENGTH
+	}
+	return strings.TrimSpace(string(snippet[:cut])) + "…"
+}
+
 func GetTitleFromContent(content string) string {
 	lines := strings.SplitN(content, "\n", 2)
 	return strings.TrimSpace(
 		stripmd.Strip(lines[0]))
 }
 
+/**
+ * Index the given notes in a single batch.
+ */
+func IndexNotes(index bleve.Index, db *sql.DB, noteIds []int) error {
+	batch := index.NewBatch()
+	authorNames := make(map[int]string)
+	for _, noteId := range noteIds {
+		var authorId, created, privacy int
+		var content string
+		err := db.QueryRow("SELECT author, content, created, IFNULL(privacy,0) FROM notes WHERE rowid = ?", noteId).
+			Scan(&authorId, &content, &created, &privacy)
+		if err != nil {
+			return err
+		}
+		tags, err := notes.GetNoteTags(db, noteId)
+		if err != nil {
+			return err
+		}
+		notebook, err := notes.GetNoteNotebook(db, noteId)
+		if err != nil {
+			return err
+		}
+		language, err := notes.GetNoteLanguage(db, noteId)
+		if err != nil {
+			return err
+		}
+		comments, err := notes.GetCommentContents(db, noteId)
+		if err != nil {
+			return err
+		}
+
+		authorName, ok := authorNames[authorId]
+		if !ok {
+			author, err := notes.GetAuthor(db, authorId)
+			if err != nil {
+				return err
+			}
+			if author == nil {
+				return fmt.Errorf("cannot find author %d of note %d", authorId, noteId)
+			}
+			authorName = author.Name
+			authorNames[authorId] = authorName
+		}
+
+		doc := NewNoteDocument(noteId, authorName, content, created)
+		doc.AuthorId = strconv.Itoa(authorId)
+		if language != notes.AUTO_LANGUAGE {
+			doc.Language = language
+		}
+		for _, comment := range comments {
+			doc.Comments = append(doc.Comments, stripmd.Strip(comment))
+		}
+		doc.Notebook = notebook
+		doc.Privacy = notes.PrivacyName(privacy)
+		doc.Tags = tags
+		if err = batch.Index(doc.Id, doc); err != nil {
+			return err
+		}
+	}
+	return index.Batch(batch)
+}
+
+/**
+ * Map note documents so that author, language, notebook, privacy and tags
+ * can be filtered and faceted on whole values while the author stays
+ * searchable as text.  Each analyzer of a supported language has its own
+ * document type analyzing content, title and comments, chosen by the
+ * document's language.  Titles and author names are copied to TitleSuggest and
+ * AuthorSuggest split into prefixes for suggestions.  Creation time is
+ * copied to CreatedFacet because bleve counts a date facet twice when
+ * results are also sorted on the same field.  Author ids are kept apart
+ * from names, which need not be unique, to filter readable notes.
+ */
+func NewIndexMapping() mapping.IndexMapping {
+	indexMapping := bleve.NewIndexMapping()
+	err := indexMapping.AddCustomTokenFilter(SUGGEST_ANALYZER, map[string]interface{}{
+		"type": edgengram.Name,
+		"min":  float64(SUGGEST_MIN_PREFIX),
+		"max":  float64(SUGGEST_MAX_PREFIX),
+	})
+	if err == nil {
+		err = indexMapping.AddCustomAnalyzer(SUGGEST_ANALYZER, map[string]interface{}{
+			"type":          custom.Name,
+			"tokenizer":     unicode.Name,
+			"token_filters": []string{lowercase.Name, SUGGEST_ANALYZER},
+		})
+	}
+	if err == nil {
+		err = indexMapping.AddCustomTokenFilter(SUGGEST_QUERY_ANALYZER, map[string]interface{}{
+			"type":   truncate.Name,
+			"length": float64(SUGGEST_MAX_PREFIX),
+		})
+	}
+	if err == nil {
+		err = indexMapping.AddCustomAnalyzer(SUGGEST_QUERY_ANALYZER, map[string]interface{}{
+			"type":          custom.Name,
+			"tokenizer":     unicode.Name,
+			"token_filters": []string{lowercase.Name, SUGGEST_QUERY_ANALYZER},
+		})
+	}
+	if err != nil {
+		log.Fatalf("Cannot define suggestion analyzers: %s", err.Error())
+	}
+	indexMapping.DefaultMapping = newNoteMapping(standard.Name)
+	for _, analyzer := range indexedAnalyzers() {
+		indexMapping.AddDocumentMapping(analyzer, newNoteMapping(analyzer))
+	}
+	return indexMapping
+}
+
+/**
+ * Build the document of a note in its detected language.
+ */
+func NewNoteDocument(noteId int, authorName string, content string, created int) NoteDocument {
+	plainContent := stripmd.Strip(content)
+	return NoteDocument{
+		Author:   authorName,
+		Content:  plainContent,
+		Created:  time.Unix(int64(created), 0),
+		Id:       strconv.Itoa(noteId),
+		Language: DetectLanguage(plainContent),
+		Title:    GetTitleFromContent(content),
+	}
+}
+
 func OpenIndex(indexFileName string) (bleve.Index, error) {
 	return bleve.Open(indexFileName)
 }
 
+/**
+ * Search with bleve's query string syntax, with words analyzed as in each
+ * language's notes.
+ */
 func SearchIndex(index *bleve.Index, searchStr string) ([]SearchHit, error) {
-	query := bleve.NewQueryStringQuery(searchStr)
-	searchRequest := bleve.NewSearchRequest(query)
-	searchResult, err := (*index).Search(searchRequest)
+	query, err := newQueryStringQuery(searchStr)
 	if err != nil {
 		return nil, err
 	}
-
-	// TODO: trim for readability
-	// how to avoid non-readable documents crowding out results?
-	// Require +(Author:<user-id> Author:<shares-user>) ?
-	var searchHits []SearchHit
-	for _, h := range searchResult.Hits {
-		searchHits = append(searchHits, SearchHit{h.ID, h.Score})
+	result, err := SearchNotes(index, query, SearchOptions{Size: DEFAULT_SEARCH_SIZE})
+	if err != nil {
+		return nil, err
 	}
-	return searchHits, nil
+	return result.Hits, nil
+}
+
+func newNoteMapping(analyzer string) *mapping.DocumentMapping {
+	author := bleve.NewTextFieldMapping()
+	author.Analyzer = standard.Name
+	authorKeyword := bleve.NewKeywordFieldMapping()
+	authorKeyword.Name = "AuthorKeyword"
+	authorSuggest := newSuggestFieldMapping("AuthorSuggest")
+	authorId := bleve.NewKeywordFieldMapping()
+	authorId.IncludeInAll = false
+	comments := bleve.NewTextFieldMapping()
+	comments.Analyzer = analyzer
+	content := bleve.NewTextFieldMapping()
+	content.Analyzer = analyzer
+	createdFacet := bleve.NewDateTimeFieldMapping()
+	createdFacet.Name = "CreatedFacet"
+	title := bleve.NewTextFieldMapping()
+	title.Analyzer = analyzer
+	titleSuggest := newSuggestFieldMapping("TitleSuggest")
+
+	noteMapping := bleve.NewDocumentMapping()
+	noteMapping.AddFieldMappingsAt("Author", author, authorKeyword, authorSuggest)
+	noteMapping.AddFieldMappingsAt("AuthorId", authorId)
+	noteMapping.AddFieldMappingsAt("Comments", comments)
+	noteMapping.AddFieldMappingsAt("Content", content)
+	noteMapping.AddFieldMappingsAt("Created", bleve.NewDateTimeFieldMapping(), createdFacet)
+	noteMapping.AddFieldMappingsAt("Language", bleve.NewKeywordFieldMapping())
+	noteMapping.AddFieldMappingsAt("Notebook", bleve.NewKeywordFieldMapping())
+	noteMapping.AddFieldMappingsAt("Privacy", bleve.NewKeywordFieldMapping())
+	noteMapping.AddFieldMappingsAt("Tags", bleve.NewKeywordFieldMapping())
+	noteMapping.AddFieldMappingsAt("Title", title, titleSuggest)
+	return noteMapping
+}
+
+func newSuggestFieldMapping(name string) *mapping.FieldMapping {
+	suggest := bleve.NewTextFieldMapping()
+	suggest.Analyzer = SUGGEST_ANALYZER
+	suggest.IncludeInAll = false
+	suggest.IncludeTermVectors = false
+	suggest.Name = name
+	suggest.Store = false
+	return suggest
 }
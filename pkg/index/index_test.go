@@ -2,9 +2,12 @@ package index
 
 import (
 	"database/sql"
+	"errors"
 	"org/bredin/go-notes/pkg/notes"
+	"strings"
 	"testing"
 
+	"github.com/blevesearch/bleve/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,4 +42,273 @@ func Test_IndexNotesDb(t *testing.T) {
 
 	searchResult, _ := SearchIndex(&index, "ciao")
 	assert.Equal(t, 1, len(searchResult), "Expected only one relevant document")
+
+	orphanId, err := notes.CreateNote(db, &notes.NoteRecord{Author: authorId + 1, Content: "orphan"})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	assert.NotNil(t, IndexNotes(index, db, []int{orphanId}), "Expected an error for a note without author")
+}
+
+func Test_CutsSnippets(t *testing.T) {
+	words := strings.Repeat("lentils ", 30)
+	snippet := GetSnippetFromContent("# Groceries\n\n" + words)
+	assert.Equal(t, strings.TrimSpace(words[:200])+"…", snippet, "Expected snippets cut between words")
+	long := strings.Repeat("x", 150)
+	snippet = GetSnippetFromContent("# Groceries\n\nBuy " + long + long)
+	assert.Equal(t, "Buy "+long+strings.Repeat("x", 46)+"…", snippet, "Expected words longer than half a snippet cut")
+	assert.Equal(t, "", GetSnippetFromContent("# Groceries"))
+}
+
+func Test_ParsesQuerySyntax(t *testing.T) {
+	q, err := ParseQuery(`weekly "status report" author:me author:"Jane Doe" #Work tag:home ` +
+		`after:2024-01-01 before:2024-02-01 privacy:public notebook:Projects http://example.com`)
+	assert.Nil(t, err, "Unexpected error parsing query")
+	assert.Equal(t, &NoteQuery{
+		Authors:       []string{"me", "Jane Doe"},
+		CreatedAfter:  "2024-01-01",
+		CreatedBefore: "2024-02-01",
+		Notebook:      "Projects",
+		Phrases:       []string{"status report"},
+		Privacy:       []string{"public"},
+		Tags:          []string{"#Work", "home"},
+		Text:          "weekly http://example.com",
+	}, q)
+	_, err = q.Query()
+	assert.Nil(t, err, "Unexpected error building query")
+
+	for input, position := range map[string]int{
+		`plans after:yesterday`: 12,
+		`plans "unterminated`:   6,
+		`author: plans`:         0,
+		`privacy:secret`:        8,
+	} {
+		_, err = ParseQuery(input)
+		queryErr, ok := err.(*QueryError)
+		assert.True(t, ok, "Expected a QueryError for %s, got %v", input, err)
+		assert.Equal(t, position, queryErr.Position, input)
+		assert.True(t, errors.Is(err, ErrInvalidSearch))
+	}
+
+	_, err = (&NoteQuery{CreatedAfter: "2024-02-01", CreatedBefore: "2024-01-01"}).Query()
+	queryErr, ok := err.(*QueryError)
+	assert.True(t, ok, "Expected a QueryError, got %v", err)
+	assert.Equal(t, "createdBefore", queryErr.Field)
+}
+
+func Test_FindsRelatedNotes(t *testing.T) {
+	index, err := bleve.NewMemOnly(NewIndexMapping())
+	if err != nil {
+		t.Fatalf("Cannot create index %s", err)
+	}
+	defer index.Close()
+
+	docs := []NoteDocument{
+		NewNoteDocument(1, "Test Author", "# Sourdough\n\nFeed the sourdough starter with rye flour", 0),
+		NewNoteDocument(2, "Test Author", "# Bread\n\nBake sourdough with rye flour", 0),
+		NewNoteDocument(3, "Test Author", "# Garden\n\nWater the tomatoes", 0),
+		NewNoteDocument(4, "Test Author", "# Errands\n\nPost office", 0),
+	}
+	docs[0].Tags = []string{"baking"}
+	docs[3].Tags = []string{"baking"}
+	for _, doc := range docs {
+		assert.Nil(t, index.Index(doc.Id, doc), "Unexpected error indexing")
+	}
+
+	q, err := RelatedQuery(&index, docs[0])
+	assert.Nil(t, err, "Unexpected error building related query")
+	related, err := SearchRelated(&index, q, 10)
+	assert.Nil(t, err, "Unexpected error searching related notes")
+	assert.Equal(t, 2, len(related), "Expected notes sharing terms or tags")
+	assert.Equal(t, "2", related[0].Id)
+	assert.ElementsMatch(t, []string{"sourdough", "rye", "flour"}, related[0].SharedTerms)
+	assert.Equal(t, "Shares terms flour, rye, sourdough", related[0].Reason)
+	assert.Equal(t, "4", related[1].Id)
+	assert.Equal(t, []string{"baking"}, related[1].SharedTags)
+	assert.Equal(t, "Shares tags baking", related[1].Reason)
+
+	q, err = RelatedQuery(&index, docs[2])
+	assert.Nil(t, err, "Unexpected error building related query")
+	assert.Nil(t, q, "Expected no query for a note sharing nothing")
+}
+
+func Test_FiltersReadableNotesByAuthorId(t *testing.T) {
+	index, err := bleve.NewMemOnly(NewIndexMapping())
+	if err != nil {
+		t.Fatalf("Cannot create index %s", err)
+	}
+	defer index.Close()
+
+	docs := []NoteDocument{
+		NewNoteDocument(1, "Sam", "# Mine", 0),
+		NewNoteDocument(2, "Sam", "# Namesake's", 0),
+		NewNoteDocument(3, "Kim", "# Shared", 0),
+		NewNoteDocument(4, "Kim", "# Public", 0),
+	}
+	for i, authorId := range []string{"1", "2", "3", "3"} {
+		docs[i].AuthorId = authorId
+		docs[i].Privacy = []string{"private", "private", "protected", "public"}[i]
+		assert.Nil(t, index.Index(docs[i].Id, docs[i]), "Unexpected error indexing")
+	}
+
+	ids := func(sharerIds []int) []string {
+		result, err := SearchNotes(&index, ReadableQuery(bleve.NewMatchAllQuery(), 1, sharerIds),
+			SearchOptions{Size: 10, Sort: SORT_OLDEST})
+		assert.Nil(t, err, "Unexpected error searching")
+		found := []string{}
+		for _, hit := range result.Hits {
+			found = append(found, hit.Id)
+		}
+		return found
+	}
+	assert.ElementsMatch(t, []string{"1", "4"}, ids([]int{1}), "Expected notes of namesakes hidden")
+	assert.ElementsMatch(t, []string{"1", "3", "4"}, ids([]int{1, 3}))
+}
+
+func Test_AnalyzesByLanguage(t *testing.T) {
+	for text, language := range map[string]string{
+		"The cat is on the table":        "en",
+		"Il gatto è sul tavolo, non qui": "it",
+		"Le chat est sur la table":       "fr",
+		"Die Katze ist auf dem Tisch":    "de",
+		"El gato está en la mesa":        "es",
+		"猫はテーブルの上にいます":                   "ja",
+		"고양이가 탁자 위에 있어요":                 "ko",
+		"猫在桌子上":                          "zh",
+		"hello":                          DEFAULT_LANGUAGE,
+	} {
+		assert.Equal(t, language, DetectLanguage(text), text)
+	}
+
+	index, err := bleve.NewMemOnly(NewIndexMapping())
+	if err != nil {
+		t.Fatalf("Cannot create index %s", err)
+	}
+	defer index.Close()
+	docs := []NoteDocument{
+		NewNoteDocument(1, "Test Author", "# Frutta\n\nLe ragazze mangiano le mele e non le pere, che sono per il gatto", 0),
+		NewNoteDocument(2, "Test Author", "# Fruit\n\nThe girls are eating apples", 0),
+		NewNoteDocument(3, "Test Author", "# 水果\n\n女孩们在吃苹果", 0),
+	}
+	docs[1].Language = "en"
+	for _, doc := range docs {
+		assert.Nil(t, index.Index(doc.Id, doc), "Unexpected error indexing")
+	}
+
+	for searchStr, expected := range map[string][]string{
+		"ragazza mela":          {"1"},
+		"apple eat":             {"2"},
+		"苹果":                    {"3"},
+		"+girl +Language:it":    {},
+		"+ragazze +Language:it": {"1"},
+		"-mela +Content:apple":  {"2"},
+		"Title:frut*":           {"1"},
+	} {
+		hits, err := SearchIndex(&index, searchStr)
+		assert.Nil(t, err, "Unexpected error searching %s", searchStr)
+		ids := []string{}
+		for _, hit := range hits {
+			ids = append(ids, hit.Id)
+		}
+		assert.Equal(t, expected, ids, searchStr)
+	}
+
+	_, err = SearchIndex(&index, `"ragazze`)
+	assert.True(t, errors.Is(err, ErrInvalidSearch), "Expected malformed query strings to be refused")
+}
+
+func Test_MigratesIndex(t *testing.T) {
+	tmpDirName := t.TempDir()
+	dbFileName := tmpDirName + "/notes.sqlite3"
+	indexDirName := tmpDirName + "/test_index"
+
+	db, _ := notes.CreateNoteDb(dbFileName)
+	authorId, _ := notes.CreateAuthor(db, "Test Author", "")
+	noteId, err := notes.CreateNote(db, &notes.NoteRecord{
+		Author: authorId, Content: "buonasera", Privacy: notes.DEFAULT_ACCESS, RenderHint: 1,
+	})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	assert.Nil(t, notes.SetNoteLanguage(db, noteId, "it"), "Unexpected error setting language")
+	db.Close()
+
+	oldIndex, err := bleve.New(indexDirName, bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatalf("Cannot create index %s", err)
+	}
+	oldIndex.Close()
+
+	index, err := MigrateIndex(dbFileName, indexDirName)
+	if err != nil {
+		t.Fatalf("Cannot migrate index %s", err)
+	}
+	docCount, _ := index.DocCount()
+	assert.Equal(t, uint64(1), docCount, "Reindexed all notes")
+	hits, err := SearchIndex(&index, "buonasera +Language:it")
+	assert.Nil(t, err, "Unexpected error searching")
+	assert.Equal(t, 1, len(hits), "Expected the note in its set language")
+	index.Close()
+
+	index, err = MigrateIndex(dbFileName, indexDirName)
+	if err != nil {
+		t.Fatalf("Cannot reopen index %s", err)
+	}
+	defer index.Close()
+	version, _ := index.GetInternal([]byte(MAPPING_VERSION_KEY))
+	assert.Equal(t, MAPPING_VERSION, string(version))
+}
+
+func Test_SuggestsCompletions(t *testing.T) {
+	index, err := bleve.NewMemOnly(NewIndexMapping())
+	if err != nil {
+		t.Fatalf("Cannot create index %s", err)
+	}
+	defer index.Close()
+
+	docs := []NoteDocument{
+		NewNoteDocument(1, "Ada Lovelace", "# Grocery list\n\nLentils and rice", 0),
+		NewNoteDocument(2, "Ada Lovelace", "# Gardening plans\n\nTomatoes", 0),
+		NewNoteDocument(3, "Grace Hopper", "# Compiler notes\n\nLinking", 0),
+	}
+	docs[0].Tags = []string{"groceries", "errands"}
+	docs[1].Tags = []string{"garden"}
+	docs[2].Privacy = "private"
+	for _, doc := range docs {
+		assert.Nil(t, index.Index(doc.Id, doc), "Unexpected error indexing")
+	}
+
+	texts := func(input string, filter string) []string {
+		q := bleve.NewMatchAllQuery()
+		var suggestions []Suggestion
+		if filter == "" {
+			suggestions, err = Suggest(&index, input, q, 10)
+		} else {
+			privacy := bleve.NewTermQuery(filter)
+			privacy.SetField("Privacy")
+			suggestions, err = Suggest(&index, input, privacy, 10)
+		}
+		assert.Nil(t, err, "Unexpected error suggesting %s", input)
+		result := []string{}
+		for _, suggestion := range suggestions {
+			result = append(result, suggestion.Kind+":"+suggestion.Text)
+		}
+		return result
+	}
+
+	assert.Equal(t, []string{"title:Grocery list", "title:Gardening plans", "tag:garden", "tag:groceries", "author:Grace Hopper"}, texts("g", ""))
+	assert.Equal(t, []string{"title:Grocery list", "tag:groceries", "author:Grace Hopper"}, texts("groc", ""))
+	assert.Equal(t, []string{"title:Grocery list", "tag:groceries"}, texts("grocer", ""))
+	assert.Equal(t, []string{"title:Grocery list"}, texts("grpcery", ""))
+	assert.Equal(t, []string{"title:Gardening plans", "tag:garden"}, texts("gardn", ""))
+	assert.Equal(t, []string{"title:Gardening plans"}, texts("gardening pl", ""))
+	assert.Equal(t, []string{"tag:errands"}, texts("#err", ""))
+	assert.Equal(t, []string{"author:Ada Lovelace"}, texts("love", ""))
+	assert.Equal(t, []string{}, texts("comp", "public"))
+	assert.Equal(t, []string{}, texts("  ", ""))
+
+	suggestions, err := Suggest(&index, "ada", bleve.NewMatchAllQuery(), 10)
+	assert.Nil(t, err, "Unexpected error suggesting")
+	assert.Equal(t, []Suggestion{{Count: 2, Kind: SUGGEST_AUTHOR, Text: "Ada Lovelace"}}, suggestions)
+
+	assert.True(t, isOneEditAway("garden", "gardn"))
+	assert.True(t, isOneEditAway("garden", "warden"))
+	assert.False(t, isOneEditAway("garden", "garden"))
+	assert.False(t, isOneEditAway("garden", "gard"))
 }
@@ -0,0 +1,171 @@
+package index
+
+import (
+	"org/bredin/go-notes/pkg/notes"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/lang/cjk"
+	"github.com/blevesearch/bleve/v2/analysis/lang/de"
+	"github.com/blevesearch/bleve/v2/analysis/lang/en"
+	"github.com/blevesearch/bleve/v2/analysis/lang/es"
+	"github.com/blevesearch/bleve/v2/analysis/lang/fr"
+	"github.com/blevesearch/bleve/v2/analysis/lang/it"
+)
+
+const DEFAULT_LANGUAGE = "en"
+
+// Bump MAPPING_VERSION whenever NewIndexMapping changes so that
+// MigrateIndex rebuilds indexes made with the old mapping.
+const MAPPING_VERSION = "5"
+const MAPPING_VERSION_KEY = "mappingVersion"
+
+var languageAnalyzers = map[string]string{
+	"de": de.AnalyzerName,
+	"en": en.AnalyzerName,
+	"es": es.AnalyzerName,
+	"fr": fr.AnalyzerName,
+	"it": it.AnalyzerName,
+	"ja": cjk.AnalyzerName,
+	"ko": cjk.AnalyzerName,
+	"zh": cjk.AnalyzerName,
+}
+
+// Frequent short words that tell the Latin-script languages apart.
+var languageWords = map[string][]string{
+	"de": {"der", "die", "das", "und", "ist", "nicht", "mit", "ein", "eine", "zu", "den", "von", "auf", "ich", "sie", "auch"},
+	"en": {"the", "and", "is", "are", "of", "to", "with", "this", "that", "for", "you", "not", "have", "was", "it", "on"},
+	"es": {"el", "los", "las", "y", "es", "que", "una", "por", "con", "para", "del", "se", "como", "pero", "muy", "está"},
+	"fr": {"le", "les", "des", "est", "et", "une", "dans", "pour", "pas", "qui", "avec", "sur", "ce", "vous", "nous", "je"},
+	"it": {"il", "gli", "della", "che", "non", "sono", "per", "con", "una", "questo", "nel", "anche", "come", "è", "ciao", "sei"},
+}
+
+/**
+ * Guess the language of a text: Japanese, Korean or Chinese from its
+ * script, otherwise the language whose frequent words it uses most,
+ * falling back to DEFAULT_LANGUAGE.
+ */
+func DetectLanguage(text string) string {
+	var letters, han, kana, hangul int
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Han, r):
+			han++
+		}
+		if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	if cjkLetters := han + kana + hangul; cjkLetters > 0 && cjkLetters*3 >= letters {
+		switch {
+		case kana > 0:
+			return "ja"
+		case hangul > han:
+			return "ko"
+		}
+		return "zh"
+	}
+
+	counts := make(map[string]int)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	for _, word := range words {
+		for language, frequent := range languageWords {
+			for _, frequentWord := range frequent {
+				if word == frequentWord {
+					counts[language]++
+				}
+			}
+		}
+	}
+	detected, best := DEFAULT_LANGUAGE, counts[DEFAULT_LANGUAGE]
+	for _, language := range []string{"de", "es", "fr", "it"} {
+		if counts[language] > best {
+			detected, best = language, counts[language]
+		}
+	}
+	return detected
+}
+
+/**
+ * Return the analyzer for a language, that of DEFAULT_LANGUAGE when it is
+ * not supported.
+ */
+func LanguageAnalyzer(language string) string {
+	if analyzer, ok := languageAnalyzers[language]; ok {
+		return analyzer
+	}
+	return languageAnalyzers[DEFAULT_LANGUAGE]
+}
+
+/**
+ * Open an index, first rebuilding it from the database when it is missing
+ * or was built with an older mapping. The new index is built beside the
+ * old one and only replaces it once complete.
+ */
+func MigrateIndex(dbFileName string, indexDirName string) (bleve.Index, error) {
+	index, err := bleve.Open(indexDirName)
+	if err == nil {
+		version, err := index.GetInternal([]byte(MAPPING_VERSION_KEY))
+		if err != nil || string(version) == MAPPING_VERSION {
+			return index, err
+		}
+		index.Close()
+	} else if err != bleve.ErrorIndexPathDoesNotExist {
+		return nil, err
+	}
+
+	rebuildDirName := indexDirName + ".rebuild"
+	if err = os.RemoveAll(rebuildDirName); err != nil {
+		return nil, err
+	}
+	index, err = CreateIndex(dbFileName, rebuildDirName)
+	if err != nil {
+		return nil, err
+	}
+	index.Close()
+	if err = os.RemoveAll(indexDirName); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(rebuildDirName, indexDirName); err != nil {
+		return nil, err
+	}
+	return bleve.Open(indexDirName)
+}
+
+/**
+ * Return the supported languages analyzed by an analyzer.
+ */
+func analyzerLanguages(analyzer string) []string {
+	var languages []string
+	for _, language := range notes.LANGUAGES {
+		if LanguageAnalyzer(language) == analyzer {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
+
+/**
+ * Analyzers of the supported languages, each mapping one document type.
+ */
+func indexedAnalyzers() []string {
+	seen := make(map[string]bool)
+	var analyzers []string
+	for _, analyzer := range languageAnalyzers {
+		if !seen[analyzer] {
+			seen[analyzer] = true
+			analyzers = append(analyzers, analyzer)
+		}
+	}
+	sort.Strings(analyzers)
+	return analyzers
+}
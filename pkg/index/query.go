@@ -0,0 +1,381 @@
+package index
+
+import (
+	"fmt"
+	"org/bredin/go-notes/pkg/notes"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+const AUTHOR_SELF = "me"
+const QUERY_DATE_FORMAT = "2006-01-02"
+
+/**
+ * Free text combined with filters. Authors and privacy levels match any
+ * of those listed, tags must all be present, and the creation range
+ * includes CreatedAfter and excludes CreatedBefore. Dates are either
+ * YYYY-MM-DD or RFC 3339. Text is analyzed for each language in turn to
+ * match notes in that language, or only for Language when given.
+ */
+type NoteQuery struct {
+	Authors       []string `json:"authors,omitempty"`
+	CreatedAfter  string   `json:"createdAfter,omitempty"`
+	CreatedBefore string   `json:"createdBefore,omitempty"`
+	Language      string   `json:"language,omitempty"`
+	Notebook      string   `json:"notebook,omitempty"`
+	Phrases       []string `json:"phrases,omitempty"`
+	Privacy       []string `json:"privacy,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	Text          string   `json:"text,omitempty"`
+}
+
+/**
+ * Locates a query error by character position in the query syntax or by
+ * field name in a structured query.
+ */
+type QueryError struct {
+	Field    string
+	Message  string
+	Position int
+}
+
+func (e *QueryError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s at position %d", e.Message, e.Position)
+}
+
+func (e *QueryError) Unwrap() error {
+	return ErrInvalidSearch
+}
+
+/**
+ * Parse the query syntax: free words and "quoted phrases" mixed with
+ * author:, after:, before:, lang:, notebook:, privacy: and tag: filters,
+ * whose values may be quoted, and #tag shorthands.  Unknown prefixes are kept
+ * as text.
+ */
+func ParseQuery(input string) (*NoteQuery, error) {
+	var q NoteQuery
+	var words []string
+	runes := []rune(input)
+	for pos := 0; pos < len(runes); {
+		if unicode.IsSpace(runes[pos]) {
+			pos++
+			continue
+		}
+		start := pos
+		if runes[pos] == '"' {
+			phrase, end, err := readQuoted(runes, pos)
+			if err != nil {
+				return nil, err
+			}
+			if phrase = strings.TrimSpace(phrase); phrase != "" {
+				q.Phrases = append(q.Phrases, phrase)
+			}
+			pos = end
+			continue
+		}
+
+		end := pos
+		for end < len(runes) && !unicode.IsSpace(runes[end]) && runes[end] != ':' {
+			end++
+		}
+		key := strings.ToLower(string(runes[pos:end]))
+		if end < len(runes) && runes[end] == ':' && isFilterKey(key) {
+			valueStart := end + 1
+			value, valueEnd, err := readValue(runes, valueStart)
+			if err != nil {
+				return nil, err
+			}
+			if value == "" {
+				return nil, &QueryError{Message: "missing value for " + key, Position: start}
+			}
+			if err = q.addFilter(key, value, valueStart); err != nil {
+				return nil, err
+			}
+			pos = valueEnd
+			continue
+		}
+
+		for end < len(runes) && !unicode.IsSpace(runes[end]) {
+			end++
+		}
+		word := string(runes[start:end])
+		if strings.HasPrefix(word, "#") && len(word) > 1 {
+			q.Tags = append(q.Tags, word)
+		} else {
+			words = append(words, word)
+		}
+		pos = end
+	}
+	q.Text = strings.Join(words, " ")
+	return &q, nil
+}
+
+/**
+ * Build the bleve query, matching all notes when nothing is given.
+ */
+func (q *NoteQuery) Query() (query.Query, error) {
+	var conjuncts []query.Query
+	language, err := notes.ParseLanguage(q.Language)
+	if err != nil {
+		return nil, &QueryError{Field: "language", Message: err.Error()}
+	}
+	if language != notes.AUTO_LANGUAGE {
+		conjuncts = append(conjuncts, newTermsQuery("Language", []string{language}))
+		conjuncts = append(conjuncts, q.textQueries(LanguageAnalyzer(language))...)
+	} else if textQueries := q.textQueries(""); len(textQueries) > 0 {
+		var disjuncts []query.Query
+		for _, analyzer := range indexedAnalyzers() {
+			disjunct := append(q.textQueries(analyzer), newTermsQuery("Language", analyzerLanguages(analyzer)))
+			disjuncts = append(disjuncts, bleve.NewConjunctionQuery(disjunct...))
+		}
+		conjuncts = append(conjuncts, bleve.NewDisjunctionQuery(disjuncts...))
+	}
+	if len(q.Authors) > 0 {
+		conjuncts = append(conjuncts, newTermsQuery("AuthorKeyword", q.Authors))
+	}
+	if q.Notebook != "" {
+		conjuncts = append(conjuncts, newTermsQuery("Notebook", []string{q.Notebook}))
+	}
+	if len(q.Privacy) > 0 {
+		var names []string
+		for _, privacy := range q.Privacy {
+			level, err := notes.ParsePrivacy(privacy)
+			if err != nil {
+				return nil, &QueryError{Field: "privacy", Message: err.Error()}
+			}
+			names = append(names, notes.PrivacyName(level))
+		}
+		conjuncts = append(conjuncts, newTermsQuery("Privacy", names))
+	}
+	for _, tag := range q.Tags {
+		if tag = notes.NormalizeTag(tag); tag != "" {
+			conjuncts = append(conjuncts, newTermsQuery("Tags", []string{tag}))
+		}
+	}
+
+	if q.CreatedAfter != "" || q.CreatedBefore != "" {
+		var after, before time.Time
+		if q.CreatedAfter != "" {
+			if after, err = parseQueryDate(q.CreatedAfter); err != nil {
+				return nil, &QueryError{Field: "createdAfter", Message: err.Error()}
+			}
+		}
+		if q.CreatedBefore != "" {
+			if before, err = parseQueryDate(q.CreatedBefore); err != nil {
+				return nil, &QueryError{Field: "createdBefore", Message: err.Error()}
+			}
+		}
+		if !after.IsZero() && !before.IsZero() && !after.Before(before) {
+			return nil, &QueryError{Field: "createdBefore", Message: "must be later than createdAfter"}
+		}
+		inclusive, exclusive := true, false
+		dateQuery := bleve.NewDateRangeInclusiveQuery(after, before, &inclusive, &exclusive)
+		dateQuery.SetField("Created")
+		conjuncts = append(conjuncts, dateQuery)
+	}
+
+	if len(conjuncts) == 0 {
+		return bleve.NewMatchAllQuery(), nil
+	}
+	return bleve.NewConjunctionQuery(conjuncts...), nil
+}
+
+/**
+ * Restrict a query to the notes readable by an author: their own, public
+ * ones and protected ones of the sharers, who should include the author.
+ * Authors are matched by id, as names need not be unique.
+ */
+func ReadableQuery(q query.Query, authorId int, sharerIds []int) query.Query {
+	public := bleve.NewTermQuery(notes.PrivacyName(notes.PUBLIC_ACCESS))
+	public.SetField("Privacy")
+	protected := bleve.NewTermQuery(notes.PrivacyName(notes.PROTECTED_ACCESS))
+	protected.SetField("Privacy")
+	readable := []query.Query{newTermsQuery("AuthorId", []string{strconv.Itoa(authorId)}), public}
+	if len(sharerIds) > 0 {
+		sharers := []string{}
+		for _, sharerId := range sharerIds {
+			sharers = append(sharers, strconv.Itoa(sharerId))
+		}
+		readable = append(readable, bleve.NewConjunctionQuery(protected, newTermsQuery("AuthorId", sharers)))
+	}
+	return bleve.NewConjunctionQuery(q, bleve.NewDisjunctionQuery(readable...))
+}
+
+func (q *NoteQuery) addFilter(key string, value string, position int) error {
+	switch key {
+	case "after", "before":
+		if _, err := parseQueryDate(value); err != nil {
+			return &QueryError{Message: err.Error(), Position: position}
+		}
+		if key == "after" {
+			q.CreatedAfter = value
+		} else {
+			q.CreatedBefore = value
+		}
+	case "author":
+		q.Authors = append(q.Authors, value)
+	case "lang":
+		if _, err := notes.ParseLanguage(value); err != nil {
+			return &QueryError{Message: err.Error(), Position: position}
+		}
+		q.Language = value
+	case "notebook":
+		q.Notebook = value
+	case "privacy":
+		if _, err := notes.ParsePrivacy(value); err != nil {
+			return &QueryError{Message: err.Error(), Position: position}
+		}
+		q.Privacy = append(q.Privacy, value)
+	case "tag":
+		q.Tags = append(q.Tags, value)
+	}
+	return nil
+}
+
+/**
+ * Match the text and phrases analyzed by the given analyzer, or by that of
+ * each field when it is blank.
+ */
+func (q *NoteQuery) textQueries(analyzer string) []query.Query {
+	var queries []query.Query
+	if strings.TrimSpace(q.Text) != "" {
+		matchQuery := bleve.NewMatchQuery(q.Text)
+		matchQuery.Analyzer = analyzer
+		queries = append(queries, matchQuery)
+	}
+	for _, phrase := range q.Phrases {
+		phraseQuery := bleve.NewMatchPhraseQuery(phrase)
+		phraseQuery.Analyzer = analyzer
+		queries = append(queries, phraseQuery)
+	}
+	return queries
+}
+
+func isFilterKey(key string) bool {
+	switch key {
+	case "after", "author", "before", "lang", "notebook", "privacy", "tag":
+		return true
+	}
+	return false
+}
+
+func isTextField(field string) bool {
+	switch field {
+	case "", "Comments", "Content", "Title":
+		return true
+	}
+	return false
+}
+
+/**
+ * Parse bleve's query string syntax, analyzing words searched in all
+ * fields, content, titles and comments as in each language's notes.
+ */
+func newQueryStringQuery(input string) (query.Query, error) {
+	if _, err := bleve.NewQueryStringQuery(input).Parse(); err != nil {
+		return nil, fmt.Errorf("%s: %w", err.Error(), ErrInvalidSearch)
+	}
+	var disjuncts []query.Query
+	for _, analyzer := range indexedAnalyzers() {
+		parsed, err := bleve.NewQueryStringQuery(input).Parse()
+		if err != nil {
+			return nil, err
+		}
+		setTextAnalyzer(parsed, analyzer)
+		disjuncts = append(disjuncts,
+			bleve.NewConjunctionQuery(parsed, newTermsQuery("Language", analyzerLanguages(analyzer))))
+	}
+	return bleve.NewDisjunctionQuery(disjuncts...), nil
+}
+
+func newTermsQuery(field string, terms []string) query.Query {
+	var disjuncts []query.Query
+	for _, term := range terms {
+		termQuery := bleve.NewTermQuery(term)
+		termQuery.SetField(field)
+		disjuncts = append(disjuncts, termQuery)
+	}
+	if len(disjuncts) == 1 {
+		return disjuncts[0]
+	}
+	return bleve.NewDisjunctionQuery(disjuncts...)
+}
+
+func parseQueryDate(value string) (time.Time, error) {
+	date, err := time.Parse(QUERY_DATE_FORMAT, value)
+	if err != nil {
+		date, err = time.Parse(time.RFC3339, value)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", value)
+	}
+	if date.Year() < 1678 || date.Year() > 2261 {
+		return time.Time{}, fmt.Errorf("date %q out of range", value)
+	}
+	return date, nil
+}
+
+/**
+ * Read a double-quoted string starting at the opening quote, returning
+ * its contents and the position after the closing quote.
+ */
+func readQuoted(runes []rune, start int) (string, int, error) {
+	for end := start + 1; end < len(runes); end++ {
+		if runes[end] == '"' {
+			return string(runes[start+1 : end]), end + 1, nil
+		}
+	}
+	return "", 0, &QueryError{Message: "unterminated quote", Position: start}
+}
+
+func readValue(runes []rune, start int) (string, int, error) {
+	if start < len(runes) && runes[start] == '"' {
+		value, end, err := readQuoted(runes, start)
+		return strings.TrimSpace(value), end, err
+	}
+	end := start
+	for end < len(runes) && !unicode.IsSpace(runes[end]) {
+		end++
+	}
+	return string(runes[start:end]), end, nil
+}
+
+/**
+ * Set the analyzer of the text matches of a parsed query string, leaving
+ * matches on keyword fields to theirs.
+ */
+func setTextAnalyzer(q query.Query, analyzer string) {
+	switch q := q.(type) {
+	case *query.BooleanQuery:
+		for _, clause := range []query.Query{q.Must, q.Should, q.MustNot} {
+			if clause != nil {
+				setTextAnalyzer(clause, analyzer)
+			}
+		}
+	case *query.ConjunctionQuery:
+		for _, conjunct := range q.Conjuncts {
+			setTextAnalyzer(conjunct, analyzer)
+		}
+	case *query.DisjunctionQuery:
+		for _, disjunct := range q.Disjuncts {
+			setTextAnalyzer(disjunct, analyzer)
+		}
+	case *query.MatchQuery:
+		if isTextField(q.FieldVal) {
+			q.Analyzer = analyzer
+		}
+	case *query.MatchPhraseQuery:
+		if isTextField(q.FieldVal) {
+			q.Analyzer = analyzer
+		}
+	}
+}
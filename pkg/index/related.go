@@ -0,0 +1,187 @@
+package index
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+const RELATED_QUERY_TERMS = 25
+const RELATED_REASON_TERMS = 5
+
+type RelatedNote struct {
+	Id          string
+	Reason      string
+	Score       float64
+	SharedTags  []string `json:",omitempty"`
+	SharedTerms []string `json:",omitempty"`
+}
+
+type weightedTerm struct {
+	term   string
+	weight float64
+}
+
+/**
+ * Build a "more like this" query from a note's content, title and tags.
+ * Its RELATED_QUERY_TERMS most distinctive terms, frequent in the note
+ * and rare in the index, are boosted by weight and the note itself is
+ * excluded. Returns nil when the note has nothing to match on.
+ */
+func RelatedQuery(index *bleve.Index, doc NoteDocument) (query.Query, error) {
+	terms, err := getWeightedTerms(index, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var disjuncts []query.Query
+	for _, term := range terms {
+		for _, field := range []string{"Content", "Title"} {
+			termQuery := bleve.NewTermQuery(term.term)
+			termQuery.SetField(field)
+			termQuery.SetBoost(term.weight)
+			disjuncts = append(disjuncts, termQuery)
+		}
+	}
+	for _, tag := range doc.Tags {
+		tagQuery := bleve.NewTermQuery(tag)
+		tagQuery.SetField("Tags")
+		disjuncts = append(disjuncts, tagQuery)
+	}
+	if len(disjuncts) == 0 {
+		return nil, nil
+	}
+
+	related := bleve.NewBooleanQuery()
+	related.AddMust(bleve.NewDisjunctionQuery(disjuncts...))
+	related.AddMustNot(bleve.NewDocIDQuery([]string{doc.Id}))
+	return related, nil
+}
+
+/**
+ * Run a related query, explaining each hit by the tags and, best first,
+ * the terms it shares with the original note.
+ */
+func SearchRelated(index *bleve.Index, q query.Query, size int) ([]RelatedNote, error) {
+	related := []RelatedNote{}
+	if q == nil {
+		return related, nil
+	}
+	if size <= 0 {
+		size = DEFAULT_SEARCH_SIZE
+	}
+	searchRequest := bleve.NewSearchRequestOptions(q, size, 0, false)
+	searchRequest.IncludeLocations = true
+	searchResult, err := (*index).Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hit := range searchResult.Hits {
+		note := RelatedNote{Id: hit.ID, Score: hit.Score}
+		for tag := range hit.Locations["Tags"] {
+			note.SharedTags = append(note.SharedTags, tag)
+		}
+		sort.Strings(note.SharedTags)
+
+		termScores := make(map[string]float64)
+		for _, field := range []string{"Content", "Title"} {
+			for term, locations := range hit.Locations[field] {
+				termScores[term] += float64(len(locations))
+			}
+		}
+		for term := range termScores {
+			note.SharedTerms = append(note.SharedTerms, term)
+		}
+		sort.Slice(note.SharedTerms, func(i, j int) bool {
+			a, b := note.SharedTerms[i], note.SharedTerms[j]
+			return termScores[a] > termScores[b] || termScores[a] == termScores[b] && a < b
+		})
+		if len(note.SharedTerms) > RELATED_REASON_TERMS {
+			note.SharedTerms = note.SharedTerms[:RELATED_REASON_TERMS]
+		}
+
+		var reasons []string
+		if len(note.SharedTags) > 0 {
+			reasons = append(reasons, "tags "+strings.Join(note.SharedTags, ", "))
+		}
+		if len(note.SharedTerms) > 0 {
+			reasons = append(reasons, "terms "+strings.Join(note.SharedTerms, ", "))
+		}
+		if len(reasons) > 0 {
+			note.Reason = "Shares " + strings.Join(reasons, " and ")
+		}
+		related = append(related, note)
+	}
+	return related, nil
+}
+
+/**
+ * Analyze the content and title as the index does for the note's language
+ * and weight each term by its count in the note times its inverse
+ * document frequency, normalized so the best term weighs 1. Terms found
+ * in no other note are dropped.
+ */
+func getWeightedTerms(index *bleve.Index, doc NoteDocument) ([]weightedTerm, error) {
+	counts := make(map[string]int)
+	analyzer := (*index).Mapping().AnalyzerNamed(LanguageAnalyzer(doc.Language))
+	if analyzer == nil {
+		return nil, fmt.Errorf("no analyzer for language %s", doc.Language)
+	}
+	for _, text := range []string{doc.Content, doc.Title} {
+		for _, token := range analyzer.Analyze([]byte(text)) {
+			counts[string(token.Term)]++
+		}
+	}
+
+	advanced, err := (*index).Advanced()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := advanced.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	numDocs, err := reader.DocCount()
+	if err != nil {
+		return nil, err
+	}
+
+	var terms []weightedTerm
+	for term, count := range counts {
+		var docFreq uint64
+		for _, field := range []string{"Content", "Title"} {
+			termReader, err := reader.TermFieldReader([]byte(term), field, false, false, false)
+			if err != nil {
+				return nil, err
+			}
+			if fieldFreq := termReader.Count(); fieldFreq > docFreq {
+				docFreq = fieldFreq
+			}
+			termReader.Close()
+		}
+		if docFreq <= 1 {
+			continue
+		}
+		idf := math.Log(1 + float64(numDocs)/float64(docFreq))
+		terms = append(terms, weightedTerm{term, float64(count) * idf})
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		return terms[i].weight > terms[j].weight || terms[i].weight == terms[j].weight && terms[i].term < terms[j].term
+	})
+	if len(terms) > RELATED_QUERY_TERMS {
+		terms = terms[:RELATED_QUERY_TERMS]
+	}
+	if len(terms) > 0 {
+		best := terms[0].weight
+		for i := range terms {
+			terms[i].weight /= best
+		}
+	}
+	return terms, nil
+}
@@ -0,0 +1,146 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+const SORT_NEWEST = "newest"
+const SORT_OLDEST = "oldest"
+const SORT_RELEVANCE = "relevance"
+
+const FACET_SIZE = 10
+
+var ErrInvalidSearch = errors.New("invalid search")
+
+type FacetCount struct {
+	Count int
+	Term  string
+}
+
+type SearchOptions struct {
+	After     *SearchCursor
+	Facets    bool
+	Highlight bool
+	Size      int
+	Sort      string
+}
+
+type SearchResult struct {
+	Facets map[string][]FacetCount `json:",omitempty"`
+	Hits   []SearchHit
+	Next   *SearchCursor `json:"-"`
+	Total  uint64
+}
+
+var sortOrders = map[string][]string{
+	"":             {"-_score", "_id"},
+	SORT_NEWEST:    {"-Created", "-_id"},
+	SORT_OLDEST:    {"Created", "_id"},
+	SORT_RELEVANCE: {"-_score", "_id"},
+}
+
+/**
+ * Search notes. Optionally highlight matches in the Comments, Content and
+ * Title fields and count hits by author, notebook, tag, privacy and creation
+ * date.
+ */
+func SearchNotes(index *bleve.Index, q query.Query, options SearchOptions) (*SearchResult, error) {
+	sortOrder, ok := sortOrders[options.Sort]
+	if !ok {
+		return nil, fmt.Errorf("illegal sort %s: %w", options.Sort, ErrInvalidSearch)
+	}
+	size := options.Size
+	if size <= 0 {
+		size = DEFAULT_SEARCH_SIZE
+	}
+
+	searchRequest := bleve.NewSearchRequestOptions(q, size+1, 0, false)
+	searchRequest.SortBy(sortOrder)
+	if options.After != nil {
+		if len(options.After.Sort) != len(sortOrder) {
+			return nil, fmt.Errorf("cursor does not match sort %s: %w", options.Sort, ErrInvalidSearch)
+		}
+		searchRequest.SetSearchAfter(options.After.Sort)
+	}
+	if options.Highlight {
+		searchRequest.Highlight = bleve.NewHighlightWithStyle("html")
+		searchRequest.Highlight.Fields = []string{"Comments", "Content", "Title"}
+	}
+	if options.Facets {
+		addFacets(searchRequest, time.Now())
+	}
+
+	searchResult, err := (*index).Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SearchResult{Hits: []SearchHit{}, Total: searchResult.Total}
+	for _, h := range searchResult.Hits {
+		if len(result.Hits) == size {
+			result.Next = newSearchCursor(searchResult.Hits[size-1])
+			break
+		}
+		result.Hits = append(result.Hits, SearchHit{Fragments: h.Fragments, Id: h.ID, Score: h.Score})
+	}
+	if options.Facets {
+		result.Facets = getFacetCounts(searchResult.Facets)
+	}
+	return result, nil
+}
+
+func addFacets(searchRequest *bleve.SearchRequest, now time.Time) {
+	searchRequest.AddFacet("Author", bleve.NewFacetRequest("AuthorKeyword", FACET_SIZE))
+	searchRequest.AddFacet("Notebook", bleve.NewFacetRequest("Notebook", FACET_SIZE))
+	searchRequest.AddFacet("Privacy", bleve.NewFacetRequest("Privacy", FACET_SIZE))
+	searchRequest.AddFacet("Tags", bleve.NewFacetRequest("Tags", FACET_SIZE))
+
+	created := bleve.NewFacetRequest("CreatedFacet", 5)
+	day := now.AddDate(0, 0, -1)
+	week := now.AddDate(0, 0, -7)
+	month := now.AddDate(0, -1, 0)
+	year := now.AddDate(-1, 0, 0)
+	created.AddDateTimeRange("day", day, now)
+	created.AddDateTimeRange("week", week, day)
+	created.AddDateTimeRange("month", month, week)
+	created.AddDateTimeRange("year", year, month)
+	created.AddDateTimeRange("older", time.Unix(0, 0), year)
+	searchRequest.AddFacet("Created", created)
+}
+
+func getFacetCounts(facets search.FacetResults) map[string][]FacetCount {
+	result := make(map[string][]FacetCount)
+	for name, facet := range facets {
+		counts := []FacetCount{}
+		for _, term := range facet.Terms.Terms() {
+			counts = append(counts, FacetCount{Count: term.Count, Term: term.Term})
+		}
+		for _, dateRange := range facet.DateRanges {
+			counts = append(counts, FacetCount{Count: dateRange.Count, Term: dateRange.Name})
+		}
+		result[name] = counts
+	}
+	return result
+}
+
+/**
+ * Score sort keys come back as a placeholder, so substitute the score
+ * itself for search_after.
+ */
+func newSearchCursor(hit *search.DocumentMatch) *SearchCursor {
+	sort := make([]string, len(hit.Sort))
+	for i, value := range hit.Sort {
+		if value == "_score" {
+			value = strconv.FormatFloat(hit.Score, 'g', -1, 64)
+		}
+		sort[i] = value
+	}
+	return &SearchCursor{Sort: sort}
+}
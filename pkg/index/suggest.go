@@ -0,0 +1,190 @@
+package index
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+const SUGGEST_AUTHOR = "author"
+const SUGGEST_TAG = "tag"
+const SUGGEST_TITLE = "title"
+
+// Prefixes shorter than SUGGEST_FUZZY_LENGTH only match exactly, as a
+// single typo in them would match most of the index.
+const SUGGEST_FUZZY_LENGTH = 4
+const SUGGEST_FACET_SIZE = 100
+
+// Titles and author names are indexed a second time split into prefixes
+// of SUGGEST_MIN_PREFIX to SUGGEST_MAX_PREFIX letters, and input words
+// are cut to SUGGEST_MAX_PREFIX letters to match them.
+const SUGGEST_ANALYZER = "suggest"
+const SUGGEST_QUERY_ANALYZER = "suggest_query"
+const SUGGEST_MIN_PREFIX = 1
+const SUGGEST_MAX_PREFIX = 20
+
+/**
+ * A completion of what the user is typing: the title of a note, a tag or
+ * an author name. Count is the number of readable notes with the tag or
+ * by the author.
+ */
+type Suggestion struct {
+	Count  int `json:",omitempty"`
+	Kind   string
+	NoteId int `json:",omitempty"`
+	Text   string
+}
+
+/**
+ * Suggest up to size titles, then tags and author names, starting with
+ * or, for longer input, one typo away from the input, among the notes
+ * matching filter.
+ */
+func Suggest(index *bleve.Index, input string, filter query.Query, size int) ([]Suggestion, error) {
+	if size <= 0 {
+		size = DEFAULT_SEARCH_SIZE
+	}
+	suggestions := []Suggestion{}
+	input = strings.ToLower(strings.TrimSpace(input))
+	if input == "" {
+		return suggestions, nil
+	}
+
+	titles, err := suggestTitles(index, input, filter, size)
+	if err != nil {
+		return nil, err
+	}
+	suggestions = append(suggestions, titles...)
+
+	tag := strings.TrimPrefix(input, "#")
+	tagQuery := bleve.NewPrefixQuery(tag)
+	tagQuery.SetField("Tags")
+	tags, err := suggestTerms(index, SUGGEST_TAG, "Tags", tag, withFuzzy(tagQuery, "Tags", tag), filter, size)
+	if err != nil {
+		return nil, err
+	}
+	suggestions = append(suggestions, tags...)
+
+	authorQuery := newSuggestQuery("AuthorSuggest", input)
+	authors, err := suggestTerms(index, SUGGEST_AUTHOR, "AuthorKeyword", "", authorQuery, filter, size)
+	if err != nil {
+		return nil, err
+	}
+	return append(suggestions, authors...), nil
+}
+
+/**
+ * Whether a and b differ by exactly one inserted, deleted or replaced
+ * letter.
+ */
+func isOneEditAway(a string, b string) bool {
+	s, t := []rune(a), []rune(b)
+	if len(s) < len(t) {
+		s, t = t, s
+	}
+	if len(s)-len(t) > 1 {
+		return false
+	}
+	i := 0
+	for i < len(t) && s[i] == t[i] {
+		i++
+	}
+	if i == len(t) {
+		return len(s) != len(t)
+	}
+	if len(s) == len(t) {
+		return string(s[i+1:]) == string(t[i+1:])
+	}
+	return string(s[i+1:]) == string(t[i:])
+}
+
+/**
+ * Match every word of the input as the start of a word of the field,
+ * allowing a typo in longer words.
+ */
+func newSuggestQuery(field string, input string) query.Query {
+	prefixQuery := bleve.NewMatchQuery(input)
+	prefixQuery.Analyzer = SUGGEST_QUERY_ANALYZER
+	prefixQuery.SetField(field)
+	prefixQuery.SetOperator(query.MatchQueryOperatorAnd)
+	if len([]rune(input)) < SUGGEST_FUZZY_LENGTH {
+		return prefixQuery
+	}
+	fuzzyQuery := bleve.NewMatchQuery(input)
+	fuzzyQuery.Analyzer = SUGGEST_QUERY_ANALYZER
+	fuzzyQuery.SetField(field)
+	fuzzyQuery.SetOperator(query.MatchQueryOperatorAnd)
+	fuzzyQuery.SetFuzziness(1)
+	return bleve.NewDisjunctionQuery(prefixQuery, fuzzyQuery)
+}
+
+/**
+ * Count the notes matching q and filter by each term of field, most
+ * frequent first. With a prefix, terms of the matching notes that
+ * neither start with it nor are a typo away are left out, since notes
+ * have several tags.
+ */
+func suggestTerms(index *bleve.Index, kind string, field string, prefix string, q query.Query, filter query.Query, size int) ([]Suggestion, error) {
+	searchRequest := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(q, filter), 0, 0, false)
+	searchRequest.AddFacet(field, bleve.NewFacetRequest(field, SUGGEST_FACET_SIZE))
+	searchResult, err := (*index).Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	suggestions := []Suggestion{}
+	facet, ok := searchResult.Facets[field]
+	if !ok || facet.Terms == nil {
+		return suggestions, nil
+	}
+	for _, term := range facet.Terms.Terms() {
+		if prefix != "" && !strings.HasPrefix(term.Term, prefix) && !isOneEditAway(term.Term, prefix) {
+			continue
+		}
+		suggestions = append(suggestions, Suggestion{Count: term.Count, Kind: kind, Text: term.Term})
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Count > suggestions[j].Count
+	})
+	if len(suggestions) > size {
+		suggestions = suggestions[:size]
+	}
+	return suggestions, nil
+}
+
+func suggestTitles(index *bleve.Index, input string, filter query.Query, size int) ([]Suggestion, error) {
+	searchRequest := bleve.NewSearchRequestOptions(
+		bleve.NewConjunctionQuery(newSuggestQuery("TitleSuggest", input), filter), size, 0, false)
+	searchRequest.Fields = []string{"Title"}
+	searchResult, err := (*index).Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	suggestions := []Suggestion{}
+	for _, hit := range searchResult.Hits {
+		title, _ := hit.Fields["Title"].(string)
+		noteId, err := strconv.Atoi(hit.ID)
+		if err != nil || title == "" {
+			continue
+		}
+		suggestions = append(suggestions, Suggestion{Kind: SUGGEST_TITLE, NoteId: noteId, Text: title})
+	}
+	return suggestions, nil
+}
+
+/**
+ * Also match terms of a keyword field a typo away from longer input.
+ */
+func withFuzzy(q query.Query, field string, input string) query.Query {
+	if len([]rune(input)) < SUGGEST_FUZZY_LENGTH {
+		return q
+	}
+	fuzzyQuery := bleve.NewFuzzyQuery(input)
+	fuzzyQuery.SetField(field)
+	fuzzyQuery.SetFuzziness(1)
+	return bleve.NewDisjunctionQuery(q, fuzzyQuery)
+}
@@ -0,0 +1,41 @@
+package notes
+
+import (
+	"database/sql"
+)
+
+type AttachmentRecord struct {
+	Content  []byte
+	MimeType string
+	Name     string
+	Note     int
+}
+
+/**
+ * Store an attachment, replacing any attachment of the same name on the note.
+ */
+func CreateAttachment(db Execer, attachment *AttachmentRecord) error {
+	query := "INSERT OR REPLACE INTO attachments (note, name, mimeType, content) VALUES (?, ?, ?, ?)"
+	_, err := db.Exec(query, attachment.Note, attachment.Name, attachment.MimeType, attachment.Content)
+	return err
+}
+
+func GetAttachments(db *sql.DB, noteId int) ([]AttachmentRecord, error) {
+	rows, err := db.Query(
+		"SELECT note, name, IFNULL(mimeType, ''), content FROM attachments WHERE note = ? ORDER BY name",
+		noteId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []AttachmentRecord
+	for rows.Next() {
+		var attachment AttachmentRecord
+		if err = rows.Scan(&attachment.Note, &attachment.Name, &attachment.MimeType, &attachment.Content); err != nil {
+			return result, err
+		}
+		result = append(result, attachment)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,258 @@
+package notes
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const commentColumns = "comments.id, comments.note, comments.author, users.userName, comments.parent, " +
+	"comments.content, comments.created, comments.edited, comments.resolved, comments.deleted"
+
+var ErrCommentForbidden = errors.New("comment not accessible")
+var ErrCommentNotFound = errors.New("comment not found")
+var ErrInvalidComment = errors.New("invalid comment")
+
+/**
+ * A markdown comment on a note, starting a thread or replying to Parent.
+ * Deleted comments keep their place in threads with replies but lose
+ * their content. Resolved only applies to the comment starting a thread.
+ */
+type Comment struct {
+	Author     int
+	AuthorName string
+	Content    string
+	Created    int
+	Deleted    bool
+	Edited     int
+	Id         int
+	Note       int
+	Parent     int
+	Resolved   bool
+}
+
+/**
+ * Tell whether userId may comment on a note: its author may, and so may
+ * those the author shares with when they can read it. Other readers of
+ * public notes only see the comments.
+ */
+func CanCommentNote(db *sql.DB, userId int, noteId int) (bool, error) {
+	var canComment bool
+	err := db.QueryRow(
+		"SELECT author = ? OR (IFNULL(privacy,0) IN (?, ?) AND author IN (SELECT user FROM sharing WHERE sharesWith = ?)) "+
+			"FROM notes WHERE rowid = ?",
+		userId, PROTECTED_ACCESS, PUBLIC_ACCESS, userId, noteId).Scan(&canComment)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("no note %d: %w", noteId, ErrNoteNotFound)
+	}
+	return canComment, err
+}
+
+/**
+ * Add a comment on behalf of its author, replying to Parent when set,
+ * which must be a comment on the same note, and notify the note's author
+ * and those mentioned.
+ */
+func CreateComment(db *sql.DB, comment *Comment) (int, error) {
+	comment.Content = strings.TrimSpace(comment.Content)
+	if comment.Content == "" {
+		return 0, fmt.Errorf("%w: content is blank", ErrInvalidComment)
+	}
+	canComment, err := CanCommentNote(db, comment.Author, comment.Note)
+	if err != nil {
+		return 0, err
+	}
+	if !canComment {
+		return 0, fmt.Errorf("note %d cannot be commented by user %d: %w", comment.Note, comment.Author, ErrNoteForbidden)
+	}
+	if comment.Parent != 0 {
+		var parentNote int
+		err = db.QueryRow("SELECT note FROM comments WHERE id = ?", comment.Parent).Scan(&parentNote)
+		if err == sql.ErrNoRows || (err == nil && parentNote != comment.Note) {
+			return 0, fmt.Errorf("no comment %d on note %d: %w", comment.Parent, comment.Note, ErrCommentNotFound)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	result, err := db.Exec(
+		"INSERT INTO comments (note, author, parent, content, created, edited, resolved, deleted) "+
+			"VALUES (?, ?, ?, ?, ?, 0, 0, 0)",
+		comment.Note, comment.Author, comment.Parent, comment.Content, comment.Created)
+	if err != nil {
+		return 0, err
+	}
+	lastRow, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err = notifyComment(db, comment.Author, comment.Note, int(lastRow)); err != nil {
+		return 0, err
+	}
+	return int(lastRow), notifyMentions(db, comment.Author, comment.Note, int(lastRow), comment.Content)
+}
+
+/**
+ * Delete a comment of userId. Comments with replies are only emptied so
+ * that their thread stays whole.
+ */
+func DeleteComment(db *sql.DB, userId int, commentId int) error {
+	comment, err := getOwnComment(db, userId, commentId)
+	if err != nil {
+		return err
+	}
+	var replies int
+	if err = db.QueryRow("SELECT COUNT(*) FROM comments WHERE parent = ?", comment.Id).Scan(&replies); err != nil {
+		return err
+	}
+	if replies > 0 {
+		_, err = db.Exec("UPDATE comments SET content = '', deleted = 1 WHERE id = ?", comment.Id)
+	} else {
+		_, err = db.Exec("DELETE FROM comments WHERE id = ?", comment.Id)
+	}
+	return err
+}
+
+/**
+ * Fetch a comment on a note that userId can read.
+ */
+func GetComment(db *sql.DB, userId int, commentId int) (*Comment, error) {
+	comment, err := getComment(db, commentId)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = GetNote(db, userId, comment.Note); err != nil {
+		return nil, err
+	}
+	return comment, nil
+}
+
+/**
+ * Return the content of the comments on a note, oldest first, for
+ * indexing along with it.
+ */
+func GetCommentContents(db *sql.DB, noteId int) ([]string, error) {
+	rows, err := db.Query("SELECT content FROM comments WHERE note = ? AND NOT deleted ORDER BY created, id", noteId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contents []string
+	var content string
+	for rows.Next() {
+		if err = rows.Scan(&content); err != nil {
+			return contents, err
+		}
+		contents = append(contents, content)
+	}
+	return contents, rows.Err()
+}
+
+/**
+ * List the comments on a note that userId can read, oldest first. Replies
+ * name their parent, from which clients rebuild the threads.
+ */
+func GetNoteComments(db *sql.DB, userId int, noteId int) ([]Comment, error) {
+	if _, err := GetNote(db, userId, noteId); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(
+		"SELECT "+commentColumns+" FROM comments JOIN users ON users.rowid = comments.author "+
+			"WHERE comments.note = ? ORDER BY comments.created, comments.id", noteId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []Comment{}
+	for rows.Next() {
+		var comment Comment
+		if err = scanComment(rows, &comment); err != nil {
+			return comments, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+/**
+ * Mark the thread a comment starts as resolved or not. The author of the
+ * comment and the author of the note may.
+ */
+func ResolveComment(db *sql.DB, userId int, commentId int, resolved bool) error {
+	comment, err := GetComment(db, userId, commentId)
+	if err != nil {
+		return err
+	}
+	if comment.Parent != 0 {
+		return fmt.Errorf("%w: comment %d replies to %d and cannot be resolved on its own", ErrInvalidComment, commentId, comment.Parent)
+	}
+	noteAuthor, err := GetNoteAuthor(db, comment.Note)
+	if err != nil {
+		return err
+	}
+	if comment.Author != userId && noteAuthor != userId {
+		return fmt.Errorf("comment %d cannot be resolved by user %d: %w", commentId, userId, ErrCommentForbidden)
+	}
+	_, err = db.Exec("UPDATE comments SET resolved = ? WHERE id = ?", resolved, commentId)
+	return err
+}
+
+/**
+ * Replace the content of a comment of userId, noting when it was edited.
+ */
+func UpdateComment(db *sql.DB, userId int, commentId int, content string) error {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return fmt.Errorf("%w: content is blank", ErrInvalidComment)
+	}
+	comment, err := getOwnComment(db, userId, commentId)
+	if err != nil {
+		return err
+	}
+	if comment.Deleted {
+		return fmt.Errorf("comment %d was deleted: %w", commentId, ErrCommentNotFound)
+	}
+	_, err = db.Exec("UPDATE comments SET content = ?, edited = ? WHERE id = ?", content, time.Now().Unix(), commentId)
+	if err != nil {
+		return err
+	}
+	return notifyMentions(db, userId, comment.Note, commentId, content)
+}
+
+func getComment(db *sql.DB, commentId int) (*Comment, error) {
+	var comment Comment
+	row := db.QueryRow(
+		"SELECT "+commentColumns+" FROM comments JOIN users ON users.rowid = comments.author "+
+			"WHERE comments.id = ?", commentId)
+	err := scanComment(row, &comment)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no comment %d: %w", commentId, ErrCommentNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+/**
+ * Fetch a comment that userId wrote on a note they can still read.
+ */
+func getOwnComment(db *sql.DB, userId int, commentId int) (*Comment, error) {
+	comment, err := GetComment(db, userId, commentId)
+	if err != nil {
+		return nil, err
+	}
+	if comment.Author != userId {
+		return nil, fmt.Errorf("comment %d is not by user %d: %w", commentId, userId, ErrCommentForbidden)
+	}
+	return comment, nil
+}
+
+func scanComment(row interface{ Scan(...interface{}) error }, comment *Comment) error {
+	return row.Scan(&comment.Id, &comment.Note, &comment.Author, &comment.AuthorName, &comment.Parent,
+		&comment.Content, &comment.Created, &comment.Edited, &comment.Resolved, &comment.Deleted)
+}
@@ -0,0 +1,71 @@
+package notes
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Position in the recent-notes order, which sorts by creation time and
+ * then rowid so that notes created in the same second page stably.
+ */
+type NoteCursor struct {
+	Created int
+	Id      int
+}
+
+/**
+ * Position in the todo order, which sorts by due date, with tasks without
+ * one last, and then by id.
+ */
+type TaskCursor struct {
+	Due string
+	Id  int
+}
+
+func ParseNoteCursor(cursor string) (*NoteCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor: %s", cursor)
+	}
+	fields := strings.Split(string(decoded), ".")
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("malformed cursor: %s", cursor)
+	}
+	created, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor: %s", cursor)
+	}
+	noteId, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor: %s", cursor)
+	}
+	return &NoteCursor{Created: created, Id: noteId}, nil
+}
+
+func (c NoteCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(strconv.Itoa(c.Created) + "." + strconv.Itoa(c.Id)))
+}
+
+func ParseTaskCursor(cursor string) (*TaskCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor: %s", cursor)
+	}
+	fields := strings.Split(string(decoded), ".")
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("malformed cursor: %s", cursor)
+	}
+	taskId, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor: %s", cursor)
+	}
+	return &TaskCursor{Due: fields[0], Id: taskId}, nil
+}
+
+func (c TaskCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.Due + "." + strconv.Itoa(c.Id)))
+}
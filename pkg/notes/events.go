@@ -0,0 +1,231 @@
+package notes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+const EVENT_CREATED = "created"
+const EVENT_DELETED = "deleted"
+const EVENT_PRIVACY = "privacy"
+const EVENT_SHARED = "shared"
+const EVENT_UPDATED = "updated"
+
+// Events older than EVENT_RETENTION_DAYS are pruned, after which clients
+// resuming from them have to reload.
+const EVENT_RETENTION_DAYS = 30
+
+var ErrEventsPruned = errors.New("events pruned")
+
+// Selects the notebook and tags of the note of a row of notes, which
+// events keep so that they can be told even once the note is deleted.
+const noteLabelColumns = "(SELECT notebook FROM notebooks WHERE note = notes.rowid), " +
+	"(SELECT json_group_array(tag) FROM (SELECT tag FROM tags WHERE note = notes.rowid ORDER BY tag))"
+
+/**
+ * A change recorded by the write functions. Privacy is the note's privacy
+ * after the change, Notebook and Tags are the note's when the change was
+ * recorded. User is who Author started sharing with for shared events,
+ * which concern no note.
+ */
+type Event struct {
+	Author   int
+	Created  int
+	Id       int
+	Kind     string
+	NoteId   int      `json:",omitempty"`
+	Notebook string   `json:",omitempty"`
+	Privacy  string   `json:",omitempty"`
+	Tags     []string `json:",omitempty"`
+	User     int      `json:",omitempty"`
+}
+
+type eventBus struct {
+	mutex       sync.Mutex
+	subscribers map[chan int]bool
+}
+
+var bus = eventBus{subscribers: make(map[chan int]bool)}
+
+/**
+ * Return up to limit events after the given id, whoever they concern, with
+ * the id to resume from. Fails with ErrEventsPruned when events after the
+ * given id were pruned.
+ */
+func GetAllEventsAfter(db *sql.DB, after int, limit int) ([]Event, int, error) {
+	return getEventsAfter(db, after, limit, "1")
+}
+
+/**
+ * Return up to limit events after the given id concerning notes userId
+ * could read before or after the change, as currently shared, or sharing
+ * by or with userId.
+ * The returned id is where to resume, past events userId may not read.
+ * Fails with ErrEventsPruned when events after the given id were pruned.
+ */
+func GetEventsAfter(db *sql.DB, userId int, after int, limit int) ([]Event, int, error) {
+	return getEventsAfter(db, after, limit,
+		"(author = ? OR user = ? OR (kind != ? AND ("+
+			"privacy = ? OR previous = ? OR ((privacy = ? OR previous = ?) AND "+
+			"author IN (SELECT user FROM sharing WHERE sharesWith = ?)))))",
+		userId, userId, EVENT_SHARED, PUBLIC_ACCESS, PUBLIC_ACCESS, PROTECTED_ACCESS, PROTECTED_ACCESS, userId)
+}
+
+/**
+ * Return the id of the latest event, 0 when there is none.
+ */
+func GetLatestEventId(db *sql.DB) (int, error) {
+	var latest int
+	err := db.QueryRow("SELECT IFNULL(MAX(id),0) FROM events").Scan(&latest)
+	return latest, err
+}
+
+func PruneEvents(db *sql.DB, before time.Time) (int64, error) {
+	result, err := db.Exec("DELETE FROM events WHERE created < ?", before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+/**
+ * Announce the events committed so far to subscribers. Writes given a
+ * transaction leave announcing their events to the caller, once it has
+ * committed. When the latest id cannot be read, subscribers hear of the
+ * events along with the next ones.
+ */
+func PublishEvents(db *sql.DB) {
+	if latest, err := GetLatestEventId(db); err == nil {
+		announceEvent(latest)
+	}
+}
+
+/**
+ * Subscribe to the ids of committed events, which subscribers then read
+ * with GetEventsAfter. Only the latest id is kept for slow subscribers.
+ */
+func SubscribeEvents() chan int {
+	subscriber := make(chan int, 1)
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.subscribers[subscriber] = true
+	return subscriber
+}
+
+func UnsubscribeEvents(subscriber chan int) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	delete(bus.subscribers, subscriber)
+}
+
+func announceEvent(eventId int) {
+	if eventId <= 0 {
+		return
+	}
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	for subscriber := range bus.subscribers {
+		latest := eventId
+		select {
+		case pending := <-subscriber:
+			if pending > latest {
+				latest = pending
+			}
+		default:
+		}
+		subscriber <- latest
+	}
+}
+
+/**
+ * Return up to limit events after the given id matching a condition, and
+ * the id to resume from.
+ */
+func getEventsAfter(db *sql.DB, after int, limit int, condition string, args ...interface{}) ([]Event, int, error) {
+	var oldest, latest int
+	err := db.QueryRow("SELECT IFNULL(MIN(id),0), IFNULL(MAX(id),0) FROM events").Scan(&oldest, &latest)
+	if err != nil {
+		return nil, after, err
+	}
+	if after > 0 && after < oldest-1 {
+		return nil, after, ErrEventsPruned
+	}
+
+	rows, err := db.Query(
+		"SELECT id, author, created, kind, IFNULL(note,0), IFNULL(notebook,''), IFNULL(privacy,-1), "+
+			"IFNULL(tags,'[]'), IFNULL(user,0) FROM events "+
+			"WHERE id > ? AND id <= ? AND "+condition+" ORDER BY id LIMIT ?",
+		append(append([]interface{}{after, latest}, args...), limit)...)
+	if err != nil {
+		return nil, after, err
+	}
+	defer rows.Close()
+
+	var result []Event
+	for rows.Next() {
+		var event Event
+		var privacy int
+		var tags string
+		if err = rows.Scan(&event.Id, &event.Author, &event.Created, &event.Kind, &event.NoteId,
+			&event.Notebook, &privacy, &tags, &event.User); err != nil {
+			return nil, after, err
+		}
+		if err = json.Unmarshal([]byte(tags), &event.Tags); err != nil {
+			return nil, after, err
+		}
+		if len(event.Tags) == 0 {
+			event.Tags = nil
+		}
+		if privacy >= 0 {
+			event.Privacy = PrivacyName(privacy)
+		}
+		result = append(result, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, after, err
+	}
+	if len(result) == limit {
+		return result, result[len(result)-1].Id, nil
+	}
+	return result, latest, nil
+}
+
+/**
+ * Announce an event recorded outside a transaction, and so already
+ * committed.
+ */
+func publishEvent(db Execer, eventId int) {
+	if _, ok := db.(*sql.DB); ok {
+		announceEvent(eventId)
+	}
+}
+
+/**
+ * Run an insert into events, returning the new event's id or 0 when the
+ * insert selected no row.
+ */
+func recordEvent(db Execer, query string, args ...interface{}) (int, error) {
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	if numRows, err := result.RowsAffected(); err != nil || numRows <= 0 {
+		return 0, err
+	}
+	lastRow, err := result.LastInsertId()
+	return int(lastRow), err
+}
+
+/**
+ * Record an event on a note as it currently is.
+ */
+func recordNoteEvent(db Execer, kind string, noteId int) (int, error) {
+	return recordEvent(db,
+		"INSERT INTO events (author, created, kind, note, previous, privacy, notebook, tags) "+
+			"SELECT author, ?, ?, rowid, IFNULL(privacy,0), IFNULL(privacy,0), "+noteLabelColumns+
+			" FROM notes WHERE rowid = ?",
+		time.Now().Unix(), kind, noteId)
+}
@@ -0,0 +1,25 @@
+package notes
+
+import (
+	"database/sql"
+)
+
+/**
+ * Return the note previously imported by the author from content with
+ * the given hash, or 0 if there is none.
+ */
+func GetImportedNote(db *sql.DB, authorId int, hash string) (int, error) {
+	var noteId int
+	err := db.QueryRow(
+		"SELECT note FROM imports WHERE author = ? AND hash = ?", authorId, hash).Scan(&noteId)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return noteId, err
+}
+
+func RecordImport(db Execer, authorId int, hash string, noteId int) error {
+	query := "INSERT OR REPLACE INTO imports (author, hash, note) VALUES (?, ?, ?)"
+	_, err := db.Exec(query, authorId, hash, noteId)
+	return err
+}
@@ -0,0 +1,257 @@
+package notes
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const JOURNAL_DATE_FORMAT = "2006-01-02"
+const DEFAULT_JOURNAL_TIME_ZONE = "UTC"
+const JOURNAL_TODAY = "today"
+
+const NOTE_TYPE_JOURNAL = "journal"
+
+var ErrInvalidJournal = errors.New("invalid journal")
+
+/**
+ * A date with a journal note.
+ */
+type JournalDay struct {
+	Date   string
+	NoteId int
+}
+
+/**
+ * How journal notes of a user are created: from Template, unless 0, and
+ * dated in TimeZone, an IANA name.
+ */
+type JournalSettings struct {
+	Template int
+	TimeZone string
+}
+
+/**
+ * List the dates from through to, inclusive, with a journal note of
+ * userId, dated in their time zone.
+ */
+func GetJournalDays(db *sql.DB, userId int, from string, to string) ([]JournalDay, error) {
+	location, err := getJournalLocation(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	start, err := ParseJournalDate(from, location)
+	if err != nil {
+		return nil, err
+	}
+	end, err := ParseJournalDate(to, location)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(
+		"SELECT rowid, created FROM notes WHERE author = ? AND type = ? AND created >= ? AND created < ? "+
+			"ORDER BY created, rowid",
+		userId, NOTE_TYPE_JOURNAL, start.Unix(), end.AddDate(0, 0, 1).Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := []JournalDay{}
+	for rows.Next() {
+		var noteId, created int
+		if err = rows.Scan(&noteId, &created); err != nil {
+			return days, err
+		}
+		date := time.Unix(int64(created), 0).In(location).Format(JOURNAL_DATE_FORMAT)
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, JournalDay{Date: date, NoteId: noteId})
+		}
+	}
+	return days, rows.Err()
+}
+
+/**
+ * Return the journal note of userId for a date in their time zone, or
+ * JOURNAL_TODAY, creating it from their journal template unless it
+ * exists. Notes for other days than today are created at noon of that
+ * day, so that they keep their date if the time zone changes by a few
+ * hours. Dates after today are invalid. Reports whether the note was
+ * created.
+ */
+func GetJournalNote(db *sql.DB, userId int, date string) (int, bool, error) {
+	settings, err := GetJournalSettings(db, userId)
+	if err != nil {
+		return 0, false, err
+	}
+	location, err := time.LoadLocation(settings.TimeZone)
+	if err != nil {
+		return 0, false, err
+	}
+	now := time.Now().In(location)
+	if date == JOURNAL_TODAY {
+		date = now.Format(JOURNAL_DATE_FORMAT)
+	}
+	day, err := ParseJournalDate(date, location)
+	if err != nil {
+		return 0, false, err
+	}
+	if day.After(now) {
+		return 0, false, fmt.Errorf("%w: date %s is after today", ErrInvalidJournal, date)
+	}
+	if noteId, err := findJournalNote(db, userId, day); err != sql.ErrNoRows {
+		return noteId, false, err
+	}
+
+	created := time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, location)
+	if now.Format(JOURNAL_DATE_FORMAT) == date {
+		created = now
+	}
+	note, tags, err := newJournalNote(db, userId, settings.Template, date, now)
+	if err != nil {
+		return 0, false, err
+	}
+	note.Created = int(created.Unix())
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	noteId, err := findJournalNote(tx, userId, day)
+	if err != sql.ErrNoRows {
+		tx.Rollback()
+		return noteId, false, err
+	}
+	noteId, err = CreateNote(tx, note)
+	if err == nil {
+		err = SetNoteType(tx, noteId, NOTE_TYPE_JOURNAL)
+	}
+	if err == nil && len(tags) > 0 {
+		err = SetNoteTags(tx, noteId, tags)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	PublishEvents(db)
+	return noteId, true, nil
+}
+
+/**
+ * Return the journal settings of userId, without a template and in UTC
+ * until they set them.
+ */
+func GetJournalSettings(db *sql.DB, userId int) (*JournalSettings, error) {
+	settings := JournalSettings{TimeZone: DEFAULT_JOURNAL_TIME_ZONE}
+	err := db.QueryRow("SELECT template, timeZone FROM journals WHERE user = ?", userId).
+		Scan(&settings.Template, &settings.TimeZone)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+/**
+ * Return the type of a note, "" for plain notes.
+ */
+func GetNoteType(db *sql.DB, noteId int) (string, error) {
+	var noteType string
+	err := db.QueryRow("SELECT IFNULL(type,'') FROM notes WHERE rowid = ?", noteId).Scan(&noteType)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("no note %d: %w", noteId, ErrNoteNotFound)
+	}
+	return noteType, err
+}
+
+/**
+ * Parse a YYYY-MM-DD date as the start of that day in a location, wrapping
+ * ErrInvalidJournal when it is not one.
+ */
+func ParseJournalDate(date string, location *time.Location) (time.Time, error) {
+	day, err := time.ParseInLocation(JOURNAL_DATE_FORMAT, date, location)
+	if err != nil {
+		return day, fmt.Errorf("%w: illegal date %q, expected YYYY-MM-DD", ErrInvalidJournal, date)
+	}
+	return day, nil
+}
+
+/**
+ * Set how journal notes of userId are created, checking that the time
+ * zone is known and that they can read the template.
+ */
+func SetJournalSettings(db *sql.DB, userId int, settings *JournalSettings) error {
+	if _, err := time.LoadLocation(settings.TimeZone); err != nil || settings.TimeZone == "" {
+		return fmt.Errorf("%w: unknown time zone %q", ErrInvalidJournal, settings.TimeZone)
+	}
+	if settings.Template != 0 {
+		if _, err := GetTemplate(db, userId, settings.Template); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec("INSERT OR REPLACE INTO journals (user, template, timeZone) VALUES (?, ?, ?)",
+		userId, settings.Template, settings.TimeZone)
+	return err
+}
+
+func SetNoteType(db Execer, noteId int, noteType string) error {
+	_, err := db.Exec("UPDATE notes SET type = ? WHERE rowid = ?", noteType, noteId)
+	return err
+}
+
+/**
+ * Return the first journal note of userId created on a day, starting at
+ * the time given, or sql.ErrNoRows.
+ */
+func findJournalNote(db Queryer, userId int, day time.Time) (int, error) {
+	var noteId int
+	err := db.QueryRow(
+		"SELECT rowid FROM notes WHERE author = ? AND type = ? AND created >= ? AND created < ? "+
+			"ORDER BY created, rowid LIMIT 1",
+		userId, NOTE_TYPE_JOURNAL, day.Unix(), day.AddDate(0, 0, 1).Unix()).Scan(&noteId)
+	return noteId, err
+}
+
+func getJournalLocation(db *sql.DB, userId int) (*time.Location, error) {
+	settings, err := GetJournalSettings(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	return time.LoadLocation(settings.TimeZone)
+}
+
+/**
+ * Build the journal note of userId for a date from their template, with
+ * the template's privacy and tags, or as a private note titled with the
+ * date when they have none or can no longer read it.
+ */
+func newJournalNote(db *sql.DB, userId int, templateId int, date string, now time.Time) (*NoteRecord, []string, error) {
+	note := NoteRecord{
+		Author:     userId,
+		Content:    "# " + date + "\n\n",
+		Privacy:    PRIVATE_ACCESS,
+		RenderHint: MARKDOWN_RENDER,
+	}
+	if templateId == 0 {
+		return &note, nil, nil
+	}
+	template, err := GetTemplate(db, userId, templateId)
+	if errors.Is(err, ErrTemplateNotFound) || errors.Is(err, ErrNoteNotFound) || errors.Is(err, ErrNoteForbidden) {
+		return &note, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	author, err := GetAuthor(db, userId)
+	if err != nil || author == nil {
+		return nil, nil, fmt.Errorf("no user %d: %v", userId, err)
+	}
+	values := TemplateValues(author.Name, date, now)
+	values["date"] = date
+	note.Content = ExpandTemplate(template.Content, values)
+	note.Privacy = template.Privacy
+	note.RenderHint = template.RenderHint
+	return &note, template.Tags, nil
+}
@@ -0,0 +1,92 @@
+package notes
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// A note without a language set has it detected from its content when
+// indexed.
+const AUTO_LANGUAGE = ""
+
+var LANGUAGES = []string{"de", "en", "es", "fr", "it", "ja", "ko", "zh"}
+
+/**
+ * Return the language set on a note, or AUTO_LANGUAGE when none is.
+ */
+func GetNoteLanguage(db *sql.DB, noteId int) (string, error) {
+	var language string
+	err := db.QueryRow("SELECT language FROM languages WHERE note = ?", noteId).Scan(&language)
+	if err == sql.ErrNoRows {
+		return AUTO_LANGUAGE, nil
+	}
+	return language, err
+}
+
+/**
+ * Fetch the languages set on several notes in one query, keyed by note id.
+ */
+func GetNotesLanguages(db *sql.DB, noteIds []int) (map[int]string, error) {
+	result := make(map[int]string)
+	if len(noteIds) == 0 {
+		return result, nil
+	}
+	args := make([]interface{}, len(noteIds))
+	for i, noteId := range noteIds {
+		args[i] = noteId
+	}
+	rows, err := db.Query(
+		"SELECT note, language FROM languages WHERE note IN ("+Placeholders(len(noteIds))+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var noteId int
+	var language string
+	for rows.Next() {
+		if err = rows.Scan(&noteId, &language); err != nil {
+			return result, err
+		}
+		result[noteId] = language
+	}
+	return result, rows.Err()
+}
+
+/**
+ * Accept an ISO 639-1 code among LANGUAGES in any case, or blank or "auto"
+ * for AUTO_LANGUAGE.
+ */
+func ParseLanguage(language string) (string, error) {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if language == "" || language == "auto" {
+		return AUTO_LANGUAGE, nil
+	}
+	for _, supported := range LANGUAGES {
+		if language == supported {
+			return language, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported language: %s", language)
+}
+
+/**
+ * Set the language of a note, or go back to detecting it when the
+ * language is AUTO_LANGUAGE.
+ */
+func SetNoteLanguage(db Execer, noteId int, language string) error {
+	language, err := ParseLanguage(language)
+	if err != nil {
+		return err
+	}
+	if language == AUTO_LANGUAGE {
+		_, err = db.Exec("DELETE FROM languages WHERE note = ?", noteId)
+	} else {
+		_, err = db.Exec("INSERT OR REPLACE INTO languages (note, language) VALUES (?, ?)", noteId, language)
+	}
+	if err != nil {
+		return err
+	}
+	return touchNote(db, noteId, false)
+}
@@ -0,0 +1,95 @@
+package notes
+
+import (
+	"database/sql"
+	"strings"
+)
+
+type NotebookRecord struct {
+	Count int
+	Name  string
+}
+
+/**
+ * List the notebooks holding notes of an author, by name, with the number
+ * of those notes in each.
+ */
+func GetAuthorNotebooks(db *sql.DB, authorId int) ([]NotebookRecord, error) {
+	rows, err := db.Query(
+		"SELECT notebooks.notebook, COUNT(*) FROM notebooks JOIN notes ON notes.rowid = notebooks.note "+
+			"WHERE notes.author = ? GROUP BY notebooks.notebook ORDER BY notebooks.notebook", authorId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notebooks := []NotebookRecord{}
+	for rows.Next() {
+		var notebook NotebookRecord
+		if err = rows.Scan(&notebook.Name, &notebook.Count); err != nil {
+			return notebooks, err
+		}
+		notebooks = append(notebooks, notebook)
+	}
+	return notebooks, rows.Err()
+}
+
+/**
+ * Return the notebook holding a note, or "" when it is in none.
+ */
+func GetNoteNotebook(db *sql.DB, noteId int) (string, error) {
+	var notebook string
+	err := db.QueryRow("SELECT notebook FROM notebooks WHERE note = ?", noteId).Scan(&notebook)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return notebook, err
+}
+
+/**
+ * Fetch the notebooks of several notes in one query, keyed by note id.
+ */
+func GetNotesNotebooks(db *sql.DB, noteIds []int) (map[int]string, error) {
+	result := make(map[int]string)
+	if len(noteIds) == 0 {
+		return result, nil
+	}
+	args := make([]interface{}, len(noteIds))
+	for i, noteId := range noteIds {
+		args[i] = noteId
+	}
+	rows, err := db.Query(
+		"SELECT note, notebook FROM notebooks WHERE note IN ("+Placeholders(len(noteIds))+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var noteId int
+	var notebook string
+	for rows.Next() {
+		if err = rows.Scan(&noteId, &notebook); err != nil {
+			return result, err
+		}
+		result[noteId] = notebook
+	}
+	return result, rows.Err()
+}
+
+/**
+ * Move a note into a notebook, or out of any notebook when the name is
+ * blank.
+ */
+func SetNoteNotebook(db Execer, noteId int, notebook string) error {
+	var err error
+	notebook = strings.TrimSpace(notebook)
+	if notebook == "" {
+		_, err = db.Exec("DELETE FROM notebooks WHERE note = ?", noteId)
+	} else {
+		_, err = db.Exec("INSERT OR REPLACE INTO notebooks (note, notebook) VALUES (?, ?)", noteId, notebook)
+	}
+	if err != nil {
+		return err
+	}
+	return touchNote(db, noteId, false)
+}
@@ -2,7 +2,12 @@ package notes
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -12,11 +17,35 @@ const PROTECTED_ACCESS = 1
 const PUBLIC_ACCESS = 2
 const DEFAULT_ACCESS = 1
 
+const PLAIN_TEXT_RENDER = 0
+const MARKDOWN_RENDER = 1
+const CODE_RENDER = 2
+
+// Internal links between notes are written as [text](note:<id>) and to
+// a note's attachments as [text](attachment:<name>).
+const ATTACHMENT_LINK_PREFIX = "attachment:"
+const NOTE_LINK_PREFIX = "note:"
+
+var ErrNoteForbidden = errors.New("note not accessible")
+var ErrNoteNotFound = errors.New("note not found")
+
 type AuthorRecord struct {
 	Id   int
 	Name string
 }
 
+// Execer is satisfied by both *sql.DB and *sql.Tx so that writes can be
+// batched in transactions.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+type NoteEntry struct {
+	NoteRecord
+	AuthorName string
+	Id         int
+}
+
 type NoteRecord struct {
 	Author     int
 	Content    string
@@ -25,11 +54,38 @@ type NoteRecord struct {
 	RenderHint int
 }
 
+// Queryer is satisfied by both *sql.DB and *sql.Tx so that checks can be
+// made in the transaction of the write they guard.
+type Queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 type TitleRecord struct {
 	Id    int
 	Title string
 }
 
+func AttachmentLink(name string) string {
+	return ATTACHMENT_LINK_PREFIX + url.PathEscape(name)
+}
+
+/**
+ * Tell whether userId may edit a note: its author may, and so may those
+ * the author shares with when the note is protected. Public notes are
+ * only readable by others.
+ */
+func CanEditNote(db Queryer, userId int, noteId int) (bool, error) {
+	var canEdit bool
+	err := db.QueryRow(
+		"SELECT author = ? OR (IFNULL(privacy,0) = ? AND author IN (SELECT user FROM sharing WHERE sharesWith = ?)) "+
+			"FROM notes WHERE rowid = ?",
+		userId, PROTECTED_ACCESS, userId, noteId).Scan(&canEdit)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("no note %d: %w", noteId, ErrNoteNotFound)
+	}
+	return canEdit, err
+}
+
 func CreateAuthor(db *sql.DB, authorName string, password string) (int, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 0)
 	if err != nil {
@@ -51,7 +107,7 @@ func CreateAuthor(db *sql.DB, authorName string, password string) (int, error) {
 	return authorId, err
 }
 
-func CreateNote(db *sql.DB, note *NoteRecord) (int, error) {
+func CreateNote(db Execer, note *NoteRecord) (int, error) {
 	query := "INSERT INTO notes(author, content, created, privacy, renderHint) " +
 		"VALUES(?, ?, ?, ?, ?)"
 	result, err := db.Exec(query, note.Author, note.Content, note.Created, note.Privacy, note.RenderHint)
@@ -59,7 +115,24 @@ func CreateNote(db *sql.DB, note *NoteRecord) (int, error) {
 		return 0, err
 	}
 	lastRow, err := result.LastInsertId()
-	return int(lastRow), err
+	if err != nil {
+		return 0, err
+	}
+	if err = touchNote(db, int(lastRow), false); err != nil {
+		return 0, err
+	}
+	if err = setNoteTasks(db, int(lastRow), note.Content); err != nil {
+		return 0, err
+	}
+	if err = notifyMentions(db, note.Author, int(lastRow), 0, note.Content); err != nil {
+		return 0, err
+	}
+	eventId, err := recordNoteEvent(db, EVENT_CREATED, int(lastRow))
+	if err != nil {
+		return 0, err
+	}
+	publishEvent(db, eventId)
+	return int(lastRow), nil
 }
 
 func CreateNoteDb(dbFileName string) (*sql.DB, error) {
@@ -68,13 +141,59 @@ func CreateNoteDb(dbFileName string) (*sql.DB, error) {
 		return nil, err
 	}
 	db.SetMaxOpenConns(1)
+	var hasTasks bool
+	err = db.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'tasks'").Scan(&hasTasks)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	queries := []string{
-		"CREATE TABLE IF NOT EXISTS notes (author INT, content TEXT, created INT, privacy INT, renderHint INT)",
+		"CREATE TABLE IF NOT EXISTS notes (author INT, content TEXT, created INT, privacy INT, renderHint INT, type TEXT)",
 		"CREATE TABLE IF NOT EXISTS users (userName TEXT, secret TEXT)",
 		"CREATE TABLE IF NOT EXISTS sharing (user INT, sharesWith INT, UNIQUE(user, sharesWith))",
 		"CREATE INDEX IF NOT EXISTS idx_shares_with ON sharing (sharesWith)",
 		"CREATE INDEX IF NOT EXISTS idx_sharing_users ON sharing (user)",
+		"CREATE TABLE IF NOT EXISTS tags (note INT, tag TEXT, UNIQUE(note, tag))",
+		"CREATE INDEX IF NOT EXISTS idx_tags_tag ON tags (tag)",
+		"CREATE TABLE IF NOT EXISTS imports (author INT, hash TEXT, note INT, UNIQUE(author, hash))",
+		"CREATE TABLE IF NOT EXISTS attachments (note INT, name TEXT, mimeType TEXT, content BLOB, UNIQUE(note, name))",
+		"CREATE TABLE IF NOT EXISTS notebooks (note INT UNIQUE, notebook TEXT)",
+		"CREATE INDEX IF NOT EXISTS idx_notebooks_notebook ON notebooks (notebook)",
+		"CREATE TABLE IF NOT EXISTS languages (note INT UNIQUE, language TEXT)",
+		"CREATE TABLE IF NOT EXISTS searches (author INT, created INT, name TEXT, pinned INT, query TEXT, UNIQUE(author, name))",
+		"CREATE TABLE IF NOT EXISTS events (id INTEGER PRIMARY KEY AUTOINCREMENT, author INT, created INT, kind TEXT, " +
+			"note INT, previous INT, privacy INT, user INT, notebook TEXT, tags TEXT)",
+		"CREATE TABLE IF NOT EXISTS revisions (note INTEGER PRIMARY KEY, author INT, deleted INT, previous INT, " +
+			"privacy INT, revision INT, sequence INT)",
+		"CREATE INDEX IF NOT EXISTS idx_revisions_sequence ON revisions (sequence)",
+		"CREATE TABLE IF NOT EXISTS comments (id INTEGER PRIMARY KEY AUTOINCREMENT, note INT, author INT, parent INT, " +
+			"content TEXT, created INT, edited INT, resolved INT, deleted INT)",
+		"CREATE INDEX IF NOT EXISTS idx_comments_note ON comments (note)",
+		"CREATE INDEX IF NOT EXISTS idx_comments_parent ON comments (parent)",
+		"CREATE TABLE IF NOT EXISTS follows (user INT, note INT, UNIQUE(user, note))",
+		"CREATE INDEX IF NOT EXISTS idx_follows_note ON follows (note)",
+		"CREATE TABLE IF NOT EXISTS notifications (id INTEGER PRIMARY KEY AUTOINCREMENT, user INT, actor INT, " +
+			"kind TEXT, note INT, comment INT, created INT, read INT)",
+		"CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications (user, read)",
+		"CREATE TABLE IF NOT EXISTS webhooks (id INTEGER PRIMARY KEY AUTOINCREMENT, active INT, allUsers INT, " +
+			"author INT, created INT, cursor INT, events TEXT, notebook TEXT, secret TEXT, tag TEXT, url TEXT)",
+		"CREATE TABLE IF NOT EXISTS deliveries (id INTEGER PRIMARY KEY AUTOINCREMENT, attempts INT, created INT, " +
+			"delivered INT, error TEXT, event INT, kind TEXT, nextAttempt INT, payload TEXT, responseCode INT, " +
+			"status TEXT, webhook INT)",
+		"CREATE INDEX IF NOT EXISTS idx_deliveries_status ON deliveries (status, nextAttempt)",
+		"CREATE INDEX IF NOT EXISTS idx_deliveries_webhook ON deliveries (webhook)",
+		"CREATE TABLE IF NOT EXISTS templates (note INT UNIQUE, privacy INT)",
+		"CREATE TABLE IF NOT EXISTS templateTags (note INT, tag TEXT, UNIQUE(note, tag))",
+		"CREATE TABLE IF NOT EXISTS journals (user INT UNIQUE, template INT, timeZone TEXT)",
+		"CREATE TABLE IF NOT EXISTS tasks (id INTEGER PRIMARY KEY AUTOINCREMENT, note INT, position INT, line INT, " +
+			"done INT, due TEXT, text TEXT, UNIQUE(note, position))",
+		"CREATE INDEX IF NOT EXISTS idx_tasks_due ON tasks (done, due)",
+		// Notes written before revisions were kept start at revision 1.
+		"INSERT INTO revisions (note, author, deleted, previous, privacy, revision, sequence) " +
+			"SELECT rowid, author, 0, IFNULL(privacy,0), IFNULL(privacy,0), 1, " +
+			"(SELECT IFNULL(MAX(sequence),0) FROM revisions) + rowid FROM notes " +
+			"WHERE rowid NOT IN (SELECT note FROM revisions)",
 	}
 	for _, query := range queries {
 		if _, err = db.Exec(query); err != nil {
@@ -82,10 +201,76 @@ func CreateNoteDb(dbFileName string) (*sql.DB, error) {
 			return nil, err
 		}
 	}
+	// Notes created before note types are plain notes.
+	if err = addColumn(db, "notes", "type", "TEXT"); err == nil {
+		_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_notes_type ON notes (author, type, created)")
+	}
+	if err == nil && !hasTasks {
+		err = setAllNoteTasks(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	return db, nil
 }
 
+/**
+ * Delete a note authored by userId along with its tags, attachments,
+ * notebook membership, language, comments, followers, notifications,
+ * template flag and tasks, in a transaction of the caller so that it can
+ * check the note's revision first. The caller publishes the event once
+ * committed.
+ */
+func DeleteNote(tx *sql.Tx, userId int, noteId int) error {
+	_, err := recordNoteEvent(tx, EVENT_DELETED, noteId)
+	if err == nil {
+		err = touchNote(tx, noteId, true)
+	}
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM notes WHERE rowid = ? AND author = ?", noteId, userId)
+	if err != nil {
+		return err
+	}
+	if numRows, err := result.RowsAffected(); err != nil || numRows <= 0 {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("delete matches no user-note id pair: %d %d", userId, noteId)
+	}
+	for _, query := range []string{
+		"DELETE FROM tags WHERE note = ?",
+		"DELETE FROM attachments WHERE note = ?",
+		"DELETE FROM imports WHERE note = ?",
+		"DELETE FROM notebooks WHERE note = ?",
+		"DELETE FROM languages WHERE note = ?",
+		"DELETE FROM comments WHERE note = ?",
+		"DELETE FROM follows WHERE note = ?",
+		"DELETE FROM notifications WHERE note = ?",
+		"DELETE FROM templates WHERE note = ?",
+		"DELETE FROM templateTags WHERE note = ?",
+		"DELETE FROM tasks WHERE note = ?",
+	} {
+		if _, err = tx.Exec(query, noteId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Replace the content of a note editorId can edit, as CanEditNote tells,
+ * as an edit of theirs rather than of the note's author.
+ */
+func EditNoteContent(db Execer, editorId int, noteId int, content string) error {
+	return updateNoteContent(db, editorId, noteId, content,
+		"(author = ? OR (IFNULL(privacy,0) = ? AND author IN (SELECT user FROM sharing WHERE sharesWith = ?)))",
+		editorId, PROTECTED_ACCESS, editorId)
+}
+
 func GetAuthor(db *sql.DB, userId int) (*AuthorRecord, error) {
 	var author AuthorRecord
 	rows, err := db.Query(
@@ -104,6 +289,43 @@ func GetAuthor(db *sql.DB, userId int) (*AuthorRecord, error) {
 	return &author, nil
 }
 
+func GetAuthorByName(db *sql.DB, userName string) (*AuthorRecord, error) {
+	var author AuthorRecord
+	rows, err := db.Query(
+		"SELECT rowId AS id, userName AS name FROM users WHERE userName = ?", userName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, nil
+	}
+	if err = rows.Scan(&author.Id, &author.Name); err != nil {
+		return nil, err
+	}
+	return &author, nil
+}
+
+func GetAuthorNotes(db *sql.DB, authorId int) ([]int, error) {
+	rows, err := db.Query(
+		"SELECT rowid FROM notes WHERE author = ? ORDER BY created, rowid", authorId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []int
+	var rowid int
+	for rows.Next() {
+		if err = rows.Scan(&rowid); err != nil {
+			return result, err
+		}
+		result = append(result, rowid)
+	}
+	return result, rows.Err()
+}
+
 func GetNote(db *sql.DB, userId int, noteId int) (*NoteRecord, error) {
 	var note NoteRecord
 	rows, err := db.Query(
@@ -118,7 +340,11 @@ func GetNote(db *sql.DB, userId int, noteId int) (*NoteRecord, error) {
 	defer rows.Close()
 
 	if !rows.Next() {
-		return nil, fmt.Errorf("no note %d accessible to user %d", noteId, userId)
+		rows.Close()
+		if _, err = GetNoteAuthor(db, noteId); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no note %d accessible to user %d: %w", noteId, userId, ErrNoteForbidden)
 	}
 	if err = rows.Scan(&note.Author, &note.Content, &note.Created, &note.Privacy, &note.RenderHint); err != nil {
 		return nil, err
@@ -126,32 +352,115 @@ func GetNote(db *sql.DB, userId int, noteId int) (*NoteRecord, error) {
 	return &note, nil
 }
 
-func GetRecentNotes(db *sql.DB, userId int, limit int) ([]int, error) {
+/**
+ * Return the author of a note, or ErrNoteNotFound.
+ */
+func GetNoteAuthor(db *sql.DB, noteId int) (int, error) {
+	var authorId int
+	err := db.QueryRow("SELECT author FROM notes WHERE rowid = ?", noteId).Scan(&authorId)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("no note %d: %w", noteId, ErrNoteNotFound)
+	}
+	return authorId, err
+}
+
+/**
+ * Fetch the notes readable by userId among noteIds, with their author
+ * names, in one query. Unreadable and missing notes are left out; the
+ * rest keep the order of noteIds.
+ */
+func GetNotes(db *sql.DB, userId int, noteIds []int) ([]NoteEntry, error) {
+	if len(noteIds) == 0 {
+		return nil, nil
+	}
+	args := []interface{}{userId, PUBLIC_ACCESS, PROTECTED_ACCESS, userId}
+	for _, noteId := range noteIds {
+		args = append(args, noteId)
+	}
 	rows, err := db.Query(
-		"SELECT DISTINCT(notes.rowid) FROM notes, sharing "+
-			"WHERE notes.author = ? OR notes.privacy = ? OR "+
-			"(notes.privacy = ? AND sharing.user = notes.author AND sharing.sharesWith = ?) "+
-			"ORDER BY notes.created DESC LIMIT ?",
-		userId, PUBLIC_ACCESS, PROTECTED_ACCESS, userId, limit)
+		"SELECT DISTINCT notes.rowid, notes.author, users.userName, notes.content, notes.created, "+
+			"IFNULL(notes.privacy,0), IFNULL(notes.renderHint,0) "+
+			"FROM notes JOIN users ON users.rowid = notes.author, sharing "+
+			"WHERE (notes.author = ? OR notes.privacy = ? OR "+
+			"(notes.privacy = ? AND sharing.user = notes.author AND sharing.sharesWith = ?)) "+
+			"AND notes.rowid IN ("+Placeholders(len(noteIds))+")",
+		args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var result []int
-	var rowid int
+	found := make(map[int]NoteEntry)
 	for rows.Next() {
-		if err = rows.Scan(&rowid); err != nil {
-			return result, err
+		var entry NoteEntry
+		if err = rows.Scan(&entry.Id, &entry.Author, &entry.AuthorName, &entry.Content, &entry.Created,
+			&entry.Privacy, &entry.RenderHint); err != nil {
+			return nil, err
 		}
-		result = append(result, rowid)
+		found[entry.Id] = entry
 	}
 	if err = rows.Err(); err != nil {
-		return result, err
+		return nil, err
+	}
+
+	var result []NoteEntry
+	for _, noteId := range noteIds {
+		if entry, ok := found[noteId]; ok {
+			result = append(result, entry)
+			delete(found, noteId)
+		}
 	}
 	return result, nil
 }
 
+func GetRecentNotes(db *sql.DB, userId int, limit int) ([]int, error) {
+	noteIds, _, err := GetRecentNotesAfter(db, userId, limit, nil)
+	return noteIds, err
+}
+
+/**
+ * Return up to limit notes readable by userId, newest first, starting after
+ * the cursor if given. The returned cursor is nil on the last page.
+ */
+func GetRecentNotesAfter(db *sql.DB, userId int, limit int, after *NoteCursor) ([]int, *NoteCursor, error) {
+	query := "SELECT DISTINCT notes.rowid, notes.created FROM notes, sharing " +
+		"WHERE (notes.author = ? OR notes.privacy = ? OR " +
+		"(notes.privacy = ? AND sharing.user = notes.author AND sharing.sharesWith = ?)) "
+	args := []interface{}{userId, PUBLIC_ACCESS, PROTECTED_ACCESS, userId}
+	if after != nil {
+		query += "AND (notes.created < ? OR (notes.created = ? AND notes.rowid < ?)) "
+		args = append(args, after.Created, after.Created, after.Id)
+	}
+	query += "ORDER BY notes.created DESC, notes.rowid DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var result []int
+	var cursor NoteCursor
+	for rows.Next() {
+		if len(result) == limit {
+			return result, &cursor, nil
+		}
+		if err = rows.Scan(&cursor.Id, &cursor.Created); err != nil {
+			return result, nil, err
+		}
+		result = append(result, cursor.Id)
+	}
+	if err = rows.Err(); err != nil {
+		return result, nil, err
+	}
+	return result, nil, nil
+}
+
+func NoteLink(noteId int) string {
+	return NOTE_LINK_PREFIX + strconv.Itoa(noteId)
+}
+
 func OpenNoteDb(dbFileName string) (*sql.DB, error) {
 	db, err := sql.Open("sqlite3", dbFileName+"?cache=shared")
 	if err != nil {
@@ -165,11 +474,57 @@ func OpenNoteDb(dbFileName string) (*sql.DB, error) {
 	return db, nil
 }
 
-func SetNotePrivacy(db *sql.DB, userId int, noteId int, privacy int) error {
+func ParsePrivacy(privacy string) (int, error) {
+	switch privacy {
+	case "private":
+		return PRIVATE_ACCESS, nil
+	case "protected":
+		return PROTECTED_ACCESS, nil
+	case "public":
+		return PUBLIC_ACCESS, nil
+	}
+	mode, err := strconv.Atoi(privacy)
+	if err != nil || mode < 0 || mode > PUBLIC_ACCESS {
+		return 0, fmt.Errorf("illegal privacy mode: %s", privacy)
+	}
+	return mode, nil
+}
+
+/**
+ * Return n comma-separated SQL placeholders for an IN clause.
+ */
+func Placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strings.Repeat("?,", n-1) + "?"
+}
+
+func PrivacyName(privacy int) string {
+	switch privacy {
+	case PRIVATE_ACCESS:
+		return "private"
+	case PUBLIC_ACCESS:
+		return "public"
+	}
+	return "protected"
+}
+
+func SetNotePrivacy(db Execer, userId int, noteId int, privacy int) error {
 	if privacy < 0 || privacy > PUBLIC_ACCESS {
 		return fmt.Errorf("illegal privacy mode: %d", privacy)
 	}
 
+	// Recorded first to keep the previous privacy, so that users losing
+	// access hear about it.
+	eventId, err := recordEvent(db,
+		"INSERT INTO events (author, created, kind, note, previous, privacy, notebook, tags) "+
+			"SELECT author, ?, ?, rowid, IFNULL(privacy,0), ?, "+noteLabelColumns+
+			" FROM notes WHERE rowid = ? AND author = ?",
+		time.Now().Unix(), EVENT_PRIVACY, privacy, noteId, userId)
+	if err != nil {
+		return err
+	}
 	query := "UPDATE notes SET privacy = ? WHERE rowid = ? AND author = ?"
 	result, err := db.Exec(query, privacy, noteId, userId)
 	if err != nil {
@@ -179,11 +534,107 @@ func SetNotePrivacy(db *sql.DB, userId int, noteId int, privacy int) error {
 	if numRows <= 0 {
 		return fmt.Errorf("privacy update matches no user-note id pair: %d %d", userId, noteId)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	if err = touchNote(db, noteId, false); err != nil {
+		return err
+	}
+	publishEvent(db, eventId)
+	return nil
+}
+
+func SetNoteRenderHint(db Execer, userId int, noteId int, renderHint int) error {
+	if renderHint < PLAIN_TEXT_RENDER || renderHint > CODE_RENDER {
+		return fmt.Errorf("illegal render hint: %d", renderHint)
+	}
+
+	query := "UPDATE notes SET renderHint = ? WHERE rowid = ? AND author = ?"
+	result, err := db.Exec(query, renderHint, noteId, userId)
+	if err != nil {
+		return err
+	}
+	numRows, err := result.RowsAffected()
+	if numRows <= 0 {
+		return fmt.Errorf("render hint update matches no user-note id pair: %d %d", userId, noteId)
+	}
+	if err != nil {
+		return err
+	}
+	return touchNote(db, noteId, false)
 }
 
 func SharesWith(db *sql.DB, sharerId int, shareeId int) error {
 	query := "INSERT INTO sharing (user, sharesWith) VALUES (?, ?)"
-	_, err := db.Exec(query, sharerId, shareeId)
+	if _, err := db.Exec(query, sharerId, shareeId); err != nil || sharerId == shareeId {
+		return err
+	}
+	if err := resequenceSharedNotes(db, sharerId); err != nil {
+		return err
+	}
+	if err := notifyShared(db, sharerId, shareeId); err != nil {
+		return err
+	}
+	eventId, err := recordEvent(db, "INSERT INTO events (author, created, kind, user) VALUES (?, ?, ?, ?)",
+		sharerId, time.Now().Unix(), EVENT_SHARED, shareeId)
+	if err != nil {
+		return err
+	}
+	publishEvent(db, eventId)
+	return nil
+}
+
+func UpdateNoteContent(db Execer, userId int, noteId int, content string) error {
+	return updateNoteContent(db, userId, noteId, content, "author = ?", userId)
+}
+
+/**
+ * Add a column to a table created before the column existed.
+ */
+func addColumn(db *sql.DB, table string, column string, definition string) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
 	return err
 }
+
+/**
+ * Replace the content of a note matching a condition on notes, notifying
+ * mentions and followers of the edit by editorId.
+ */
+func updateNoteContent(db Execer, editorId int, noteId int, content string, condition string,
+	args ...interface{}) error {
+	query := "UPDATE notes SET content = ? WHERE rowid = ? AND " + condition
+	result, err := db.Exec(query, append([]interface{}{content, noteId}, args...)...)
+	if err != nil {
+		return err
+	}
+	numRows, err := result.RowsAffected()
+	if numRows <= 0 {
+		return fmt.Errorf("content update matches no user-note id pair: %d %d", editorId, noteId)
+	}
+	if err != nil {
+		return err
+	}
+	if err = touchNote(db, noteId, false); err != nil {
+		return err
+	}
+	if err = setNoteTasks(db, noteId, content); err != nil {
+		return err
+	}
+	if err = notifyMentions(db, editorId, noteId, 0, content); err != nil {
+		return err
+	}
+	if err = notifyFollowers(db, editorId, noteId); err != nil {
+		return err
+	}
+	eventId, err := recordNoteEvent(db, EVENT_UPDATED, noteId)
+	if err != nil {
+		return err
+	}
+	publishEvent(db, eventId)
+	return nil
+}
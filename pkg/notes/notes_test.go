@@ -2,8 +2,10 @@ package notes
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -102,6 +104,57 @@ func Test_GetsRecentNotes(t *testing.T) {
 		fmt.Sprintf("expected: %v, got %v", expectedRecent, recent))
 }
 
+func Test_GetsReadableNotesInBatch(t *testing.T) {
+	dbFileName := ":memory:"
+	db, err := createDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+
+	authorId2, err := CreateAuthor(db, "Another Test User", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+	publicId, _ := CreateNote(db, &NoteRecord{authorId2, "public", 1, PUBLIC_ACCESS, 0})
+	privateId, _ := CreateNote(db, &NoteRecord{authorId2, "private", 2, PRIVATE_ACCESS, 0})
+	ownId, _ := CreateNote(db, &NoteRecord{1, "own", 3, PRIVATE_ACCESS, 0})
+
+	entries, err := GetNotes(db, 1, []int{ownId, privateId, publicId, 99})
+	assert.Nil(t, err, "Unexpected error on batch retrieval")
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, ownId, entries[0].Id)
+	assert.Equal(t, "Test User", entries[0].AuthorName)
+	assert.Equal(t, publicId, entries[1].Id)
+	assert.Equal(t, "Another Test User", entries[1].AuthorName)
+}
+
+func Test_PagesRecentNotes(t *testing.T) {
+	dbFileName := ":memory:"
+	db, err := createDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+
+	userId := 1
+	for i := 1; i < 6; i++ {
+		note := NoteRecord{
+			userId, "some note", i / 2, DEFAULT_ACCESS, 0,
+		}
+		_, _ = CreateNote(db, &note)
+	}
+
+	page, cursor, err := GetRecentNotesAfter(db, userId, 3, nil)
+	assert.Nil(t, err, "Unexpected error getting first page")
+	assert.Equal(t, []int{5, 4, 3}, page)
+	assert.NotNil(t, cursor, "Expected cursor for next page")
+
+	parsed, err := ParseNoteCursor(cursor.String())
+	assert.Nil(t, err, "Unexpected error parsing cursor")
+	page, cursor, err = GetRecentNotesAfter(db, userId, 3, parsed)
+	assert.Nil(t, err, "Unexpected error getting last page")
+	assert.Equal(t, []int{2, 1}, page)
+	assert.Nil(t, cursor, "Unexpected cursor on last page")
+
+	_, err = ParseNoteCursor("bogus")
+	assert.NotNil(t, err, "Expected error on malformed cursor")
+}
+
 func Test_ChecksPrivacyMode(t *testing.T) {
 	dbFileName := ":memory:"
 	db, err := createDb(dbFileName)
@@ -162,6 +215,646 @@ func Test_UpdatesPrivacy(t *testing.T) {
 	assert.NotNil(t, err, "Expected error on private-note retrieval")
 }
 
+func Test_SetsNoteTags(t *testing.T) {
+	dbFileName := ":memory:"
+	db, err := createDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+
+	note := NoteRecord{
+		1, "# My first note", int(time.Now().Unix()), DEFAULT_ACCESS, 0,
+	}
+	id, err := CreateNote(db, &note)
+	assert.Nil(t, err, "Unexpected error on note insertion")
+
+	err = SetNoteTags(db, id, []string{"#Work", "home", " ", "work"})
+	assert.Nil(t, err, "Unexpected error on set tags")
+	tags, err := GetNoteTags(db, id)
+	assert.Nil(t, err, "Unexpected error on get tags")
+	assert.Equal(t, []string{"home", "work"}, tags)
+
+	err = SetNoteTags(db, id, []string{"travel"})
+	assert.Nil(t, err, "Unexpected error on replacing tags")
+	tags, _ = GetNoteTags(db, id)
+	assert.Equal(t, []string{"travel"}, tags)
+}
+
+func Test_ParsesPrivacy(t *testing.T) {
+	for name, expected := range map[string]int{
+		"private": PRIVATE_ACCESS, "protected": PROTECTED_ACCESS, "public": PUBLIC_ACCESS, "2": PUBLIC_ACCESS,
+	} {
+		privacy, err := ParsePrivacy(name)
+		assert.Nil(t, err, "Unexpected error parsing privacy "+name)
+		assert.Equal(t, expected, privacy)
+		assert.Equal(t, PrivacyName(expected), PrivacyName(privacy))
+	}
+	_, err := ParsePrivacy("secret")
+	assert.NotNil(t, err, "Expected error on illegal privacy name")
+}
+
+func Test_DistinguishesMissingFromForbidden(t *testing.T) {
+	dbFileName := ":memory:"
+	db, err := createDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+
+	note := NoteRecord{
+		1, "#Private note", int(time.Now().Unix()), PRIVATE_ACCESS, 0,
+	}
+	id, err := CreateNote(db, &note)
+	assert.Nil(t, err, "Unexpected error on note insertion")
+
+	_, err = GetNote(db, 2, id)
+	assert.True(t, errors.Is(err, ErrNoteForbidden), "Expected forbidden error, got %v", err)
+	_, err = GetNote(db, 1, id+1)
+	assert.True(t, errors.Is(err, ErrNoteNotFound), "Expected not found error, got %v", err)
+}
+
+func Test_DeletesNote(t *testing.T) {
+	dbFileName := ":memory:"
+	db, err := createDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+
+	note := NoteRecord{
+		1, "# My first note", int(time.Now().Unix()), DEFAULT_ACCESS, 0,
+	}
+	id, err := CreateNote(db, &note)
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	assert.Nil(t, SetNoteTags(db, id, []string{"work"}), "Unexpected error on set tags")
+
+	err = deleteNote(db, 2, id)
+	assert.NotNil(t, err, "Expected error on unauthorized delete")
+	err = deleteNote(db, 1, id)
+	assert.Nil(t, err, "Unexpected error on delete")
+
+	_, err = GetNote(db, 1, id)
+	assert.True(t, errors.Is(err, ErrNoteNotFound), "Expected deleted note to be missing")
+	tags, _ := GetNoteTags(db, id)
+	assert.Empty(t, tags)
+}
+
+func Test_SavesSearches(t *testing.T) {
+	dbFileName := ":memory:"
+	db, err := createDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+
+	search := SavedSearch{Author: 1, Name: " Weekly ", Pinned: true, Query: `{"text":"weekly"}`}
+	id, err := CreateSavedSearch(db, &search)
+	assert.Nil(t, err, "Unexpected error saving search")
+	_, err = CreateSavedSearch(db, &SavedSearch{Author: 1, Name: "Weekly"})
+	assert.True(t, errors.Is(err, ErrSearchExists), "Expected duplicate name to be refused")
+	_, err = CreateSavedSearch(db, &SavedSearch{Author: 1, Name: "Daily"})
+	assert.Nil(t, err, "Unexpected error saving search")
+
+	saved, err := GetSavedSearch(db, 1, id)
+	assert.Nil(t, err, "Unexpected error fetching saved search")
+	assert.Equal(t, "Weekly", saved.Name)
+	_, err = GetSavedSearch(db, 2, id)
+	assert.True(t, errors.Is(err, ErrSearchNotFound), "Expected other author's search to be missing")
+
+	searches, err := GetSavedSearches(db, 1, false)
+	assert.Nil(t, err, "Unexpected error listing saved searches")
+	assert.Equal(t, 2, len(searches))
+	assert.Equal(t, "Daily", searches[0].Name)
+	searches, err = GetSavedSearches(db, 1, true)
+	assert.Nil(t, err, "Unexpected error listing pinned searches")
+	assert.Equal(t, []SavedSearch{*saved}, searches)
+
+	saved.Name = "Daily"
+	assert.True(t, errors.Is(UpdateSavedSearch(db, saved), ErrSearchExists), "Expected rename to be refused")
+	assert.True(t, errors.Is(DeleteSavedSearch(db, 2, id), ErrSearchNotFound), "Expected unauthorized delete to fail")
+	assert.Nil(t, DeleteSavedSearch(db, 1, id), "Unexpected error deleting saved search")
+}
+
+func Test_SetsNoteLanguage(t *testing.T) {
+	dbFileName := ":memory:"
+	db, err := createDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+
+	note := NoteRecord{1, "# Appunti", int(time.Now().Unix()), DEFAULT_ACCESS, 0}
+	id, err := CreateNote(db, &note)
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	language, err := GetNoteLanguage(db, id)
+	assert.Nil(t, err, "Unexpected error getting language")
+	assert.Equal(t, AUTO_LANGUAGE, language)
+
+	assert.Nil(t, SetNoteLanguage(db, id, " IT "), "Unexpected error setting language")
+	languages, err := GetNotesLanguages(db, []int{id, id + 1})
+	assert.Nil(t, err, "Unexpected error getting languages")
+	assert.Equal(t, map[int]string{id: "it"}, languages)
+
+	assert.NotNil(t, SetNoteLanguage(db, id, "tlh"), "Expected unsupported language to be refused")
+	assert.Nil(t, SetNoteLanguage(db, id, "auto"), "Unexpected error resetting language")
+	language, _ = GetNoteLanguage(db, id)
+	assert.Equal(t, AUTO_LANGUAGE, language)
+}
+
+func Test_RecordsEvents(t *testing.T) {
+	dbFileName := ":memory:"
+	db, err := createDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+	otherId, err := CreateAuthor(db, "Other User", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+	subscriber := SubscribeEvents()
+	defer UnsubscribeEvents(subscriber)
+
+	kinds := func(userId int, after int) []string {
+		events, next, err := GetEventsAfter(db, userId, after, 10)
+		assert.Nil(t, err, "Unexpected error getting events")
+		latest, _ := GetLatestEventId(db)
+		assert.Equal(t, latest, next, "Expected to resume past unreadable events")
+		result := []string{}
+		for _, event := range events {
+			result = append(result, fmt.Sprintf("%s %d", event.Kind, event.NoteId))
+		}
+		return result
+	}
+
+	id, err := CreateNote(db, &NoteRecord{1, "# Plans", int(time.Now().Unix()), PROTECTED_ACCESS, 0})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	assert.Equal(t, 1, <-subscriber, "Expected the event to be published")
+	assert.Nil(t, UpdateNoteContent(db, 1, id, "# Plans\n\nweekly"), "Unexpected error on update")
+	assert.Equal(t, []string{}, kinds(otherId, 0))
+
+	assert.Nil(t, SharesWith(db, 1, otherId), "Unexpected error sharing")
+	assert.Nil(t, SetNotePrivacy(db, 1, id, PRIVATE_ACCESS), "Unexpected error updating privacy")
+	assert.Equal(t, 4, <-subscriber, "Expected only the latest id to be kept")
+	tx, err := db.Begin()
+	assert.Nil(t, err, "Unexpected error starting transaction")
+	assert.Nil(t, DeleteNote(tx, 1, id), "Unexpected error deleting note")
+	assert.Equal(t, 0, len(subscriber), "Expected no event published before commit")
+	assert.Nil(t, tx.Commit(), "Unexpected error committing")
+	PublishEvents(db)
+	assert.Equal(t, 5, <-subscriber, "Expected the event published once committed")
+	assert.Equal(t, []string{"created 1", "updated 1", "shared 0", "privacy 1", "deleted 1"}, kinds(1, 0))
+	assert.Equal(t, []string{"created 1", "updated 1", "shared 0", "privacy 1"}, kinds(otherId, 0))
+
+	events, _, err := GetEventsAfter(db, otherId, 2, 10)
+	assert.Nil(t, err, "Unexpected error getting events")
+	assert.Equal(t, Event{Author: 1, Created: events[0].Created, Id: 3, Kind: EVENT_SHARED, User: otherId}, events[0])
+	assert.Equal(t, "private", events[1].Privacy)
+
+	pruned, err := PruneEvents(db, time.Now().Add(time.Minute))
+	assert.Nil(t, err, "Unexpected error pruning events")
+	assert.Equal(t, int64(5), pruned)
+	_, err = CreateNote(db, &NoteRecord{1, "# Later", int(time.Now().Unix()), PUBLIC_ACCESS, 0})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	_, _, err = GetEventsAfter(db, 1, 2, 10)
+	assert.True(t, errors.Is(err, ErrEventsPruned), "Expected missed events to be reported")
+	assert.Equal(t, []string{"created 1"}, kinds(otherId, 5))
+}
+
+func Test_TracksRevisions(t *testing.T) {
+	dbFileName := t.TempDir() + "/notes.sqlite3"
+	db, err := createDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+	otherId, err := CreateAuthor(db, "Other User", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+
+	changes := func(userId int, after int) []string {
+		revisions, _, err := GetChangesAfter(db, userId, after, 10)
+		assert.Nil(t, err, "Unexpected error getting changes")
+		result := []string{}
+		for _, revision := range revisions {
+			result = append(result, fmt.Sprintf("%d@%d %v", revision.NoteId, revision.Revision, revision.Deleted))
+		}
+		return result
+	}
+
+	id, err := CreateNote(db, &NoteRecord{1, "# Plans", int(time.Now().Unix()), PROTECTED_ACCESS, 0})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	assert.Nil(t, SetNoteTags(db, id, []string{"weekly"}), "Unexpected error setting tags")
+	assert.Nil(t, UpdateNoteContent(db, 1, id, "# Plans\n\nreview"), "Unexpected error on update")
+	revision, err := GetNoteRevision(db, id)
+	assert.Nil(t, err, "Unexpected error getting revision")
+	assert.Equal(t, Revision{Author: 1, NoteId: id, Revision: 3, Sequence: 3}, *revision)
+	assert.Equal(t, []string{"1@3 false"}, changes(1, 0))
+	assert.Equal(t, []string{}, changes(1, 3))
+	assert.Equal(t, []string{}, changes(otherId, 0))
+
+	assert.Nil(t, SharesWith(db, 1, otherId), "Unexpected error sharing")
+	assert.Equal(t, []string{"1@3 false"}, changes(otherId, 3), "Expected newly shared notes to sync")
+	latest, err := GetLatestSequence(db)
+	assert.Nil(t, err, "Unexpected error getting latest sequence")
+	assert.Nil(t, SetNotePrivacy(db, 1, id, PRIVATE_ACCESS), "Unexpected error updating privacy")
+	assert.Nil(t, SetNoteNotebook(db, id, "Work"), "Unexpected error setting notebook")
+	assert.Equal(t, []string{"1@5 true"}, changes(otherId, latest), "Expected unreadable notes as deleted")
+
+	result, err := db.Exec("INSERT INTO notes (author, content, created, privacy) VALUES (1, 'legacy', 0, 0)")
+	assert.Nil(t, err, "Unexpected error inserting note")
+	legacyId, _ := result.LastInsertId()
+	assert.Nil(t, deleteNote(db, 1, id), "Unexpected error deleting note")
+	assert.Equal(t, []string{"1@6 true"}, changes(1, latest))
+	assert.Equal(t, []string{"1@6 true"}, changes(otherId, latest))
+	revisions, err := GetNotesRevisions(db, []int{id})
+	assert.Nil(t, err, "Unexpected error getting revisions")
+	assert.Equal(t, map[int]int{id: 6}, revisions)
+
+	db.Close()
+	db, err = CreateNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error reopening DB")
+	defer db.Close()
+	revision, err = GetNoteRevision(db, int(legacyId))
+	assert.Nil(t, err, "Unexpected error getting revision")
+	assert.Equal(t, 1, revision.Revision, "Expected notes without revisions to get one")
+}
+
+func Test_ThreadsComments(t *testing.T) {
+	db, err := createDb(":memory:")
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+	otherId, err := CreateAuthor(db, "Other User", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+	thirdId, err := CreateAuthor(db, "Third User", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+	assert.Nil(t, SharesWith(db, 1, otherId), "Unexpected error sharing")
+
+	now := int(time.Now().Unix())
+	id, err := CreateNote(db, &NoteRecord{1, "# Plans", now, PROTECTED_ACCESS, 0})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	rootId, err := CreateComment(db, &Comment{Author: otherId, Content: "What about *Friday*?", Created: now, Note: id})
+	assert.Nil(t, err, "Unexpected error commenting")
+	replyId, err := CreateComment(db, &Comment{Author: 1, Content: "Fine", Created: now, Note: id, Parent: rootId})
+	assert.Nil(t, err, "Unexpected error replying")
+	_, err = CreateComment(db, &Comment{Author: thirdId, Content: "Me too", Created: now, Note: id})
+	assert.True(t, errors.Is(err, ErrNoteForbidden), "Expected unshared users kept out, got %v", err)
+	_, err = CreateComment(db, &Comment{Author: 1, Content: " ", Created: now, Note: id})
+	assert.True(t, errors.Is(err, ErrInvalidComment), "Expected blank comments rejected, got %v", err)
+	_, err = CreateComment(db, &Comment{Author: 1, Content: "Lost", Created: now, Note: id, Parent: 999})
+	assert.True(t, errors.Is(err, ErrCommentNotFound), "Expected unknown parents rejected, got %v", err)
+
+	assert.Nil(t, SetNotePrivacy(db, 1, id, PUBLIC_ACCESS), "Unexpected error updating privacy")
+	canComment, err := CanCommentNote(db, thirdId, id)
+	assert.Nil(t, err, "Unexpected error checking rights")
+	assert.False(t, canComment, "Expected public notes readable but not open to comments")
+	comments, err := GetNoteComments(db, thirdId, id)
+	assert.Nil(t, err, "Unexpected error listing comments")
+	assert.Equal(t, 2, len(comments))
+	assert.Equal(t, "Other User", comments[0].AuthorName)
+	assert.Equal(t, rootId, comments[1].Parent)
+
+	err = UpdateComment(db, 1, rootId, "Hijacked")
+	assert.True(t, errors.Is(err, ErrCommentForbidden), "Expected others' comments left alone, got %v", err)
+	assert.Nil(t, UpdateComment(db, otherId, rootId, "What about Saturday?"), "Unexpected error editing")
+	err = ResolveComment(db, thirdId, rootId, true)
+	assert.True(t, errors.Is(err, ErrCommentForbidden), "Expected readers unable to resolve, got %v", err)
+	assert.Nil(t, ResolveComment(db, 1, rootId, true), "Unexpected error resolving")
+	assert.True(t, errors.Is(ResolveComment(db, 1, replyId, true), ErrInvalidComment), "Expected replies not resolvable")
+	comment, err := GetComment(db, otherId, rootId)
+	assert.Nil(t, err, "Unexpected error getting comment")
+	assert.Equal(t, "What about Saturday?", comment.Content)
+	assert.True(t, comment.Resolved)
+	assert.NotEqual(t, 0, comment.Edited)
+
+	assert.Nil(t, DeleteComment(db, otherId, rootId), "Unexpected error deleting")
+	comments, _ = GetNoteComments(db, 1, id)
+	assert.Equal(t, 2, len(comments), "Expected comments with replies kept")
+	assert.True(t, comments[0].Deleted)
+	assert.Equal(t, "", comments[0].Content)
+	contents, err := GetCommentContents(db, id)
+	assert.Nil(t, err, "Unexpected error getting contents")
+	assert.Equal(t, []string{"Fine"}, contents)
+	assert.Nil(t, DeleteComment(db, 1, replyId), "Unexpected error deleting")
+	comments, _ = GetNoteComments(db, 1, id)
+	assert.Equal(t, 1, len(comments))
+
+	assert.Nil(t, SetNotePrivacy(db, 1, id, PRIVATE_ACCESS), "Unexpected error updating privacy")
+	_, err = GetNoteComments(db, otherId, id)
+	assert.True(t, errors.Is(err, ErrNoteForbidden), "Expected comments as private as their note, got %v", err)
+	assert.Nil(t, deleteNote(db, 1, id), "Unexpected error deleting note")
+	_, err = GetComment(db, 1, rootId)
+	assert.True(t, errors.Is(err, ErrCommentNotFound), "Expected comments deleted with their note, got %v", err)
+}
+
+func Test_NotifiesUsers(t *testing.T) {
+	db, err := createDb(":memory:")
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+	otherId, err := CreateAuthor(db, "Other User", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+	thirdId, err := CreateAuthor(db, "Third", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+
+	kinds := func(userId int) []string {
+		notifications, err := GetNotifications(db, userId, false, 0, 10)
+		assert.Nil(t, err, "Unexpected error listing notifications")
+		result := []string{}
+		for _, notification := range notifications {
+			result = append(result, fmt.Sprintf("%s %d by %s", notification.Kind, notification.NoteId, notification.ActorName))
+		}
+		return result
+	}
+	assert.Equal(t, [][]string{{"Other User. Mail", "Other User", "Other"}, {"third"}}, findMentions("Ask @Other User. Mail a@b.com, (@third)"))
+
+	now := int(time.Now().Unix())
+	id, err := CreateNote(db, &NoteRecord{1, "# Plans\n\nAsk @other user and @Third", now, PROTECTED_ACCESS, 0})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	assert.Equal(t, []string{}, kinds(otherId), "Expected no mention of users who cannot read the note")
+	assert.Nil(t, SharesWith(db, 1, otherId), "Unexpected error sharing")
+	assert.Equal(t, []string{"shared 0 by Test User"}, kinds(otherId))
+
+	content := "# Plans\n\nAsk @Other User and @Third"
+	assert.Nil(t, UpdateNoteContent(db, 1, id, content), "Unexpected error on update")
+	assert.Nil(t, UpdateNoteContent(db, 1, id, content+"!"), "Unexpected error on update")
+	assert.Equal(t, []string{"mention 1 by Test User", "shared 0 by Test User"}, kinds(otherId),
+		"Expected one mention per note")
+	assert.Equal(t, []string{}, kinds(thirdId))
+
+	assert.Nil(t, FollowNote(db, otherId, id), "Unexpected error following")
+	assert.True(t, errors.Is(FollowNote(db, thirdId, id), ErrNoteForbidden), "Expected unreadable notes unfollowable")
+	_, err = CreateComment(db, &Comment{Author: otherId, Content: "Done, @test user", Created: now, Note: id})
+	assert.Nil(t, err, "Unexpected error commenting")
+	assert.Equal(t, []string{"mention 1 by Other User", "comment 1 by Other User"}, kinds(1))
+	assert.Nil(t, UpdateNoteContent(db, 1, id, content+"?"), "Unexpected error on update")
+	assert.Nil(t, UpdateNoteContent(db, 1, id, content+"?!"), "Unexpected error on update")
+	assert.Equal(t, "edit 1 by Test User", kinds(otherId)[0], "Expected followers notified of edits")
+	assert.Equal(t, 3, len(kinds(otherId)), "Expected unread edits notified once")
+
+	unread, err := CountUnreadNotifications(db, otherId)
+	assert.Nil(t, err, "Unexpected error counting")
+	assert.Equal(t, 3, unread)
+	notifications, _ := GetNotifications(db, otherId, true, 0, 10)
+	assert.Nil(t, MarkNotificationsRead(db, otherId, []int{notifications[0].Id}), "Unexpected error marking read")
+	unread, _ = CountUnreadNotifications(db, otherId)
+	assert.Equal(t, 2, unread)
+	page, _ := GetNotifications(db, otherId, false, notifications[0].Id, 10)
+	assert.Equal(t, 2, len(page), "Expected notifications before the cursor")
+	assert.Nil(t, MarkNotificationsRead(db, otherId, nil), "Unexpected error marking all read")
+	unread, _ = CountUnreadNotifications(db, otherId)
+	assert.Equal(t, 0, unread)
+
+	assert.Nil(t, SetNotePrivacy(db, 1, id, PRIVATE_ACCESS), "Unexpected error updating privacy")
+	assert.Equal(t, []string{"shared 0 by Test User"}, kinds(otherId), "Expected notifications as private as their note")
+	assert.Nil(t, UnfollowNote(db, otherId, id), "Unexpected error unfollowing")
+}
+
+func Test_QueuesWebhookDeliveries(t *testing.T) {
+	db, err := createDb(":memory:")
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+	otherId, err := CreateAuthor(db, "Other User", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+
+	now := int(time.Now().Unix())
+	_, err = CreateNote(db, &NoteRecord{1, "# Before", now, PRIVATE_ACCESS, 0})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	webhook := Webhook{Active: true, Author: 1, Created: now, Events: []string{EVENT_CREATED}, Secret: "s",
+		Tag: "work", Url: "http://localhost/hook"}
+	webhook.Id, err = CreateWebhook(db, &webhook)
+	assert.Nil(t, err, "Unexpected error creating webhook")
+	stored, err := GetWebhook(db, 1, webhook.Id)
+	assert.Nil(t, err, "Unexpected error fetching webhook")
+	latest, _ := GetLatestEventId(db)
+	assert.Equal(t, latest, stored.Cursor, "Expected webhooks to start with new events")
+	assert.Equal(t, []string{EVENT_CREATED}, stored.Events)
+	_, err = GetWebhook(db, otherId, webhook.Id)
+	assert.True(t, errors.Is(err, ErrWebhookNotFound), "Expected webhooks private to their author")
+
+	deliveries := []Delivery{
+		{Created: now, EventId: latest, Kind: EVENT_CREATED, NextAttempt: 1000, Payload: "{}"},
+		{Created: now, EventId: latest, Kind: EVENT_CREATED, NextAttempt: 5000, Payload: "{}"},
+	}
+	assert.Nil(t, QueueDeliveries(db, webhook.Id, latest+1, deliveries), "Unexpected error queueing")
+	stored, _ = GetWebhook(db, 1, webhook.Id)
+	assert.Equal(t, latest+1, stored.Cursor, "Expected the cursor moved with the queue")
+	due, err := GetDueDeliveries(db, 2000, 10, 10)
+	assert.Nil(t, err, "Unexpected error listing due deliveries")
+	assert.Equal(t, 1, len(due))
+	capped, _ := GetDueDeliveries(db, 6000, 1, 10)
+	assert.Equal(t, []int{due[0].Id}, []int{capped[0].Id}, "Expected at most one delivery per webhook")
+	next, _ := GetNextDeliveryTime(db)
+	assert.Equal(t, int64(1000), next)
+
+	assert.Nil(t, RecordDeliveryAttempt(db, due[0].Id, 500, errors.New("boom"), 3000), "Unexpected error recording")
+	next, _ = GetNextDeliveryTime(db)
+	assert.Equal(t, int64(3000), next, "Expected failed deliveries retried")
+	assert.Nil(t, RecordDeliveryAttempt(db, due[0].Id, 200, nil, 0), "Unexpected error recording")
+	due, _ = GetDueDeliveries(db, 6000, 10, 10)
+	assert.Nil(t, RecordDeliveryAttempt(db, due[0].Id, 0, errors.New("refused"), 0), "Unexpected error recording")
+	log, err := GetDeliveries(db, 1, webhook.Id, 0, 10)
+	assert.Nil(t, err, "Unexpected error listing deliveries")
+	assert.Equal(t, []string{DELIVERY_FAILED, DELIVERY_DELIVERED}, []string{log[0].Status, log[1].Status})
+	assert.Equal(t, 2, log[1].Attempts)
+	assert.Equal(t, "refused", log[0].Error)
+	next, _ = GetNextDeliveryTime(db)
+	assert.Equal(t, int64(0), next, "Expected nothing left to deliver")
+	older, _ := GetDeliveries(db, 1, webhook.Id, log[0].Id, 10)
+	assert.Equal(t, 1, len(older))
+
+	stored.Active = false
+	assert.Nil(t, UpdateWebhook(db, stored), "Unexpected error updating webhook")
+	active, _ := GetActiveWebhooks(db)
+	assert.Equal(t, 0, len(active))
+	stored.Author = otherId
+	assert.True(t, errors.Is(UpdateWebhook(db, stored), ErrWebhookNotFound), "Expected others' webhooks unchangeable")
+	assert.True(t, errors.Is(DeleteWebhook(db, otherId, webhook.Id), ErrWebhookNotFound))
+	assert.Nil(t, DeleteWebhook(db, 1, webhook.Id), "Unexpected error deleting webhook")
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM deliveries").Scan(&count)
+	assert.Equal(t, 0, count, "Expected deliveries deleted with their webhook")
+}
+
+func Test_ExpandsTemplates(t *testing.T) {
+	db, err := createDb(":memory:")
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+	otherId, err := CreateAuthor(db, "Other User", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+
+	content := "# Standup {{date}}\n\nBy {{ User }} for {{title}}\n\n{{done: What did you do?}}\n{{blockers}}\n{{Done}}"
+	assert.Equal(t, []TemplatePrompt{{"What did you do?", "done"}, {"", "blockers"}}, TemplatePrompts(content))
+	now := time.Date(2024, 3, 5, 9, 30, 0, 0, time.UTC)
+	values := TemplateValues("Test User", "Team", now)
+	values["DONE"] = "Shipped"
+	assert.Equal(t, "# Standup 2024-03-05\n\nBy Test User for Team\n\nShipped\n\nShipped",
+		ExpandTemplate(content, values), "Expected placeholders without values blank")
+
+	id, err := CreateNote(db, &NoteRecord{1, content, int(now.Unix()), PROTECTED_ACCESS, MARKDOWN_RENDER})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	_, err = GetTemplate(db, 1, id)
+	assert.True(t, errors.Is(err, ErrTemplateNotFound), "Expected notes not templates until flagged")
+	assert.True(t, errors.Is(SetTemplate(db, otherId, id, PUBLIC_ACCESS, nil), ErrNoteForbidden),
+		"Expected only authors to flag templates")
+	assert.Nil(t, SetTemplate(db, 1, id, PUBLIC_ACCESS, []string{" #Standup", ""}), "Unexpected error flagging")
+	template, err := GetTemplate(db, 1, id)
+	assert.Nil(t, err, "Unexpected error fetching template")
+	assert.Equal(t, PUBLIC_ACCESS, template.Privacy)
+	assert.Equal(t, []string{"standup"}, template.Tags)
+	assert.Equal(t, "Test User", template.AuthorName)
+	assert.Nil(t, SetTemplate(db, 1, id, PUBLIC_ACCESS, []string{"1:1, weekly", "standup", "#Standup"}))
+	template, _ = GetTemplate(db, 1, id)
+	assert.Equal(t, []string{"1:1, weekly", "standup"}, template.Tags, "Expected tags with commas kept whole")
+
+	templates, _ := GetTemplates(db, otherId)
+	assert.Equal(t, 0, len(templates), "Expected templates as private as their note")
+	assert.Nil(t, SharesWith(db, 1, otherId), "Unexpected error sharing")
+	templates, _ = GetTemplates(db, otherId)
+	assert.Equal(t, 1, len(templates), "Expected shared templates listed")
+	strangerId, err := CreateAuthor(db, "Stranger", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+	publicId, err := CreateNote(db, &NoteRecord{strangerId, content, int(now.Unix()), PUBLIC_ACCESS, MARKDOWN_RENDER})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	assert.Nil(t, SetTemplate(db, strangerId, publicId, PUBLIC_ACCESS, nil), "Unexpected error flagging")
+	templates, _ = GetTemplates(db, otherId)
+	assert.Equal(t, 1, len(templates), "Expected public templates of others not listed")
+	_, err = GetTemplate(db, otherId, publicId)
+	assert.Nil(t, err, "Expected public templates still readable")
+
+	assert.True(t, errors.Is(UnsetTemplate(db, otherId, id), ErrTemplateNotFound))
+	assert.Nil(t, UnsetTemplate(db, 1, id), "Unexpected error unflagging")
+	templates, _ = GetTemplates(db, 1)
+	assert.Equal(t, 0, len(templates))
+}
+
+func Test_KeepsJournal(t *testing.T) {
+	db, err := createDb(":memory:")
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+
+	settings, err := GetJournalSettings(db, 1)
+	assert.Nil(t, err, "Unexpected error fetching settings")
+	assert.Equal(t, JournalSettings{Template: 0, TimeZone: "UTC"}, *settings)
+	assert.True(t, errors.Is(SetJournalSettings(db, 1, &JournalSettings{TimeZone: "Mars/Olympus"}), ErrInvalidJournal))
+	assert.Nil(t, SetJournalSettings(db, 1, &JournalSettings{TimeZone: "Asia/Tokyo"}), "Unexpected error on settings")
+
+	id, created, err := GetJournalNote(db, 1, "2024-03-05")
+	assert.Nil(t, err, "Unexpected error on journal note")
+	assert.True(t, created)
+	note, _ := GetNote(db, 1, id)
+	assert.Equal(t, "# 2024-03-05\n\n", note.Content)
+	assert.Equal(t, PRIVATE_ACCESS, note.Privacy)
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	assert.Equal(t, "2024-03-05 12:00", time.Unix(int64(note.Created), 0).In(tokyo).Format("2006-01-02 15:04"))
+	noteType, _ := GetNoteType(db, id)
+	assert.Equal(t, NOTE_TYPE_JOURNAL, noteType)
+	again, created, err := GetJournalNote(db, 1, "2024-03-05")
+	assert.Nil(t, err, "Unexpected error on journal note")
+	assert.False(t, created, "Expected one journal note per day")
+	assert.Equal(t, id, again)
+	_, _, err = GetJournalNote(db, 1, "March 5")
+	assert.True(t, errors.Is(err, ErrInvalidJournal), "Expected dates as YYYY-MM-DD")
+	_, _, err = GetJournalNote(db, 1, time.Now().AddDate(0, 0, 2).Format(JOURNAL_DATE_FORMAT))
+	assert.True(t, errors.Is(err, ErrInvalidJournal), "Expected no journal notes for future days")
+
+	templateId, err := CreateNote(db, &NoteRecord{1, "# Log {{date}}\n\n{{mood: How do you feel?}}", 0, PRIVATE_ACCESS, 0})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	assert.True(t, errors.Is(SetJournalSettings(db, 1, &JournalSettings{Template: templateId, TimeZone: "UTC"}),
+		ErrTemplateNotFound), "Expected journal templates to be templates")
+	assert.Nil(t, SetTemplate(db, 1, templateId, PROTECTED_ACCESS, []string{"journal"}), "Unexpected error flagging")
+	assert.Nil(t, SetJournalSettings(db, 1, &JournalSettings{Template: templateId, TimeZone: "Asia/Tokyo"}))
+	id, _, err = GetJournalNote(db, 1, "2024-03-07")
+	assert.Nil(t, err, "Unexpected error on journal note")
+	note, _ = GetNote(db, 1, id)
+	assert.Equal(t, "# Log 2024-03-07\n\n", note.Content)
+	assert.Equal(t, PROTECTED_ACCESS, note.Privacy)
+	tags, _ := GetNoteTags(db, id)
+	assert.Equal(t, []string{"journal"}, tags)
+	today, _, err := GetJournalNote(db, 1, JOURNAL_TODAY)
+	assert.Nil(t, err, "Unexpected error on journal note")
+
+	days, err := GetJournalDays(db, 1, "2024-03-01", "2024-03-31")
+	assert.Nil(t, err, "Unexpected error listing days")
+	assert.Equal(t, []JournalDay{{"2024-03-05", again}, {"2024-03-07", id}}, days)
+	days, _ = GetJournalDays(db, 1, time.Now().In(tokyo).Format(JOURNAL_DATE_FORMAT), time.Now().In(tokyo).Format(JOURNAL_DATE_FORMAT))
+	assert.Equal(t, []JournalDay{{time.Now().In(tokyo).Format(JOURNAL_DATE_FORMAT), today}}, days)
+	assert.Nil(t, SetJournalSettings(db, 1, &JournalSettings{TimeZone: "America/Los_Angeles"}))
+	days, _ = GetJournalDays(db, 1, "2024-03-01", "2024-03-31")
+	assert.Equal(t, 2, len(days), "Expected days kept across nearby time zones")
+	assert.Equal(t, "2024-03-04", days[0].Date, "Expected days dated in the current time zone")
+}
+
+func Test_AddsColumnsToOldDbs(t *testing.T) {
+	dbFileName := t.TempDir() + "/notes.sqlite3"
+	db, err := OpenNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error opening DB")
+	_, err = db.Exec("CREATE TABLE notes (author INT, content TEXT, created INT, privacy INT, renderHint INT)")
+	assert.Nil(t, err, "Unexpected error creating old table")
+	_, err = db.Exec("INSERT INTO notes VALUES (1, '# Old\n\n- [ ] Migrate', 0, 0, 0)")
+	assert.Nil(t, err, "Unexpected error on old note")
+	db.Close()
+
+	db, err = CreateNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB migration")
+	defer db.Close()
+	noteType, err := GetNoteType(db, 1)
+	assert.Nil(t, err, "Unexpected error fetching note type")
+	assert.Equal(t, "", noteType)
+	tasks, err := GetTasks(db, 1, false, "", nil, 10)
+	assert.Nil(t, err, "Unexpected error listing tasks")
+	assert.Equal(t, 1, len(tasks), "Expected tasks of old notes extracted")
+	db.Close()
+	db, err = CreateNoteDb(dbFileName)
+	assert.Nil(t, err, "Expected migrations to run once")
+}
+
+func Test_ExtractsTasks(t *testing.T) {
+	db, err := createDb(":memory:")
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+	otherId, err := CreateAuthor(db, "Other", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+
+	content := "# Trip\r\n\r\n- [ ] Book @due(2025-01-10) flights\r\n* [x] Renew passport\r\n" +
+		"1. [ ] Pack @due(2025-01-02)\r\n```\r\n- [ ] not a task\r\n```\r\n- [ ]\r\n  - [X] Nested"
+	noteId, err := CreateNote(db, &NoteRecord{1, content, 0, PROTECTED_ACCESS, MARKDOWN_RENDER})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	open, err := GetTasks(db, 1, false, "", nil, 10)
+	assert.Nil(t, err, "Unexpected error listing tasks")
+	assert.Equal(t, []Task{
+		{Due: "2025-01-02", Id: open[0].Id, Line: 5, NoteId: noteId, Text: "Pack"},
+		{Due: "2025-01-10", Id: open[1].Id, Line: 3, NoteId: noteId, Text: "Book flights"},
+	}, open)
+	done, _ := GetTasks(db, 1, true, "", nil, 10)
+	assert.Equal(t, []string{"Renew passport", "Nested"}, []string{done[0].Text, done[1].Text})
+	due, _ := GetTasks(db, 1, false, "2025-01-05", nil, 10)
+	assert.Equal(t, 1, len(due))
+	page, _ := GetTasks(db, 1, false, "", &TaskCursor{Due: open[0].Due, Id: open[0].Id}, 10)
+	assert.Equal(t, open[1:], page)
+
+	bookId, checked := open[1].Id, true
+	task, err := setTaskDone(db, 1, bookId, &checked)
+	assert.Nil(t, err, "Unexpected error checking task")
+	assert.True(t, task.Done)
+	assert.Equal(t, bookId, task.Id, "Expected tasks to keep their id")
+	note, _ := GetNote(db, 1, noteId)
+	assert.Equal(t, strings.Replace(content, "- [ ] Book", "- [x] Book", 1), note.Content)
+	_, err = setTaskDone(db, otherId, open[0].Id, &checked)
+	assert.True(t, errors.Is(err, ErrTaskNotFound), "Expected tasks of unreadable notes hidden")
+	publicId, err := CreateNote(db, &NoteRecord{1, "- [ ] Read", 0, PUBLIC_ACCESS, MARKDOWN_RENDER})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+	public, _ := GetTasks(db, otherId, false, "", nil, 10)
+	assert.Equal(t, publicId, public[0].NoteId)
+	_, err = setTaskDone(db, otherId, public[0].Id, nil)
+	assert.True(t, errors.Is(err, ErrNoteForbidden), "Expected public notes of others not editable")
+	assert.Nil(t, SharesWith(db, 1, otherId), "Unexpected error sharing")
+	assert.Nil(t, FollowNote(db, 1, noteId), "Unexpected error following")
+	task, err = setTaskDone(db, otherId, open[0].Id, nil)
+	assert.Nil(t, err, "Expected shared protected notes editable")
+	assert.True(t, task.Done, "Expected open tasks checked when flipped")
+	notifications, _ := GetNotifications(db, 1, true, 0, 10)
+	assert.Equal(t, 1, len(notifications))
+	assert.Equal(t, otherId, notifications[0].Actor, "Expected the edit made by whoever checked the task")
+
+	content = "# Trip\n\n- [ ] Insure\n- [ ] Book flights"
+	assert.Nil(t, UpdateNoteContent(db, 1, noteId, content), "Unexpected error on update")
+	book, err := GetTask(db, 1, bookId)
+	assert.Nil(t, err, "Expected tasks to keep their id when moved")
+	assert.Equal(t, Task{Id: bookId, Line: 4, NoteId: noteId, Text: "Book flights"}, *book)
+	open, _ = GetTasks(db, 1, false, "", nil, 10)
+	assert.Equal(t, []string{"Book flights", "Read", "Insure"}, []string{open[0].Text, open[1].Text, open[2].Text},
+		"Expected new tasks not to take over ids")
+	_, err = GetTask(db, 1, task.Id)
+	assert.True(t, errors.Is(err, ErrTaskNotFound), "Expected removed tasks gone")
+	assert.Nil(t, deleteNote(db, 1, noteId), "Unexpected error on deletion")
+	open, _ = GetTasks(db, 1, false, "", nil, 10)
+	assert.Equal(t, []int{publicId}, []int{open[0].NoteId})
+}
+
 func createDb(dbFileName string) (*sql.DB, error) {
 	db, err := CreateNoteDb(dbFileName)
 	if err != nil || db == nil {
@@ -175,3 +868,35 @@ func createDb(dbFileName string) (*sql.DB, error) {
 
 	return db, nil
 }
+
+func deleteNote(db *sql.DB, userId int, noteId int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = DeleteNote(tx, userId, noteId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	PublishEvents(db)
+	return nil
+}
+
+func setTaskDone(db *sql.DB, userId int, taskId int, done *bool) (*Task, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err = SetTaskDone(tx, userId, taskId, done); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	PublishEvents(db)
+	return GetTask(db, userId, taskId)
+}
@@ -0,0 +1,225 @@
+package notes
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const NOTIFICATION_COMMENT = "comment"
+const NOTIFICATION_EDIT = "edit"
+const NOTIFICATION_MENTION = "mention"
+const NOTIFICATION_SHARED = "shared"
+
+// A mention is @ and up to MENTION_WORDS words, as user names may have
+// spaces; the longest run of words naming a user wins.
+const MENTION_WORDS = 3
+
+var mentionPattern = regexp.MustCompile(fmt.Sprintf(`(?:^|[^\p{L}\p{N}_@.])@([\p{L}\p{N}_.-]+(?: [\p{L}\p{N}_.-]+){0,%d})`,
+	MENTION_WORDS-1))
+
+/**
+ * Something that happened to User, done by Actor: a mention in a note or
+ * in a comment, a comment on one of their notes, an edit of a note they
+ * follow, or sharing with them, which concerns no note.
+ */
+type Notification struct {
+	Actor     int
+	ActorName string
+	CommentId int `json:",omitempty"`
+	Created   int
+	Id        int
+	Kind      string
+	NoteId    int `json:",omitempty"`
+	Read      bool
+}
+
+/**
+ * Count the notifications of userId not read yet, among those still
+ * readable.
+ */
+func CountUnreadNotifications(db *sql.DB, userId int) (int, error) {
+	where, args := visibleNotifications(userId)
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM notifications LEFT JOIN notes ON notes.rowid = notifications.note "+
+		"WHERE NOT notifications.read AND "+where, args...).Scan(&count)
+	return count, err
+}
+
+/**
+ * Follow the edits of a note userId can read.
+ */
+func FollowNote(db *sql.DB, userId int, noteId int) error {
+	if _, err := GetNote(db, userId, noteId); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT OR IGNORE INTO follows (user, note) VALUES (?, ?)", userId, noteId)
+	return err
+}
+
+/**
+ * List up to limit notifications of userId, newest first, before the
+ * notification id given unless 0. Notifications about notes userId can
+ * no longer read, or about deleted comments, are left out.
+ */
+func GetNotifications(db *sql.DB, userId int, unreadOnly bool, before int, limit int) ([]Notification, error) {
+	where, args := visibleNotifications(userId)
+	if unreadOnly {
+		where += " AND NOT notifications.read"
+	}
+	if before > 0 {
+		where += " AND notifications.id < ?"
+		args = append(args, before)
+	}
+	rows, err := db.Query(
+		"SELECT notifications.id, notifications.actor, IFNULL(users.userName,''), notifications.kind, "+
+			"notifications.note, notifications.comment, notifications.created, notifications.read "+
+			"FROM notifications LEFT JOIN notes ON notes.rowid = notifications.note "+
+			"LEFT JOIN users ON users.rowid = notifications.actor "+
+			"WHERE "+where+" ORDER BY notifications.id DESC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var notification Notification
+		err = rows.Scan(&notification.Id, &notification.Actor, &notification.ActorName, &notification.Kind,
+			&notification.NoteId, &notification.CommentId, &notification.Created, &notification.Read)
+		if err != nil {
+			return notifications, err
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications, rows.Err()
+}
+
+/**
+ * Mark notifications of userId as read, all of them when no id is given.
+ */
+func MarkNotificationsRead(db *sql.DB, userId int, notificationIds []int) error {
+	query := "UPDATE notifications SET read = 1 WHERE user = ?"
+	args := []interface{}{userId}
+	if len(notificationIds) > 0 {
+		query += " AND id IN (" + Placeholders(len(notificationIds)) + ")"
+		for _, notificationId := range notificationIds {
+			args = append(args, notificationId)
+		}
+	}
+	_, err := db.Exec(query, args...)
+	return err
+}
+
+func UnfollowNote(db *sql.DB, userId int, noteId int) error {
+	_, err := db.Exec("DELETE FROM follows WHERE user = ? AND note = ?", userId, noteId)
+	return err
+}
+
+/**
+ * Return the names a text may mention: for each @, its first words, the
+ * longest first.
+ */
+func findMentions(content string) [][]string {
+	var mentions [][]string
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		words := strings.Fields(match[1])
+		var names []string
+		for n := len(words); n > 0; n-- {
+			if name := strings.TrimRight(strings.Join(words[:n], " "), "."); name != "" {
+				names = append(names, name)
+			}
+		}
+		mentions = append(mentions, names)
+	}
+	return mentions
+}
+
+/**
+ * Notify the author of a note of a comment by someone else.
+ */
+func notifyComment(db Execer, actorId int, noteId int, commentId int) error {
+	_, err := db.Exec(
+		"INSERT INTO notifications (user, actor, kind, note, comment, created, read) "+
+			"SELECT author, ?, ?, rowid, ?, ?, 0 FROM notes WHERE rowid = ? AND author != ?",
+		actorId, NOTIFICATION_COMMENT, commentId, time.Now().Unix(), noteId, actorId)
+	return err
+}
+
+/**
+ * Notify those following a note who can still read it of an edit, unless
+ * they have yet to read of an earlier one.
+ */
+func notifyFollowers(db Execer, actorId int, noteId int) error {
+	readable, args := readableBy("follows.user")
+	_, err := db.Exec(
+		"INSERT INTO notifications (user, actor, kind, note, comment, created, read) "+
+			"SELECT follows.user, ?, ?, notes.rowid, 0, ?, 0 FROM follows JOIN notes ON notes.rowid = follows.note "+
+			"WHERE follows.note = ? AND follows.user != ? AND "+readable+" AND NOT EXISTS ("+
+			"SELECT 1 FROM notifications WHERE user = follows.user AND kind = ? AND note = ? AND NOT read)",
+		append(append([]interface{}{actorId, NOTIFICATION_EDIT, time.Now().Unix(), noteId, actorId}, args...),
+			NOTIFICATION_EDIT, noteId)...)
+	return err
+}
+
+/**
+ * Notify the users mentioned in a note, or in one of its comments, who
+ * can read the note. Each is notified once per note or comment, however
+ * often it is edited.
+ */
+func notifyMentions(db Execer, actorId int, noteId int, commentId int, content string) error {
+	readable, readableArgs := readableBy("users.rowid")
+	for _, names := range findMentions(content) {
+		args := []interface{}{actorId, NOTIFICATION_MENTION, commentId, time.Now().Unix(), noteId, actorId}
+		args = append(args, readableArgs...)
+		args = append(args, NOTIFICATION_MENTION, noteId, commentId)
+		for _, name := range names {
+			args = append(args, name)
+		}
+		_, err := db.Exec(
+			"INSERT INTO notifications (user, actor, kind, note, comment, created, read) "+
+				"SELECT users.rowid, ?, ?, notes.rowid, ?, ?, 0 FROM users, notes "+
+				"WHERE notes.rowid = ? AND users.rowid != ? AND "+readable+" AND NOT EXISTS ("+
+				"SELECT 1 FROM notifications WHERE user = users.rowid AND kind = ? AND note = ? AND comment = ?) "+
+				"AND users.userName COLLATE NOCASE IN ("+Placeholders(len(names))+") "+
+				"ORDER BY length(users.userName) DESC LIMIT 1",
+			args...)
+		if err != nil {
+			return fmt.Errorf("cannot notify mention of %s: %w", names[0], err)
+		}
+	}
+	return nil
+}
+
+/**
+ * Notify a user that sharerId now shares with them.
+ */
+func notifyShared(db Execer, sharerId int, shareeId int) error {
+	_, err := db.Exec(
+		"INSERT INTO notifications (user, actor, kind, note, comment, created, read) VALUES (?, ?, ?, 0, 0, ?, 0)",
+		shareeId, sharerId, NOTIFICATION_SHARED, time.Now().Unix())
+	return err
+}
+
+/**
+ * Return the condition for notes to be readable by the user in the given
+ * column, as in GetNote, with its arguments.
+ */
+func readableBy(userColumn string) (string, []interface{}) {
+	return "(notes.author = " + userColumn + " OR IFNULL(notes.privacy,0) = ? OR (IFNULL(notes.privacy,0) = ? AND " +
+			"notes.author IN (SELECT user FROM sharing WHERE sharesWith = " + userColumn + ")))",
+		[]interface{}{PUBLIC_ACCESS, PROTECTED_ACCESS}
+}
+
+/**
+ * Return the condition for notifications of userId to show, with its
+ * arguments, for a query joining the notes they concern.
+ */
+func visibleNotifications(userId int) (string, []interface{}) {
+	readable, args := readableBy("notifications.user")
+	return "notifications.user = ? AND (notifications.note = 0 OR " + readable + ") AND " +
+			"(notifications.comment = 0 OR notifications.comment IN (SELECT id FROM comments WHERE NOT deleted))",
+		append([]interface{}{userId}, args...)
+}
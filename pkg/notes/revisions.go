@@ -0,0 +1,146 @@
+package notes
+
+import (
+	"database/sql"
+)
+
+/**
+ * The state of a note for sync. Revision counts the writes to the note
+ * and Sequence orders the latest of them among all notes. Deleted notes
+ * keep their revision as a tombstone.
+ */
+type Revision struct {
+	Author   int
+	Deleted  bool
+	NoteId   int
+	Revision int
+	Sequence int
+}
+
+/**
+ * Return up to limit notes changed after the sequence cursor that userId
+ * can read, or could read before their latest privacy change. Those no
+ * longer readable are returned as deleted. The returned sequence is where
+ * to resume.
+ */
+func GetChangesAfter(db *sql.DB, userId int, after int, limit int) ([]Revision, int, error) {
+	latest, err := GetLatestSequence(db)
+	if err != nil {
+		return nil, after, err
+	}
+
+	rows, err := db.Query(
+		"SELECT note, author, deleted, revision, sequence, "+
+			"author = ? OR privacy = ? OR (privacy = ? AND author IN (SELECT user FROM sharing WHERE sharesWith = ?)) "+
+			"FROM revisions WHERE sequence > ? AND sequence <= ? AND (author = ? OR privacy = ? OR previous = ? OR "+
+			"((privacy = ? OR previous = ?) AND author IN (SELECT user FROM sharing WHERE sharesWith = ?))) "+
+			"ORDER BY sequence LIMIT ?",
+		userId, PUBLIC_ACCESS, PROTECTED_ACCESS, userId, after, latest,
+		userId, PUBLIC_ACCESS, PUBLIC_ACCESS, PROTECTED_ACCESS, PROTECTED_ACCESS, userId, limit)
+	if err != nil {
+		return nil, after, err
+	}
+	defer rows.Close()
+
+	var result []Revision
+	for rows.Next() {
+		var revision Revision
+		var readable bool
+		if err = rows.Scan(&revision.NoteId, &revision.Author, &revision.Deleted, &revision.Revision,
+			&revision.Sequence, &readable); err != nil {
+			return nil, after, err
+		}
+		revision.Deleted = revision.Deleted || !readable
+		result = append(result, revision)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, after, err
+	}
+	if len(result) == limit {
+		return result, result[len(result)-1].Sequence, nil
+	}
+	return result, latest, nil
+}
+
+/**
+ * Return the sequence of the latest change, 0 when there is none.
+ */
+func GetLatestSequence(db *sql.DB) (int, error) {
+	var latest int
+	err := db.QueryRow("SELECT IFNULL(MAX(sequence),0) FROM revisions").Scan(&latest)
+	return latest, err
+}
+
+/**
+ * Return the sync state of a note, or nil for a note that never existed.
+ */
+func GetNoteRevision(db Queryer, noteId int) (*Revision, error) {
+	revision := Revision{NoteId: noteId}
+	err := db.QueryRow("SELECT author, deleted, revision, sequence FROM revisions WHERE note = ?", noteId).
+		Scan(&revision.Author, &revision.Deleted, &revision.Revision, &revision.Sequence)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+/**
+ * Fetch the revisions of several notes in one query, keyed by note id.
+ */
+func GetNotesRevisions(db *sql.DB, noteIds []int) (map[int]int, error) {
+	result := make(map[int]int)
+	if len(noteIds) == 0 {
+		return result, nil
+	}
+	args := make([]interface{}, len(noteIds))
+	for i, noteId := range noteIds {
+		args[i] = noteId
+	}
+	rows, err := db.Query(
+		"SELECT note, revision FROM revisions WHERE note IN ("+Placeholders(len(noteIds))+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var noteId, revision int
+	for rows.Next() {
+		if err = rows.Scan(&noteId, &revision); err != nil {
+			return result, err
+		}
+		result[noteId] = revision
+	}
+	return result, rows.Err()
+}
+
+/**
+ * Give the protected notes of an author new sequences, so that whoever
+ * the author starts sharing with syncs them.
+ */
+func resequenceSharedNotes(db Execer, authorId int) error {
+	_, err := db.Exec(
+		"UPDATE revisions SET sequence = (SELECT MAX(sequence) FROM revisions) + note "+
+			"WHERE author = ? AND privacy = ? AND deleted = 0",
+		authorId, PROTECTED_ACCESS)
+	return err
+}
+
+/**
+ * Count a write to a note, or its deletion, and move it to the end of the
+ * change sequence. Previous keeps the privacy before the latest privacy
+ * change, so that users losing access learn about it.
+ */
+func touchNote(db Execer, noteId int, deleted bool) error {
+	_, err := db.Exec(
+		"INSERT INTO revisions (note, author, deleted, previous, privacy, revision, sequence) "+
+			"SELECT rowid, author, ?, IFNULL(privacy,0), IFNULL(privacy,0), 1, "+
+			"(SELECT IFNULL(MAX(sequence),0) + 1 FROM revisions) FROM notes WHERE rowid = ? "+
+			"ON CONFLICT(note) DO UPDATE SET author = excluded.author, deleted = excluded.deleted, "+
+			"previous = CASE WHEN privacy != excluded.privacy THEN privacy ELSE previous END, "+
+			"privacy = excluded.privacy, revision = revision + 1, sequence = excluded.sequence",
+		deleted, noteId)
+	return err
+}
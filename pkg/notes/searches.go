@@ -0,0 +1,160 @@
+package notes
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+var ErrSearchExists = errors.New("saved search name already used")
+var ErrSearchNotFound = errors.New("saved search not found")
+
+/**
+ * A named query owned by its author. The query is kept as the JSON of a
+ * structured search and holds no access rights: it is run with those of
+ * whoever executes it.
+ */
+type SavedSearch struct {
+	Author  int
+	Created int
+	Id      int
+	Name    string
+	Pinned  bool
+	Query   string
+}
+
+func CreateSavedSearch(db *sql.DB, search *SavedSearch) (int, error) {
+	search.Name = strings.TrimSpace(search.Name)
+	if err := checkSearchName(db, search.Author, search.Name, 0); err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(
+		"INSERT INTO searches (author, created, name, pinned, query) VALUES (?, ?, ?, ?, ?)",
+		search.Author, search.Created, search.Name, search.Pinned, search.Query)
+	if err != nil {
+		return 0, err
+	}
+	lastRow, err := result.LastInsertId()
+	return int(lastRow), err
+}
+
+func DeleteSavedSearch(db *sql.DB, userId int, searchId int) error {
+	result, err := db.Exec("DELETE FROM searches WHERE rowid = ? AND author = ?", searchId, userId)
+	if err != nil {
+		return err
+	}
+	if numRows, err := result.RowsAffected(); err != nil || numRows <= 0 {
+		if err != nil {
+			return err
+		}
+		return ErrSearchNotFound
+	}
+	return nil
+}
+
+/**
+ * Return the ids of the authors whose protected notes userId may read,
+ * including userId.
+ */
+func GetSharers(db *sql.DB, userId int) ([]int, error) {
+	rows, err := db.Query("SELECT user FROM sharing WHERE sharesWith = ? ORDER BY user", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sharerIds []int
+	var sharerId int
+	for rows.Next() {
+		if err = rows.Scan(&sharerId); err != nil {
+			return sharerIds, err
+		}
+		sharerIds = append(sharerIds, sharerId)
+	}
+	return sharerIds, rows.Err()
+}
+
+/**
+ * Fetch a saved search of userId, wrapping ErrSearchNotFound when userId
+ * has none with that id.
+ */
+func GetSavedSearch(db *sql.DB, userId int, searchId int) (*SavedSearch, error) {
+	search := SavedSearch{Id: searchId}
+	err := db.QueryRow(
+		"SELECT author, created, name, pinned, query FROM searches WHERE rowid = ? AND author = ?",
+		searchId, userId).Scan(&search.Author, &search.Created, &search.Name, &search.Pinned, &search.Query)
+	if err == sql.ErrNoRows {
+		return nil, ErrSearchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &search, nil
+}
+
+/**
+ * List the saved searches of userId by name, or only the pinned ones.
+ */
+func GetSavedSearches(db *sql.DB, userId int, pinnedOnly bool) ([]SavedSearch, error) {
+	query := "SELECT rowid, author, created, name, pinned, query FROM searches WHERE author = ? "
+	if pinnedOnly {
+		query += "AND pinned "
+	}
+	rows, err := db.Query(query+"ORDER BY name", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := []SavedSearch{}
+	for rows.Next() {
+		var search SavedSearch
+		err = rows.Scan(&search.Id, &search.Author, &search.Created, &search.Name, &search.Pinned, &search.Query)
+		if err != nil {
+			return searches, err
+		}
+		searches = append(searches, search)
+	}
+	return searches, rows.Err()
+}
+
+/**
+ * Replace the name, pin and query of a saved search owned by its author.
+ */
+func UpdateSavedSearch(db *sql.DB, search *SavedSearch) error {
+	search.Name = strings.TrimSpace(search.Name)
+	if err := checkSearchName(db, search.Author, search.Name, search.Id); err != nil {
+		return err
+	}
+	result, err := db.Exec(
+		"UPDATE searches SET name = ?, pinned = ?, query = ? WHERE rowid = ? AND author = ?",
+		search.Name, search.Pinned, search.Query, search.Id, search.Author)
+	if err != nil {
+		return err
+	}
+	if numRows, err := result.RowsAffected(); err != nil || numRows <= 0 {
+		if err != nil {
+			return err
+		}
+		return ErrSearchNotFound
+	}
+	return nil
+}
+
+func checkSearchName(db *sql.DB, userId int, name string, searchId int) error {
+	if name == "" {
+		return errors.New("saved search name is blank")
+	}
+	var existingId int
+	err := db.QueryRow("SELECT rowid FROM searches WHERE author = ? AND name = ?", userId, name).Scan(&existingId)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existingId != searchId {
+		return ErrSearchExists
+	}
+	return nil
+}
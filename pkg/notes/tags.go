@@ -0,0 +1,96 @@
+package notes
+
+import (
+	"database/sql"
+	"strings"
+)
+
+func GetNoteTags(db *sql.DB, noteId int) ([]string, error) {
+	rows, err := db.Query("SELECT tag FROM tags WHERE note = ? ORDER BY tag", noteId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []string
+	var tag string
+	for rows.Next() {
+		if err = rows.Scan(&tag); err != nil {
+			return result, err
+		}
+		result = append(result, tag)
+	}
+	return result, rows.Err()
+}
+
+/**
+ * Fetch the tags of several notes in one query, keyed by note id.
+ */
+func GetNotesTags(db *sql.DB, noteIds []int) (map[int][]string, error) {
+	result := make(map[int][]string)
+	if len(noteIds) == 0 {
+		return result, nil
+	}
+	args := make([]interface{}, len(noteIds))
+	for i, noteId := range noteIds {
+		args[i] = noteId
+	}
+	rows, err := db.Query(
+		"SELECT note, tag FROM tags WHERE note IN ("+Placeholders(len(noteIds))+") ORDER BY note, tag",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var noteId int
+	var tag string
+	for rows.Next() {
+		if err = rows.Scan(&noteId, &tag); err != nil {
+			return result, err
+		}
+		result[noteId] = append(result[noteId], tag)
+	}
+	return result, rows.Err()
+}
+
+/**
+ * Replace the tags on a note.  Tags are trimmed and lower-cased; empty
+ * tags are dropped.  The tags are replaced in a transaction of their own
+ * unless one is given.
+ */
+func SetNoteTags(db Execer, noteId int, tags []string) error {
+	conn, ok := db.(*sql.DB)
+	if !ok {
+		return setNoteTags(db, noteId, tags)
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	if err = setNoteTags(tx, noteId, tags); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+}
+
+func setNoteTags(db Execer, noteId int, tags []string) error {
+	if _, err := db.Exec("DELETE FROM tags WHERE note = ?", noteId); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		tag = NormalizeTag(tag)
+		if tag == "" {
+			continue
+		}
+		if _, err := db.Exec("INSERT OR IGNORE INTO tags (note, tag) VALUES (?, ?)", noteId, tag); err != nil {
+			return err
+		}
+	}
+	return touchNote(db, noteId, false)
+}
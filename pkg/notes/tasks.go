@@ -0,0 +1,257 @@
+package notes
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TASK_DUE_FORMAT = "2006-01-02"
+
+var ErrTaskNotFound = errors.New("task not found")
+
+// Tasks are GFM checkboxes in list items, - [ ] open and - [x] done, with
+// an optional due date written as @due(YYYY-MM-DD) anywhere in their text.
+var taskPattern = regexp.MustCompile(`^(\s*(?:[-*+]|\d+[.)])\s+\[)([ xX])\]\s+(\S.*)$`)
+var taskDuePattern = regexp.MustCompile(`@due\((\d{4}-\d{2}-\d{2})\)`)
+
+/**
+ * A checkbox of a note, at Line counted from 1. Due is empty when the
+ * task has no due date.
+ */
+type Task struct {
+	Done   bool
+	Due    string `json:",omitempty"`
+	Id     int
+	Line   int
+	NoteId int
+	Text   string
+}
+
+/**
+ * A task found in note content, with the offset of its checkbox mark.
+ */
+type taskMatch struct {
+	Task
+	mark int
+}
+
+/**
+ * Fetch a task of a note userId can read.
+ */
+func GetTask(db *sql.DB, userId int, taskId int) (*Task, error) {
+	tasks, err := queryTasks(db, userId, "tasks.id = ?", taskId)
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("no task %d: %w", taskId, ErrTaskNotFound)
+	}
+	return &tasks[0], nil
+}
+
+/**
+ * List up to limit tasks, open or done, of the notes userId can read,
+ * soonest due first and those without a due date last, after the cursor
+ * if given. Only tasks due on or before dueBefore are listed unless it is
+ * empty.
+ */
+func GetTasks(db *sql.DB, userId int, done bool, dueBefore string, after *TaskCursor, limit int) ([]Task, error) {
+	condition := "tasks.done = ?"
+	args := []interface{}{done}
+	if dueBefore != "" {
+		condition += " AND tasks.due != '' AND tasks.due <= ?"
+		args = append(args, dueBefore)
+	}
+	if after != nil {
+		condition += " AND (tasks.due = '', tasks.due, tasks.id) > (?, ?, ?)"
+		args = append(args, after.Due == "", after.Due, after.Id)
+	}
+	condition += " ORDER BY tasks.due = '', tasks.due, tasks.id LIMIT ?"
+	return queryTasks(db, userId, condition, append(args, limit)...)
+}
+
+/**
+ * Check or uncheck a task of a note userId can edit by rewriting its
+ * checkbox in the note, as an edit of userId. The task is flipped when
+ * done is nil, as it is when the note is rewritten. The caller publishes
+ * the event once committed.
+ */
+func SetTaskDone(tx *sql.Tx, userId int, taskId int, done *bool) error {
+	var noteId, position int
+	var content string
+	readable, readableArgs := readableBy(strconv.Itoa(userId))
+	err := tx.QueryRow("SELECT tasks.note, tasks.position, notes.content FROM tasks "+
+		"JOIN notes ON notes.rowid = tasks.note WHERE "+readable+" AND tasks.id = ?",
+		append(readableArgs, taskId)...).Scan(&noteId, &position, &content)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no task %d: %w", taskId, ErrTaskNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	canEdit, err := CanEditNote(tx, userId, noteId)
+	if err != nil {
+		return err
+	}
+	if !canEdit {
+		return fmt.Errorf("note %d not editable by user %d: %w", noteId, userId, ErrNoteForbidden)
+	}
+
+	matches := findTasks(content)
+	if position >= len(matches) {
+		return fmt.Errorf("no task %d in note %d: %w", taskId, noteId, ErrTaskNotFound)
+	}
+	checked := !matches[position].Done
+	if done != nil {
+		checked = *done
+	}
+	if matches[position].Done == checked {
+		return nil
+	}
+	mark := " "
+	if checked {
+		mark = "x"
+	}
+	content = content[:matches[position].mark] + mark + content[matches[position].mark+1:]
+	return EditNoteContent(tx, userId, noteId, content)
+}
+
+/**
+ * Parse the tasks of note content, skipping fenced code blocks.
+ */
+func findTasks(content string) []taskMatch {
+	var matches []taskMatch
+	fence, offset := "", 0
+	for i, line := range strings.Split(content, "\n") {
+		start := offset
+		offset += len(line) + 1
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			continue
+		}
+
+		match := taskPattern.FindStringSubmatchIndex(line)
+		if match == nil {
+			continue
+		}
+		task := Task{Done: line[match[4]] != ' ', Line: i + 1}
+		text := line[match[6]:match[7]]
+		if due := taskDuePattern.FindStringSubmatch(text); due != nil {
+			if _, err := time.Parse(TASK_DUE_FORMAT, due[1]); err == nil {
+				task.Due = due[1]
+				text = taskDuePattern.ReplaceAllString(text, "")
+			}
+		}
+		task.Text = strings.Join(strings.Fields(text), " ")
+		matches = append(matches, taskMatch{Task: task, mark: start + match[4]})
+	}
+	return matches
+}
+
+func queryTasks(db *sql.DB, userId int, condition string, args ...interface{}) ([]Task, error) {
+	readable, readableArgs := readableBy(strconv.Itoa(userId))
+	rows, err := db.Query(
+		"SELECT tasks.id, tasks.note, tasks.line, tasks.done, tasks.due, tasks.text FROM tasks "+
+			"JOIN notes ON notes.rowid = tasks.note WHERE "+readable+" AND "+condition,
+		append(readableArgs, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []Task{}
+	for rows.Next() {
+		var task Task
+		if err = rows.Scan(&task.Id, &task.NoteId, &task.Line, &task.Done, &task.Due, &task.Text); err != nil {
+			return tasks, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+/**
+ * Store the tasks of a note as its content has them. Tasks keep their id
+ * as long as they keep their text, so that tasks added, removed or moved
+ * around them do not take it over; tasks sharing a text keep theirs in
+ * order.
+ */
+func setNoteTasks(db Execer, noteId int, content string) error {
+	// Stored tasks are moved to negative positions until claimed, keeping
+	// their order.
+	_, err := db.Exec("UPDATE tasks SET position = -1 - position WHERE note = ? AND position >= 0", noteId)
+	if err != nil {
+		return err
+	}
+	for position, match := range findTasks(content) {
+		result, err := db.Exec(
+			"UPDATE tasks SET position = ?, line = ?, done = ?, due = ? WHERE id = "+
+				"(SELECT id FROM tasks WHERE note = ? AND position < 0 AND text = ? ORDER BY position DESC LIMIT 1)",
+			position, match.Line, match.Done, match.Due, noteId, match.Text)
+		if err != nil {
+			return err
+		}
+		if numRows, err := result.RowsAffected(); err != nil || numRows > 0 {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		_, err = db.Exec("INSERT INTO tasks (note, position, line, done, due, text) VALUES (?, ?, ?, ?, ?, ?)",
+			noteId, position, match.Line, match.Done, match.Due, match.Text)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("DELETE FROM tasks WHERE note = ? AND position < 0", noteId)
+	return err
+}
+
+/**
+ * Extract the tasks of all notes, which were written before tasks were.
+ */
+func setAllNoteTasks(db *sql.DB) error {
+	rows, err := db.Query("SELECT rowid, IFNULL(content,'') FROM notes")
+	if err != nil {
+		return err
+	}
+	contents := make(map[int]string)
+	for rows.Next() {
+		var noteId int
+		var content string
+		if err = rows.Scan(&noteId, &content); err != nil {
+			rows.Close()
+			return err
+		}
+		contents[noteId] = content
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for noteId, content := range contents {
+		if err = setNoteTasks(tx, noteId, content); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,220 @@
+package notes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TEMPLATE_DATE_FORMAT = "2006-01-02"
+const TEMPLATE_TIME_FORMAT = "15:04"
+
+var ErrTemplateNotFound = errors.New("template not found")
+
+// Placeholders are {{name}}, or {{name: label}} for custom prompts, which
+// the label describes to whoever fills them in.
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([\p{L}\p{N}_-]+)\s*(?::\s*([^{}]*?)\s*)?\}\}`)
+
+var templateBuiltins = map[string]bool{"date": true, "time": true, "title": true, "user": true}
+
+/**
+ * A note flagged as a template. Privacy and Tags are given to the notes
+ * created from it, not to the template itself.
+ */
+type Template struct {
+	Author     int
+	AuthorName string
+	Content    string
+	Id         int
+	Privacy    int
+	RenderHint int
+	Tags       []string
+}
+
+/**
+ * A placeholder of a template other than the built-in date, time, title
+ * and user, whose value is asked for when creating a note from it.
+ */
+type TemplatePrompt struct {
+	Label string
+	Name  string
+}
+
+/**
+ * Replace the placeholders of a template with their values, by case
+ * insensitive name. Placeholders without a value are left blank.
+ */
+func ExpandTemplate(content string, values map[string]string) string {
+	lowered := make(map[string]string, len(values))
+	for name, value := range values {
+		lowered[strings.ToLower(name)] = value
+	}
+	return placeholderPattern.ReplaceAllStringFunc(content, func(placeholder string) string {
+		match := placeholderPattern.FindStringSubmatch(placeholder)
+		return lowered[strings.ToLower(match[1])]
+	})
+}
+
+/**
+ * Fetch a template userId can read, wrapping ErrTemplateNotFound when the
+ * note is readable but not a template.
+ */
+func GetTemplate(db *sql.DB, userId int, noteId int) (*Template, error) {
+	if _, err := GetNote(db, userId, noteId); err != nil {
+		return nil, err
+	}
+	templates, err := queryTemplates(db, userId, "templates.note = ?", noteId)
+	if err != nil {
+		return nil, err
+	}
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("note %d: %w", noteId, ErrTemplateNotFound)
+	}
+	return &templates[0], nil
+}
+
+/**
+ * List the templates of userId and those shared with them, oldest first.
+ * Public templates of authors not sharing with userId are left out.
+ */
+func GetTemplates(db *sql.DB, userId int) ([]Template, error) {
+	return queryTemplates(db, userId,
+		"(notes.author = ? OR notes.author IN (SELECT user FROM sharing WHERE sharesWith = ?))", userId, userId)
+}
+
+/**
+ * Flag a note of userId as a template, or change the privacy and tags of
+ * the notes created from it.
+ */
+func SetTemplate(db *sql.DB, userId int, noteId int, privacy int, tags []string) error {
+	authorId, err := GetNoteAuthor(db, noteId)
+	if err != nil {
+		return err
+	}
+	if authorId != userId {
+		return fmt.Errorf("note %d not authored by user %d: %w", noteId, userId, ErrNoteForbidden)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT OR REPLACE INTO templates (note, privacy) VALUES (?, ?)", noteId, privacy)
+	if err == nil {
+		err = setTemplateTags(tx, noteId, tags)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/**
+ * List the custom prompts of a template in the order they first appear.
+ */
+func TemplatePrompts(content string) []TemplatePrompt {
+	prompts := []TemplatePrompt{}
+	seen := make(map[string]bool)
+	for _, match := range placeholderPattern.FindAllStringSubmatch(content, -1) {
+		name := strings.ToLower(match[1])
+		if templateBuiltins[name] || seen[name] {
+			continue
+		}
+		seen[name] = true
+		prompts = append(prompts, TemplatePrompt{Label: match[2], Name: name})
+	}
+	return prompts
+}
+
+/**
+ * Return the values of the built-in placeholders.
+ */
+func TemplateValues(userName string, title string, now time.Time) map[string]string {
+	return map[string]string{
+		"date":  now.Format(TEMPLATE_DATE_FORMAT),
+		"time":  now.Format(TEMPLATE_TIME_FORMAT),
+		"title": title,
+		"user":  userName,
+	}
+}
+
+/**
+ * Stop using a note of userId as a template, leaving the note as it is.
+ */
+func UnsetTemplate(db *sql.DB, userId int, noteId int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(
+		"DELETE FROM templates WHERE note = ? AND note IN (SELECT rowid FROM notes WHERE author = ?)",
+		noteId, userId)
+	if err != nil {
+		return err
+	}
+	if numRows, err := result.RowsAffected(); err != nil || numRows <= 0 {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("no template %d of user %d: %w", noteId, userId, ErrTemplateNotFound)
+	}
+	if _, err = tx.Exec("DELETE FROM templateTags WHERE note = ?", noteId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func queryTemplates(db *sql.DB, userId int, condition string, args ...interface{}) ([]Template, error) {
+	readable, readableArgs := readableBy(strconv.Itoa(userId))
+	rows, err := db.Query(
+		"SELECT notes.rowid, notes.author, IFNULL(users.userName,''), notes.content, templates.privacy, "+
+			"IFNULL(notes.renderHint,0), (SELECT json_group_array(tag) FROM (SELECT tag FROM templateTags "+
+			"WHERE note = templates.note ORDER BY rowid)) FROM templates JOIN notes ON notes.rowid = templates.note "+
+			"LEFT JOIN users ON users.rowid = notes.author WHERE "+readable+" AND "+condition+" ORDER BY notes.rowid",
+		append(readableArgs, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []Template{}
+	for rows.Next() {
+		var template Template
+		var tags string
+		err = rows.Scan(&template.Id, &template.Author, &template.AuthorName, &template.Content, &template.Privacy,
+			&template.RenderHint, &tags)
+		if err != nil {
+			return templates, err
+		}
+		if err = json.Unmarshal([]byte(tags), &template.Tags); err != nil {
+			return templates, err
+		}
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+/**
+ * Replace the tags given to the notes created from a template, normalized
+ * in the order given.
+ */
+func setTemplateTags(tx *sql.Tx, noteId int, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM templateTags WHERE note = ?", noteId); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if tag = NormalizeTag(tag); tag == "" {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO templateTags (note, tag) VALUES (?, ?)", noteId, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
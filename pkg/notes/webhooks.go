@@ -0,0 +1,279 @@
+package notes
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const DELIVERY_DELIVERED = "delivered"
+const DELIVERY_FAILED = "failed"
+const DELIVERY_PENDING = "pending"
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+/**
+ * A delivery of an event to a webhook, queued until it succeeds or runs
+ * out of attempts. NextAttempt is in Unix milliseconds so that retries
+ * can be close together.
+ */
+type Delivery struct {
+	Attempts     int
+	Created      int
+	Delivered    int    `json:",omitempty"`
+	Error        string `json:",omitempty"`
+	EventId      int
+	Id           int
+	Kind         string
+	NextAttempt  int64 `json:"-"`
+	Payload      string
+	ResponseCode int `json:",omitempty"`
+	Status       string
+	WebhookId    int
+}
+
+/**
+ * A URL the events readable by its author are posted to, or all events
+ * when an admin set AllUsers. Events lists the kinds wanted, all of them
+ * when empty, and Notebook and Tag restrict them to notes filed there.
+ * Cursor is the id of the last event considered.
+ */
+type Webhook struct {
+	Active   bool
+	AllUsers bool
+	Author   int
+	Created  int
+	Cursor   int
+	Events   []string
+	Id       int
+	Notebook string
+	Secret   string
+	Tag      string
+	Url      string
+}
+
+/**
+ * Register a webhook, which gets the events recorded from now on.
+ */
+func CreateWebhook(db *sql.DB, webhook *Webhook) (int, error) {
+	result, err := db.Exec(
+		"INSERT INTO webhooks (active, allUsers, author, created, cursor, events, notebook, secret, tag, url) "+
+			"SELECT ?, ?, ?, ?, IFNULL(MAX(id),0), ?, ?, ?, ?, ? FROM events",
+		webhook.Active, webhook.AllUsers, webhook.Author, webhook.Created, strings.Join(webhook.Events, ","),
+		webhook.Notebook, webhook.Secret, webhook.Tag, webhook.Url)
+	if err != nil {
+		return 0, err
+	}
+	lastRow, err := result.LastInsertId()
+	return int(lastRow), err
+}
+
+/**
+ * Delete a webhook of userId along with its deliveries.
+ */
+func DeleteWebhook(db *sql.DB, userId int, webhookId int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM webhooks WHERE id = ? AND author = ?", webhookId, userId)
+	if err == nil {
+		var numRows int64
+		if numRows, err = result.RowsAffected(); err == nil && numRows <= 0 {
+			err = fmt.Errorf("no webhook %d of user %d: %w", webhookId, userId, ErrWebhookNotFound)
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM deliveries WHERE webhook = ?", webhookId)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+/**
+ * List the active webhooks of everybody.
+ */
+func GetActiveWebhooks(db *sql.DB) ([]Webhook, error) {
+	return queryWebhooks(db, "active ORDER BY id")
+}
+
+/**
+ * List up to limit deliveries to a webhook of userId, newest first,
+ * before the delivery id given unless 0.
+ */
+func GetDeliveries(db *sql.DB, userId int, webhookId int, before int, limit int) ([]Delivery, error) {
+	if _, err := GetWebhook(db, userId, webhookId); err != nil {
+		return nil, err
+	}
+	query := "webhook = ?"
+	args := []interface{}{webhookId}
+	if before > 0 {
+		query += " AND id < ?"
+		args = append(args, before)
+	}
+	return queryDeliveries(db, query+" ORDER BY id DESC LIMIT ?", append(args, limit)...)
+}
+
+/**
+ * List up to limit pending deliveries to active webhooks due at now, in
+ * Unix milliseconds, oldest first, and at most perWebhook of them to any
+ * one webhook.
+ */
+func GetDueDeliveries(db *sql.DB, now int64, perWebhook int, limit int) ([]Delivery, error) {
+	return queryDeliveries(db, "id IN (SELECT id FROM (SELECT id, "+
+		"ROW_NUMBER() OVER (PARTITION BY webhook ORDER BY id) AS rank FROM deliveries "+
+		"WHERE status = ? AND nextAttempt <= ? AND webhook IN (SELECT id FROM webhooks WHERE active)) "+
+		"WHERE rank <= ?) ORDER BY id LIMIT ?", DELIVERY_PENDING, now, perWebhook, limit)
+}
+
+/**
+ * Return when the next pending delivery to an active webhook is due, in
+ * Unix milliseconds, or 0 when none is pending.
+ */
+func GetNextDeliveryTime(db *sql.DB) (int64, error) {
+	var next int64
+	err := db.QueryRow("SELECT IFNULL(MIN(nextAttempt),0) FROM deliveries WHERE status = ? AND "+
+		"webhook IN (SELECT id FROM webhooks WHERE active)", DELIVERY_PENDING).Scan(&next)
+	return next, err
+}
+
+/**
+ * Fetch a webhook of userId, wrapping ErrWebhookNotFound when userId has
+ * none with that id.
+ */
+func GetWebhook(db *sql.DB, userId int, webhookId int) (*Webhook, error) {
+	webhooks, err := queryWebhooks(db, "id = ? AND author = ?", webhookId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if len(webhooks) == 0 {
+		return nil, fmt.Errorf("no webhook %d of user %d: %w", webhookId, userId, ErrWebhookNotFound)
+	}
+	return &webhooks[0], nil
+}
+
+func GetWebhooks(db *sql.DB, userId int) ([]Webhook, error) {
+	return queryWebhooks(db, "author = ? ORDER BY id", userId)
+}
+
+/**
+ * Queue deliveries of events to a webhook and move its cursor past them,
+ * at once so that no event is queued twice or skipped.
+ */
+func QueueDeliveries(db *sql.DB, webhookId int, cursor int, deliveries []Delivery) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, delivery := range deliveries {
+		_, err = tx.Exec(
+			"INSERT INTO deliveries (attempts, created, delivered, error, event, kind, nextAttempt, payload, "+
+				"responseCode, status, webhook) VALUES (0, ?, 0, '', ?, ?, ?, ?, 0, ?, ?)",
+			delivery.Created, delivery.EventId, delivery.Kind, delivery.NextAttempt, delivery.Payload,
+			DELIVERY_PENDING, webhookId)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.Exec("UPDATE webhooks SET cursor = ? WHERE id = ?", cursor, webhookId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+/**
+ * Record the outcome of an attempt at a delivery: delivered, retried at
+ * nextAttempt, or failed for good when nextAttempt is 0.
+ */
+func RecordDeliveryAttempt(db *sql.DB, deliveryId int, responseCode int, deliveryErr error, nextAttempt int64) error {
+	status, errorMessage, delivered := DELIVERY_DELIVERED, "", time.Now().Unix()
+	if deliveryErr != nil {
+		status, errorMessage, delivered = DELIVERY_PENDING, deliveryErr.Error(), 0
+		if nextAttempt == 0 {
+			status = DELIVERY_FAILED
+		}
+	}
+	_, err := db.Exec(
+		"UPDATE deliveries SET attempts = attempts + 1, delivered = ?, error = ?, nextAttempt = ?, "+
+			"responseCode = ?, status = ? WHERE id = ?",
+		delivered, errorMessage, nextAttempt, responseCode, status, deliveryId)
+	return err
+}
+
+/**
+ * Replace the settings of a webhook owned by its author.
+ */
+func UpdateWebhook(db *sql.DB, webhook *Webhook) error {
+	result, err := db.Exec(
+		"UPDATE webhooks SET active = ?, allUsers = ?, events = ?, notebook = ?, tag = ?, url = ? "+
+			"WHERE id = ? AND author = ?",
+		webhook.Active, webhook.AllUsers, strings.Join(webhook.Events, ","), webhook.Notebook, webhook.Tag,
+		webhook.Url, webhook.Id, webhook.Author)
+	if err != nil {
+		return err
+	}
+	if numRows, err := result.RowsAffected(); err != nil || numRows <= 0 {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("no webhook %d of user %d: %w", webhook.Id, webhook.Author, ErrWebhookNotFound)
+	}
+	return nil
+}
+
+func queryDeliveries(db *sql.DB, condition string, args ...interface{}) ([]Delivery, error) {
+	rows, err := db.Query(
+		"SELECT id, attempts, created, delivered, error, event, kind, nextAttempt, payload, responseCode, status, "+
+			"webhook FROM deliveries WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var delivery Delivery
+		err = rows.Scan(&delivery.Id, &delivery.Attempts, &delivery.Created, &delivery.Delivered, &delivery.Error,
+			&delivery.EventId, &delivery.Kind, &delivery.NextAttempt, &delivery.Payload, &delivery.ResponseCode,
+			&delivery.Status, &delivery.WebhookId)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func queryWebhooks(db *sql.DB, condition string, args ...interface{}) ([]Webhook, error) {
+	rows, err := db.Query(
+		"SELECT id, active, allUsers, author, created, cursor, events, notebook, secret, tag, url FROM webhooks "+
+			"WHERE "+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		var events string
+		err = rows.Scan(&webhook.Id, &webhook.Active, &webhook.AllUsers, &webhook.Author, &webhook.Created,
+			&webhook.Cursor, &events, &webhook.Notebook, &webhook.Secret, &webhook.Tag, &webhook.Url)
+		if err != nil {
+			return webhooks, err
+		}
+		webhook.Events = []string{}
+		if events != "" {
+			webhook.Events = strings.Split(events, ",")
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
@@ -0,0 +1,187 @@
+package render
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"org/bredin/go-notes/pkg/notes"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+const DEFAULT_CACHE_SIZE = 1000
+
+type Cache struct {
+	entries map[string]*RenderedNote
+	keys    []string
+	mutex   sync.Mutex
+	size    int
+}
+
+type RenderedNote struct {
+	Html string
+	Toc  []TocEntry
+}
+
+type TocEntry struct {
+	Id    string
+	Level int
+	Title string
+}
+
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+)
+
+var policy = newPolicy()
+
+/**
+ * Cache rendered notes keyed by a hash of their content and render hint,
+ * evicting the oldest entry once full.
+ */
+func NewCache(size int) *Cache {
+	return &Cache{entries: make(map[string]*RenderedNote), size: size}
+}
+
+func (c *Cache) Render(content string, renderHint int) (*RenderedNote, error) {
+	hash := sha256.Sum256([]byte(strconv.Itoa(renderHint) + "\x00" + content))
+	key := hex.EncodeToString(hash[:])
+
+	c.mutex.Lock()
+	rendered, ok := c.entries[key]
+	c.mutex.Unlock()
+	if ok {
+		return rendered, nil
+	}
+
+	rendered, err := Render(content, renderHint)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		if len(c.keys) >= c.size {
+			delete(c.entries, c.keys[0])
+			c.keys = c.keys[1:]
+		}
+		c.entries[key] = rendered
+		c.keys = append(c.keys, key)
+	}
+	return rendered, nil
+}
+
+/**
+ * Render note content to sanitized HTML according to its render hint.
+ * Markdown headings get anchor ids and are listed in the table of contents.
+ */
+func Render(content string, renderHint int) (*RenderedNote, error) {
+	switch renderHint {
+	case notes.PLAIN_TEXT_RENDER:
+		return &RenderedNote{
+			Html: `<pre class="plain">` + html.EscapeString(content) + "</pre>",
+			Toc:  []TocEntry{},
+		}, nil
+	case notes.CODE_RENDER:
+		return &RenderedNote{
+			Html: "<pre><code>" + html.EscapeString(content) + "</code></pre>",
+			Toc:  []TocEntry{},
+		}, nil
+	}
+
+	source := []byte(content)
+	doc := markdown.Parser().Parse(text.NewReader(source))
+	toc := []TocEntry{}
+	err := ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := node.(type) {
+		case *ast.Heading:
+			id, _ := n.AttributeString("id")
+			idBytes, _ := id.([]byte)
+			toc = append(toc, TocEntry{
+				Id:    string(idBytes),
+				Level: n.Level,
+				Title: string(n.Text(source)),
+			})
+		case *ast.Link:
+			n.Destination = rewriteDestination(n.Destination)
+		}
+		return ast.WalkContinue, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err = markdown.Renderer().Render(&buf, source, doc); err != nil {
+		return nil, err
+	}
+	return &RenderedNote{Html: policy.Sanitize(buf.String()), Toc: toc}, nil
+}
+
+/**
+ * Render a table of contents as a nested navigation list, each sublist
+ * inside the item of the heading it follows. Skipped heading levels get
+ * an item of their own to hold the deeper list.
+ */
+func TocHtml(toc []TocEntry) string {
+	var sb strings.Builder
+	sb.WriteString(`<nav class="toc">`)
+	depth := 0
+	for _, entry := range toc {
+		for depth > entry.Level {
+			sb.WriteString("</li></ul>")
+			depth--
+		}
+		if depth > 0 && depth == entry.Level {
+			sb.WriteString("</li>")
+		}
+		for depth < entry.Level {
+			sb.WriteString("<ul>")
+			depth++
+			if depth < entry.Level {
+				sb.WriteString("<li>")
+			}
+		}
+		sb.WriteString(`<li><a href="#` + html.EscapeString(entry.Id) + `">` +
+			html.EscapeString(entry.Title) + "</a>")
+	}
+	for ; depth > 0; depth-- {
+		sb.WriteString("</li></ul>")
+	}
+	sb.WriteString("</nav>")
+	return sb.String()
+}
+
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("id").OnElements("h1", "h2", "h3", "h4", "h5", "h6")
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	return p
+}
+
+func rewriteDestination(destination []byte) []byte {
+	link := string(destination)
+	if strings.HasPrefix(link, notes.NOTE_LINK_PREFIX) {
+		noteId := strings.TrimPrefix(link, notes.NOTE_LINK_PREFIX)
+		if _, err := strconv.Atoi(noteId); err == nil {
+			return []byte("/note/render/" + noteId)
+		}
+	}
+	return destination
+}
@@ -0,0 +1,52 @@
+package render
+
+import (
+	"org/bredin/go-notes/pkg/notes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RendersMarkdown(t *testing.T) {
+	content := "# Title\n\n## Tasks\n\n- [x] done\n\n| a |\n| - |\n| 1 |\n\nSee [other](note:7) " +
+		"and [bad](javascript:alert(1)).\n\n<script>alert(1)</script>"
+	rendered, err := Render(content, notes.MARKDOWN_RENDER)
+	assert.Nil(t, err, "Unexpected error rendering markdown")
+	assert.Contains(t, rendered.Html, `<h1 id="title">Title</h1>`)
+	assert.Contains(t, rendered.Html, `<input checked="" disabled="" type="checkbox"`)
+	assert.Contains(t, rendered.Html, "<table>")
+	assert.Contains(t, rendered.Html, `href="/note/render/7"`)
+	assert.NotContains(t, rendered.Html, "javascript:")
+	assert.NotContains(t, rendered.Html, "<script>")
+	assert.Equal(t, []TocEntry{{"title", 1, "Title"}, {"tasks", 2, "Tasks"}}, rendered.Toc)
+	assert.Equal(t,
+		`<nav class="toc"><ul><li><a href="#title">Title</a><ul><li><a href="#tasks">Tasks</a></li></ul></li></ul></nav>`,
+		TocHtml(rendered.Toc))
+	assert.Equal(t,
+		`<nav class="toc"><ul><li><ul><li><a href="#a">A</a></li></ul></li><li><a href="#b">B</a><ul><li><ul>`+
+			`<li><a href="#c">C</a></li></ul></li></ul></li><li><a href="#d">D</a></li></ul></nav>`,
+		TocHtml([]TocEntry{{"a", 2, "A"}, {"b", 1, "B"}, {"c", 3, "C"}, {"d", 1, "D"}}),
+		"Expected skipped levels held in items of their own")
+}
+
+func Test_RendersHints(t *testing.T) {
+	rendered, err := Render("<b>x</b>", notes.PLAIN_TEXT_RENDER)
+	assert.Nil(t, err, "Unexpected error rendering plain text")
+	assert.Equal(t, `<pre class="plain">&lt;b&gt;x&lt;/b&gt;</pre>`, rendered.Html)
+
+	rendered, err = Render("if a < b {}", notes.CODE_RENDER)
+	assert.Nil(t, err, "Unexpected error rendering code")
+	assert.Equal(t, "<pre><code>if a &lt; b {}</code></pre>", rendered.Html)
+}
+
+func Test_CachesRenderedNotes(t *testing.T) {
+	cache := NewCache(1)
+	first, _ := cache.Render("# One", notes.MARKDOWN_RENDER)
+	again, _ := cache.Render("# One", notes.MARKDOWN_RENDER)
+	assert.True(t, first == again, "Expected cached rendering")
+
+	cache.Render("# Two", notes.MARKDOWN_RENDER)
+	evicted, _ := cache.Render("# One", notes.MARKDOWN_RENDER)
+	assert.False(t, first == evicted, "Expected eviction")
+	assert.Equal(t, first, evicted)
+}
@@ -0,0 +1,877 @@
+package routes
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"org/bredin/go-notes/pkg/collab"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"org/bredin/go-notes/pkg/render"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/gofiber/fiber/v2"
+)
+
+const DEFAULT_PAGE_SIZE = 10
+const MAX_PAGE_SIZE = 100
+
+const FULL_VIEW = "full"
+const SUMMARY_VIEW = "summary"
+
+type BatchRequest struct {
+	Ids  []int  `json:"ids"`
+	View string `json:"view"`
+}
+
+type BatchResponse struct {
+	Items   interface{} `json:"items"`
+	Missing []int       `json:"missing"`
+}
+
+type NoteRequest struct {
+	Content    *string   `json:"content" form:"content"`
+	Language   *string   `json:"language" form:"language"`
+	Notebook   *string   `json:"notebook" form:"notebook"`
+	Privacy    *int      `json:"privacy" form:"privacy"`
+	RenderHint *int      `json:"renderHint" form:"renderHint"`
+	Tags       *[]string `json:"tags" form:"tags"`
+}
+
+type NoteResponse struct {
+	notes.NoteRecord
+	Id       int
+	Language string
+	Notebook string
+	Revision int
+	Tags     []string
+}
+
+type NoteSummary struct {
+	Author     int
+	AuthorName string
+	Created    int
+	Id         int
+	Snippet    string
+	Title      string
+}
+
+type Page struct {
+	Facets    map[string][]index.FacetCount `json:"facets,omitempty"`
+	Items     interface{}                   `json:"items"`
+	Next      string                        `json:"next,omitempty"`
+	Summaries []NoteSummary                 `json:"summaries,omitempty"`
+	Total     uint64                        `json:"total,omitempty"`
+}
+
+func installApiRoutes(api fiber.Router, dbFileName string, idx *bleve.Index, renderCache *render.Cache, hub *collab.Hub) {
+	api.Post("/admin/backups", installBackup(dbFileName, idx))
+	api.Get("/events", installApiEvents(dbFileName))
+	api.Get("/export", installExport(dbFileName))
+	api.Get("/journal", installJournalCalendar(dbFileName))
+	api.Get("/journal/settings", installJournalSettingsGet(dbFileName))
+	api.Patch("/journal/settings", installJournalSettingsUpdate(dbFileName))
+	api.Get("/journal/:date", installJournalNote(dbFileName, idx))
+	api.Get("/notebooks", installNotebookList(dbFileName))
+	api.Get("/notes", installApiNoteList(dbFileName))
+	api.Post("/notes", installApiNoteCreate(dbFileName, idx))
+	api.Post("/notes/batch", installApiNoteBatch(dbFileName))
+	api.Post("/notes/import", installNoteImport(dbFileName, idx))
+	api.Get("/notes/:noteId", installApiNoteGet(dbFileName))
+	api.Patch("/notes/:noteId", installApiNoteUpdate(dbFileName, idx))
+	api.Delete("/notes/:noteId", installApiNoteDelete(dbFileName, idx))
+	api.Get("/notes/:noteId/collab", installApiCollab(dbFileName, hub))
+	api.Get("/notes/:noteId/comments", installCommentList(dbFileName, renderCache))
+	api.Post("/notes/:noteId/comments", installCommentCreate(dbFileName, idx, renderCache))
+	api.Get("/notes/:noteId/comments/:commentId", installCommentGet(dbFileName, renderCache))
+	api.Patch("/notes/:noteId/comments/:commentId", installCommentUpdate(dbFileName, idx, renderCache))
+	api.Delete("/notes/:noteId/comments/:commentId", installCommentDelete(dbFileName, idx))
+	api.Post("/notes/:noteId/follow", installNoteFollow(dbFileName, true))
+	api.Delete("/notes/:noteId/follow", installNoteFollow(dbFileName, false))
+	api.Get("/notes/:noteId/related", installApiNoteRelated(dbFileName, idx))
+	api.Get("/notes/:noteId/render", installNoteRender(dbFileName, renderCache))
+	api.Post("/notes/:noteId/template", installTemplateSet(dbFileName))
+	api.Delete("/notes/:noteId/template", installTemplateUnset(dbFileName))
+	api.Get("/notifications", installNotificationList(dbFileName))
+	api.Post("/notifications/read", installNotificationRead(dbFileName))
+	api.Get("/notifications/unread", installNotificationCount(dbFileName))
+	api.Get("/search", installApiSearch(dbFileName, idx))
+	api.Post("/search", installApiSearch(dbFileName, idx))
+	api.Get("/searches", installSavedSearchList(dbFileName))
+	api.Post("/searches", installSavedSearchCreate(dbFileName))
+	api.Get("/searches/:searchId", installSavedSearchGet(dbFileName))
+	api.Patch("/searches/:searchId", installSavedSearchUpdate(dbFileName))
+	api.Delete("/searches/:searchId", installSavedSearchDelete(dbFileName))
+	api.Get("/searches/:searchId/notes", installSavedSearchRun(dbFileName, idx))
+	api.Get("/suggest", installApiSuggest(dbFileName, idx))
+	api.Post("/sync", installApiSync(dbFileName, idx))
+	api.Get("/tasks", installTaskList(dbFileName))
+	api.Post("/tasks/:taskId/toggle", installTaskToggle(dbFileName, idx))
+	api.Get("/templates", installTemplateList(dbFileName))
+	api.Get("/templates/:templateId", installTemplateGet(dbFileName))
+	api.Post("/templates/:templateId/notes", installTemplateNoteCreate(dbFileName, idx))
+	api.Get("/users/:userId", installUserGet(dbFileName))
+	api.Get("/webhooks", installWebhookList(dbFileName))
+	api.Post("/webhooks", installWebhookCreate(dbFileName))
+	api.Get("/webhooks/:webhookId", installWebhookGet(dbFileName))
+	api.Patch("/webhooks/:webhookId", installWebhookUpdate(dbFileName))
+	api.Delete("/webhooks/:webhookId", installWebhookDelete(dbFileName))
+	api.Get("/webhooks/:webhookId/deliveries", installWebhookDeliveries(dbFileName))
+}
+
+/**
+ * Report whether summaries were requested with ?expand=summary.
+ */
+func getExpand(c *fiber.Ctx) (bool, error) {
+	switch expand := c.Query("expand"); expand {
+	case "":
+		return false, nil
+	case SUMMARY_VIEW:
+		return true, nil
+	default:
+		return false, fmt.Errorf("illegal expand: %s", expand)
+	}
+}
+
+func getNoteResponse(db *sql.DB, userId int, noteId int) (*NoteResponse, error) {
+	note, err := notes.GetNote(db, userId, noteId)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := notes.GetNoteTags(db, noteId)
+	if err != nil {
+		return nil, err
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	notebook, err := notes.GetNoteNotebook(db, noteId)
+	if err != nil {
+		return nil, err
+	}
+	language, err := notes.GetNoteLanguage(db, noteId)
+	if err != nil {
+		return nil, err
+	}
+	response := NoteResponse{NoteRecord: *note, Id: noteId, Language: language, Notebook: notebook, Tags: tags}
+	revision, err := notes.GetNoteRevision(db, noteId)
+	if err != nil {
+		return nil, err
+	}
+	if revision != nil {
+		response.Revision = revision.Revision
+	}
+	return &response, nil
+}
+
+/**
+ * Complete fetched notes with their tags, notebooks, languages and
+ * revisions.
+ */
+func getNoteResponses(db *sql.DB, entries []notes.NoteEntry) ([]NoteResponse, error) {
+	var noteIds []int
+	for _, entry := range entries {
+		noteIds = append(noteIds, entry.Id)
+	}
+	tags, err := notes.GetNotesTags(db, noteIds)
+	if err != nil {
+		return nil, err
+	}
+	notebooks, err := notes.GetNotesNotebooks(db, noteIds)
+	if err != nil {
+		return nil, err
+	}
+	languages, err := notes.GetNotesLanguages(db, noteIds)
+	if err != nil {
+		return nil, err
+	}
+	revisions, err := notes.GetNotesRevisions(db, noteIds)
+	if err != nil {
+		return nil, err
+	}
+	responses := []NoteResponse{}
+	for _, entry := range entries {
+		noteTags := tags[entry.Id]
+		if noteTags == nil {
+			noteTags = []string{}
+		}
+		responses = append(responses, NoteResponse{
+			NoteRecord: entry.NoteRecord,
+			Id:         entry.Id,
+			Language:   languages[entry.Id],
+			Notebook:   notebooks[entry.Id],
+			Revision:   revisions[entry.Id],
+			Tags:       noteTags,
+		})
+	}
+	return responses, nil
+}
+
+func getNoteSummaries(db *sql.DB, userId int, noteIds []int) ([]NoteSummary, error) {
+	entries, err := notes.GetNotes(db, userId, noteIds)
+	if err != nil {
+		return nil, err
+	}
+	summaries := []NoteSummary{}
+	for _, entry := range entries {
+		summaries = append(summaries, newNoteSummary(entry))
+	}
+	return summaries, nil
+}
+
+/**
+ * Parse the limit query parameter, capping it at MAX_PAGE_SIZE.
+ */
+func getPageSize(c *fiber.Ctx) (int, error) {
+	limit, err := strconv.Atoi(c.Query("limit", strconv.Itoa(DEFAULT_PAGE_SIZE)))
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("illegal limit: %s", c.Query("limit"))
+	}
+	if limit > MAX_PAGE_SIZE {
+		limit = MAX_PAGE_SIZE
+	}
+	return limit, nil
+}
+
+/**
+ * Restrict a query to the notes userId may read as of the last indexing.
+ */
+func getReadableQuery(db *sql.DB, userId int, q query.Query) (query.Query, error) {
+	sharers, err := notes.GetSharers(db, userId)
+	if err != nil {
+		return nil, err
+	}
+	return index.ReadableQuery(q, userId, sharers), nil
+}
+
+/**
+ * Return which of the notes found in the index userId may read right now,
+ * so that hits do not depend on the index being up to date.
+ */
+func getReadableIds(db *sql.DB, userId int, ids []string) (map[string]bool, error) {
+	var noteIds []int
+	for _, id := range ids {
+		if noteId, err := strconv.Atoi(id); err == nil {
+			noteIds = append(noteIds, noteId)
+		}
+	}
+	entries, err := notes.GetNotes(db, userId, noteIds)
+	if err != nil {
+		return nil, err
+	}
+	readable := make(map[string]bool)
+	for _, entry := range entries {
+		readable[strconv.Itoa(entry.Id)] = true
+	}
+	return readable, nil
+}
+
+/**
+ * Fetch up to MAX_PAGE_SIZE notes at once as full records or summaries.
+ * Ids of notes that are missing or not readable are listed separately.
+ */
+func installApiNoteBatch(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		var request BatchRequest
+		if err := c.BodyParser(&request); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		if len(request.Ids) == 0 || len(request.Ids) > MAX_PAGE_SIZE {
+			return sendError(c, fiber.StatusBadRequest,
+				fmt.Errorf("expected between 1 and %d ids, got %d", MAX_PAGE_SIZE, len(request.Ids)))
+		}
+		if request.View == "" {
+			request.View = SUMMARY_VIEW
+		}
+		if request.View != SUMMARY_VIEW && request.View != FULL_VIEW {
+			return sendError(c, fiber.StatusBadRequest, fmt.Errorf("illegal view: %s", request.View))
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		entries, err := notes.GetNotes(db, userId, request.Ids)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		found := make(map[int]bool)
+		for _, entry := range entries {
+			found[entry.Id] = true
+		}
+		missing := []int{}
+		for _, noteId := range request.Ids {
+			if !found[noteId] {
+				missing = append(missing, noteId)
+			}
+		}
+
+		if request.View == SUMMARY_VIEW {
+			summaries := []NoteSummary{}
+			for _, entry := range entries {
+				summaries = append(summaries, newNoteSummary(entry))
+			}
+			return c.JSON(BatchResponse{Items: summaries, Missing: missing})
+		}
+
+		responses, err := getNoteResponses(db, entries)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		return c.JSON(BatchResponse{Items: responses, Missing: missing})
+	}
+}
+
+func installApiNoteCreate(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		var request NoteRequest
+		if err := c.BodyParser(&request); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		note, err := newNoteRecord(userId, request)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		// The metadata is set in the same transaction so that the created
+		// event is seen with the note's notebook and tags.
+		tx, err := db.Begin()
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		noteId, err := notes.CreateNote(tx, &note)
+		if err != nil {
+			tx.Rollback()
+			log.Errorf("Save: %s", err.Error())
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		metadata := NoteRequest{Language: request.Language, Notebook: request.Notebook, Tags: request.Tags}
+		if err = updateNote(tx, userId, noteId, metadata); err != nil {
+			tx.Rollback()
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		notes.PublishEvents(db)
+		if err = index.IndexNotes(*idx, db, []int{noteId}); err != nil {
+			log.Errorf("Cannot update index: %s", err.Error())
+		}
+
+		response, err := getNoteResponse(db, userId, noteId)
+		if err != nil {
+			return sendNoteError(c, err)
+		}
+		c.Location("/api/v1/notes/" + strconv.Itoa(noteId))
+		return sendNoteResponse(c, fiber.StatusCreated, response)
+	}
+}
+
+func installApiNoteDelete(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		noteId, err := strconv.Atoi(c.Params("noteId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		if err = checkNoteAuthor(db, userId, noteId); err != nil {
+			return sendNoteError(c, err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if status, err := checkIfMatch(c, tx, noteId); err != nil {
+			tx.Rollback()
+			return sendError(c, status, err)
+		}
+		if err = notes.DeleteNote(tx, userId, noteId); err != nil {
+			tx.Rollback()
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		notes.PublishEvents(db)
+		if err = (*idx).Delete(strconv.Itoa(noteId)); err != nil {
+			log.Errorf("Cannot update index: %s", err.Error())
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func installApiNoteGet(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		noteId, err := strconv.Atoi(c.Params("noteId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		response, err := getNoteResponse(db, userId, noteId)
+		if err != nil {
+			return sendNoteError(c, err)
+		}
+		return sendNoteResponse(c, fiber.StatusOK, response)
+	}
+}
+
+func installApiNoteList(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		limit, err := getPageSize(c)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		expand, err := getExpand(c)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		var after *notes.NoteCursor
+		if cursor := c.Query("cursor"); cursor != "" {
+			if after, err = notes.ParseNoteCursor(cursor); err != nil {
+				return sendError(c, fiber.StatusBadRequest, err)
+			}
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		noteIds, next, err := notes.GetRecentNotesAfter(db, userId, limit, after)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if noteIds == nil {
+			noteIds = []int{}
+		}
+		page := Page{Items: noteIds}
+		if expand {
+			if page.Summaries, err = getNoteSummaries(db, userId, noteIds); err != nil {
+				return sendError(c, fiber.StatusInternalServerError, err)
+			}
+		}
+		params := url.Values{"limit": {strconv.Itoa(limit)}}
+		if expand {
+			params.Set("expand", SUMMARY_VIEW)
+		}
+		if next != nil {
+			params.Set("cursor", next.String())
+		}
+		return sendPage(c, page, next != nil, params)
+	}
+}
+
+/**
+ * List notes on the same subject as a note, among those the caller may
+ * read, with the reasons they were picked.
+ */
+func installApiNoteRelated(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		noteId, err := strconv.Atoi(c.Params("noteId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		size, err := getPageSize(c)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		expand, err := getExpand(c)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		note, err := notes.GetNote(db, userId, noteId)
+		if err != nil {
+			return sendNoteError(c, err)
+		}
+		doc := index.NewNoteDocument(noteId, "", note.Content, note.Created)
+		if doc.Tags, err = notes.GetNoteTags(db, noteId); err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		language, err := notes.GetNoteLanguage(db, noteId)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if language != notes.AUTO_LANGUAGE {
+			doc.Language = language
+		}
+		relatedQuery, err := index.RelatedQuery(idx, doc)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if relatedQuery != nil {
+			if relatedQuery, err = getReadableQuery(db, userId, relatedQuery); err != nil {
+				return sendError(c, fiber.StatusInternalServerError, err)
+			}
+		}
+		found, err := index.SearchRelated(idx, relatedQuery, size)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		var ids []string
+		for _, note := range found {
+			ids = append(ids, note.Id)
+		}
+		readable, err := getReadableIds(db, userId, ids)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		related := []index.RelatedNote{}
+		for _, note := range found {
+			if readable[note.Id] {
+				related = append(related, note)
+			}
+		}
+
+		page := Page{Items: related}
+		if expand {
+			var noteIds []int
+			for _, note := range related {
+				if noteId, err := strconv.Atoi(note.Id); err == nil {
+					noteIds = append(noteIds, noteId)
+				}
+			}
+			if page.Summaries, err = getNoteSummaries(db, userId, noteIds); err != nil {
+				return sendError(c, fiber.StatusInternalServerError, err)
+			}
+		}
+		return c.JSON(page)
+	}
+}
+
+func installApiNoteUpdate(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		noteId, err := strconv.Atoi(c.Params("noteId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		var request NoteRequest
+		if err = c.BodyParser(&request); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		if err = checkNoteAuthor(db, userId, noteId); err != nil {
+			return sendNoteError(c, err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if status, err := checkIfMatch(c, tx, noteId); err != nil {
+			tx.Rollback()
+			return sendError(c, status, err)
+		}
+		if err = updateNote(tx, userId, noteId, request); err != nil {
+			tx.Rollback()
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		notes.PublishEvents(db)
+
+		if err = index.IndexNotes(*idx, db, []int{noteId}); err != nil {
+			log.Errorf("Cannot update index: %s", err.Error())
+		}
+		response, err := getNoteResponse(db, userId, noteId)
+		if err != nil {
+			return sendNoteError(c, err)
+		}
+		return sendNoteResponse(c, fiber.StatusOK, response)
+	}
+}
+
+func installApiSearch(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		var noteQuery *index.NoteQuery
+		var err error
+		if c.Method() == fiber.MethodPost {
+			noteQuery = &index.NoteQuery{}
+			if err = c.BodyParser(noteQuery); err != nil {
+				return sendError(c, fiber.StatusBadRequest, err)
+			}
+		} else {
+			if c.Query("q") == "" {
+				return sendError(c, fiber.StatusBadRequest, fmt.Errorf("missing query parameter q"))
+			}
+			if noteQuery, err = index.ParseQuery(c.Query("q")); err != nil {
+				return sendError(c, fiber.StatusBadRequest, err)
+			}
+		}
+		log.Infof("Search %+v", *noteQuery)
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		return sendSearchPage(c, db, idx, userId, noteQuery)
+	}
+}
+
+/**
+ * Complete titles, tags and author names of readable notes from what the
+ * user has typed so far.
+ */
+func installApiSuggest(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		if strings.TrimSpace(c.Query("q")) == "" {
+			return sendError(c, fiber.StatusBadRequest, fmt.Errorf("missing query parameter q"))
+		}
+		size, err := getPageSize(c)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		readableQuery, err := getReadableQuery(db, userId, bleve.NewMatchAllQuery())
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		found, err := index.Suggest(idx, c.Query("q"), readableQuery, size)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		var ids []string
+		for _, suggestion := range found {
+			if suggestion.NoteId != 0 {
+				ids = append(ids, strconv.Itoa(suggestion.NoteId))
+			}
+		}
+		readable, err := getReadableIds(db, userId, ids)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		suggestions := []index.Suggestion{}
+		for _, suggestion := range found {
+			if suggestion.NoteId == 0 || readable[strconv.Itoa(suggestion.NoteId)] {
+				suggestions = append(suggestions, suggestion)
+			}
+		}
+		return c.JSON(Page{Items: suggestions})
+	}
+}
+
+/**
+ * Build a new note of userId from a request, checking its fields.
+ */
+func newNoteRecord(userId int, request NoteRequest) (notes.NoteRecord, error) {
+	if request.Content == nil {
+		return notes.NoteRecord{}, fmt.Errorf("missing content")
+	}
+	note := notes.NoteRecord{
+		Author:     userId,
+		Content:    *request.Content,
+		Created:    int(time.Now().Unix()),
+		Privacy:    notes.DEFAULT_ACCESS,
+		RenderHint: notes.MARKDOWN_RENDER,
+	}
+	if request.Privacy != nil {
+		note.Privacy = *request.Privacy
+	}
+	if request.RenderHint != nil {
+		note.RenderHint = *request.RenderHint
+	}
+	if note.Privacy < notes.PRIVATE_ACCESS || note.Privacy > notes.PUBLIC_ACCESS {
+		return note, fmt.Errorf("illegal privacy mode: %d", note.Privacy)
+	}
+	if note.RenderHint < notes.PLAIN_TEXT_RENDER || note.RenderHint > notes.CODE_RENDER {
+		return note, fmt.Errorf("illegal render hint: %d", note.RenderHint)
+	}
+	if request.Language != nil {
+		if _, err := notes.ParseLanguage(*request.Language); err != nil {
+			return note, err
+		}
+	}
+	return note, nil
+}
+
+func newNoteSummary(entry notes.NoteEntry) NoteSummary {
+	return NoteSummary{
+		Author:     entry.Author,
+		AuthorName: entry.AuthorName,
+		Created:    entry.Created,
+		Id:         entry.Id,
+		Snippet:    index.GetSnippetFromContent(entry.Content),
+		Title:      index.GetTitleFromContent(entry.Content),
+	}
+}
+
+/**
+ * Send a page with a link to the next page, if any, in both the body and
+ * the Link header.
+ */
+func sendPage(c *fiber.Ctx, page Page, hasNext bool, params url.Values) error {
+	if hasNext {
+		page.Next = c.Path() + "?" + params.Encode()
+		c.Set(fiber.HeaderLink, "<"+page.Next+`>; rel="next"`)
+	}
+	return c.JSON(page)
+}
+
+/**
+ * Run a structured query with the access rights userId has now, paged and
+ * shaped by the request parameters.
+ */
+func sendSearchPage(c *fiber.Ctx, db *sql.DB, idx *bleve.Index, userId int, noteQuery *index.NoteQuery) error {
+	size, err := getPageSize(c)
+	if err != nil {
+		return sendError(c, fiber.StatusBadRequest, err)
+	}
+	expand, err := getExpand(c)
+	if err != nil {
+		return sendError(c, fiber.StatusBadRequest, err)
+	}
+	options := index.SearchOptions{
+		Facets:    c.Query("facets") == "true",
+		Highlight: c.Query("highlight") == "true",
+		Size:      size,
+		Sort:      c.Query("sort"),
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		if options.After, err = index.ParseSearchCursor(cursor); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+	}
+
+	author, err := notes.GetAuthor(db, userId)
+	if err != nil || author == nil {
+		return sendError(c, fiber.StatusInternalServerError, err)
+	}
+	for i, authorName := range noteQuery.Authors {
+		if authorName == index.AUTHOR_SELF {
+			noteQuery.Authors[i] = author.Name
+		}
+	}
+	searchQuery, err := noteQuery.Query()
+	if err != nil {
+		return sendError(c, fiber.StatusBadRequest, err)
+	}
+	if searchQuery, err = getReadableQuery(db, userId, searchQuery); err != nil {
+		return sendError(c, fiber.StatusInternalServerError, err)
+	}
+	result, err := index.SearchNotes(idx, searchQuery, options)
+	if errors.Is(err, index.ErrInvalidSearch) {
+		return sendError(c, fiber.StatusBadRequest, err)
+	}
+	if err != nil {
+		return sendError(c, fiber.StatusInternalServerError, err)
+	}
+	var ids []string
+	for _, hit := range result.Hits {
+		ids = append(ids, hit.Id)
+	}
+	readable, err := getReadableIds(db, userId, ids)
+	if err != nil {
+		return sendError(c, fiber.StatusInternalServerError, err)
+	}
+	hits := result.Hits[:0]
+	for _, hit := range result.Hits {
+		if readable[hit.Id] {
+			hits = append(hits, hit)
+		}
+	}
+	result.Hits = hits
+	page := Page{Facets: result.Facets, Items: result.Hits, Total: result.Total}
+	if expand {
+		var noteIds []int
+		for _, hit := range result.Hits {
+			if noteId, err := strconv.Atoi(hit.Id); err == nil {
+				noteIds = append(noteIds, noteId)
+			}
+		}
+		if page.Summaries, err = getNoteSummaries(db, userId, noteIds); err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+	}
+
+	params := url.Values{"limit": {strconv.Itoa(size)}}
+	for _, name := range []string{"expand", "facets", "highlight", "q", "sort"} {
+		if value := c.Query(name); value != "" {
+			params.Set(name, value)
+		}
+	}
+	if result.Next != nil {
+		params.Set("cursor", result.Next.String())
+	}
+	return sendPage(c, page, result.Next != nil, params)
+}
+
+/**
+ * Apply the fields set in a request to a note of userId.
+ */
+func updateNote(db notes.Execer, userId int, noteId int, request NoteRequest) error {
+	var err error
+	if request.Content != nil {
+		err = notes.UpdateNoteContent(db, userId, noteId, *request.Content)
+	}
+	if err == nil && request.Language != nil {
+		err = notes.SetNoteLanguage(db, noteId, *request.Language)
+	}
+	if err == nil && request.Notebook != nil {
+		err = notes.SetNoteNotebook(db, noteId, *request.Notebook)
+	}
+	if err == nil && request.Privacy != nil {
+		err = notes.SetNotePrivacy(db, userId, noteId, *request.Privacy)
+	}
+	if err == nil && request.RenderHint != nil {
+		err = notes.SetNoteRenderHint(db, userId, noteId, *request.RenderHint)
+	}
+	if err == nil && request.Tags != nil {
+		err = notes.SetNoteTags(db, noteId, *request.Tags)
+	}
+	return err
+}
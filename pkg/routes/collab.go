@@ -0,0 +1,212 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"org/bredin/go-notes/pkg/collab"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// Connections are pinged every COLLAB_PING_PERIOD and dropped when no
+// pong comes back within COLLAB_PONG_WAIT or a write takes longer than
+// COLLAB_WRITE_WAIT.
+const COLLAB_PING_PERIOD = 30 * time.Second
+const COLLAB_PONG_WAIT = 60 * time.Second
+const COLLAB_WRITE_WAIT = 10 * time.Second
+
+// The largest message accepted from clients, in bytes.
+const COLLAB_MAX_MESSAGE = 1 << 20
+
+// Sessions are authenticated by the Authorization header, which browsers
+// never add on their own, so any origin may connect.
+var collabUpgrader = websocket.FastHTTPUpgrader{
+	CheckOrigin: func(ctx *fasthttp.RequestCtx) bool { return true },
+}
+
+/**
+ * Stores the documents of editing sessions as notes, saved on behalf of
+ * their authors so that co-authors go through the same update path.
+ */
+type noteStore struct {
+	dbFileName string
+	idx        *bleve.Index
+}
+
+/**
+ * Join the collaborative editing session of a note over a WebSocket. Only
+ * users who may edit the note get in.
+ */
+func installApiCollab(dbFileName string, hub *collab.Hub) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		noteId, err := strconv.Atoi(c.Params("noteId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		if !websocket.FastHTTPIsWebSocketUpgrade(c.Context()) {
+			return sendError(c, fiber.StatusUpgradeRequired, fmt.Errorf("editing sessions run over WebSocket"))
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		canEdit, err := notes.CanEditNote(db, userId, noteId)
+		if err != nil {
+			return sendNoteError(c, err)
+		}
+		if !canEdit {
+			return sendNoteError(c, fmt.Errorf("note %d is not editable by user %d: %w", noteId, userId, notes.ErrNoteForbidden))
+		}
+		author, err := notes.GetAuthor(db, userId)
+		if err != nil || author == nil {
+			return sendError(c, fiber.StatusInternalServerError, fmt.Errorf("no user %d", userId))
+		}
+
+		session, participant, err := hub.Join(noteId, userId, author.Name)
+		if err != nil {
+			return sendNoteError(c, err)
+		}
+		err = collabUpgrader.Upgrade(c.Context(), func(conn *websocket.Conn) {
+			serveCollab(conn, session, participant)
+		})
+		if err != nil {
+			session.Leave(participant)
+			log.Infof("Collab %d: %s", userId, err.Error())
+		}
+		return nil
+	}
+}
+
+/**
+ * Relay messages between a connection and its session until either side
+ * goes away.
+ */
+func serveCollab(conn *websocket.Conn, session *collab.Session, participant *collab.Participant) {
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		writeCollab(conn, participant)
+	}()
+
+	conn.SetReadLimit(COLLAB_MAX_MESSAGE)
+	conn.SetReadDeadline(time.Now().Add(COLLAB_PONG_WAIT))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(COLLAB_PONG_WAIT))
+	})
+	for {
+		var message collab.Message
+		if err := conn.ReadJSON(&message); err != nil {
+			break
+		}
+		session.Receive(participant, message)
+	}
+	session.Leave(participant)
+	<-written
+}
+
+/**
+ * Write the messages of a participant and keep the connection alive,
+ * closing it once the participant left or was dropped.
+ */
+func writeCollab(conn *websocket.Conn, participant *collab.Participant) {
+	defer conn.Close()
+	ping := time.NewTicker(COLLAB_PING_PERIOD)
+	defer ping.Stop()
+	for {
+		select {
+		case message, ok := <-participant.Messages():
+			conn.SetWriteDeadline(time.Now().Add(COLLAB_WRITE_WAIT))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := conn.WriteJSON(message); err != nil {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(COLLAB_WRITE_WAIT))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *noteStore) CanEdit(noteId int, userId int) (bool, error) {
+	db, err := notes.OpenNoteDb(s.dbFileName)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	canEdit, err := notes.CanEditNote(db, userId, noteId)
+	if errors.Is(err, notes.ErrNoteNotFound) {
+		return false, nil
+	}
+	return canEdit, err
+}
+
+func (s *noteStore) Load(noteId int) (string, int, error) {
+	db, err := notes.OpenNoteDb(s.dbFileName)
+	if err != nil {
+		return "", 0, err
+	}
+	defer db.Close()
+	authorId, err := notes.GetNoteAuthor(db, noteId)
+	if err != nil {
+		return "", 0, err
+	}
+	note, err := notes.GetNote(db, authorId, noteId)
+	if err != nil {
+		return "", 0, err
+	}
+	revision, err := getRevision(db, noteId)
+	return note.Content, revision, err
+}
+
+/**
+ * Save the content of a note as an edit of userId unless it changed since
+ * revision, then index it.
+ */
+func (s *noteStore) Save(noteId int, userId int, content string, revision int) (int, error) {
+	db, err := notes.OpenNoteDb(s.dbFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	current, err := notes.GetNoteRevision(tx, noteId)
+	if err == nil && (current == nil || current.Revision != revision) {
+		err = collab.ErrNoteChanged
+	}
+	if err == nil {
+		err = notes.EditNoteContent(tx, userId, noteId, content)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	notes.PublishEvents(db)
+
+	if err = index.IndexNotes(*s.idx, db, []int{noteId}); err != nil {
+		log.Errorf("Cannot update index: %s", err.Error())
+	}
+	return getRevision(db, noteId)
+}
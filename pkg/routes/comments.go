@@ -0,0 +1,279 @@
+package routes
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"org/bredin/go-notes/pkg/render"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/gofiber/fiber/v2"
+)
+
+type CommentRequest struct {
+	Content  *string `json:"content"`
+	ParentId *int    `json:"parentId"`
+	Resolved *bool   `json:"resolved"`
+}
+
+/**
+ * A comment with its markdown content rendered as Html. ParentId is 0 for
+ * comments starting a thread.
+ */
+type CommentResponse struct {
+	Author     int
+	AuthorName string
+	Content    string
+	Created    int
+	Deleted    bool
+	Edited     int
+	Html       string
+	Id         int
+	NoteId     int
+	ParentId   int
+	Resolved   bool
+}
+
+/**
+ * Fetch the comment named by the commentId parameter, which must be on the
+ * note named by the noteId parameter.
+ */
+func getCommentParam(c *fiber.Ctx, db *sql.DB) (*notes.Comment, error) {
+	noteId, err := strconv.Atoi(c.Params("noteId"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", notes.ErrNoteNotFound, c.Params("noteId"))
+	}
+	commentId, err := strconv.Atoi(c.Params("commentId"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", notes.ErrCommentNotFound, c.Params("commentId"))
+	}
+	comment, err := notes.GetComment(db, getUserId(c), commentId)
+	if err != nil {
+		return nil, err
+	}
+	if comment.Note != noteId {
+		return nil, fmt.Errorf("no comment %d on note %d: %w", commentId, noteId, notes.ErrCommentNotFound)
+	}
+	return comment, nil
+}
+
+func getCommentResponse(comment *notes.Comment, cache *render.Cache) (*CommentResponse, error) {
+	rendered, err := cache.Render(comment.Content, notes.MARKDOWN_RENDER)
+	if err != nil {
+		return nil, err
+	}
+	return &CommentResponse{
+		Author:     comment.Author,
+		AuthorName: comment.AuthorName,
+		Content:    comment.Content,
+		Created:    comment.Created,
+		Deleted:    comment.Deleted,
+		Edited:     comment.Edited,
+		Html:       rendered.Html,
+		Id:         comment.Id,
+		NoteId:     comment.Note,
+		ParentId:   comment.Parent,
+		Resolved:   comment.Resolved,
+	}, nil
+}
+
+/**
+ * Comment on a note, or reply to one of its comments, and index the
+ * comment along with the note.
+ */
+func installCommentCreate(dbFileName string, idx *bleve.Index, cache *render.Cache) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		noteId, err := strconv.Atoi(c.Params("noteId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		var request CommentRequest
+		if err = c.BodyParser(&request); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		if request.Content == nil {
+			return sendError(c, fiber.StatusBadRequest, fmt.Errorf("missing comment content"))
+		}
+		comment := notes.Comment{
+			Author:  userId,
+			Content: *request.Content,
+			Created: int(time.Now().Unix()),
+			Note:    noteId,
+		}
+		if request.ParentId != nil {
+			comment.Parent = *request.ParentId
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		commentId, err := notes.CreateComment(db, &comment)
+		if err != nil {
+			return sendCommentError(c, err)
+		}
+		created, err := notes.GetComment(db, userId, commentId)
+		if err != nil {
+			return sendCommentError(c, err)
+		}
+		if err = index.IndexNotes(*idx, db, []int{noteId}); err != nil {
+			log.Errorf("Cannot update index: %s", err.Error())
+		}
+		response, err := getCommentResponse(created, cache)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		c.Location(fmt.Sprintf("/api/v1/notes/%d/comments/%d", noteId, commentId))
+		return c.Status(fiber.StatusCreated).JSON(response)
+	}
+}
+
+func installCommentDelete(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		comment, err := getCommentParam(c, db)
+		if err != nil {
+			return sendCommentError(c, err)
+		}
+		if err = notes.DeleteComment(db, getUserId(c), comment.Id); err != nil {
+			return sendCommentError(c, err)
+		}
+		if err = index.IndexNotes(*idx, db, []int{comment.Note}); err != nil {
+			log.Errorf("Cannot update index: %s", err.Error())
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func installCommentGet(dbFileName string, cache *render.Cache) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		comment, err := getCommentParam(c, db)
+		if err != nil {
+			return sendCommentError(c, err)
+		}
+		response, err := getCommentResponse(comment, cache)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		return c.JSON(response)
+	}
+}
+
+/**
+ * List the comments on a note, oldest first, to whoever can read it.
+ */
+func installCommentList(dbFileName string, cache *render.Cache) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		noteId, err := strconv.Atoi(c.Params("noteId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		comments, err := notes.GetNoteComments(db, userId, noteId)
+		if err != nil {
+			return sendCommentError(c, err)
+		}
+		items := []CommentResponse{}
+		for i := range comments {
+			response, err := getCommentResponse(&comments[i], cache)
+			if err != nil {
+				return sendError(c, fiber.StatusInternalServerError, err)
+			}
+			items = append(items, *response)
+		}
+		return c.JSON(Page{Items: items})
+	}
+}
+
+/**
+ * Edit the content of a comment, by its author, and resolve or reopen the
+ * thread it starts, by its author or the note's.
+ */
+func installCommentUpdate(dbFileName string, idx *bleve.Index, cache *render.Cache) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		var request CommentRequest
+		if err := c.BodyParser(&request); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		if request.ParentId != nil {
+			return sendError(c, fiber.StatusBadRequest, fmt.Errorf("comments cannot move between threads"))
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		comment, err := getCommentParam(c, db)
+		if err != nil {
+			return sendCommentError(c, err)
+		}
+		if request.Content != nil {
+			if err = notes.UpdateComment(db, userId, comment.Id, *request.Content); err != nil {
+				return sendCommentError(c, err)
+			}
+			if err = index.IndexNotes(*idx, db, []int{comment.Note}); err != nil {
+				log.Errorf("Cannot update index: %s", err.Error())
+			}
+		}
+		if request.Resolved != nil {
+			if err = notes.ResolveComment(db, userId, comment.Id, *request.Resolved); err != nil {
+				return sendCommentError(c, err)
+			}
+		}
+
+		if comment, err = notes.GetComment(db, userId, comment.Id); err != nil {
+			return sendCommentError(c, err)
+		}
+		response, err := getCommentResponse(comment, cache)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		return c.JSON(response)
+	}
+}
+
+/**
+ * Send a comment or note access error as a 404 or 403, an invalid comment
+ * as a 400, or anything else as a 500.
+ */
+func sendCommentError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, notes.ErrCommentNotFound):
+		return sendError(c, fiber.StatusNotFound, err)
+	case errors.Is(err, notes.ErrCommentForbidden):
+		return sendError(c, fiber.StatusForbidden, err)
+	case errors.Is(err, notes.ErrNoteNotFound), errors.Is(err, notes.ErrNoteForbidden):
+		return sendNoteError(c, err)
+	case errors.Is(err, notes.ErrInvalidComment):
+		return sendError(c, fiber.StatusBadRequest, err)
+	}
+	return sendError(c, fiber.StatusInternalServerError, err)
+}
@@ -0,0 +1,136 @@
+package routes
+
+import (
+	"errors"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const BAD_REQUEST_ERROR = "bad_request"
+const COMMENT_FORBIDDEN_ERROR = "comment_forbidden"
+const COMMENT_NOT_FOUND_ERROR = "comment_not_found"
+const CONFLICT_ERROR = "conflict"
+const FORBIDDEN_ERROR = "forbidden"
+const INTERNAL_ERROR = "internal_error"
+const INVALID_QUERY_ERROR = "invalid_query"
+const NOT_FOUND_ERROR = "not_found"
+const NOTE_FORBIDDEN_ERROR = "note_forbidden"
+const NOTE_NOT_FOUND_ERROR = "note_not_found"
+const PRECONDITION_FAILED_ERROR = "precondition_failed"
+const PRECONDITION_REQUIRED_ERROR = "precondition_required"
+const SEARCH_NOT_FOUND_ERROR = "search_not_found"
+const TASK_NOT_FOUND_ERROR = "task_not_found"
+const TEMPLATE_NOT_FOUND_ERROR = "template_not_found"
+const UPGRADE_REQUIRED_ERROR = "upgrade_required"
+const WEBHOOK_NOT_FOUND_ERROR = "webhook_not_found"
+
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+/**
+ * Query errors also carry the offending field of a structured query or
+ * the character position in the query syntax.
+ */
+type ErrorDetail struct {
+	Code     string `json:"code"`
+	Field    string `json:"field,omitempty"`
+	Message  string `json:"message"`
+	Position *int   `json:"position,omitempty"`
+}
+
+/**
+ * Send a JSON error body with a machine-readable code derived from the
+ * status and, for note and comment access failures, the underlying error.
+ */
+func sendError(c *fiber.Ctx, status int, err error) error {
+	return sendErrorCode(c, status, errorCode(status, err), err)
+}
+
+func sendErrorCode(c *fiber.Ctx, status int, code string, err error) error {
+	detail := ErrorDetail{Code: code, Message: code}
+	if err != nil {
+		detail.Message = err.Error()
+	}
+	var queryErr *index.QueryError
+	if errors.As(err, &queryErr) {
+		detail.Field = queryErr.Field
+		if queryErr.Field == "" {
+			detail.Position = &queryErr.Position
+		}
+	}
+	return c.Status(status).JSON(ErrorBody{detail})
+}
+
+/**
+ * Send a note access error as a 404 or 403, or anything else as a 500.
+ */
+func sendNoteError(c *fiber.Ctx, err error) error {
+	return sendError(c, noteErrorStatus(err), err)
+}
+
+/**
+ * Send a saved search error as a 404 or 409, or anything else as a 500.
+ */
+func sendSearchError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, notes.ErrSearchNotFound):
+		return sendError(c, fiber.StatusNotFound, err)
+	case errors.Is(err, notes.ErrSearchExists):
+		return sendError(c, fiber.StatusConflict, err)
+	}
+	return sendError(c, fiber.StatusInternalServerError, err)
+}
+
+func errorCode(status int, err error) string {
+	var queryErr *index.QueryError
+	switch {
+	case errors.As(err, &queryErr):
+		return INVALID_QUERY_ERROR
+	case errors.Is(err, notes.ErrCommentNotFound):
+		return COMMENT_NOT_FOUND_ERROR
+	case errors.Is(err, notes.ErrCommentForbidden):
+		return COMMENT_FORBIDDEN_ERROR
+	case errors.Is(err, notes.ErrNoteNotFound):
+		return NOTE_NOT_FOUND_ERROR
+	case errors.Is(err, notes.ErrNoteForbidden):
+		return NOTE_FORBIDDEN_ERROR
+	case errors.Is(err, notes.ErrSearchNotFound):
+		return SEARCH_NOT_FOUND_ERROR
+	case errors.Is(err, notes.ErrTaskNotFound):
+		return TASK_NOT_FOUND_ERROR
+	case errors.Is(err, notes.ErrTemplateNotFound):
+		return TEMPLATE_NOT_FOUND_ERROR
+	case errors.Is(err, notes.ErrWebhookNotFound):
+		return WEBHOOK_NOT_FOUND_ERROR
+	}
+	switch status {
+	case fiber.StatusBadRequest:
+		return BAD_REQUEST_ERROR
+	case fiber.StatusConflict:
+		return CONFLICT_ERROR
+	case fiber.StatusForbidden:
+		return FORBIDDEN_ERROR
+	case fiber.StatusNotFound:
+		return NOT_FOUND_ERROR
+	case fiber.StatusPreconditionFailed:
+		return PRECONDITION_FAILED_ERROR
+	case fiber.StatusPreconditionRequired:
+		return PRECONDITION_REQUIRED_ERROR
+	case fiber.StatusUpgradeRequired:
+		return UPGRADE_REQUIRED_ERROR
+	}
+	return INTERNAL_ERROR
+}
+
+func noteErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, notes.ErrNoteNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, notes.ErrNoteForbidden):
+		return fiber.StatusForbidden
+	}
+	return fiber.StatusInternalServerError
+}
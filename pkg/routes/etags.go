@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"fmt"
+	"org/bredin/go-notes/pkg/notes"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+/**
+ * Check that the If-Match header of a write names the current revision of
+ * a note, so that nobody overwrites changes they have not seen. Returns
+ * the status to send when it does not: 428 without the header and 412
+ * when the note changed since.
+ */
+func checkIfMatch(c *fiber.Ctx, db notes.Queryer, noteId int) (int, error) {
+	ifMatch := c.Get(fiber.HeaderIfMatch)
+	if ifMatch == "" {
+		return fiber.StatusPreconditionRequired, fmt.Errorf("changing note %d requires an If-Match header", noteId)
+	}
+	revision, err := notes.GetNoteRevision(db, noteId)
+	if err != nil {
+		return fiber.StatusInternalServerError, err
+	}
+	if revision == nil || revision.Deleted {
+		return fiber.StatusNotFound, fmt.Errorf("no note %d: %w", noteId, notes.ErrNoteNotFound)
+	}
+	if !matchesETag(ifMatch, noteETag(revision.Revision), false) {
+		return fiber.StatusPreconditionFailed,
+			fmt.Errorf("note %d changed since %s, now at revision %d", noteId, ifMatch, revision.Revision)
+	}
+	return 0, nil
+}
+
+/**
+ * Tell whether an If-Match or If-None-Match header lists an ETag or is *.
+ * The weak comparison of If-None-Match ignores W/ prefixes, the strong
+ * comparison of If-Match never matches them.
+ */
+func matchesETag(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func noteETag(revision int) string {
+	return `"` + strconv.Itoa(revision) + `"`
+}
+
+/**
+ * Send a note with its ETag, or only a 304 to a read whose If-None-Match
+ * already names its revision.
+ */
+func sendNoteResponse(c *fiber.Ctx, status int, response *NoteResponse) error {
+	etag := noteETag(response.Revision)
+	c.Set(fiber.HeaderETag, etag)
+	if c.Method() == fiber.MethodGet && matchesETag(c.Get(fiber.HeaderIfNoneMatch), etag, true) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	return c.Status(status).JSON(response)
+}
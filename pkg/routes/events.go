@@ -0,0 +1,126 @@
+package routes
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"org/bredin/go-notes/pkg/notes"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const EVENT_BATCH_SIZE = 100
+
+// Streams send a comment every EVENT_KEEPALIVE to notice disconnected
+// clients and end after EVENT_STREAM_DURATION, when EventSource clients
+// reconnect from their last event id.
+const EVENT_KEEPALIVE = 15 * time.Second
+const EVENT_STREAM_DURATION = 30 * time.Minute
+const EVENT_RECONNECT_DELAY = 2 * time.Second
+
+const EVENT_RESET = "reset"
+
+/**
+ * Stream the events on notes the user can read, and on sharing by or with
+ * them, as Server-Sent Events. Clients resume after the id of the last
+ * event they got, from the Last-Event-ID header or the after parameter,
+ * and otherwise only get new events. When the events to resume from were
+ * pruned, a reset event tells them to reload instead.
+ */
+func installApiEvents(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		lastEventId := c.Get("Last-Event-ID", c.Query("after"))
+		after, err := strconv.Atoi(lastEventId)
+		if err != nil && lastEventId != "" || after < 0 {
+			return sendError(c, fiber.StatusBadRequest, fmt.Errorf("illegal event id: %s", lastEventId))
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		subscriber := notes.SubscribeEvents()
+		if lastEventId == "" {
+			if after, err = notes.GetLatestEventId(db); err != nil {
+				notes.UnsubscribeEvents(subscriber)
+				db.Close()
+				return sendError(c, fiber.StatusInternalServerError, err)
+			}
+		}
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set("X-Accel-Buffering", "no")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer db.Close()
+			defer notes.UnsubscribeEvents(subscriber)
+			if err := streamEvents(w, db, userId, after, subscriber); err != nil {
+				log.Infof("Events %d: %s", userId, err.Error())
+			}
+		})
+		return nil
+	}
+}
+
+/**
+ * Write events as they are committed until the client goes away or
+ * EVENT_STREAM_DURATION is over.
+ */
+func streamEvents(w *bufio.Writer, db *sql.DB, userId int, after int, subscriber chan int) error {
+	fmt.Fprintf(w, "retry: %d\n\n", EVENT_RECONNECT_DELAY.Milliseconds())
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	keepalive := time.NewTicker(EVENT_KEEPALIVE)
+	defer keepalive.Stop()
+	end := time.After(EVENT_STREAM_DURATION)
+
+	for {
+		events, next, err := notes.GetEventsAfter(db, userId, after, EVENT_BATCH_SIZE)
+		if errors.Is(err, notes.ErrEventsPruned) {
+			if next, err = notes.GetLatestEventId(db); err == nil {
+				err = writeEvent(w, next, EVENT_RESET, struct{}{})
+			}
+		}
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err = writeEvent(w, event.Id, event.Kind, event); err != nil {
+				return err
+			}
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+		after = next
+		if len(events) == EVENT_BATCH_SIZE {
+			continue
+		}
+
+		select {
+		case <-subscriber:
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			if err = w.Flush(); err != nil {
+				return err
+			}
+		case <-end:
+			return nil
+		}
+	}
+}
+
+func writeEvent(w *bufio.Writer, eventId int, kind string, data interface{}) error {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", eventId, kind, content)
+	return err
+}
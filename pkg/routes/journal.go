@@ -0,0 +1,163 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Calendars list at most JOURNAL_MAX_DAYS days at once.
+const JOURNAL_MAX_DAYS = 366
+
+type JournalSettingsRequest struct {
+	Template *int    `json:"template"`
+	TimeZone *string `json:"timeZone"`
+}
+
+/**
+ * List the dates with a journal note of the caller from through to,
+ * inclusive, by default the current month in their time zone.
+ */
+func installJournalCalendar(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		settings, err := notes.GetJournalSettings(db, userId)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		location, err := time.LoadLocation(settings.TimeZone)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		now := time.Now().In(location)
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, location)
+		from := c.Query("from", monthStart.Format(notes.JOURNAL_DATE_FORMAT))
+		to := c.Query("to", monthStart.AddDate(0, 1, -1).Format(notes.JOURNAL_DATE_FORMAT))
+		start, err := notes.ParseJournalDate(from, location)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		end, err := notes.ParseJournalDate(to, location)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		if end.Before(start) || end.After(start.AddDate(0, 0, JOURNAL_MAX_DAYS-1)) {
+			return sendError(c, fiber.StatusBadRequest,
+				fmt.Errorf("illegal range %s to %s, at most %d days", from, to, JOURNAL_MAX_DAYS))
+		}
+
+		days, err := notes.GetJournalDays(db, userId, from, to)
+		if err != nil {
+			return sendJournalError(c, err)
+		}
+		return c.JSON(Page{Items: days})
+	}
+}
+
+/**
+ * Return the caller's journal note for a date, or today, creating it from
+ * their journal template when there is none yet.
+ */
+func installJournalNote(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		noteId, created, err := notes.GetJournalNote(db, userId, c.Params("date"))
+		if err != nil {
+			return sendJournalError(c, err)
+		}
+		status := fiber.StatusOK
+		if created {
+			status = fiber.StatusCreated
+			if err = index.IndexNotes(*idx, db, []int{noteId}); err != nil {
+				log.Errorf("Cannot update index: %s", err.Error())
+			}
+		}
+
+		response, err := getNoteResponse(db, userId, noteId)
+		if err != nil {
+			return sendNoteError(c, err)
+		}
+		c.Location("/api/v1/notes/" + strconv.Itoa(noteId))
+		return sendNoteResponse(c, status, response)
+	}
+}
+
+func installJournalSettingsGet(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		settings, err := notes.GetJournalSettings(db, getUserId(c))
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		return c.JSON(settings)
+	}
+}
+
+/**
+ * Change the template or time zone of the caller's journal. A template of
+ * 0 goes back to plain notes titled with their date.
+ */
+func installJournalSettingsUpdate(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		var request JournalSettingsRequest
+		if err := c.BodyParser(&request); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		settings, err := notes.GetJournalSettings(db, userId)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if request.Template != nil {
+			settings.Template = *request.Template
+		}
+		if request.TimeZone != nil {
+			settings.TimeZone = *request.TimeZone
+		}
+		if err = notes.SetJournalSettings(db, userId, settings); err != nil {
+			return sendJournalError(c, err)
+		}
+		return c.JSON(settings)
+	}
+}
+
+/**
+ * Send an invalid date or time zone as a 400, a template error as a 404 or
+ * 403, or anything else as a 500.
+ */
+func sendJournalError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, notes.ErrInvalidJournal) {
+		return sendError(c, fiber.StatusBadRequest, err)
+	}
+	return sendTemplateError(c, err)
+}
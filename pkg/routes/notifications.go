@@ -0,0 +1,139 @@
+package routes
+
+import (
+	"fmt"
+	"net/url"
+	"org/bredin/go-notes/pkg/notes"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type NotificationCount struct {
+	Unread int `json:"unread"`
+}
+
+/**
+ * The notifications to mark as read, all of them when Ids is empty.
+ */
+type NotificationReadRequest struct {
+	Ids []int `json:"ids"`
+}
+
+/**
+ * Follow or stop following the edits of a note the caller can read.
+ */
+func installNoteFollow(dbFileName string, follow bool) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		noteId, err := strconv.Atoi(c.Params("noteId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		if follow {
+			err = notes.FollowNote(db, userId, noteId)
+		} else {
+			err = notes.UnfollowNote(db, userId, noteId)
+		}
+		if err != nil {
+			return sendNoteError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func installNotificationCount(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		unread, err := notes.CountUnreadNotifications(db, getUserId(c))
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		return c.JSON(NotificationCount{Unread: unread})
+	}
+}
+
+/**
+ * List the caller's notifications newest first, or only the unread ones,
+ * paged by the id of the last one listed.
+ */
+func installNotificationList(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		limit, err := getPageSize(c)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		unreadOnly := c.Query("unread") == "true"
+		before := 0
+		if cursor := c.Query("cursor"); cursor != "" {
+			if before, err = strconv.Atoi(cursor); err != nil || before <= 0 {
+				return sendError(c, fiber.StatusBadRequest, fmt.Errorf("illegal cursor: %s", cursor))
+			}
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		notifications, err := notes.GetNotifications(db, userId, unreadOnly, before, limit+1)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		hasNext := len(notifications) > limit
+		params := url.Values{"limit": {strconv.Itoa(limit)}}
+		if hasNext {
+			notifications = notifications[:limit]
+			params.Set("cursor", strconv.Itoa(notifications[limit-1].Id))
+		}
+		if unreadOnly {
+			params.Set("unread", "true")
+		}
+		return sendPage(c, Page{Items: notifications}, hasNext, params)
+	}
+}
+
+/**
+ * Mark notifications of the caller as read and return how many are left
+ * unread.
+ */
+func installNotificationRead(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		var request NotificationReadRequest
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&request); err != nil {
+				return sendError(c, fiber.StatusBadRequest, err)
+			}
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		if err = notes.MarkNotificationsRead(db, userId, request.Ids); err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		unread, err := notes.CountUnreadNotifications(db, userId)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		return c.JSON(NotificationCount{Unread: unread})
+	}
+}
@@ -0,0 +1,17 @@
+package routes
+
+import (
+	_ "embed"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+//go:embed openapi.json
+var openApiSpec []byte
+
+func installOpenApi() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		c.Type("json")
+		return c.Send(openApiSpec)
+	}
+}
@@ -1,11 +1,21 @@
 package routes
 
 import (
+	"bufio"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/url"
 	"org/bredin/go-notes/pkg/auth"
+	"org/bredin/go-notes/pkg/backup"
+	"org/bredin/go-notes/pkg/collab"
+	"org/bredin/go-notes/pkg/export"
+	"org/bredin/go-notes/pkg/importer"
 	"org/bredin/go-notes/pkg/index"
 	"org/bredin/go-notes/pkg/notes"
+	"org/bredin/go-notes/pkg/render"
+	"path/filepath"
 	"strconv"
 	"time"
 
@@ -27,28 +37,53 @@ func InstallRoutes(app *fiber.App, dbFileName string, idx *bleve.Index) {
 
 	app.Use(fiberLogger.New())
 	app.Use(cors.New(cors.Config{
-		AllowMethods:  "GET, POST",
+		AllowMethods:  "GET, POST, PATCH, DELETE",
 		AllowOrigins:  "*",
-		AllowHeaders:  "Accept, Authorization, Content-Type, Origin, user, pass",
-		ExposeHeaders: "Accept, Authorization, Content-Type, Origin, user, pass",
+		AllowHeaders:  "Accept, Authorization, Content-Type, If-Match, If-None-Match, Last-Event-ID, Origin, user, pass",
+		ExposeHeaders: "Accept, Authorization, Content-Type, Origin, user, pass, Deprecation, ETag, Link, Location",
 	}))
 
 	// Static is installed before jwt checks because client
 	// MD viewer will have difficultly injecting
 	// auth info into request.
 	app.Static("/public", "./data/public")
+	app.Get("/openapi.json", installOpenApi())
 
-	app.Post("/login", installLogin(dbFileName))
+	app.Post("/login", deprecated("/api/v1/login"), installLogin(dbFileName))
+	app.Post("/api/v1/login", installLogin(dbFileName))
 	app.Use(jwtWare.New(jwtWare.Config{
 		SigningKey: auth.GetSecret(),
 	}))
 
-	app.Post("/note/create", installNoteCreate(dbFileName, idx))
-	app.Get("/note/privacy/:noteId/:privacy", installUpdateNotePrivacy(dbFileName))
-	app.Get("/note/get/:noteId", installNoteGet(dbFileName))
-	app.Get("/note/recent/:numNotes", installRecent(dbFileName))
-	app.Get("/note/search/:searchStr", installSearch(idx))
-	app.Get("/user/get/:userId", installUserGet(dbFileName))
+	renderCache := render.NewCache(render.DEFAULT_CACHE_SIZE)
+	hub := collab.NewHub(&noteStore{dbFileName, idx})
+	installApiRoutes(app.Group("/api/v1"), dbFileName, idx, renderCache, hub)
+	app.Get("/journal/:date", installJournalNote(dbFileName, idx))
+	app.Get("/note/related/:noteId", installApiNoteRelated(dbFileName, idx))
+	app.Get("/note/suggest", installApiSuggest(dbFileName, idx))
+
+	// Deprecated routes predating /api/v1.
+	app.Post("/admin/backup", deprecated("/api/v1/admin/backups"), installBackup(dbFileName, idx))
+	app.Post("/note/create", deprecated("/api/v1/notes"), installNoteCreate(dbFileName, idx))
+	app.Post("/note/import", deprecated("/api/v1/notes/import"), installNoteImport(dbFileName, idx))
+	app.Get("/note/privacy/:noteId/:privacy", deprecated("/api/v1/notes/{id}"), installUpdateNotePrivacy(dbFileName, idx))
+	app.Get("/note/get/:noteId", deprecated("/api/v1/notes/{id}"), installNoteGet(dbFileName))
+	app.Get("/note/render/:noteId", deprecated("/api/v1/notes/{id}/render"), installNoteRender(dbFileName, renderCache))
+	app.Get("/note/recent/:numNotes", deprecated("/api/v1/notes"), installRecent(dbFileName))
+	app.Get("/note/search/:searchStr", deprecated("/api/v1/search"), installSearch(idx))
+	app.Get("/user/export", deprecated("/api/v1/export"), installExport(dbFileName))
+	app.Get("/user/get/:userId", deprecated("/api/v1/users/{id}"), installUserGet(dbFileName))
+}
+
+/**
+ * Mark a route as deprecated in favor of its successor.
+ */
+func deprecated(successor string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		c.Set("Deprecation", "true")
+		c.Set(fiber.HeaderLink, "<"+successor+`>; rel="successor-version"`)
+		return c.Next()
+	}
 }
 
 func getUserId(c *fiber.Ctx) int {
@@ -58,6 +93,67 @@ func getUserId(c *fiber.Ctx) int {
 	return int(userId)
 }
 
+func checkNoteAuthor(db *sql.DB, userId int, noteId int) error {
+	authorId, err := notes.GetNoteAuthor(db, noteId)
+	if err != nil {
+		return err
+	}
+	if authorId != userId {
+		return fmt.Errorf("note %d is not authored by user %d: %w", noteId, userId, notes.ErrNoteForbidden)
+	}
+	return nil
+}
+
+func installBackup(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	backupRoot := filepath.Join(filepath.Dir(dbFileName), "backups")
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		if !auth.IsAdmin(userId) {
+			return sendError(c, fiber.StatusForbidden, fmt.Errorf("user %d is not an admin", userId))
+		}
+		log.Infof("Backup by %d", userId)
+
+		backupDir, err := backup.Backup(dbFileName, *idx, backupRoot)
+		if err != nil {
+			log.Errorf("Backup: %s", err.Error())
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		removed, err := backup.Rotate(backupRoot, backup.DEFAULT_RETENTION)
+		if err != nil {
+			log.Errorf("Backup rotation: %s", err.Error())
+		}
+		return c.JSON(fiber.Map{"backup": filepath.Base(backupDir), "removed": removed})
+	}
+}
+
+func installExport(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		format := c.Query("format", export.FORMAT_ZIP)
+		contentType, err := export.ContentType(format)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		log.Infof("Export %d as %s", userId, format)
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+
+		c.Attachment("notes." + format)
+		c.Set(fiber.HeaderContentType, contentType)
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer db.Close()
+			if err := export.Export(db, userId, format, w); err != nil {
+				log.Errorf("Export %d: %s", userId, err.Error())
+			}
+			w.Flush()
+		})
+		return nil
+	}
+}
+
 func installLogin(dbFileName string) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		username := c.FormValue("user")
@@ -66,21 +162,18 @@ func installLogin(dbFileName string) func(c *fiber.Ctx) error {
 
 		db, err := notes.OpenNoteDb(dbFileName)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusInternalServerError)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		defer db.Close()
 
 		userId, err := auth.GetUserId(db, username, password)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusForbidden)
+			return sendError(c, fiber.StatusForbidden, err)
 		}
 
 		token, err := auth.GetSignedToken(username, userId)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusInternalServerError)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		return c.JSON(fiber.Map{"token": token, "id": userId})
 	}
@@ -93,21 +186,19 @@ func installNoteCreate(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) e
 			c.FormValue("content"))
 		if err != nil {
 			log.Errorf("Create cannot unescape query")
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusBadRequest)
+			return sendError(c, fiber.StatusBadRequest, err)
 		}
 		note := notes.NoteRecord{
 			Author:     userId,
 			Content:    content,
 			Created:    int(time.Now().Unix()),
 			Privacy:    notes.DEFAULT_ACCESS,
-			RenderHint: 1,
+			RenderHint: notes.MARKDOWN_RENDER,
 		}
 
 		db, err := notes.OpenNoteDb(dbFileName)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusInternalServerError)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		defer db.Close()
 
@@ -115,12 +206,11 @@ func installNoteCreate(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) e
 		if err != nil {
 			msg := err.Error()
 			log.Errorf("Save: %s", msg)
-			c.SendString(msg)
-			return c.SendStatus(500)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		res := c.SendString(strconv.Itoa(id))
 		// TODO: do in background
-		err = (*idx).Index(strconv.Itoa(id), note)
+		err = index.IndexNotes(*idx, db, []int{id})
 		if err != nil {
 			log.Errorf("Cannot update index: %s", err.Error())
 		}
@@ -133,59 +223,125 @@ func installNoteGet(dbFileName string) func(c *fiber.Ctx) error {
 		userId := getUserId(c)
 		noteId, err := strconv.Atoi(c.Params("noteId"))
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusBadRequest)
+			return sendError(c, fiber.StatusBadRequest, err)
 		}
 
 		db, err := notes.OpenNoteDb(dbFileName)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusInternalServerError)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		defer db.Close()
 
 		note, err := notes.GetNote(db, userId, noteId)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(500)
+			return sendNoteError(c, err)
 		}
-		if note == nil {
-			return c.SendStatus(fiber.StatusNotFound)
+		revision, err := notes.GetNoteRevision(db, noteId)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if revision != nil {
+			etag := noteETag(revision.Revision)
+			c.Set(fiber.HeaderETag, etag)
+			if matchesETag(c.Get(fiber.HeaderIfNoneMatch), etag, true) {
+				return c.SendStatus(fiber.StatusNotModified)
+			}
 		}
-
 		jsonResult, err := json.Marshal(note)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(500)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		return c.SendString(string(jsonResult))
 	}
 }
+func installNoteImport(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		file, err := c.FormFile("archive")
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		archive, err := file.Open()
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		defer archive.Close()
+		format := c.FormValue("format", importer.FORMAT_MARKDOWN)
+		log.Infof("Import %s %s for %d", format, file.Filename, userId)
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		report, err := importer.ImportArchive(db, *idx, userId, format, archive, file.Size)
+		if err != nil {
+			log.Errorf("Import: %s", err.Error())
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		return c.JSON(report)
+	}
+}
+
+func installNoteRender(dbFileName string, cache *render.Cache) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		noteId, err := strconv.Atoi(c.Params("noteId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		note, err := notes.GetNote(db, userId, noteId)
+		if err != nil {
+			return sendNoteError(c, err)
+		}
+
+		rendered, err := cache.Render(note.Content, note.RenderHint)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if c.Query("format") == "json" {
+			return c.JSON(rendered)
+		}
+		c.Type("html")
+		if len(rendered.Toc) > 1 {
+			return c.SendString(render.TocHtml(rendered.Toc) + rendered.Html)
+		}
+		return c.SendString(rendered.Html)
+	}
+}
+
 func installRecent(dbFileName string) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		userId := getUserId(c)
 		numNotes, err := strconv.Atoi(c.Params("numNotes"))
 		if err != nil || numNotes <= 0 {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusBadRequest)
+			return sendError(c, fiber.StatusBadRequest, fmt.Errorf("illegal count: %s", c.Params("numNotes")))
+		}
+		if numNotes > MAX_PAGE_SIZE {
+			numNotes = MAX_PAGE_SIZE
 		}
 
 		db, err := notes.OpenNoteDb(dbFileName)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusInternalServerError)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		defer db.Close()
 
 		searchHits, err := notes.GetRecentNotes(db, userId, numNotes)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusInternalServerError)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		jsonResult, err := json.Marshal(searchHits)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusInternalServerError)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		return c.SendString(string(jsonResult))
 	}
@@ -197,51 +353,53 @@ func installSearch(idx *bleve.Index) func(c *fiber.Ctx) error {
 		searchStr, err := url.QueryUnescape(searchStr)
 		if err != nil {
 			log.Errorf("Search cannot unescape query")
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusBadRequest)
+			return sendError(c, fiber.StatusBadRequest, err)
 		}
 		log.Infof("Search %s", searchStr)
 
 		searchHits, err := index.SearchIndex(idx, searchStr)
+		if errors.Is(err, index.ErrInvalidSearch) {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusInternalServerError)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		jsonResult, err := json.Marshal(searchHits)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusInternalServerError)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		return c.SendString(string(jsonResult))
 	}
 }
 
-func installUpdateNotePrivacy(dbFileName string) func(c *fiber.Ctx) error {
+func installUpdateNotePrivacy(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		userId := getUserId(c)
 		noteId, err := strconv.Atoi(c.Params("noteId"))
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusBadRequest)
+			return sendError(c, fiber.StatusBadRequest, err)
 		}
 
 		privacy, err := strconv.Atoi(c.Params("privacy"))
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusBadRequest)
+			return sendError(c, fiber.StatusBadRequest, err)
 		}
 
 		db, err := notes.OpenNoteDb(dbFileName)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusInternalServerError)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		defer db.Close()
 
+		if err = checkNoteAuthor(db, userId, noteId); err != nil {
+			return sendNoteError(c, err)
+		}
 		err = notes.SetNotePrivacy(db, userId, noteId, privacy)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(500)
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		if err = index.IndexNotes(*idx, db, []int{noteId}); err != nil {
+			log.Errorf("Cannot update index: %s", err.Error())
 		}
 		return c.SendString("OK")
 	}
@@ -251,30 +409,26 @@ func installUserGet(dbFileName string) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		userId, err := strconv.Atoi(c.Params("userId"))
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusBadRequest)
+			return sendError(c, fiber.StatusBadRequest, err)
 		}
 
 		db, err := notes.OpenNoteDb(dbFileName)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(fiber.StatusInternalServerError)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		defer db.Close()
 
 		author, err := notes.GetAuthor(db, userId)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(500)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		if author == nil {
-			return c.SendStatus(fiber.StatusNotFound)
+			return sendError(c, fiber.StatusNotFound, fmt.Errorf("no user %d", userId))
 		}
 
 		jsonResult, err := json.Marshal(author)
 		if err != nil {
-			c.SendString(err.Error())
-			return c.SendStatus(500)
+			return sendError(c, fiber.StatusInternalServerError, err)
 		}
 		return c.SendString(string(jsonResult))
 	}
@@ -0,0 +1,50 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+var pathParamRegexp = regexp.MustCompile(`:(\w+)`)
+
+func Test_OpenApiMatchesRoutes(t *testing.T) {
+	os.Setenv("SECRET", "test secret")
+	app := fiber.New()
+	InstallRoutes(app, t.TempDir()+"/notes.sqlite3", nil)
+
+	response, err := app.Test(httptest.NewRequest("GET", "/openapi.json", nil))
+	assert.Nil(t, err, "Unexpected error fetching spec")
+	assert.Equal(t, fiber.StatusOK, response.StatusCode)
+	body, _ := io.ReadAll(response.Body)
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage
+	}
+	assert.Nil(t, json.Unmarshal(body, &spec), "Unexpected error parsing spec")
+
+	documented := make(map[string]bool)
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			if method != "parameters" {
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+	served := make(map[string]bool)
+	for _, route := range app.GetRoutes(true) {
+		if route.Method == fiber.MethodHead || !strings.HasPrefix(route.Path, "/api/v1/") {
+			continue
+		}
+		path := pathParamRegexp.ReplaceAllString(strings.TrimPrefix(route.Path, "/api/v1"), "{$1}")
+		served[route.Method+" "+path] = true
+	}
+	assert.NotEmpty(t, served)
+	assert.Equal(t, served, documented)
+}
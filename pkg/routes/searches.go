@@ -0,0 +1,299 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/gofiber/fiber/v2"
+)
+
+/**
+ * A notebook is either the set of notes filed under a name or a pinned
+ * saved search, whose notes are found again each time it is listed.
+ */
+type NotebookResponse struct {
+	Count    int `json:",omitempty"`
+	Name     string
+	Notes    string
+	SearchId int `json:",omitempty"`
+	Smart    bool
+}
+
+type SavedSearchRequest struct {
+	Name   *string          `json:"name"`
+	Pinned *bool            `json:"pinned"`
+	Query  *index.NoteQuery `json:"query"`
+}
+
+type SavedSearchResponse struct {
+	Created int
+	Id      int
+	Name    string
+	Pinned  bool
+	Query   index.NoteQuery
+}
+
+/**
+ * Fetch the caller's saved search named by the searchId parameter.
+ */
+func getSavedSearchParam(c *fiber.Ctx, db *sql.DB) (*notes.SavedSearch, error) {
+	searchId, err := strconv.Atoi(c.Params("searchId"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", notes.ErrSearchNotFound, c.Params("searchId"))
+	}
+	return notes.GetSavedSearch(db, getUserId(c), searchId)
+}
+
+func getSavedSearchResponse(search *notes.SavedSearch) (*SavedSearchResponse, error) {
+	response := SavedSearchResponse{
+		Created: search.Created,
+		Id:      search.Id,
+		Name:    search.Name,
+		Pinned:  search.Pinned,
+	}
+	if err := json.Unmarshal([]byte(search.Query), &response.Query); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+/**
+ * List the caller's notebooks followed by their pinned searches.
+ */
+func installNotebookList(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		notebooks, err := notes.GetAuthorNotebooks(db, userId)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		pinned, err := notes.GetSavedSearches(db, userId, true)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+
+		items := []NotebookResponse{}
+		for _, notebook := range notebooks {
+			q := url.Values{"q": {fmt.Sprintf("notebook:%q", notebook.Name)}}
+			items = append(items, NotebookResponse{
+				Count: notebook.Count,
+				Name:  notebook.Name,
+				Notes: "/api/v1/search?" + q.Encode(),
+			})
+		}
+		for _, search := range pinned {
+			items = append(items, NotebookResponse{
+				Name:     search.Name,
+				Notes:    "/api/v1/searches/" + strconv.Itoa(search.Id) + "/notes",
+				SearchId: search.Id,
+				Smart:    true,
+			})
+		}
+		return c.JSON(Page{Items: items})
+	}
+}
+
+func installSavedSearchCreate(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		var request SavedSearchRequest
+		if err := c.BodyParser(&request); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		if request.Name == nil || strings.TrimSpace(*request.Name) == "" {
+			return sendError(c, fiber.StatusBadRequest, fmt.Errorf("missing saved search name"))
+		}
+		if request.Query == nil {
+			request.Query = &index.NoteQuery{}
+		}
+		search := notes.SavedSearch{
+			Author:  userId,
+			Created: int(time.Now().Unix()),
+			Name:    *request.Name,
+			Pinned:  request.Pinned != nil && *request.Pinned,
+		}
+		if err := setSavedSearchQuery(&search, request.Query); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		if search.Id, err = notes.CreateSavedSearch(db, &search); err != nil {
+			return sendSearchError(c, err)
+		}
+		response, err := getSavedSearchResponse(&search)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		c.Location("/api/v1/searches/" + strconv.Itoa(search.Id))
+		return c.Status(fiber.StatusCreated).JSON(response)
+	}
+}
+
+func installSavedSearchDelete(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		searchId, err := strconv.Atoi(c.Params("searchId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		if err = notes.DeleteSavedSearch(db, userId, searchId); err != nil {
+			return sendSearchError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func installSavedSearchGet(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		search, err := getSavedSearchParam(c, db)
+		if err != nil {
+			return sendSearchError(c, err)
+		}
+		response, err := getSavedSearchResponse(search)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		return c.JSON(response)
+	}
+}
+
+func installSavedSearchList(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		searches, err := notes.GetSavedSearches(db, userId, c.Query("pinned") == "true")
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		items := []SavedSearchResponse{}
+		for i := range searches {
+			response, err := getSavedSearchResponse(&searches[i])
+			if err != nil {
+				return sendError(c, fiber.StatusInternalServerError, err)
+			}
+			items = append(items, *response)
+		}
+		return c.JSON(Page{Items: items})
+	}
+}
+
+/**
+ * Run a saved search as the caller, so that notes shared or unshared since
+ * it was saved are found or hidden accordingly.
+ */
+func installSavedSearchRun(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		search, err := getSavedSearchParam(c, db)
+		if err != nil {
+			return sendSearchError(c, err)
+		}
+
+		var noteQuery index.NoteQuery
+		if err = json.Unmarshal([]byte(search.Query), &noteQuery); err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		return sendSearchPage(c, db, idx, getUserId(c), &noteQuery)
+	}
+}
+
+func installSavedSearchUpdate(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var request SavedSearchRequest
+		if err := c.BodyParser(&request); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		if request.Name != nil && strings.TrimSpace(*request.Name) == "" {
+			return sendError(c, fiber.StatusBadRequest, fmt.Errorf("blank saved search name"))
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		search, err := getSavedSearchParam(c, db)
+		if err != nil {
+			return sendSearchError(c, err)
+		}
+
+		if request.Name != nil {
+			search.Name = *request.Name
+		}
+		if request.Pinned != nil {
+			search.Pinned = *request.Pinned
+		}
+		if request.Query != nil {
+			if err = setSavedSearchQuery(search, request.Query); err != nil {
+				return sendError(c, fiber.StatusBadRequest, err)
+			}
+		}
+		if err = notes.UpdateSavedSearch(db, search); err != nil {
+			return sendSearchError(c, err)
+		}
+		response, err := getSavedSearchResponse(search)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		return c.JSON(response)
+	}
+}
+
+/**
+ * Check that a query builds before storing it. Author "me" is kept as is
+ * and resolved each time the search runs.
+ */
+func setSavedSearchQuery(search *notes.SavedSearch, noteQuery *index.NoteQuery) error {
+	if _, err := noteQuery.Query(); err != nil {
+		return err
+	}
+	query, err := json.Marshal(noteQuery)
+	if err != nil {
+		return err
+	}
+	search.Query = string(query)
+	return nil
+}
@@ -0,0 +1,332 @@
+package routes
+
+import (
+	"database/sql"
+	"fmt"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"strconv"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Client versions that lost a conflict are kept as new notes with this
+// tag.
+const SYNC_CONFLICT_TAG = "conflict"
+
+/**
+ * A note changed offline. Id is 0 for a note created offline, which the
+ * client names with ClientId, and BaseRevision is the revision the client
+ * last got from the server. Only the fields set are changed.
+ */
+type SyncChange struct {
+	NoteRequest
+	BaseRevision int    `json:"baseRevision"`
+	ClientId     string `json:"clientId"`
+	Deleted      bool   `json:"deleted"`
+	Id           int    `json:"id"`
+}
+
+type SyncNote struct {
+	Deleted  bool `json:",omitempty"`
+	Id       int
+	Note     *NoteResponse `json:",omitempty"`
+	Revision int
+}
+
+type SyncRequest struct {
+	Changes []SyncChange `json:"changes"`
+	Cursor  int          `json:"cursor"`
+}
+
+/**
+ * Changes lists the notes changed since the request cursor, including the
+ * client's own. More is set when the client should sync again from Cursor
+ * right away.
+ */
+type SyncResponse struct {
+	Applied   []SyncResult `json:"applied"`
+	Changes   []SyncNote   `json:"changes"`
+	Conflicts []SyncResult `json:"conflicts"`
+	Cursor    int          `json:"cursor"`
+	More      bool         `json:"more"`
+	Rejected  []SyncResult `json:"rejected"`
+}
+
+/**
+ * The outcome of a client change. Revision is that of the note on the
+ * server after the change or, on conflict, despite it. The client's
+ * version then lives on as the note CopyId, unless it was a deletion.
+ */
+type SyncResult struct {
+	ClientId string `json:",omitempty"`
+	CopyId   int    `json:",omitempty"`
+	Error    string `json:",omitempty"`
+	Id       int
+	Revision int
+}
+
+/**
+ * Apply the changes a client made offline, then send the changes to notes
+ * readable by the user since the client's cursor. A change made on top of
+ * an outdated revision never overwrites the server's version: it is
+ * reported as a conflict and kept as a copy.
+ */
+func installApiSync(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		var request SyncRequest
+		if err := c.BodyParser(&request); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		if len(request.Changes) > MAX_PAGE_SIZE {
+			return sendError(c, fiber.StatusBadRequest,
+				fmt.Errorf("expected at most %d changes, got %d", MAX_PAGE_SIZE, len(request.Changes)))
+		}
+		size, err := getPageSize(c)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		latest, err := notes.GetLatestSequence(db)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if request.Cursor < 0 || request.Cursor > latest {
+			return sendError(c, fiber.StatusBadRequest, fmt.Errorf("unknown sync cursor: %d", request.Cursor))
+		}
+
+		response := SyncResponse{Applied: []SyncResult{}, Conflicts: []SyncResult{}, Rejected: []SyncResult{}}
+		var indexed []int
+		for _, change := range request.Changes {
+			result, conflict, err := applySyncChange(db, userId, change)
+			switch {
+			case err != nil:
+				result.Error = err.Error()
+				response.Rejected = append(response.Rejected, result)
+				continue
+			case conflict:
+				response.Conflicts = append(response.Conflicts, result)
+			default:
+				response.Applied = append(response.Applied, result)
+			}
+			if change.Deleted && !conflict {
+				if err = (*idx).Delete(strconv.Itoa(result.Id)); err != nil {
+					log.Errorf("Cannot update index: %s", err.Error())
+				}
+			} else if !conflict {
+				indexed = append(indexed, result.Id)
+			}
+			if result.CopyId != 0 {
+				indexed = append(indexed, result.CopyId)
+			}
+		}
+		if err = index.IndexNotes(*idx, db, indexed); err != nil {
+			log.Errorf("Cannot update index: %s", err.Error())
+		}
+
+		revisions, cursor, err := notes.GetChangesAfter(db, userId, request.Cursor, size)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if response.Changes, err = getSyncNotes(db, userId, revisions); err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		response.Cursor = cursor
+		response.More = len(revisions) == size
+		return c.JSON(response)
+	}
+}
+
+/**
+ * Apply a client change unless it conflicts with the server's version.
+ * Errors reject the change alone.
+ */
+func applySyncChange(db *sql.DB, userId int, change SyncChange) (SyncResult, bool, error) {
+	result := SyncResult{ClientId: change.ClientId, Id: change.Id}
+	if change.Id == 0 {
+		if change.Deleted {
+			return result, false, fmt.Errorf("cannot delete a note never synced")
+		}
+		noteId, err := createSyncNote(db, userId, change.NoteRequest)
+		if err != nil {
+			return result, false, err
+		}
+		result.Id = noteId
+		result.Revision, err = getRevision(db, noteId)
+		return result, false, err
+	}
+
+	// The revision is read in the transaction writing the change, so that
+	// no other write gets in between.
+	tx, err := db.Begin()
+	if err != nil {
+		return result, false, err
+	}
+	revision, err := notes.GetNoteRevision(tx, change.Id)
+	if err != nil {
+		tx.Rollback()
+		return result, false, err
+	}
+	if revision == nil {
+		tx.Rollback()
+		return result, false, fmt.Errorf("no note %d: %w", change.Id, notes.ErrNoteNotFound)
+	}
+	if revision.Author != userId {
+		tx.Rollback()
+		return result, false, fmt.Errorf("note %d is not authored by user %d: %w", change.Id, userId, notes.ErrNoteForbidden)
+	}
+	result.Revision = revision.Revision
+	if revision.Deleted && change.Deleted {
+		tx.Rollback()
+		return result, false, nil
+	}
+	if revision.Deleted || revision.Revision != change.BaseRevision {
+		tx.Rollback()
+		if change.Deleted {
+			return result, true, nil
+		}
+		result.CopyId, err = createConflictCopy(db, userId, change, revision.Deleted)
+		return result, true, err
+	}
+
+	if change.Deleted {
+		err = notes.DeleteNote(tx, userId, change.Id)
+	} else {
+		err = updateNote(tx, userId, change.Id, change.NoteRequest)
+	}
+	if err != nil {
+		tx.Rollback()
+		return result, false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return result, false, err
+	}
+	notes.PublishEvents(db)
+	result.Revision, err = getRevision(db, change.Id)
+	return result, false, err
+}
+
+/**
+ * Keep the client's version of a note changed or deleted on the server as
+ * a new note tagged SYNC_CONFLICT_TAG, taking what the client left
+ * unchanged from the server's version. A client version of a deleted note
+ * that only changed metadata has nothing worth keeping.
+ */
+func createConflictCopy(db *sql.DB, userId int, change SyncChange, deleted bool) (int, error) {
+	request := change.NoteRequest
+	tags := []string{}
+	if request.Tags != nil {
+		tags = *request.Tags
+	}
+	if deleted && request.Content == nil {
+		return 0, nil
+	}
+	if !deleted {
+		current, err := getNoteResponse(db, userId, change.Id)
+		if err != nil {
+			return 0, err
+		}
+		if request.Content == nil {
+			request.Content = &current.Content
+		}
+		if request.Language == nil {
+			request.Language = &current.Language
+		}
+		if request.Notebook == nil {
+			request.Notebook = &current.Notebook
+		}
+		if request.Privacy == nil {
+			request.Privacy = &current.Privacy
+		}
+		if request.RenderHint == nil {
+			request.RenderHint = &current.RenderHint
+		}
+		if request.Tags == nil {
+			tags = current.Tags
+		}
+	}
+	tags = append(tags, SYNC_CONFLICT_TAG)
+	request.Tags = &tags
+	return createSyncNote(db, userId, request)
+}
+
+/**
+ * Create a note with all the fields of a request in one transaction.
+ */
+func createSyncNote(db *sql.DB, userId int, request NoteRequest) (int, error) {
+	note, err := newNoteRecord(userId, request)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	noteId, err := notes.CreateNote(tx, &note)
+	if err == nil {
+		metadata := NoteRequest{Language: request.Language, Notebook: request.Notebook, Tags: request.Tags}
+		err = updateNote(tx, userId, noteId, metadata)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	notes.PublishEvents(db)
+	return noteId, nil
+}
+
+func getRevision(db *sql.DB, noteId int) (int, error) {
+	revision, err := notes.GetNoteRevision(db, noteId)
+	if err != nil || revision == nil {
+		return 0, err
+	}
+	return revision.Revision, nil
+}
+
+/**
+ * Send changed notes in full, and those deleted or no longer readable as
+ * tombstones.
+ */
+func getSyncNotes(db *sql.DB, userId int, revisions []notes.Revision) ([]SyncNote, error) {
+	var noteIds []int
+	for _, revision := range revisions {
+		if !revision.Deleted {
+			noteIds = append(noteIds, revision.NoteId)
+		}
+	}
+	entries, err := notes.GetNotes(db, userId, noteIds)
+	if err != nil {
+		return nil, err
+	}
+	responses, err := getNoteResponses(db, entries)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[int]*NoteResponse)
+	for i := range responses {
+		found[responses[i].Id] = &responses[i]
+	}
+
+	syncNotes := []SyncNote{}
+	for _, revision := range revisions {
+		syncNote := SyncNote{Id: revision.NoteId, Revision: revision.Revision}
+		if syncNote.Note = found[revision.NoteId]; syncNote.Note == nil {
+			syncNote.Deleted = true
+		} else {
+			syncNote.Revision = syncNote.Note.Revision
+		}
+		syncNotes = append(syncNotes, syncNote)
+	}
+	return syncNotes, nil
+}
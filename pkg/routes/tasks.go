@@ -0,0 +1,189 @@
+package routes
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/gofiber/fiber/v2"
+)
+
+/**
+ * Check the task when Done is true, uncheck it when false, or flip it when
+ * Done is not given.
+ */
+type TaskRequest struct {
+	Done *bool `json:"done"`
+}
+
+type TaskResponse struct {
+	notes.Task
+	NoteTitle string
+}
+
+func getTaskResponses(db *sql.DB, userId int, tasks []notes.Task) ([]TaskResponse, error) {
+	noteIds := []int{}
+	seen := make(map[int]bool)
+	for _, task := range tasks {
+		if !seen[task.NoteId] {
+			seen[task.NoteId] = true
+			noteIds = append(noteIds, task.NoteId)
+		}
+	}
+	entries, err := notes.GetNotes(db, userId, noteIds)
+	if err != nil {
+		return nil, err
+	}
+	titles := make(map[int]string)
+	for _, entry := range entries {
+		titles[entry.Id] = index.GetTitleFromContent(entry.Content)
+	}
+
+	responses := []TaskResponse{}
+	for _, task := range tasks {
+		responses = append(responses, TaskResponse{Task: task, NoteTitle: titles[task.NoteId]})
+	}
+	return responses, nil
+}
+
+/**
+ * List the open tasks of all notes the caller can read, or the done ones
+ * with done=true, soonest due first. dueBefore keeps the tasks due on or
+ * before a date.
+ */
+func installTaskList(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		limit, err := getPageSize(c)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		done := c.Query("done") == "true"
+		dueBefore := c.Query("dueBefore")
+		if dueBefore != "" {
+			if _, err = time.Parse(notes.TASK_DUE_FORMAT, dueBefore); err != nil {
+				return sendError(c, fiber.StatusBadRequest,
+					fmt.Errorf("illegal dueBefore %q, expected YYYY-MM-DD", dueBefore))
+			}
+		}
+		var after *notes.TaskCursor
+		if cursor := c.Query("cursor"); cursor != "" {
+			if after, err = notes.ParseTaskCursor(cursor); err != nil {
+				return sendError(c, fiber.StatusBadRequest, err)
+			}
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		tasks, err := notes.GetTasks(db, userId, done, dueBefore, after, limit+1)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		hasNext := len(tasks) > limit
+		params := url.Values{"limit": {strconv.Itoa(limit)}}
+		if hasNext {
+			tasks = tasks[:limit]
+			last := tasks[limit-1]
+			params.Set("cursor", notes.TaskCursor{Due: last.Due, Id: last.Id}.String())
+		}
+		if done {
+			params.Set("done", "true")
+		}
+		if dueBefore != "" {
+			params.Set("dueBefore", dueBefore)
+		}
+		items, err := getTaskResponses(db, userId, tasks)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		return sendPage(c, Page{Items: items}, hasNext, params)
+	}
+}
+
+/**
+ * Check or uncheck a task by rewriting its checkbox in its note, which
+ * the caller must be able to edit, unless an If-Match header names an
+ * older revision of the note. Sends the new ETag of the note.
+ */
+func installTaskToggle(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		taskId, err := strconv.Atoi(c.Params("taskId"))
+		if err != nil {
+			return sendError(c, fiber.StatusNotFound, fmt.Errorf("%w: %s", notes.ErrTaskNotFound, c.Params("taskId")))
+		}
+		var request TaskRequest
+		if len(c.Body()) > 0 {
+			if err = c.BodyParser(&request); err != nil {
+				return sendError(c, fiber.StatusBadRequest, err)
+			}
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		task, err := notes.GetTask(db, userId, taskId)
+		if err != nil {
+			return sendTaskError(c, err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if c.Get(fiber.HeaderIfMatch) != "" {
+			if status, err := checkIfMatch(c, tx, task.NoteId); err != nil {
+				tx.Rollback()
+				return sendError(c, status, err)
+			}
+		}
+		if err = notes.SetTaskDone(tx, userId, taskId, request.Done); err != nil {
+			tx.Rollback()
+			return sendTaskError(c, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		notes.PublishEvents(db)
+		if err = index.IndexNotes(*idx, db, []int{task.NoteId}); err != nil {
+			log.Errorf("Cannot update index: %s", err.Error())
+		}
+
+		if task, err = notes.GetTask(db, userId, taskId); err != nil {
+			return sendTaskError(c, err)
+		}
+		responses, err := getTaskResponses(db, userId, []notes.Task{*task})
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		revision, err := getRevision(db, task.NoteId)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		c.Set(fiber.HeaderETag, noteETag(revision))
+		return c.JSON(responses[0])
+	}
+}
+
+/**
+ * Send a missing task as a 404, a note access error as a 404 or 403, or
+ * anything else as a 500.
+ */
+func sendTaskError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, notes.ErrTaskNotFound) {
+		return sendError(c, fiber.StatusNotFound, err)
+	}
+	return sendNoteError(c, err)
+}
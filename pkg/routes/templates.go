@@ -0,0 +1,274 @@
+package routes
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/gofiber/fiber/v2"
+)
+
+/**
+ * Create a note from a template. Title fills {{title}} and defaults to the
+ * template's own title; Values fill the custom prompts and may override
+ * the built-in date, time and user. Privacy and Tags default to the
+ * template's.
+ */
+type TemplateNoteRequest struct {
+	Notebook *string           `json:"notebook"`
+	Privacy  *int              `json:"privacy"`
+	Tags     *[]string         `json:"tags"`
+	Title    *string           `json:"title"`
+	Values   map[string]string `json:"values"`
+}
+
+type TemplateRequest struct {
+	Privacy *int      `json:"privacy"`
+	Tags    *[]string `json:"tags"`
+}
+
+type TemplateResponse struct {
+	Author     int
+	AuthorName string
+	Id         int
+	Privacy    int
+	Prompts    []notes.TemplatePrompt
+	Tags       []string
+	Title      string
+}
+
+/**
+ * Fetch the template named by the templateId parameter if the caller can
+ * read it.
+ */
+func getTemplateParam(c *fiber.Ctx, db *sql.DB) (*notes.Template, error) {
+	templateId, err := strconv.Atoi(c.Params("templateId"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", notes.ErrTemplateNotFound, c.Params("templateId"))
+	}
+	return notes.GetTemplate(db, getUserId(c), templateId)
+}
+
+func getTemplateResponse(template *notes.Template) TemplateResponse {
+	return TemplateResponse{
+		Author:     template.Author,
+		AuthorName: template.AuthorName,
+		Id:         template.Id,
+		Privacy:    template.Privacy,
+		Prompts:    notes.TemplatePrompts(template.Content),
+		Tags:       template.Tags,
+		Title:      index.GetTitleFromContent(template.Content),
+	}
+}
+
+func installTemplateGet(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		template, err := getTemplateParam(c, db)
+		if err != nil {
+			return sendTemplateError(c, err)
+		}
+		return c.JSON(getTemplateResponse(template))
+	}
+}
+
+/**
+ * List the templates of the caller and those shared with them.
+ */
+func installTemplateList(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		templates, err := notes.GetTemplates(db, getUserId(c))
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		items := []TemplateResponse{}
+		for i := range templates {
+			items = append(items, getTemplateResponse(&templates[i]))
+		}
+		return c.JSON(Page{Items: items})
+	}
+}
+
+/**
+ * Create a note of the caller from a template, expanding its placeholders
+ * on the server.
+ */
+func installTemplateNoteCreate(dbFileName string, idx *bleve.Index) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		var request TemplateNoteRequest
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&request); err != nil {
+				return sendError(c, fiber.StatusBadRequest, err)
+			}
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		template, err := getTemplateParam(c, db)
+		if err != nil {
+			return sendTemplateError(c, err)
+		}
+		author, err := notes.GetAuthor(db, userId)
+		if err != nil || author == nil {
+			return sendError(c, fiber.StatusInternalServerError, fmt.Errorf("no user %d: %v", userId, err))
+		}
+		values := notes.TemplateValues(author.Name, "", time.Now())
+		for name, value := range request.Values {
+			values[strings.ToLower(name)] = value
+		}
+		if request.Title != nil {
+			values["title"] = *request.Title
+		} else if values["title"] == "" {
+			values["title"] = notes.ExpandTemplate(index.GetTitleFromContent(template.Content), values)
+		}
+		content := notes.ExpandTemplate(template.Content, values)
+
+		noteRequest := NoteRequest{
+			Content:    &content,
+			Notebook:   request.Notebook,
+			Privacy:    &template.Privacy,
+			RenderHint: &template.RenderHint,
+			Tags:       &template.Tags,
+		}
+		if request.Privacy != nil {
+			noteRequest.Privacy = request.Privacy
+		}
+		if request.Tags != nil {
+			noteRequest.Tags = request.Tags
+		}
+		note, err := newNoteRecord(userId, noteRequest)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		noteId, err := notes.CreateNote(tx, &note)
+		if err == nil {
+			err = updateNote(tx, userId, noteId, NoteRequest{Notebook: noteRequest.Notebook, Tags: noteRequest.Tags})
+		}
+		if err != nil {
+			tx.Rollback()
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		notes.PublishEvents(db)
+		if err = index.IndexNotes(*idx, db, []int{noteId}); err != nil {
+			log.Errorf("Cannot update index: %s", err.Error())
+		}
+
+		response, err := getNoteResponse(db, userId, noteId)
+		if err != nil {
+			return sendNoteError(c, err)
+		}
+		c.Location("/api/v1/notes/" + strconv.Itoa(noteId))
+		return sendNoteResponse(c, fiber.StatusCreated, response)
+	}
+}
+
+/**
+ * Flag a note of the caller as a template, setting the privacy and tags of
+ * the notes to be created from it, by default private and untagged.
+ */
+func installTemplateSet(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		noteId, err := strconv.Atoi(c.Params("noteId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		var request TemplateRequest
+		if len(c.Body()) > 0 {
+			if err = c.BodyParser(&request); err != nil {
+				return sendError(c, fiber.StatusBadRequest, err)
+			}
+		}
+		privacy, tags := notes.PRIVATE_ACCESS, []string{}
+		if request.Privacy != nil {
+			privacy = *request.Privacy
+		}
+		if privacy < notes.PRIVATE_ACCESS || privacy > notes.PUBLIC_ACCESS {
+			return sendError(c, fiber.StatusBadRequest, fmt.Errorf("illegal privacy mode: %d", privacy))
+		}
+		if request.Tags != nil {
+			tags = *request.Tags
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		if err = notes.SetTemplate(db, userId, noteId, privacy, tags); err != nil {
+			return sendTemplateError(c, err)
+		}
+		template, err := notes.GetTemplate(db, userId, noteId)
+		if err != nil {
+			return sendTemplateError(c, err)
+		}
+		c.Location("/api/v1/templates/" + strconv.Itoa(noteId))
+		return c.JSON(getTemplateResponse(template))
+	}
+}
+
+func installTemplateUnset(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		noteId, err := strconv.Atoi(c.Params("noteId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		if err = notes.UnsetTemplate(db, userId, noteId); err != nil {
+			return sendTemplateError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+/**
+ * Send a template or note access error as a 404 or 403, or anything else
+ * as a 500.
+ */
+func sendTemplateError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, notes.ErrTemplateNotFound):
+		return sendError(c, fiber.StatusNotFound, err)
+	case errors.Is(err, notes.ErrNoteNotFound), errors.Is(err, notes.ErrNoteForbidden):
+		return sendNoteError(c, err)
+	}
+	return sendError(c, fiber.StatusInternalServerError, err)
+}
@@ -0,0 +1,304 @@
+package routes
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"org/bredin/go-notes/pkg/auth"
+	"org/bredin/go-notes/pkg/notes"
+	"org/bredin/go-notes/pkg/webhooks"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const WEBHOOK_SECRET_BYTES = 32
+
+var webhookEvents = map[string]bool{
+	notes.EVENT_CREATED: true,
+	notes.EVENT_DELETED: true,
+	notes.EVENT_PRIVACY: true,
+	notes.EVENT_SHARED:  true,
+	notes.EVENT_UPDATED: true,
+}
+
+type WebhookRequest struct {
+	Active   *bool     `json:"active"`
+	AllUsers *bool     `json:"allUsers"`
+	Events   *[]string `json:"events"`
+	Notebook *string   `json:"notebook"`
+	Tag      *string   `json:"tag"`
+	Url      *string   `json:"url"`
+}
+
+/**
+ * A webhook as shown to its author. Secret, which signs deliveries, is
+ * only sent when the webhook is created.
+ */
+type WebhookResponse struct {
+	Active   bool
+	AllUsers bool
+	Created  int
+	Events   []string
+	Id       int
+	Notebook string
+	Secret   string `json:",omitempty"`
+	Tag      string
+	Url      string
+}
+
+/**
+ * Fetch the caller's webhook named by the webhookId parameter.
+ */
+func getWebhookParam(c *fiber.Ctx, db *sql.DB) (*notes.Webhook, error) {
+	webhookId, err := strconv.Atoi(c.Params("webhookId"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", notes.ErrWebhookNotFound, c.Params("webhookId"))
+	}
+	return notes.GetWebhook(db, getUserId(c), webhookId)
+}
+
+func getWebhookResponse(webhook *notes.Webhook) WebhookResponse {
+	return WebhookResponse{
+		Active:   webhook.Active,
+		AllUsers: webhook.AllUsers,
+		Created:  webhook.Created,
+		Events:   webhook.Events,
+		Id:       webhook.Id,
+		Notebook: webhook.Notebook,
+		Tag:      webhook.Tag,
+		Url:      webhook.Url,
+	}
+}
+
+/**
+ * Register a webhook for the caller with a new secret to check the
+ * signatures of its deliveries.
+ */
+func installWebhookCreate(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var request WebhookRequest
+		if err := c.BodyParser(&request); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		if request.Url == nil {
+			return sendError(c, fiber.StatusBadRequest, fmt.Errorf("missing webhook url"))
+		}
+		secret := make([]byte, WEBHOOK_SECRET_BYTES)
+		if _, err := rand.Read(secret); err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		webhook := notes.Webhook{
+			Active:  true,
+			Author:  getUserId(c),
+			Created: int(time.Now().Unix()),
+			Events:  []string{},
+			Secret:  hex.EncodeToString(secret),
+		}
+		if status, err := setWebhookFields(&webhook, &request); err != nil {
+			return sendError(c, status, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		if webhook.Id, err = notes.CreateWebhook(db, &webhook); err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		response := getWebhookResponse(&webhook)
+		response.Secret = webhook.Secret
+		c.Location("/api/v1/webhooks/" + strconv.Itoa(webhook.Id))
+		return c.Status(fiber.StatusCreated).JSON(response)
+	}
+}
+
+func installWebhookDelete(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		userId := getUserId(c)
+		webhookId, err := strconv.Atoi(c.Params("webhookId"))
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		if err = notes.DeleteWebhook(db, userId, webhookId); err != nil {
+			return sendWebhookError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+/**
+ * List the deliveries to one of the caller's webhooks, newest first,
+ * paged by the id of the last one listed.
+ */
+func installWebhookDeliveries(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		limit, err := getPageSize(c)
+		if err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+		before := 0
+		if cursor := c.Query("cursor"); cursor != "" {
+			if before, err = strconv.Atoi(cursor); err != nil || before <= 0 {
+				return sendError(c, fiber.StatusBadRequest, fmt.Errorf("illegal cursor: %s", cursor))
+			}
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		webhook, err := getWebhookParam(c, db)
+		if err != nil {
+			return sendWebhookError(c, err)
+		}
+		deliveries, err := notes.GetDeliveries(db, webhook.Author, webhook.Id, before, limit+1)
+		if err != nil {
+			return sendWebhookError(c, err)
+		}
+		hasNext := len(deliveries) > limit
+		params := url.Values{"limit": {strconv.Itoa(limit)}}
+		if hasNext {
+			deliveries = deliveries[:limit]
+			params.Set("cursor", strconv.Itoa(deliveries[limit-1].Id))
+		}
+		return sendPage(c, Page{Items: deliveries}, hasNext, params)
+	}
+}
+
+func installWebhookGet(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		webhook, err := getWebhookParam(c, db)
+		if err != nil {
+			return sendWebhookError(c, err)
+		}
+		return c.JSON(getWebhookResponse(webhook))
+	}
+}
+
+func installWebhookList(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		webhooks, err := notes.GetWebhooks(db, getUserId(c))
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		items := []WebhookResponse{}
+		for i := range webhooks {
+			items = append(items, getWebhookResponse(&webhooks[i]))
+		}
+		return c.JSON(Page{Items: items})
+	}
+}
+
+/**
+ * Change the url, filters or activity of one of the caller's webhooks.
+ * Events already queued are delivered as they were filtered.
+ */
+func installWebhookUpdate(dbFileName string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		var request WebhookRequest
+		if err := c.BodyParser(&request); err != nil {
+			return sendError(c, fiber.StatusBadRequest, err)
+		}
+
+		db, err := notes.OpenNoteDb(dbFileName)
+		if err != nil {
+			return sendError(c, fiber.StatusInternalServerError, err)
+		}
+		defer db.Close()
+
+		webhook, err := getWebhookParam(c, db)
+		if err != nil {
+			return sendWebhookError(c, err)
+		}
+		if status, err := setWebhookFields(webhook, &request); err != nil {
+			return sendError(c, status, err)
+		}
+		if err = notes.UpdateWebhook(db, webhook); err != nil {
+			return sendWebhookError(c, err)
+		}
+		return c.JSON(getWebhookResponse(webhook))
+	}
+}
+
+/**
+ * Send a webhook error as a 404, or anything else as a 500.
+ */
+func sendWebhookError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, notes.ErrWebhookNotFound) {
+		return sendError(c, fiber.StatusNotFound, err)
+	}
+	return sendError(c, fiber.StatusInternalServerError, err)
+}
+
+/**
+ * Copy the fields given in a request to a webhook, checking that its url
+ * is http or https and, unless its author is an admin, not on a private
+ * network, that its events are known kinds, and that only admins ask for
+ * the events of all users. Returns the status to fail with.
+ */
+func setWebhookFields(webhook *notes.Webhook, request *WebhookRequest) (int, error) {
+	if request.Url != nil {
+		parsed, err := url.Parse(*request.Url)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fiber.StatusBadRequest, fmt.Errorf("illegal webhook url: %s", *request.Url)
+		}
+		if !auth.IsAdmin(webhook.Author) {
+			if err = webhooks.CheckHost(parsed.Hostname()); err != nil {
+				return fiber.StatusBadRequest, fmt.Errorf("illegal webhook url: %w", err)
+			}
+		}
+		webhook.Url = *request.Url
+	}
+	if request.Events != nil {
+		for _, kind := range *request.Events {
+			if !webhookEvents[kind] {
+				return fiber.StatusBadRequest, fmt.Errorf("illegal webhook event: %s", kind)
+			}
+		}
+		webhook.Events = *request.Events
+	}
+	if request.AllUsers != nil {
+		if *request.AllUsers && !auth.IsAdmin(webhook.Author) {
+			return fiber.StatusForbidden, fmt.Errorf("only admins may receive the events of all users")
+		}
+		webhook.AllUsers = *request.AllUsers
+	}
+	if request.Active != nil {
+		webhook.Active = *request.Active
+	}
+	if request.Notebook != nil {
+		webhook.Notebook = *request.Notebook
+	}
+	if request.Tag != nil {
+		webhook.Tag = notes.NormalizeTag(*request.Tag)
+	}
+	return fiber.StatusOK, nil
+}
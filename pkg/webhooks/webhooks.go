@@ -0,0 +1,455 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"org/bredin/go-notes/pkg/auth"
+	"org/bredin/go-notes/pkg/index"
+	"org/bredin/go-notes/pkg/notes"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Deliveries are posted in batches of up to DELIVERY_BATCH_SIZE, each
+// webhook's in turn and concurrently with the others', so that a slow
+// receiver holds up a batch for at most DELIVERIES_PER_WEBHOOK requests.
+const DELIVERY_BATCH_SIZE = 20
+const DELIVERIES_PER_WEBHOOK = 5
+const EVENT_BATCH_SIZE = 100
+
+// A delivery is attempted MAX_ATTEMPTS times, waiting twice as long after
+// each failure from RETRY_DELAY up to MAX_RETRY_DELAY.
+const MAX_ATTEMPTS = 8
+const MAX_RETRY_DELAY = time.Hour
+const RETRY_DELAY = 30 * time.Second
+
+// Receivers have REQUEST_TIMEOUT to answer. The queue is checked every
+// POLL_INTERVAL besides when events are announced.
+const REQUEST_TIMEOUT = 10 * time.Second
+const POLL_INTERVAL = 30 * time.Second
+
+const DELIVERY_HEADER = "X-Notes-Delivery"
+const EVENT_HEADER = "X-Notes-Event"
+const SIGNATURE_HEADER = "X-Notes-Signature"
+const TIMESTAMP_HEADER = "X-Notes-Timestamp"
+
+var ErrPrivateAddress = errors.New("private address")
+
+/**
+ * Queues the events webhooks want and posts them, retrying failures with
+ * backoff. The queue lives in the database so that deliveries survive
+ * restarts. Client posts for users other than admins and refuses to
+ * connect to private addresses, AdminClient posts for admins.
+ */
+type Dispatcher struct {
+	AdminClient *http.Client
+	Client      *http.Client
+	DbFileName  string
+	RetryDelay  time.Duration
+	stop        chan struct{}
+}
+
+/**
+ * The body posted to webhooks. Note summarizes the note an event concerns
+ * as it is when the event is queued, unless it is deleted or the webhook's
+ * author can no longer read it.
+ */
+type Payload struct {
+	Event     notes.Event
+	Note      *NoteSummary `json:",omitempty"`
+	WebhookId int
+}
+
+type NoteSummary struct {
+	Id       int
+	Notebook string `json:",omitempty"`
+	Tags     []string
+	Title    string
+}
+
+func NewDispatcher(dbFileName string) *Dispatcher {
+	dialer := &net.Dialer{Control: checkDial, Timeout: REQUEST_TIMEOUT}
+	return &Dispatcher{
+		AdminClient: &http.Client{Timeout: REQUEST_TIMEOUT},
+		Client: &http.Client{
+			Timeout:   REQUEST_TIMEOUT,
+			Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: REQUEST_TIMEOUT},
+		},
+		DbFileName: dbFileName,
+		RetryDelay: RETRY_DELAY,
+		stop:       make(chan struct{}),
+	}
+}
+
+/**
+ * Check that a webhook host is neither a private, loopback, link-local nor
+ * unspecified address, nor a name resolving to one, wrapping
+ * ErrPrivateAddress when it is. Names that do not resolve yet pass, as
+ * deliveries check the addresses they connect to again.
+ */
+func CheckHost(host string) error {
+	addresses := []net.IP{net.ParseIP(host)}
+	if addresses[0] == nil {
+		addresses, _ = net.LookupIP(host)
+	}
+	for _, address := range addresses {
+		if !isPublicAddress(address) {
+			return fmt.Errorf("%w: %s is %s", ErrPrivateAddress, host, address)
+		}
+	}
+	return nil
+}
+
+/**
+ * Return the hex HMAC-SHA256 of the timestamp, a dot and the body, keyed
+ * with the webhook secret, which receivers compare to the signature
+ * header after its "sha256=" prefix.
+ */
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/**
+ * Queue and deliver events until stopped.
+ */
+func (d *Dispatcher) Run() error {
+	db, err := notes.OpenNoteDb(d.DbFileName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	subscriber := notes.SubscribeEvents()
+	defer notes.UnsubscribeEvents(subscriber)
+
+	for {
+		if err = d.queueEvents(db); err != nil {
+			log.Printf("Cannot queue webhook deliveries: %s", err.Error())
+		}
+		wait, err := d.deliver(db)
+		if err != nil {
+			log.Printf("Cannot deliver webhooks: %s", err.Error())
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-subscriber:
+		case <-timer.C:
+		case <-d.stop:
+			timer.Stop()
+			return nil
+		}
+		timer.Stop()
+	}
+}
+
+func (d *Dispatcher) Stop() {
+	close(d.stop)
+}
+
+/**
+ * Return whether a webhook gets the events of all users, which only
+ * admins may ask for.
+ */
+func (d *Dispatcher) allUsers(webhook *notes.Webhook) bool {
+	return webhook.AllUsers && auth.IsAdmin(webhook.Author)
+}
+
+/**
+ * Post the deliveries that are due and return how long to wait for the
+ * next ones.
+ */
+func (d *Dispatcher) deliver(db *sql.DB) (time.Duration, error) {
+	due, err := notes.GetDueDeliveries(db, time.Now().UnixMilli(), DELIVERIES_PER_WEBHOOK, DELIVERY_BATCH_SIZE)
+	if err != nil || len(due) == 0 {
+		return d.nextDelivery(db), err
+	}
+	webhooks, err := notes.GetActiveWebhooks(db)
+	if err != nil {
+		return POLL_INTERVAL, err
+	}
+	active := make(map[int]*notes.Webhook)
+	for i := range webhooks {
+		active[webhooks[i].Id] = &webhooks[i]
+	}
+
+	byWebhook := make(map[int][]int)
+	for i := range due {
+		if _, ok := active[due[i].WebhookId]; ok {
+			byWebhook[due[i].WebhookId] = append(byWebhook[due[i].WebhookId], i)
+		}
+	}
+	type attempt struct {
+		delivery     *notes.Delivery
+		responseCode int
+		err          error
+	}
+	attempts := make(chan attempt)
+	for webhookId, indexes := range byWebhook {
+		go func(webhook *notes.Webhook, indexes []int) {
+			for _, i := range indexes {
+				responseCode, err := d.post(webhook, &due[i])
+				attempts <- attempt{&due[i], responseCode, err}
+			}
+		}(active[webhookId], indexes)
+	}
+
+	// Attempts are recorded as they end, draining them all even when
+	// recording fails so that no poster is left blocked.
+	var recordErr error
+	for _, indexes := range byWebhook {
+		for range indexes {
+			result := <-attempts
+			var nextAttempt int64
+			if result.err != nil && result.delivery.Attempts+1 < MAX_ATTEMPTS {
+				nextAttempt = time.Now().Add(d.retryDelay(result.delivery.Attempts)).UnixMilli()
+			}
+			if recordErr == nil {
+				recordErr = notes.RecordDeliveryAttempt(db, result.delivery.Id, result.responseCode, result.err,
+					nextAttempt)
+			}
+		}
+	}
+	if recordErr != nil {
+		return POLL_INTERVAL, recordErr
+	}
+	if len(due) == DELIVERY_BATCH_SIZE {
+		return 0, nil
+	}
+	return d.nextDelivery(db), nil
+}
+
+/**
+ * Return whether an event is among the kinds a webhook wants and concerns
+ * a note in its notebook and with its tag, when it filters on them. The
+ * note is matched as it is when readable, otherwise as the event recorded
+ * it, which is the only way deleted notes are.
+ */
+func (d *Dispatcher) matches(webhook *notes.Webhook, event *notes.Event, note *NoteSummary) bool {
+	if len(webhook.Events) > 0 {
+		wanted := false
+		for _, kind := range webhook.Events {
+			wanted = wanted || kind == event.Kind
+		}
+		if !wanted {
+			return false
+		}
+	}
+	if webhook.Notebook == "" && webhook.Tag == "" {
+		return true
+	}
+	notebook, tags := event.Notebook, event.Tags
+	if note != nil {
+		notebook, tags = note.Notebook, note.Tags
+	}
+	if webhook.Notebook != "" && notebook != webhook.Notebook {
+		return false
+	}
+	if webhook.Tag != "" {
+		for _, tag := range tags {
+			if tag == notes.NormalizeTag(webhook.Tag) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (d *Dispatcher) nextDelivery(db *sql.DB) time.Duration {
+	next, err := notes.GetNextDeliveryTime(db)
+	if err != nil || next == 0 {
+		return POLL_INTERVAL
+	}
+	wait := time.Until(time.UnixMilli(next))
+	if wait > POLL_INTERVAL {
+		return POLL_INTERVAL
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+/**
+ * Summarize the note an event concerns, or return nil when it is gone or
+ * the webhook may not read it.
+ */
+func (d *Dispatcher) noteSummary(db *sql.DB, webhook *notes.Webhook, noteId int) (*NoteSummary, error) {
+	if noteId == 0 {
+		return nil, nil
+	}
+	readerId := webhook.Author
+	if d.allUsers(webhook) {
+		authorId, err := notes.GetNoteAuthor(db, noteId)
+		if errors.Is(err, notes.ErrNoteNotFound) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		readerId = authorId
+	}
+	note, err := notes.GetNote(db, readerId, noteId)
+	if errors.Is(err, notes.ErrNoteNotFound) || errors.Is(err, notes.ErrNoteForbidden) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	notebook, err := notes.GetNoteNotebook(db, noteId)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := notes.GetNoteTags(db, noteId)
+	if err != nil {
+		return nil, err
+	}
+	return &NoteSummary{
+		Id:       noteId,
+		Notebook: notebook,
+		Tags:     tags,
+		Title:    index.GetTitleFromContent(note.Content),
+	}, nil
+}
+
+func (d *Dispatcher) post(webhook *notes.Webhook, delivery *notes.Delivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request, err := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(DELIVERY_HEADER, strconv.Itoa(delivery.Id))
+	request.Header.Set(EVENT_HEADER, delivery.Kind)
+	request.Header.Set(SIGNATURE_HEADER, "sha256="+Sign(webhook.Secret, timestamp, body))
+	request.Header.Set(TIMESTAMP_HEADER, timestamp)
+
+	client := d.Client
+	if auth.IsAdmin(webhook.Author) {
+		client = d.AdminClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("receiver answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+/**
+ * Queue the events after the cursor of each active webhook that it wants.
+ */
+func (d *Dispatcher) queueEvents(db *sql.DB) error {
+	webhooks, err := notes.GetActiveWebhooks(db)
+	if err != nil {
+		return err
+	}
+	for i := range webhooks {
+		if err = d.queueWebhookEvents(db, &webhooks[i]); err != nil {
+			return fmt.Errorf("webhook %d: %w", webhooks[i].Id, err)
+		}
+	}
+	return nil
+}
+
+func (d *Dispatcher) queueWebhookEvents(db *sql.DB, webhook *notes.Webhook) error {
+	cursor := webhook.Cursor
+	for {
+		var events []notes.Event
+		var next int
+		var err error
+		if d.allUsers(webhook) {
+			events, next, err = notes.GetAllEventsAfter(db, cursor, EVENT_BATCH_SIZE)
+		} else {
+			events, next, err = notes.GetEventsAfter(db, webhook.Author, cursor, EVENT_BATCH_SIZE)
+		}
+		if errors.Is(err, notes.ErrEventsPruned) {
+			events = nil
+			next, err = notes.GetLatestEventId(db)
+		}
+		if err != nil {
+			return err
+		}
+
+		deliveries := []notes.Delivery{}
+		for i := range events {
+			note, err := d.noteSummary(db, webhook, events[i].NoteId)
+			if err != nil {
+				return err
+			}
+			if !d.matches(webhook, &events[i], note) {
+				continue
+			}
+			payload, err := json.Marshal(Payload{Event: events[i], Note: note, WebhookId: webhook.Id})
+			if err != nil {
+				return err
+			}
+			deliveries = append(deliveries, notes.Delivery{
+				Created:     int(time.Now().Unix()),
+				EventId:     events[i].Id,
+				Kind:        events[i].Kind,
+				NextAttempt: time.Now().UnixMilli(),
+				Payload:     string(payload),
+			})
+		}
+		if next == cursor {
+			return nil
+		}
+		if err = notes.QueueDeliveries(db, webhook.Id, next, deliveries); err != nil {
+			return err
+		}
+		cursor = next
+		if len(events) < EVENT_BATCH_SIZE {
+			return nil
+		}
+	}
+}
+
+func (d *Dispatcher) retryDelay(attempts int) time.Duration {
+	delay := d.RetryDelay
+	for i := 0; i < attempts && delay < MAX_RETRY_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > MAX_RETRY_DELAY {
+		return MAX_RETRY_DELAY
+	}
+	return delay
+}
+
+/**
+ * Refuse connections to private addresses once names are resolved, so
+ * that a name cannot resolve to a public address when the webhook is
+ * registered and to a private one when it is delivered.
+ */
+func checkDial(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicAddress(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+	return nil
+}
+
+func isPublicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsUnspecified()
+}
@@ -0,0 +1,240 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"org/bredin/go-notes/pkg/notes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SignsPayloads(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163",
+		Sign("secret", "1700000000", []byte("{}")))
+}
+
+func Test_DeliversMatchingEventsWithRetries(t *testing.T) {
+	dbFileName := t.TempDir() + "/notes.sqlite3"
+	db, err := notes.CreateNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+	userId, err := notes.CreateAuthor(db, "Test User", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+
+	var lock sync.Mutex
+	var payloads []Payload
+	attempts := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		body, _ := io.ReadAll(r.Body)
+		signature := "sha256=" + Sign("secret", r.Header.Get(TIMESTAMP_HEADER), body)
+		if r.Header.Get(SIGNATURE_HEADER) != signature {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload Payload
+		json.Unmarshal(body, &payload)
+		payloads = append(payloads, payload)
+	}))
+	defer receiver.Close()
+
+	webhook := notes.Webhook{Active: true, Author: userId, Created: int(time.Now().Unix()),
+		Events: []string{notes.EVENT_CREATED}, Secret: "secret", Tag: "work", Url: receiver.URL}
+	webhook.Id, err = notes.CreateWebhook(db, &webhook)
+	assert.Nil(t, err, "Unexpected error creating webhook")
+
+	dispatcher := NewDispatcher(dbFileName)
+	dispatcher.RetryDelay = 10 * time.Millisecond
+	// The receiver listens on loopback, which only admins' webhooks reach.
+	dispatcher.Client = dispatcher.AdminClient
+	go dispatcher.Run()
+	defer dispatcher.Stop()
+
+	now := int(time.Now().Unix())
+	for _, tags := range [][]string{{"home"}, {"work"}} {
+		tx, err := db.Begin()
+		assert.Nil(t, err, "Unexpected error starting transaction")
+		noteId, err := notes.CreateNote(tx, &notes.NoteRecord{Author: userId, Content: "# Plans", Created: now})
+		assert.Nil(t, err, "Unexpected error on note insertion")
+		assert.Nil(t, notes.SetNoteTags(tx, noteId, tags), "Unexpected error tagging")
+		assert.Nil(t, tx.Commit(), "Unexpected error committing")
+		notes.PublishEvents(db)
+		assert.Nil(t, notes.UpdateNoteContent(db, userId, noteId, "# Plans\n\nUpdated"), "Unexpected error on update")
+	}
+
+	var deliveries []notes.Delivery
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(20 * time.Millisecond) {
+		deliveries, err = notes.GetDeliveries(db, userId, webhook.Id, 0, 10)
+		assert.Nil(t, err, "Unexpected error listing deliveries")
+		if len(deliveries) > 0 && deliveries[0].Status != notes.DELIVERY_PENDING {
+			break
+		}
+	}
+	assert.Equal(t, 1, len(deliveries), "Expected only created events on notes tagged work")
+	assert.Equal(t, notes.DELIVERY_DELIVERED, deliveries[0].Status)
+	assert.Equal(t, 2, deliveries[0].Attempts, "Expected the failed attempt retried")
+	assert.Equal(t, 200, deliveries[0].ResponseCode)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 1, len(payloads))
+	assert.Equal(t, notes.EVENT_CREATED, payloads[0].Event.Kind)
+	assert.Equal(t, "Plans", payloads[0].Note.Title)
+	assert.Equal(t, []string{"work"}, payloads[0].Note.Tags)
+}
+
+func Test_DeliversDeletedEventsOfFilteredWebhooks(t *testing.T) {
+	dbFileName := t.TempDir() + "/notes.sqlite3"
+	db, err := notes.CreateNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+	userId, err := notes.CreateAuthor(db, "Test User", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+
+	webhook := notes.Webhook{Active: true, Author: userId, Created: int(time.Now().Unix()),
+		Events: []string{notes.EVENT_DELETED}, Notebook: "Work", Secret: "secret", Tag: "plans", Url: receiver.URL}
+	webhook.Id, err = notes.CreateWebhook(db, &webhook)
+	assert.Nil(t, err, "Unexpected error creating webhook")
+	var noteIds []int
+	for _, notebook := range []string{"Home", "Work"} {
+		noteId, err := notes.CreateNote(db, &notes.NoteRecord{Author: userId, Content: "# Plans"})
+		assert.Nil(t, err, "Unexpected error on note insertion")
+		assert.Nil(t, notes.SetNoteNotebook(db, noteId, notebook), "Unexpected error filing")
+		assert.Nil(t, notes.SetNoteTags(db, noteId, []string{"plans"}), "Unexpected error tagging")
+		noteIds = append(noteIds, noteId)
+	}
+	for _, noteId := range noteIds {
+		tx, err := db.Begin()
+		assert.Nil(t, err, "Unexpected error starting transaction")
+		assert.Nil(t, notes.DeleteNote(tx, userId, noteId), "Unexpected error on deletion")
+		assert.Nil(t, tx.Commit(), "Unexpected error committing")
+	}
+
+	dispatcher := NewDispatcher(dbFileName)
+	dispatcher.Client = dispatcher.AdminClient
+	go dispatcher.Run()
+	defer dispatcher.Stop()
+	var deliveries []notes.Delivery
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(20 * time.Millisecond) {
+		deliveries, _ = notes.GetDeliveries(db, userId, webhook.Id, 0, 10)
+		if len(deliveries) > 0 && deliveries[0].Status != notes.DELIVERY_PENDING {
+			break
+		}
+	}
+	assert.Equal(t, 1, len(deliveries), "Expected only the deletion of the note filed in Work")
+	var payload Payload
+	assert.Nil(t, json.Unmarshal([]byte(deliveries[0].Payload), &payload))
+	assert.Equal(t, noteIds[1], payload.Event.NoteId)
+	assert.Equal(t, "Work", payload.Event.Notebook)
+	assert.Equal(t, []string{"plans"}, payload.Event.Tags)
+	assert.Nil(t, payload.Note, "Expected no summary of a deleted note")
+	assert.Equal(t, notes.DELIVERY_DELIVERED, deliveries[0].Status)
+}
+
+func Test_DeliversAroundSlowReceivers(t *testing.T) {
+	dbFileName := t.TempDir() + "/notes.sqlite3"
+	db, err := notes.CreateNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+	userId, err := notes.CreateAuthor(db, "Test User", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+	release := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	var webhookIds []int
+	for _, url := range []string{slow.URL, fast.URL} {
+		webhook := notes.Webhook{Active: true, Author: userId, Created: int(time.Now().Unix()), Secret: "secret", Url: url}
+		webhookId, err := notes.CreateWebhook(db, &webhook)
+		assert.Nil(t, err, "Unexpected error creating webhook")
+		webhookIds = append(webhookIds, webhookId)
+	}
+	dispatcher := NewDispatcher(dbFileName)
+	dispatcher.Client = dispatcher.AdminClient
+	go dispatcher.Run()
+	defer dispatcher.Stop()
+	_, err = notes.CreateNote(db, &notes.NoteRecord{Author: userId, Content: "# Plans"})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+
+	var deliveries []notes.Delivery
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(20 * time.Millisecond) {
+		deliveries, _ = notes.GetDeliveries(db, userId, webhookIds[1], 0, 10)
+		if len(deliveries) > 0 && deliveries[0].Status != notes.DELIVERY_PENDING {
+			break
+		}
+	}
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, notes.DELIVERY_DELIVERED, deliveries[0].Status, "Expected no wait for the slow receiver")
+}
+
+func Test_RefusesPrivateAddresses(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "::1", "localhost", "10.1.2.3", "192.168.0.1", "169.254.169.254",
+		"0.0.0.0", "::ffff:172.16.0.1"} {
+		assert.True(t, errors.Is(CheckHost(host), ErrPrivateAddress), host)
+	}
+	assert.Nil(t, CheckHost("93.184.216.34"))
+
+	dbFileName := t.TempDir() + "/notes.sqlite3"
+	db, err := notes.CreateNoteDb(dbFileName)
+	assert.Nil(t, err, "Unexpected error on DB creation")
+	defer db.Close()
+	userId, err := notes.CreateAuthor(db, "Test User", "")
+	assert.Nil(t, err, "Unexpected error on author creation")
+	received := make(chan bool, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- true
+	}))
+	defer receiver.Close()
+
+	// The name resolves to loopback only once delivered, as with DNS
+	// rebinding.
+	webhook := notes.Webhook{Active: true, Author: userId, Created: int(time.Now().Unix()), Secret: "secret",
+		Url: strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)}
+	webhook.Id, err = notes.CreateWebhook(db, &webhook)
+	assert.Nil(t, err, "Unexpected error creating webhook")
+	dispatcher := NewDispatcher(dbFileName)
+	go dispatcher.Run()
+	defer dispatcher.Stop()
+	_, err = notes.CreateNote(db, &notes.NoteRecord{Author: userId, Content: "# Plans"})
+	assert.Nil(t, err, "Unexpected error on note insertion")
+
+	var deliveries []notes.Delivery
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(20 * time.Millisecond) {
+		deliveries, _ = notes.GetDeliveries(db, userId, webhook.Id, 0, 10)
+		if len(deliveries) > 0 && deliveries[0].Attempts > 0 {
+			break
+		}
+	}
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, 1, deliveries[0].Attempts)
+	assert.Contains(t, deliveries[0].Error, ErrPrivateAddress.Error())
+	assert.Equal(t, 0, len(received), "Expected private receivers not reached")
+}
+
+func Test_BacksOffRetries(t *testing.T) {
+	dispatcher := NewDispatcher("")
+	assert.Equal(t, RETRY_DELAY, dispatcher.retryDelay(0))
+	assert.Equal(t, 4*RETRY_DELAY, dispatcher.retryDelay(2))
+	assert.Equal(t, MAX_RETRY_DELAY, dispatcher.retryDelay(MAX_ATTEMPTS*2))
+}